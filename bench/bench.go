@@ -0,0 +1,249 @@
+// Package bench fires synthetic chat completions at a running instance and
+// reports throughput, latency, time to first token and how the requests
+// were spread over the sessions, to help size a session pool. Run it
+// against an instance with MOCK_UPSTREAM=true to measure the proxy itself
+// without using quota.
+package bench
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options configure a benchmark run
+type Options struct {
+	URL    string
+	Key    string
+	Model  string
+	Prompt string
+	Stream bool
+	// Concurrency 同时进行的请求数
+	Concurrency int
+	// Requests 请求总数，Duration 大于0时改为持续发送到时间结束
+	Requests int
+	Duration time.Duration
+	Timeout  time.Duration
+}
+
+// Sample is the outcome of one request
+type Sample struct {
+	Status int
+	Err    error
+	// FirstToken 收到第一段内容的时间，非流式请求为0
+	FirstToken time.Duration
+	Latency    time.Duration
+}
+
+// Report summarizes a benchmark run
+type Report struct {
+	Elapsed time.Duration
+	Samples []Sample
+	// Sessions 各账号在运行期间新增的请求数，无法读取用量时为 nil
+	Sessions map[string]int
+}
+
+// Run sends the requests of opts and waits for all of them
+func Run(ctx context.Context, opts Options) *Report {
+	client := &http.Client{Timeout: opts.Timeout}
+	// 读取不到用量时不统计账号分布
+	before, _ := sessionRequests(ctx, client, opts)
+
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+	var (
+		issued  atomic.Int64
+		mutex   sync.Mutex
+		samples []Sample
+		wg      sync.WaitGroup
+	)
+	start := time.Now()
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if opts.Duration <= 0 && issued.Add(1) > int64(opts.Requests) {
+					return
+				}
+				sample := send(ctx, client, opts)
+				if ctx.Err() != nil {
+					// 时间到或中断时被取消的请求不计入结果
+					return
+				}
+				mutex.Lock()
+				samples = append(samples, sample)
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	report := &Report{Elapsed: time.Since(start), Samples: samples}
+
+	if before != nil {
+		after, err := sessionRequests(context.Background(), client, opts)
+		if err == nil {
+			report.Sessions = map[string]int{}
+			for session, n := range after {
+				if d := n - before[session]; d > 0 {
+					report.Sessions[session] = d
+				}
+			}
+		}
+	}
+	return report
+}
+
+// send 发送一个请求，流式请求记录第一段内容到达的时间
+func send(ctx context.Context, client *http.Client, opts Options) Sample {
+	body, _ := json.Marshal(map[string]interface{}{
+		"model":    opts.Model,
+		"stream":   opts.Stream,
+		"messages": []map[string]string{{"role": "user", "content": opts.Prompt}},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, opts.URL+"/v1/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return Sample{Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+opts.Key)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return Sample{Err: err, Latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+	sample := Sample{Status: resp.StatusCode}
+	if resp.StatusCode != http.StatusOK || !opts.Stream {
+		_, err = io.Copy(io.Discard, resp.Body)
+		sample.Err, sample.Latency = err, time.Since(start)
+		return sample
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok || sample.FirstToken > 0 || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content          string `json:"content"`
+					ReasoningContent string `json:"reasoning_content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if json.Unmarshal([]byte(data), &chunk) == nil && len(chunk.Choices) > 0 &&
+			(chunk.Choices[0].Delta.Content != "" || chunk.Choices[0].Delta.ReasoningContent != "") {
+			sample.FirstToken = time.Since(start)
+		}
+	}
+	sample.Err, sample.Latency = scanner.Err(), time.Since(start)
+	return sample
+}
+
+// sessionRequests 读取 /admin/usage/sessions 中各账号的累计请求数
+func sessionRequests(ctx context.Context, client *http.Client, opts Options) (map[string]int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.URL+"/admin/usage/sessions", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+opts.Key)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("usage returned %d", resp.StatusCode)
+	}
+	var usage struct {
+		Sessions map[string]struct {
+			Requests int `json:"requests"`
+			Errors   int `json:"errors"`
+		} `json:"sessions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return nil, err
+	}
+	requests := make(map[string]int, len(usage.Sessions))
+	for session, t := range usage.Sessions {
+		requests[session] = t.Requests + t.Errors
+	}
+	return requests, nil
+}
+
+// Print writes the report in a human readable form
+func (r *Report) Print(w io.Writer) {
+	var ok int
+	var latencies, firstTokens []time.Duration
+	failures := map[string]int{}
+	for _, s := range r.Samples {
+		switch {
+		case s.Err != nil:
+			failures[s.Err.Error()]++
+		case s.Status != http.StatusOK:
+			failures[fmt.Sprintf("HTTP %d", s.Status)]++
+		default:
+			ok++
+			latencies = append(latencies, s.Latency)
+			if s.FirstToken > 0 {
+				firstTokens = append(firstTokens, s.FirstToken)
+			}
+		}
+	}
+	total := len(r.Samples)
+	fmt.Fprintf(w, "requests:    %d in %v, %d ok, %d failed\n", total, r.Elapsed.Round(time.Millisecond), ok, total-ok)
+	if r.Elapsed > 0 {
+		fmt.Fprintf(w, "throughput:  %.2f req/s, %.2f ok req/s\n", float64(total)/r.Elapsed.Seconds(), float64(ok)/r.Elapsed.Seconds())
+	}
+	if len(latencies) > 0 {
+		fmt.Fprintf(w, "latency:     %s\n", percentiles(latencies))
+	}
+	if len(firstTokens) > 0 {
+		fmt.Fprintf(w, "first token: %s\n", percentiles(firstTokens))
+	}
+	for _, reason := range sortedKeys(failures) {
+		fmt.Fprintf(w, "failed:      %d × %s\n", failures[reason], reason)
+	}
+	if r.Sessions == nil {
+		fmt.Fprintln(w, "sessions:    unknown, the key can't read /admin/usage/sessions")
+		return
+	}
+	fmt.Fprintf(w, "sessions:    %d used\n", len(r.Sessions))
+	for _, session := range sortedKeys(r.Sessions) {
+		fmt.Fprintf(w, "  %-12s %d\n", session, r.Sessions[session])
+	}
+}
+
+// percentiles 返回 p50、p90、p99 与最大值
+func percentiles(d []time.Duration) string {
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	at := func(p float64) time.Duration {
+		return d[int(p*float64(len(d)-1))].Round(time.Millisecond)
+	}
+	return fmt.Sprintf("p50 %v, p90 %v, p99 %v, max %v", at(0.5), at(0.9), at(0.99), d[len(d)-1].Round(time.Millisecond))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
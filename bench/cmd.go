@@ -0,0 +1,47 @@
+package bench
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// Main implements the `pplx2api bench` subcommand:
+//
+//	pplx2api bench [-url URL] [-key KEY] [-c 10] [-n 100 | -d 1m] [-model MODEL] [-stream=false]
+func Main(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	var opts Options
+	fs.StringVar(&opts.URL, "url", "http://127.0.0.1:8080", "address of the running instance")
+	fs.StringVar(&opts.Key, "key", os.Getenv("APIKEY"), "API key, defaults to APIKEY")
+	fs.StringVar(&opts.Model, "model", "claude-4-5-sonnet", "model to request")
+	fs.StringVar(&opts.Prompt, "prompt", "Say hello in one short sentence.", "prompt of every request")
+	fs.BoolVar(&opts.Stream, "stream", true, "stream the responses and measure time to first token")
+	fs.IntVar(&opts.Concurrency, "c", 10, "concurrent requests")
+	fs.IntVar(&opts.Requests, "n", 100, "total requests")
+	fs.DurationVar(&opts.Duration, "d", 0, "keep sending for this long instead of -n requests")
+	fs.DurationVar(&opts.Timeout, "timeout", 5*time.Minute, "timeout of each request")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if opts.Concurrency <= 0 || (opts.Duration <= 0 && opts.Requests <= 0) {
+		fmt.Fprintln(os.Stderr, "-c and -n or -d must be positive")
+		return 2
+	}
+	opts.URL = strings.TrimSuffix(opts.URL, "/")
+
+	// Ctrl-C 停止发送并输出已完成请求的结果
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if opts.Duration > 0 {
+		fmt.Printf("benchmarking %s for %v with %d concurrent requests\n", opts.URL, opts.Duration, opts.Concurrency)
+	} else {
+		fmt.Printf("benchmarking %s with %d requests, %d concurrent\n", opts.URL, opts.Requests, opts.Concurrency)
+	}
+	Run(ctx, opts).Print(os.Stdout)
+	return 0
+}
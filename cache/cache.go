@@ -0,0 +1,131 @@
+// Package cache answers identical repeated completions with a recording of
+// an earlier response instead of calling Perplexity again, which saves
+// session quota for clients that resend the same prompts.
+//
+// Entries are kept in memory, at most RESPONSE_CACHE_SIZE of them with the
+// least recently used dropped first, or in Redis when REDIS_URL is set so
+// every replica shares them. The cache is off unless RESPONSE_CACHE_TTL is set.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"pplx2api/config"
+	"pplx2api/model"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SharedStore keeps cache entries shared between replicas
+type SharedStore interface {
+	CachedResponse(key string) ([]byte, bool)
+	CacheResponse(key string, value []byte, ttl time.Duration)
+}
+
+// Shared is the store shared between replicas, nil when REDIS_URL is unset
+var Shared SharedStore
+
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+var (
+	mutex   sync.Mutex
+	entries = map[string]*list.Element{}
+	order   = list.New()
+	hits    atomic.Int64
+	misses  atomic.Int64
+)
+
+// Stats are the cache counters reported by the admin API
+type Stats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// Enabled reports whether responses are cached
+func Enabled() bool {
+	return config.ConfigInstance.ResponseCacheTTL > 0
+}
+
+// Key returns the cache key of a normalized request
+func Key(request interface{}) string {
+	data, _ := json.Marshal(request)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the recorded response for key, if it hasn't expired
+func Get(key string) (*model.Recording, bool) {
+	value, ok := lookup(key)
+	if !ok {
+		misses.Add(1)
+		return nil, false
+	}
+	rec := &model.Recording{}
+	if err := json.Unmarshal(value, rec); err != nil {
+		misses.Add(1)
+		return nil, false
+	}
+	hits.Add(1)
+	return rec, true
+}
+
+func lookup(key string) ([]byte, bool) {
+	if Shared != nil {
+		return Shared.CachedResponse(key)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	el, ok := entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if time.Now().After(e.expires) {
+		order.Remove(el)
+		delete(entries, key)
+		return nil, false
+	}
+	order.MoveToFront(el)
+	return e.value, true
+}
+
+// Put stores a recorded response under key for RESPONSE_CACHE_TTL
+func Put(key string, rec *model.Recording) {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	ttl := config.ConfigInstance.ResponseCacheTTL
+	if Shared != nil {
+		Shared.CacheResponse(key, value, ttl)
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if el, ok := entries[key]; ok {
+		order.Remove(el)
+	}
+	entries[key] = order.PushFront(&entry{key: key, value: value, expires: time.Now().Add(ttl)})
+	// 超出容量时丢弃最久未使用的条目
+	for order.Len() > config.ConfigInstance.ResponseCacheSize {
+		oldest := order.Back()
+		order.Remove(oldest)
+		delete(entries, oldest.Value.(*entry).key)
+	}
+}
+
+// CurrentStats returns the number of cached entries and the hit counters
+func CurrentStats() Stats {
+	mutex.Lock()
+	n := order.Len()
+	mutex.Unlock()
+	return Stats{Entries: n, Hits: hits.Load(), Misses: misses.Load()}
+}
@@ -0,0 +1,140 @@
+// Package certs serves HTTPS with a certificate that is reloaded when its
+// files change, optionally requiring client certificates (mTLS).
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"pplx2api/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client certificate modes accepted by TLS_CLIENT_AUTH
+const (
+	ClientAuthOff      = "off"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// Reloader holds the server certificate and client CA pool and replaces
+// them when the files on disk change
+type Reloader struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   string
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	stamp    string
+}
+
+// NewReloader loads the certificate and client CA files, failing when
+// they can't be read
+func NewReloader(certFile, keyFile, clientCAFile, clientAuth string) (*Reloader, error) {
+	if clientCAFile != "" && clientAuth == ClientAuthOff {
+		return nil, errors.New("TLS_CLIENT_CA_FILE is set but TLS_CLIENT_AUTH is off")
+	}
+	if clientCAFile == "" && clientAuth != ClientAuthOff {
+		return nil, fmt.Errorf("TLS_CLIENT_AUTH %s needs TLS_CLIENT_CA_FILE", clientAuth)
+	}
+	r := &Reloader{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCAFile, ClientAuth: clientAuth}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load 读取证书与客户端 CA，全部成功后才替换当前配置
+func (r *Reloader) load() error {
+	stamp := r.modTimes()
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.ClientCAFile != "" {
+		data, err := os.ReadFile(r.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("load client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("load client CA: no certificates in %s", r.ClientCAFile)
+		}
+	}
+	r.mutex.Lock()
+	r.cert, r.clientCA, r.stamp = &cert, pool, stamp
+	r.mutex.Unlock()
+	return nil
+}
+
+// modTimes 返回证书文件的修改时间，用于判断是否需要重新加载
+func (r *Reloader) modTimes() string {
+	var stamps []string
+	for _, path := range []string{r.CertFile, r.KeyFile, r.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil {
+			stamps = append(stamps, path+"@"+info.ModTime().String())
+		}
+	}
+	return strings.Join(stamps, ",")
+}
+
+// TLSConfig returns a server config that picks up reloaded files on every
+// new connection
+func (r *Reloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			switch r.ClientAuth {
+			case ClientAuthRequire:
+				cfg.ClientAuth, cfg.ClientCAs = tls.RequireAndVerifyClientCert, r.clientCA
+			case ClientAuthOptional:
+				cfg.ClientAuth, cfg.ClientCAs = tls.VerifyClientCertIfGiven, r.clientCA
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// Watch reloads the files whenever they change, checking every interval
+// until ctx is done. A failed reload keeps the current certificate.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		r.mutex.RLock()
+		last := r.stamp
+		r.mutex.RUnlock()
+		if r.modTimes() == last {
+			continue
+		}
+		if err := r.load(); err != nil {
+			logger.Error(fmt.Sprintf("Failed to reload TLS certificate, keeping the current one: %v", err))
+			continue
+		}
+		logger.Info("TLS certificate reloaded")
+	}
+}
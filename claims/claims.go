@@ -0,0 +1,72 @@
+// Package claims splits a sourced answer into statements with the
+// citations that support them, so downstream tools can verify each claim
+// against its sources.
+//
+// Perplexity marks citations inline as [1], [2] after the sentence they
+// support. Extraction is lexical: a claim is a sentence or list item with
+// at least one citation marker, and its sources are the cited results.
+package claims
+
+import (
+	"pplx2api/model"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// citationMarker 匹配正文中的引用标记，如 [1]
+var citationMarker = regexp.MustCompile(`\[(\d{1,3})\]`)
+
+// listMarker 匹配行首的列表、标题与引用标记
+var listMarker = regexp.MustCompile(`^(\s*([-*+>#]+|\d+[.)])\s+)+`)
+
+// sentenceEnd 在句末标点或换行处切分
+var sentenceEnd = regexp.MustCompile(`([.!?。！？](?:\s*\[\d{1,3}\])*)(\s+|$)|\n+`)
+
+// Extract returns the cited statements of answer. Source indexes are zero
+// based indexes into the sourceCount citations; markers outside of that
+// range are ignored.
+func Extract(answer string, sourceCount int) []model.Claim {
+	claims := []model.Claim{}
+	for _, sentence := range split(answer) {
+		var sources []int
+		seen := map[int]bool{}
+		for _, m := range citationMarker.FindAllStringSubmatch(sentence, -1) {
+			n, _ := strconv.Atoi(m[1])
+			if n < 1 || n > sourceCount || seen[n-1] {
+				continue
+			}
+			seen[n-1] = true
+			sources = append(sources, n-1)
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		statement := strings.TrimSpace(citationMarker.ReplaceAllString(sentence, ""))
+		// 去掉列表与标题标记
+		statement = strings.TrimSpace(listMarker.ReplaceAllString(statement, ""))
+		if statement == "" {
+			continue
+		}
+		claims = append(claims, model.Claim{Statement: statement, Sources: sources})
+	}
+	return claims
+}
+
+// split 按句子切分，句末的引用标记归入前一句
+func split(text string) []string {
+	var sentences []string
+	start := 0
+	for _, loc := range sentenceEnd.FindAllStringSubmatchIndex(text, -1) {
+		end := loc[1]
+		if loc[2] >= 0 {
+			end = loc[3] // 保留标点与其后的引用标记
+		}
+		sentences = append(sentences, text[start:end])
+		start = loc[1]
+	}
+	if start < len(text) {
+		sentences = append(sentences, text[start:])
+	}
+	return sentences
+}
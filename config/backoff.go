@@ -0,0 +1,94 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"pplx2api/logger"
+	"strconv"
+	"time"
+)
+
+// BackoffPolicy controls how long the retry loop waits between attempts.
+// Delays grow from BaseDelay by Multiplier per attempt and are randomized by
+// ±Jitter (a fraction of the delay) so parallel requests don't retry in lockstep.
+type BackoffPolicy struct {
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	Multiplier float64
+	Jitter     float64
+	// MaxAttempts 同一 session 内对可重试状态码的最大尝试次数（含首次）
+	MaxAttempts     int
+	RetryableStatus map[int]bool
+}
+
+// defaultRetryableStatus 默认在同一 session 内重试的上游状态码
+var defaultRetryableStatus = []int{500, 502, 503, 504}
+
+// Delay returns the wait before retry number attempt, starting at 1
+func (p BackoffPolicy) Delay(attempt int) time.Duration {
+	if p.BaseDelay <= 0 || attempt < 1 {
+		return 0
+	}
+	delay := float64(p.BaseDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// IsRetryable reports whether an upstream status code is worth retrying on the same session
+func (p BackoffPolicy) IsRetryable(status int) bool {
+	return p.RetryableStatus[status]
+}
+
+// loadBackoffPolicy 从环境变量读取重试退避策略
+func loadBackoffPolicy() BackoffPolicy {
+	baseDelay, err := strconv.Atoi(os.Getenv("RETRY_BASE_DELAY"))
+	if err != nil || baseDelay < 0 {
+		baseDelay = 500 // 默认500毫秒
+	}
+	maxDelay, err := strconv.Atoi(os.Getenv("RETRY_MAX_DELAY"))
+	if err != nil || maxDelay < 0 {
+		maxDelay = 10000 // 默认最长10秒
+	}
+	multiplier, err := strconv.ParseFloat(os.Getenv("RETRY_MULTIPLIER"), 64)
+	if err != nil || multiplier < 1 {
+		multiplier = 2
+	}
+	jitter, err := strconv.ParseFloat(os.Getenv("RETRY_JITTER"), 64)
+	if err != nil || jitter < 0 || jitter > 1 {
+		jitter = 0.2
+	}
+	maxAttempts, err := strconv.Atoi(os.Getenv("RETRY_MAX_ATTEMPTS"))
+	if err != nil || maxAttempts <= 0 {
+		maxAttempts = 2 // 默认出现 5xx 时在同一 session 内再试一次
+	}
+	retryable := map[int]bool{}
+	codes := parseListEnv(os.Getenv("RETRY_STATUS_CODES"))
+	if len(codes) == 0 {
+		for _, code := range defaultRetryableStatus {
+			retryable[code] = true
+		}
+	}
+	for _, code := range codes {
+		status, err := strconv.Atoi(code)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Invalid retry status code: %s", code))
+			continue
+		}
+		retryable[status] = true
+	}
+	return BackoffPolicy{
+		BaseDelay:       time.Duration(baseDelay) * time.Millisecond,
+		MaxDelay:        time.Duration(maxDelay) * time.Millisecond,
+		Multiplier:      multiplier,
+		Jitter:          jitter,
+		MaxAttempts:     maxAttempts,
+		RetryableStatus: retryable,
+	}
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"os"
+	"strconv"
+)
+
+// SessionBudget limits how much a session is used per UTC day and month,
+// so accounts stay below the volume at which Perplexity throttles them.
+// Requests count every request sent on the session, tokens the estimated
+// total tokens. Zero means no limit.
+type SessionBudget struct {
+	DailyRequests   int `json:"daily_requests,omitempty"`
+	DailyTokens     int `json:"daily_tokens,omitempty"`
+	MonthlyRequests int `json:"monthly_requests,omitempty"`
+	MonthlyTokens   int `json:"monthly_tokens,omitempty"`
+}
+
+// Limited reports whether any limit is set
+func (b SessionBudget) Limited() bool {
+	return b.DailyRequests > 0 || b.DailyTokens > 0 || b.MonthlyRequests > 0 || b.MonthlyTokens > 0
+}
+
+// BudgetFor returns the budget of a session: its own if set, otherwise the
+// SESSION_* defaults
+func (c *Config) BudgetFor(session SessionInfo) SessionBudget {
+	if session.Budget != nil {
+		return *session.Budget
+	}
+	return c.SessionBudget
+}
+
+// loadSessionBudget 读取所有账号默认的用量预算
+func loadSessionBudget() SessionBudget {
+	limit := func(name string) int {
+		n, err := strconv.Atoi(os.Getenv(name))
+		if err != nil || n < 0 {
+			return 0
+		}
+		return n
+	}
+	return SessionBudget{
+		DailyRequests:   limit("SESSION_DAILY_REQUESTS"),
+		DailyTokens:     limit("SESSION_DAILY_TOKENS"),
+		MonthlyRequests: limit("SESSION_MONTHLY_REQUESTS"),
+		MonthlyTokens:   limit("SESSION_MONTHLY_TOKENS"),
+	}
+}
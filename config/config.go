@@ -3,18 +3,40 @@ package config
 import (
 	"fmt"
 	"math/rand"
+	"net/url"
 	"os"
 	"pplx2api/logger"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-
-	"github.com/joho/godotenv"
 )
 
 type SessionInfo struct {
 	SessionKey string
+	// 归档的 session 不参与轮询，但保留其索引与统计数据
+	Archived bool `json:",omitempty"`
+	// 该 session 专用的代理，为空时使用全局 PROXY
+	Proxy string `json:",omitempty"`
+	// DisabledReason 因连续认证失败被自动归档时的原因，重新启用后清空
+	DisabledReason string `json:",omitempty"`
+	// Labels 账号标签，如 region=eu，请求可指定标签只使用带有这些标签的账号
+	Labels map[string]string `json:",omitempty"`
+	// Budget 该账号的用量预算，为空时使用 SESSION_* 的默认预算
+	Budget *SessionBudget `json:",omitempty"`
+	// Fingerprint 该账号的客户端指纹，覆盖全局的 IMPERSONATE 等设置
+	Fingerprint *Fingerprint `json:",omitempty"`
+	// HeaderProfile 该账号发送的 User-Agent 等请求头的 profile，未指定时自动分配
+	HeaderProfile string `json:",omitempty"`
+	// Upstream 该账号使用的上游地址，覆盖全局的 UPSTREAM_* 设置
+	Upstream *Upstream `json:",omitempty"`
+}
+
+// TokenizerRule binds a model name pattern to a tokenizer
+type TokenizerRule struct {
+	Pattern   string
+	Tokenizer string
 }
 
 type SessionRagen struct {
@@ -25,18 +47,144 @@ type SessionRagen struct {
 type Config struct {
 	Sessions               []SessionInfo
 	Address                string
+	TLSCertFile            string
+	TLSKeyFile             string
+	TLSClientCAFile        string
+	TLSClientAuth          string
+	TLSReloadInterval      time.Duration
 	APIKey                 string
 	Proxy                  string
 	IsIncognito            bool
 	MaxChatHistoryLength   int
 	RetryCount             int
 	NoRolePrefix           bool
+	Prompt                 PromptStrategy
 	SearchResultCompatible bool
 	PromptForFile          string
 	RwMutex                sync.RWMutex
 	IgnoreSerchResult      bool
 	IgnoreModelMonitoring  bool
 	IsMaxSubscribe         bool
+	RateLimitCooldown      time.Duration
+	Cooldowns              CooldownPolicy
+	MaxFileSize            int
+	MaxImageSize           int
+	MaxImages              int
+	MaxFiles               int
+	MaxMessages            int
+	MaxPromptChars         int
+	MaxRequestBodySize     int64
+	Compression            []string
+	CompressionMinSize     int
+	AllowedFileTypes       []string
+	ModelsCacheTTL         time.Duration
+	AllowUserSession       bool
+	UserSessionTTL         time.Duration
+	ModelChains            map[string][]string
+	Tokenizers             []TokenizerRule
+	DefaultTokenizer       string
+	MaxChatHistoryTokens   int
+	ProxyPool              *ProxyPool
+	StreamResumeWindow     time.Duration
+	StreamResumeBuffer     int
+	Backoff                BackoffPolicy
+	ShutdownTimeout        time.Duration
+	SessionStateFile       string
+	DeepResearchModels     []string
+	DeepResearchDrain      time.Duration
+	DeepResearchHandoff    bool
+	ResearchJobsFile       string
+	InjectionGuard         string
+	ImageOutput            string
+	Context                ContextPolicy
+	CORS                   CORSPolicy
+	JWT                    JWTPolicy
+	Keys                   *KeyStore
+	RateLimitRPM           int
+	RateLimitTPM           int
+	RateLimitByIP          bool
+	StreamStallThreshold   time.Duration
+	StreamSlowWPS          float64
+	SSEKeepalive           time.Duration
+	StreamFlushInterval    time.Duration
+	StreamFlushBytes       int
+	NonStreamTimeout       time.Duration
+	NonStreamPartial       string
+	StreamRecovery         int
+	TraceEndpoint          string
+	TraceServiceName       string
+	TraceHeaders           map[string]string
+	SessionMinInterval     time.Duration
+	SessionPacingJitter    float64
+	ProgressChannel        string
+	ReasoningOutput        string
+	ThinkTag               string
+	RefusalSignaling       bool
+	ThreadReuse            bool
+	ThreadTTL              time.Duration
+	ExtractClaims          bool
+	ConversationStore      string
+	ConversationDir        string
+	ConversationDB         string
+	RedactLogs             bool
+	RedactTypes            []string
+	RedactPatternsFile     string
+	DateInjection          bool
+	Timezone               string
+	DebugCapture           int
+	ThreadRetention        time.Duration
+	RedisURL               string
+	RedisPrefix            string
+	UpdateCheck            bool
+	UpdateCheckInterval    time.Duration
+	UpdateRepo             string
+	UpdatePublicKey        string
+	MemoryProfile          string
+	MemoryLimit            int64
+	SSEBufferSize          int
+	MaxConcurrentRequests  int
+	MaxQueuedRequests      int
+	QueueTimeout           time.Duration
+	ImportsFile            string
+	AnomalyDetection       bool
+	AnomalyFactor          float64
+	AnomalyMinRPM          int
+	BreakerThreshold       int
+	BreakerCooldown        time.Duration
+	AnomalyThrottle        time.Duration
+	AnomalyWebhook         string
+	OllamaKey              string
+	ConfigWatch            time.Duration
+	HookPlugins            []string
+	ModerationRulesFile    string
+	ModerationKeywords     []string
+	ModerationEndpoint     string
+	ModerationAPIKey       string
+	ModerationModel        string
+	ModerationFailClosed   bool
+	ResponseCacheTTL       time.Duration
+	ResponseCacheSize      int
+	DedupInflight          bool
+	HedgeDelay             time.Duration
+	AuthFailureThreshold   int
+	ValidateSessions       bool
+	TierRouting            string
+	SessionBudget          SessionBudget
+	ChallengeCooldown      time.Duration
+	ChallengeSolver        string
+	ChallengeSolverTimeout time.Duration
+	Fingerprint            Fingerprint
+	HeaderProfiles         []HeaderProfile
+	Upstream               Upstream
+	Mock                   MockUpstream
+	MinUsableSessions      int
+	ValidateSessionsStrict bool
+	WebhookURLs            []string
+	WebhookMinInterval     time.Duration
+	// sessionSources 配置中各 session 的原始 cookie，重新加载时判断 session 是否变化
+	sessionSources []string
+	// sessionKeys 各 session 的稳定标识，运行时状态按它而不是序号保存，见 SessionStateAt
+	sessionKeys []string
 }
 
 // 解析 SESSION 格式的环境变量
@@ -52,32 +200,660 @@ func parseSessionEnv(envValue string) (int, []SessionInfo) {
 			retryCount--
 			continue
 		}
-		parts := strings.Split(pair, ":")
+		// 支持 key|proxy=代理地址 格式为单个 session 绑定代理，key 中的冒号原样保留
+		key, proxy, ok := strings.Cut(pair, "|proxy=")
 		session := SessionInfo{
-			SessionKey: parts[0],
+			SessionKey: key,
+		}
+		if ok {
+			session.Proxy = validProxyURL(proxy)
+		} else if strings.Contains(key, "://") {
+			logger.Error(fmt.Sprintf("Session %d looks like the old key:proxy form, bind a proxy with key|proxy=URL", len(sessions)))
 		}
 		sessions = append(sessions, session)
 	}
 	return retryCount, sessions
 }
 
+// defaultAllowedFileTypes 默认允许的附件类型
+var defaultAllowedFileTypes = []string{
+	"application/pdf",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/msword",
+	"text/csv",
+	"text/plain",
+	"text/markdown",
+}
+
+// validProxyURL 校验代理地址，支持 http、https 和 socks5，非法地址返回空字符串
+func validProxyURL(proxy string) string {
+	proxy = strings.TrimSpace(proxy)
+	if proxy == "" {
+		return ""
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		logger.Error(fmt.Sprintf("Invalid proxy URL: %s", proxy))
+		return ""
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return proxy
+	}
+	logger.Error(fmt.Sprintf("Unsupported proxy scheme %q, use http, https or socks5", u.Scheme))
+	return ""
+}
+
+// ProxyFor returns the proxy a session should egress through: its own
+// proxy if bound, otherwise the next one of the proxy pool, otherwise PROXY.
+func (c *Config) ProxyFor(session SessionInfo) string {
+	if session.Proxy != "" {
+		return session.Proxy
+	}
+	if c.ProxyPool != nil && c.ProxyPool.Len() > 0 {
+		return c.ProxyPool.Next()
+	}
+	return c.Proxy
+}
+
+// FixedProxyFor returns the proxy a session always egresses through, and
+// false when it is picked from the proxy pool per request
+func (c *Config) FixedProxyFor(session SessionInfo) (string, bool) {
+	if session.Proxy != "" {
+		return session.Proxy, true
+	}
+	if c.ProxyPool != nil && c.ProxyPool.Len() > 0 {
+		return "", false
+	}
+	return c.Proxy, true
+}
+
+// parseListEnv 解析英文逗号分隔的列表，忽略空项
+func parseListEnv(envValue string) []string {
+	var items []string
+	for _, item := range strings.Split(envValue, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseModelChains 解析模型回退链，格式：gpt-4o->claude-4-5-sonnet->sonar-pro;o3->o3pro->gpt-5
+func parseModelChains(envValue string) map[string][]string {
+	chains := map[string][]string{}
+	for _, entry := range strings.Split(envValue, ";") {
+		var models []string
+		for _, m := range strings.Split(entry, "->") {
+			if m = strings.TrimSpace(m); m != "" {
+				models = append(models, m)
+			}
+		}
+		if len(models) < 2 {
+			continue
+		}
+		chains[models[0]] = models[1:]
+	}
+	return chains
+}
+
+// parseTokenizerRules 解析模型与分词器的对应关系，格式：gpt-*=o200k,claude-*=cl100k
+func parseTokenizerRules(envValue string) []TokenizerRule {
+	var rules []TokenizerRule
+	for _, item := range parseListEnv(envValue) {
+		pattern, tokenizer, ok := strings.Cut(item, "=")
+		if !ok {
+			logger.Error(fmt.Sprintf("Invalid tokenizer rule: %s", item))
+			continue
+		}
+		rules = append(rules, TokenizerRule{
+			Pattern:   strings.TrimSpace(pattern),
+			Tokenizer: strings.TrimSpace(tokenizer),
+		})
+	}
+	return rules
+}
+
+// IsDeepResearch reports whether any model of a request is a long-running deep research model
+func (c *Config) IsDeepResearch(models ...string) bool {
+	for _, m := range models {
+		for _, research := range c.DeepResearchModels {
+			if strings.EqualFold(m, research) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsFileTypeAllowed reports whether an attachment MIME type may be uploaded
+func (c *Config) IsFileTypeAllowed(mimeType string) bool {
+	for _, allowed := range c.AllowedFileTypes {
+		if strings.EqualFold(allowed, mimeType) {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionCount returns the number of sessions and how many attempts a
+// request may make across them, read together under the lock since a
+// reload can change both
+func (c *Config) SessionCount() (sessions, retries int) {
+	c.RwMutex.RLock()
+	defer c.RwMutex.RUnlock()
+	return len(c.Sessions), c.RetryCount
+}
+
 // 根据模型选择合适的 session
 func (c *Config) GetSessionForModel(idx int) (SessionInfo, error) {
-	if len(c.Sessions) == 0 || idx < 0 || idx >= len(c.Sessions) {
+	c.RwMutex.RLock()
+	defer c.RwMutex.RUnlock()
+	if idx < 0 || idx >= len(c.Sessions) {
 		return SessionInfo{}, fmt.Errorf("invalid session index: %d", idx)
 	}
+	return c.Sessions[idx], nil
+}
+
+// SessionWithState returns the session at idx together with its state, read
+// under one lock so a concurrent reload cannot pair one session with the
+// state of another
+func (c *Config) SessionWithState(idx int) (SessionInfo, *SessionState, error) {
 	c.RwMutex.RLock()
 	defer c.RwMutex.RUnlock()
-	return c.Sessions[idx], nil
+	if idx < 0 || idx >= len(c.Sessions) {
+		return SessionInfo{}, nil, fmt.Errorf("invalid session index: %d", idx)
+	}
+	sessionStatesMutex.Lock()
+	defer sessionStatesMutex.Unlock()
+	key, shared := c.sessionKeyAt(idx)
+	return c.Sessions[idx], stateFor(key, shared), nil
+}
+
+// SetSessionArchived archives or reactivates the session at idx
+func (c *Config) SetSessionArchived(idx int, archived bool) error {
+	c.RwMutex.Lock()
+	defer c.RwMutex.Unlock()
+	if idx < 0 || idx >= len(c.Sessions) {
+		return fmt.Errorf("invalid session index: %d", idx)
+	}
+	c.Sessions[idx].Archived = archived
+	if !archived {
+		c.Sessions[idx].DisabledReason = ""
+	}
+	return nil
+}
+
+// QuarantineSession archives the session at idx because its cookie no
+// longer authenticates. It reports false if the session was already archived.
+func (c *Config) QuarantineSession(idx int, reason string) bool {
+	c.RwMutex.Lock()
+	defer c.RwMutex.Unlock()
+	return c.quarantine(idx, reason)
+}
+
+// QuarantineSessionKey archives the session identified by key, wherever a
+// reload has moved it, and returns its current index. It reports false if
+// the session is no longer configured or was already archived.
+func (c *Config) QuarantineSessionKey(key string, reason string) (int, bool) {
+	c.RwMutex.Lock()
+	defer c.RwMutex.Unlock()
+	for idx, configured := range c.sessionKeys {
+		if configured == key {
+			return idx, c.quarantine(idx, reason)
+		}
+	}
+	return -1, false
+}
+
+// quarantine 归档序号 idx 的 session，调用方持有 c.RwMutex 的写锁
+func (c *Config) quarantine(idx int, reason string) bool {
+	if idx < 0 || idx >= len(c.Sessions) || c.Sessions[idx].Archived {
+		return false
+	}
+	c.Sessions[idx].Archived = true
+	c.Sessions[idx].DisabledReason = reason
+	return true
 }
 
 // 从环境变量加载配置
 func LoadConfig() *Config {
+	// 配置文件的设置只在对应环境变量未设置时生效
+	file := loadConfigFile()
+	file.applyModels()
+	// 低内存模式只改变未显式设置的默认值
+	memoryProfile := strings.ToLower(os.Getenv("MEMORY_PROFILE"))
+	if memoryProfile != MemoryProfileLow {
+		if memoryProfile != "" && memoryProfile != MemoryProfileDefault {
+			logger.Error(fmt.Sprintf("Invalid MEMORY_PROFILE %q, use default or low", memoryProfile))
+		}
+		memoryProfile = MemoryProfileDefault
+	}
+	lowMemory := memoryProfile == MemoryProfileLow
 	maxChatHistoryLength, err := strconv.Atoi(os.Getenv("MAX_CHAT_HISTORY_LENGTH"))
 	if err != nil {
 		maxChatHistoryLength = 10000 // 默认值
 	}
+	rateLimitCooldown, err := strconv.Atoi(os.Getenv("RATE_LIMIT_COOLDOWN"))
+	if err != nil || rateLimitCooldown <= 0 {
+		rateLimitCooldown = 60 // 默认冷却60秒
+	}
+	maxFileSize, err := strconv.Atoi(os.Getenv("MAX_FILE_SIZE"))
+	if err != nil || maxFileSize <= 0 {
+		maxFileSize = 20 * 1024 * 1024 // 默认20MB
+		if lowMemory {
+			maxFileSize = 5 * 1024 * 1024
+		}
+	}
+	maxImageSize, err := strconv.Atoi(os.Getenv("MAX_IMAGE_SIZE"))
+	if err != nil || maxImageSize <= 0 {
+		maxImageSize = 20 * 1024 * 1024 // 默认20MB
+		if lowMemory {
+			maxImageSize = 5 * 1024 * 1024
+		}
+	}
+	maxImages, err := strconv.Atoi(os.Getenv("MAX_IMAGES"))
+	if err != nil || maxImages < 0 {
+		maxImages = 0 // 默认不限制
+	}
+	maxFiles, err := strconv.Atoi(os.Getenv("MAX_FILES"))
+	if err != nil || maxFiles < 0 {
+		maxFiles = 0 // 默认不限制
+	}
+	maxMessages, err := strconv.Atoi(os.Getenv("MAX_MESSAGES"))
+	if err != nil || maxMessages < 0 {
+		maxMessages = 0 // 默认不限制
+	}
+	maxPromptChars, err := strconv.Atoi(os.Getenv("MAX_PROMPT_CHARS"))
+	if err != nil || maxPromptChars < 0 {
+		maxPromptChars = 0 // 默认不限制
+	}
+	maxRequestBodySize, err := strconv.ParseInt(os.Getenv("MAX_REQUEST_BODY_SIZE"), 10, 64)
+	if err != nil || maxRequestBodySize < 0 {
+		maxRequestBodySize = 64 * 1024 * 1024 // 默认64MB，足够容纳 base64 编码后的附件
+		if lowMemory {
+			maxRequestBodySize = 16 * 1024 * 1024
+		}
+	}
+	var compression []string
+	for _, encoding := range parseListEnv(strings.ToLower(os.Getenv("COMPRESSION"))) {
+		if encoding != "gzip" && encoding != "br" {
+			logger.Error(fmt.Sprintf("Unknown COMPRESSION encoding %q, use gzip or br", encoding))
+			continue
+		}
+		compression = append(compression, encoding)
+	}
+	compressionMinSize, err := strconv.Atoi(os.Getenv("COMPRESSION_MIN_SIZE"))
+	if err != nil || compressionMinSize < 0 {
+		compressionMinSize = 1024 // 小响应压缩后节省有限
+	}
+	allowedFileTypes := parseListEnv(os.Getenv("ALLOWED_FILE_TYPES"))
+	if len(allowedFileTypes) == 0 {
+		allowedFileTypes = defaultAllowedFileTypes
+	}
+	modelsCacheTTL, err := strconv.Atoi(os.Getenv("MODELS_CACHE_TTL"))
+	if err != nil || modelsCacheTTL <= 0 {
+		modelsCacheTTL = 600 // 默认缓存10分钟
+	}
+	userSessionTTL, err := strconv.Atoi(os.Getenv("USER_SESSION_TTL"))
+	if err != nil || userSessionTTL <= 0 {
+		userSessionTTL = 600 // 默认缓存10分钟
+	}
+	maxChatHistoryTokens, err := strconv.Atoi(os.Getenv("MAX_CHAT_HISTORY_TOKENS"))
+	if err != nil || maxChatHistoryTokens < 0 {
+		maxChatHistoryTokens = 0 // 默认不按 token 限制
+	}
+	defaultTokenizer := os.Getenv("DEFAULT_TOKENIZER")
+	if defaultTokenizer == "" {
+		defaultTokenizer = "cl100k"
+	}
+	proxyCooldown, err := strconv.Atoi(os.Getenv("PROXY_COOLDOWN"))
+	if err != nil || proxyCooldown <= 0 {
+		proxyCooldown = 300 // 默认剔除5分钟
+	}
+	proxyFailureThreshold, err := strconv.Atoi(os.Getenv("PROXY_FAILURE_THRESHOLD"))
+	if err != nil || proxyFailureThreshold <= 0 {
+		proxyFailureThreshold = 1
+	}
+	streamResumeWindow, err := strconv.Atoi(os.Getenv("STREAM_RESUME_WINDOW"))
+	if err != nil || streamResumeWindow < 0 {
+		streamResumeWindow = 0 // 默认关闭续传
+	}
+	streamResumeBuffer, err := strconv.Atoi(os.Getenv("STREAM_RESUME_BUFFER"))
+	if err != nil || streamResumeBuffer <= 0 {
+		streamResumeBuffer = 1024 // 默认每个流缓冲最近 1024 个事件
+	}
+	shutdownTimeout, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT"))
+	if err != nil || shutdownTimeout < 0 {
+		shutdownTimeout = 30 // 默认等待30秒
+	}
+	deepResearchDrain, err := strconv.Atoi(os.Getenv("DEEP_RESEARCH_DRAIN_TIMEOUT"))
+	if err != nil || deepResearchDrain < 0 {
+		deepResearchDrain = 120 // 默认额外等待2分钟
+	}
+	deepResearchModels := parseListEnv(os.Getenv("DEEP_RESEARCH_MODELS"))
+	if len(deepResearchModels) == 0 {
+		deepResearchModels = []string{"pplx_alpha"}
+	}
+	researchJobsFile := os.Getenv("RESEARCH_JOBS_FILE")
+	if researchJobsFile == "" {
+		researchJobsFile = "research_jobs.json"
+	}
+	injectionGuard := strings.ToLower(os.Getenv("INJECTION_GUARD"))
+	switch injectionGuard {
+	case "off", "annotate", "block":
+	case "":
+		injectionGuard = "off"
+	default:
+		logger.Error(fmt.Sprintf("Invalid INJECTION_GUARD %q, use off, annotate or block", injectionGuard))
+		injectionGuard = "off"
+	}
+	imageOutput := strings.ToLower(os.Getenv("IMAGE_OUTPUT"))
+	switch imageOutput {
+	case "markdown", "image_url", "off":
+	case "":
+		imageOutput = "markdown"
+	default:
+		logger.Error(fmt.Sprintf("Invalid IMAGE_OUTPUT %q, use markdown, image_url or off", imageOutput))
+		imageOutput = "markdown"
+	}
+	sessionStateFile := os.Getenv("SESSION_STATE_FILE")
+	if sessionStateFile == "" {
+		sessionStateFile = "session_state.json"
+	}
+	importsFile := os.Getenv("IMPORTS_FILE")
+	if importsFile == "" {
+		importsFile = "imported_conversations.json"
+	}
+	keysFile := os.Getenv("KEYS_FILE")
+	if keysFile == "" {
+		keysFile = "keys.json"
+	}
+	staticKeys := parseAPIKeys(os.Getenv("API_KEYS"))
+	if apiKey := os.Getenv("APIKEY"); apiKey != "" {
+		staticKeys = append([]APIKey{{Name: DefaultKeyName, Key: apiKey, Admin: true}}, staticKeys...)
+	}
+	staticKeys = file.mergeKeys(staticKeys)
+	rateLimitRPM, err := strconv.Atoi(os.Getenv("RATE_LIMIT_RPM"))
+	if err != nil || rateLimitRPM < 0 {
+		rateLimitRPM = 0 // 默认不限制
+	}
+	rateLimitTPM, err := strconv.Atoi(os.Getenv("RATE_LIMIT_TPM"))
+	if err != nil || rateLimitTPM < 0 {
+		rateLimitTPM = 0 // 默认不限制
+	}
+	streamStallThreshold, err := strconv.Atoi(os.Getenv("STREAM_STALL_THRESHOLD"))
+	if err != nil || streamStallThreshold <= 0 {
+		streamStallThreshold = 15 // 默认15秒无输出视为停滞
+	}
+	nonStreamTimeout, err := strconv.Atoi(os.Getenv("NON_STREAM_TIMEOUT"))
+	if err != nil || nonStreamTimeout < 0 {
+		nonStreamTimeout = 600 // 默认10分钟，足够完成深度研究，0 表示不限制
+	}
+	nonStreamPartial := strings.ToLower(os.Getenv("NON_STREAM_PARTIAL"))
+	switch nonStreamPartial {
+	case PartialReturn, PartialFail:
+	case "":
+		nonStreamPartial = PartialReturn
+	default:
+		logger.Error(fmt.Sprintf("Invalid NON_STREAM_PARTIAL %q, use return or fail", nonStreamPartial))
+		nonStreamPartial = PartialReturn
+	}
+	streamRecovery, err := strconv.Atoi(os.Getenv("STREAM_RECOVERY_ATTEMPTS"))
+	if err != nil || streamRecovery < 0 {
+		streamRecovery = 1 // 默认续接一次，0 表示关闭
+	}
+	sseKeepalive, err := strconv.Atoi(os.Getenv("SSE_KEEPALIVE_INTERVAL"))
+	if err != nil || sseKeepalive < 0 {
+		sseKeepalive = 15 // 默认空闲15秒发送一次注释行，0 表示关闭
+	}
+	streamFlushInterval, err := strconv.Atoi(os.Getenv("STREAM_FLUSH_INTERVAL"))
+	if err != nil || streamFlushInterval < 0 {
+		streamFlushInterval = 0 // 默认每个数据块立即发送
+	}
+	streamFlushBytes, err := strconv.Atoi(os.Getenv("STREAM_FLUSH_BYTES"))
+	if err != nil || streamFlushBytes < 0 {
+		streamFlushBytes = 0
+	}
+	streamSlowWPS, err := strconv.ParseFloat(os.Getenv("STREAM_SLOW_WPS"), 64)
+	if err != nil || streamSlowWPS < 0 {
+		streamSlowWPS = 2
+	}
+	traceServiceName := os.Getenv("OTEL_SERVICE_NAME")
+	if traceServiceName == "" {
+		traceServiceName = "pplx2api"
+	}
+	traceHeaders := map[string]string{}
+	for _, item := range parseListEnv(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")) {
+		if k, v, ok := strings.Cut(item, "="); ok {
+			traceHeaders[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	progressChannel := strings.ToLower(os.Getenv("PROGRESS_CHANNEL"))
+	switch progressChannel {
+	case ProgressContent, ProgressReasoning, ProgressOff:
+	case "":
+		progressChannel = ProgressContent
+	default:
+		logger.Error(fmt.Sprintf("Invalid PROGRESS_CHANNEL %q, use content, reasoning or off", progressChannel))
+		progressChannel = ProgressContent
+	}
+	reasoningOutput := strings.ToLower(os.Getenv("REASONING_OUTPUT"))
+	switch reasoningOutput {
+	case ReasoningThink, ReasoningContent, ReasoningStrip:
+	case "":
+		reasoningOutput = ReasoningThink
+	default:
+		logger.Error(fmt.Sprintf("Invalid REASONING_OUTPUT %q, use think, reasoning_content or strip", reasoningOutput))
+		reasoningOutput = ReasoningThink
+	}
+	thinkTag := strings.Trim(os.Getenv("THINK_TAG"), "<>/ ")
+	if thinkTag == "" {
+		thinkTag = "think"
+	}
+	threadTTL, err := strconv.Atoi(os.Getenv("THREAD_TTL"))
+	if err != nil || threadTTL <= 0 {
+		threadTTL = 3600 // 默认1小时
+		if lowMemory {
+			threadTTL = 600
+		}
+	}
+	conversationStore := strings.ToLower(os.Getenv("CONVERSATION_STORE"))
+	switch conversationStore {
+	case "", ConversationStoreOff:
+		conversationStore = ConversationStoreOff
+	case "on", "true":
+		// 开启记录时默认使用 SQLite
+		conversationStore = ConversationStoreSQLite
+	case ConversationStoreSQLite, ConversationStoreFile:
+	default:
+		logger.Error(fmt.Sprintf("Unsupported CONVERSATION_STORE %q, use sqlite, file or off", conversationStore))
+		conversationStore = ConversationStoreOff
+	}
+	conversationDB := os.Getenv("CONVERSATION_DB")
+	if conversationDB == "" {
+		conversationDB = "conversations.db"
+	}
+	conversationDir := os.Getenv("CONVERSATION_DIR")
+	if conversationDir == "" {
+		conversationDir = "conversations"
+	}
+	redactTypes := parseListEnv(strings.ToLower(os.Getenv("REDACT_TYPES")))
+	if len(redactTypes) == 0 {
+		redactTypes = []string{"email", "phone", "api_key"}
+	}
+	tlsClientAuth := strings.ToLower(os.Getenv("TLS_CLIENT_AUTH"))
+	switch tlsClientAuth {
+	case "off", "optional", "require":
+	case "":
+		tlsClientAuth = "off"
+		if os.Getenv("TLS_CLIENT_CA_FILE") != "" {
+			tlsClientAuth = "require"
+		}
+	default:
+		logger.Error(fmt.Sprintf("Invalid TLS_CLIENT_AUTH %q, use off, optional or require", tlsClientAuth))
+		tlsClientAuth = "require"
+	}
+	tlsReloadInterval, err := strconv.Atoi(os.Getenv("TLS_RELOAD_INTERVAL"))
+	if err != nil || tlsReloadInterval < 0 {
+		tlsReloadInterval = 60 // 默认每分钟检查证书文件是否变化
+	}
+	timezone := os.Getenv("TIMEZONE")
+	if timezone == "" {
+		timezone = "America/New_York"
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		logger.Error(fmt.Sprintf("Invalid TIMEZONE %q: %v", timezone, err))
+		timezone = "America/New_York"
+	}
+	threadRetention, err := ParseThreadRetention(os.Getenv("THREAD_RETENTION"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Invalid THREAD_RETENTION: %v", err))
+		threadRetention = RetainThread
+	}
+	memoryLimit, err := strconv.Atoi(os.Getenv("MEMORY_LIMIT"))
+	if err != nil || memoryLimit < 0 {
+		memoryLimit = 0 // 默认不限制
+		if lowMemory {
+			memoryLimit = 192
+		}
+	}
+	sseBufferSize, err := strconv.Atoi(os.Getenv("SSE_BUFFER_SIZE"))
+	if err != nil || sseBufferSize <= 0 {
+		sseBufferSize = 1024 * 1024 // 默认1MB
+		if lowMemory {
+			sseBufferSize = 64 * 1024
+		}
+	}
+	maxConcurrentRequests, err := strconv.Atoi(os.Getenv("MAX_CONCURRENT_REQUESTS"))
+	if err != nil || maxConcurrentRequests < 0 {
+		maxConcurrentRequests = 0 // 默认不限制
+		if lowMemory {
+			maxConcurrentRequests = 4
+		}
+	}
+	// 排队上限默认为并发上限的两倍，负数不限制
+	maxQueuedRequests, err := strconv.Atoi(os.Getenv("MAX_QUEUED_REQUESTS"))
+	if err != nil {
+		maxQueuedRequests = 2 * maxConcurrentRequests
+	}
+	queueTimeout, err := strconv.Atoi(os.Getenv("QUEUE_TIMEOUT"))
+	if err != nil || queueTimeout < 0 {
+		queueTimeout = 60
+	}
+	updateCheckInterval, err := strconv.Atoi(os.Getenv("UPDATE_CHECK_INTERVAL"))
+	if err != nil || updateCheckInterval <= 0 {
+		updateCheckInterval = 24 // 默认每天检查一次
+	}
+	updateRepo := os.Getenv("UPDATE_REPO")
+	if updateRepo == "" {
+		updateRepo = "miraserver/pplx2api"
+	}
+	redisPrefix := os.Getenv("REDIS_PREFIX")
+	if redisPrefix == "" {
+		redisPrefix = "pplx2api"
+	}
+	debugCapture, err := strconv.Atoi(os.Getenv("DEBUG_CAPTURE"))
+	if err != nil || debugCapture < 0 {
+		debugCapture = 0 // 默认不保存
+	}
+	responseCacheTTL, err := strconv.Atoi(os.Getenv("RESPONSE_CACHE_TTL"))
+	if err != nil || responseCacheTTL < 0 {
+		responseCacheTTL = 0 // 默认关闭
+	}
+	responseCacheSize, err := strconv.Atoi(os.Getenv("RESPONSE_CACHE_SIZE"))
+	if err != nil || responseCacheSize <= 0 {
+		responseCacheSize = 1000
+		if lowMemory {
+			responseCacheSize = 100
+		}
+	}
+	authFailureThreshold, err := strconv.Atoi(os.Getenv("AUTH_FAILURE_THRESHOLD"))
+	if err != nil || authFailureThreshold < 0 {
+		authFailureThreshold = 3
+	}
+	tierRouting := strings.ToLower(os.Getenv("TIER_ROUTING"))
+	switch tierRouting {
+	case "", TierRoutingStrict, TierRoutingOverflow:
+	default:
+		logger.Error(fmt.Sprintf("Invalid TIER_ROUTING %q, use strict or overflow", tierRouting))
+		tierRouting = ""
+	}
+	minUsableSessions, err := strconv.Atoi(os.Getenv("MIN_USABLE_SESSIONS"))
+	if err != nil || minUsableSessions < 0 {
+		minUsableSessions = 1
+	}
+	webhookMinInterval, err := strconv.Atoi(os.Getenv("WEBHOOK_MIN_INTERVAL"))
+	if err != nil || webhookMinInterval < 0 {
+		webhookMinInterval = 300
+	}
+	challengeCooldown, err := strconv.Atoi(os.Getenv("CHALLENGE_COOLDOWN"))
+	if err != nil || challengeCooldown < 0 {
+		challengeCooldown = 600
+	}
+	challengeSolverTimeout, err := strconv.Atoi(os.Getenv("CHALLENGE_SOLVER_TIMEOUT"))
+	if err != nil || challengeSolverTimeout <= 0 {
+		challengeSolverTimeout = 60
+	}
+	configWatch, err := strconv.Atoi(os.Getenv("CONFIG_WATCH"))
+	if err != nil || configWatch < 0 {
+		configWatch = 0
+		if (os.Getenv("SESSIONS_FILE") != "" || os.Getenv("COOKIES_FILE") != "") && os.Getenv("CONFIG_WATCH") == "" {
+			configWatch = 10 // 设置了账号文件时默认检查其变化
+		}
+	}
+	anomalyFactor, err := strconv.ParseFloat(os.Getenv("ANOMALY_FACTOR"), 64)
+	if err != nil || anomalyFactor <= 1 {
+		anomalyFactor = 5 // 默认超过基线5倍视为异常
+	}
+	anomalyMinRPM, err := strconv.Atoi(os.Getenv("ANOMALY_MIN_RPM"))
+	if err != nil || anomalyMinRPM <= 0 {
+		anomalyMinRPM = 30
+	}
+	anomalyThrottle, err := strconv.Atoi(os.Getenv("ANOMALY_THROTTLE"))
+	if err != nil || anomalyThrottle <= 0 {
+		anomalyThrottle = 900 // 默认限制15分钟
+	}
+	breakerThreshold, err := strconv.Atoi(os.Getenv("CIRCUIT_BREAKER_THRESHOLD"))
+	if err != nil || breakerThreshold < 0 {
+		breakerThreshold = 5
+	}
+	breakerCooldown, err := strconv.Atoi(os.Getenv("CIRCUIT_BREAKER_COOLDOWN"))
+	if err != nil || breakerCooldown <= 0 {
+		breakerCooldown = 30
+	}
+	sessionMinInterval, err := strconv.Atoi(os.Getenv("SESSION_MIN_INTERVAL"))
+	if err != nil || sessionMinInterval < 0 {
+		sessionMinInterval = 0 // 默认不限制
+	}
+	hedgeDelay, err := strconv.Atoi(os.Getenv("HEDGE_DELAY"))
+	if err != nil || hedgeDelay < 0 {
+		hedgeDelay = 0 // 默认不对冲
+	}
+	sessionPacingJitter, err := strconv.ParseFloat(os.Getenv("SESSION_PACING_JITTER"), 64)
+	if err != nil || sessionPacingJitter < 0 || sessionPacingJitter > 1 {
+		sessionPacingJitter = 0.3
+	}
 	retryCount, sessions := parseSessionEnv(os.Getenv("SESSIONS"))
+	sessionsFile := os.Getenv("SESSIONS_FILE")
+	if os.Getenv("SESSIONS") == "" && sessionsFile != "" {
+		// 挂载的账号文件，变化时自动重新加载
+		if sessions, err = loadSessionsFile(sessionsFile); err != nil {
+			logger.Error(fmt.Sprintf("Failed to read SESSIONS_FILE: %v", err))
+		}
+		retryCount = len(sessions)
+	}
+	if os.Getenv("SESSIONS") == "" && len(sessions) == 0 && len(file.Sessions) > 0 {
+		sessions = file.sessions()
+		retryCount = len(sessions)
+	}
+	if cookiesFile := os.Getenv("COOKIES_FILE"); cookiesFile != "" {
+		// 浏览器导出的 cookie 中的账号追加在其他账号之后
+		n := len(sessions)
+		sessions = appendCookieSessions(sessions, cookiesFile)
+		retryCount += len(sessions) - n
+	}
+	applySessionLabels(os.Getenv("SESSION_LABELS"), sessions)
 	promptForFile := os.Getenv("PROMPT_FOR_FILE")
 	if promptForFile == "" {
 		promptForFile = "You must immerse yourself in the role of assistant in txt file, cannot respond as a user, cannot reply to this message, cannot mention this message, and ignore this message in your response." // 默认值
@@ -87,11 +863,18 @@ func LoadConfig() *Config {
 		Sessions: sessions,
 		// 设置服务地址，默认为 "0.0.0.0:8080"
 		Address: os.Getenv("ADDRESS"),
+		// 设置证书后直接提供 HTTPS，证书文件变化时自动重新加载
+		TLSCertFile: os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:  os.Getenv("TLS_KEY_FILE"),
+		// 校验客户端证书（mTLS）使用的 CA 及校验方式
+		TLSClientCAFile:   os.Getenv("TLS_CLIENT_CA_FILE"),
+		TLSClientAuth:     tlsClientAuth,
+		TLSReloadInterval: time.Duration(tlsReloadInterval) * time.Second,
 
 		// 设置 API 认证密钥
 		APIKey: os.Getenv("APIKEY"),
 		// 设置代理地址
-		Proxy: os.Getenv("PROXY"),
+		Proxy: validProxyURL(os.Getenv("PROXY")),
 		//是否匿名
 		IsIncognito: os.Getenv("IS_INCOGNITO") != "false",
 		// 设置最大聊天历史长度
@@ -100,6 +883,8 @@ func LoadConfig() *Config {
 		RetryCount: retryCount,
 		// 设置是否使用角色前缀
 		NoRolePrefix: os.Getenv("NO_ROLE_PREFIX") == "true",
+		// 消息拼接为提示词的方式
+		Prompt: loadPromptStrategy(os.Getenv("NO_ROLE_PREFIX") == "true"),
 		// 设置搜索结果兼容性
 		SearchResultCompatible: os.Getenv("SEARCH_RESULT_COMPATIBLE") == "true",
 		// 设置上传文件后的提示词
@@ -112,8 +897,206 @@ func LoadConfig() *Config {
 		RwMutex: sync.RWMutex{},
 		// 是否max订阅
 		IsMaxSubscribe: os.Getenv("IS_MAX_SUBSCRIBE") == "true",
+		// 未返回 Retry-After 时的默认冷却时间
+		RateLimitCooldown: time.Duration(rateLimitCooldown) * time.Second,
+		// 按模型类别分别冷却，深度研究限流不影响普通对话
+		Cooldowns: loadCooldownPolicy(deepResearchModels, time.Duration(rateLimitCooldown)*time.Second),
+		// 单个附件大小上限（字节）
+		MaxFileSize: maxFileSize,
+		// 单张图片大小上限（字节），包括内联与需要下载的图片
+		MaxImageSize: maxImageSize,
+		// 单个请求的图片数、附件数、消息数与消息文本字符数上限，0 表示不限制
+		MaxImages:      maxImages,
+		MaxFiles:       maxFiles,
+		MaxMessages:    maxMessages,
+		MaxPromptChars: maxPromptChars,
+		// 请求体大小上限（字节），0 表示不限制
+		MaxRequestBodySize: maxRequestBodySize,
+		// 按客户端的 Accept-Encoding 压缩非流式响应，只压缩不小于 CompressionMinSize 字节的响应
+		Compression:        compression,
+		CompressionMinSize: compressionMinSize,
+		// 允许上传的附件 MIME 类型
+		AllowedFileTypes: allowedFileTypes,
+		// 模型列表缓存时间
+		ModelsCacheTTL: time.Duration(modelsCacheTTL) * time.Second,
+		// 是否允许调用方通过请求头传入自己的 session
+		AllowUserSession: os.Getenv("ALLOW_USER_SESSION") == "true",
+		// 自带账号的连接与限流状态缓存时间
+		UserSessionTTL: time.Duration(userSessionTTL) * time.Second,
+		// 模型别名与回退链
+		ModelChains: file.mergeModelChains(parseModelChains(os.Getenv("MODEL_CHAINS"))),
+		// 各模型使用的分词器
+		Tokenizers:       parseTokenizerRules(os.Getenv("TOKENIZERS")),
+		DefaultTokenizer: defaultTokenizer,
+		// 超出此 token 数将文本转为文件
+		MaxChatHistoryTokens: maxChatHistoryTokens,
+		// 轮换使用的代理池
+		ProxyPool: NewProxyPool(parseListEnv(os.Getenv("PROXY_POOL")), time.Duration(proxyCooldown)*time.Second, proxyFailureThreshold),
+		// 流式响应断线后可通过 Last-Event-ID 续传的时间窗口
+		StreamResumeWindow: time.Duration(streamResumeWindow) * time.Second,
+		// 每个流缓冲的最近事件数，更早的事件无法续传
+		StreamResumeBuffer: streamResumeBuffer,
+		// 重试退避策略
+		Backoff: loadBackoffPolicy(),
+		// 停机时等待普通请求完成的时间
+		ShutdownTimeout: time.Duration(shutdownTimeout) * time.Second,
+		// 停机时保存账号冷却与历史，启动时恢复
+		SessionStateFile: sessionStateFile,
+		// 深度研究模型，停机时优先排空
+		DeepResearchModels: deepResearchModels,
+		DeepResearchDrain:  time.Duration(deepResearchDrain) * time.Second,
+		// 排空超时后是否将深度研究请求转为异步任务
+		DeepResearchHandoff: os.Getenv("DEEP_RESEARCH_HANDOFF") == "true",
+		ResearchJobsFile:    researchJobsFile,
+		// 检索内容与附件的提示词注入防护模式
+		InjectionGuard: injectionGuard,
+		// 回答中的图片：markdown 写入正文，image_url 作为非流式响应的内容片段返回，off 不返回
+		ImageOutput: imageOutput,
+		// 对话超出 token 预算时的处理方式
+		Context: loadContextPolicy(),
+		// 允许浏览器直接调用接口的来源、请求方法与请求头
+		CORS: loadCORSPolicy(),
+		// 客户端 API key，APIKEY 为拥有管理权限的默认 key
+		Keys: NewKeyStore(keysFile, staticKeys),
+		// 接受身份提供方签发的 JWT，声明映射为 key 的名称、模型与限流
+		JWT: loadJWTPolicy(),
+		// 每个 key 每分钟的请求数与 token 数上限，key 可单独覆盖
+		RateLimitRPM: rateLimitRPM,
+		RateLimitTPM: rateLimitTPM,
+		// 是否按 key 与客户端 IP 分别限流
+		RateLimitByIP: os.Getenv("RATE_LIMIT_BY_IP") == "true",
+		// 按 key 学习请求量基线，突增时临时限流并通知 ANOMALY_WEBHOOK
+		AnomalyDetection: os.Getenv("ANOMALY_DETECTION") == "true",
+		AnomalyFactor:    anomalyFactor,
+		AnomalyMinRPM:    anomalyMinRPM,
+		AnomalyThrottle:  time.Duration(anomalyThrottle) * time.Second,
+		AnomalyWebhook:   os.Getenv("ANOMALY_WEBHOOK"),
+		// 上游连续失败达到阈值后熔断，冷却后放行探测请求，0 表示关闭
+		BreakerThreshold: breakerThreshold,
+		BreakerCooldown:  time.Duration(breakerCooldown) * time.Second,
+		// 流式响应中途无输出超过此时间记为停滞
+		StreamStallThreshold: time.Duration(streamStallThreshold) * time.Second,
+		// 低于此每秒词数且无停滞的流记为慢速模型
+		StreamSlowWPS: streamSlowWPS,
+		// SSE 流空闲超过此时间时发送 ": keepalive" 注释行
+		SSEKeepalive: time.Duration(sseKeepalive) * time.Second,
+		// 流式响应在此间隔内写出的数据块合并发送，积累到 StreamFlushBytes 字节时提前发送
+		StreamFlushInterval: time.Duration(streamFlushInterval) * time.Millisecond,
+		StreamFlushBytes:    streamFlushBytes,
+		// 非流式请求读取上游响应的时间上限
+		NonStreamTimeout: time.Duration(nonStreamTimeout) * time.Second,
+		// 非流式请求超时或上游中断时返回已收到的部分（return）还是报错（fail）
+		NonStreamPartial: nonStreamPartial,
+		// 上游流中途断开时请求续写的次数
+		StreamRecovery: streamRecovery,
+		// OTLP/HTTP 链路追踪导出地址，为空时关闭
+		TraceEndpoint:    os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		TraceServiceName: traceServiceName,
+		TraceHeaders:     traceHeaders,
+		// 同一 session 相邻两次上游请求的最小间隔（毫秒）及随机抖动比例
+		SessionMinInterval:  time.Duration(sessionMinInterval) * time.Millisecond,
+		SessionPacingJitter: sessionPacingJitter,
+		// 深度研究与 Pro Search 的搜索进度输出方式
+		ProgressChannel: progressChannel,
+		// 思考模型推理过程的输出方式及 think 模式使用的标签名
+		ReasoningOutput: reasoningOutput,
+		ThinkTag:        thinkTag,
+		// 检测拒答并通过 refusal 字段与 content_filter 结束原因返回
+		RefusalSignaling: os.Getenv("REFUSAL_SIGNALING") == "true",
+		// 追问时复用 Perplexity 会话，只发送新的一轮消息
+		ThreadReuse: os.Getenv("THREAD_REUSE") == "true",
+		ThreadTTL:   time.Duration(threadTTL) * time.Second,
+		// 默认为所有请求提取陈述与引用
+		ExtractClaims: os.Getenv("EXTRACT_CLAIMS") == "true",
+		// 记录请求、实际发送的提示词与回答，供审计
+		ConversationStore: conversationStore,
+		ConversationDir:   conversationDir,
+		ConversationDB:    conversationDB,
+		// 写入请求记录与日志前遮盖邮箱、电话、密钥及自定义规则匹配的内容，key 可单独开关
+		RedactLogs:         os.Getenv("REDACT_LOGS") == "true",
+		RedactTypes:        redactTypes,
+		RedactPatternsFile: os.Getenv("REDACT_PATTERNS_FILE"),
+		// 默认在提示词中注入当前日期时间，时区同时作为上游请求参数
+		DateInjection: os.Getenv("DATE_INJECTION") != "false",
+		Timezone:      timezone,
+		// 保存最近多少个请求的上游调用，用于导出 curl 命令
+		DebugCapture: debugCapture,
+		// 回答后 Perplexity 会话的保留方式：保留、立即删除或保留若干分钟
+		ThreadRetention: threadRetention,
+		// 多实例部署时通过 Redis 共享账号冷却、轮询位置与用量统计
+		RedisURL:    os.Getenv("REDIS_URL"),
+		RedisPrefix: redisPrefix,
+		// 定期检查 GitHub 上的新版本，签名校验通过后才允许安装
+		UpdateCheck:         os.Getenv("UPDATE_CHECK") == "true",
+		UpdateCheckInterval: time.Duration(updateCheckInterval) * time.Hour,
+		UpdateRepo:          updateRepo,
+		UpdatePublicKey:     os.Getenv("UPDATE_PUBLIC_KEY"),
+		// 内存预算：low 模式缩小缓冲区并降低并发，MEMORY_LIMIT 为 Go 运行时的软内存上限（MB）
+		MemoryProfile:         memoryProfile,
+		MemoryLimit:           int64(memoryLimit) * 1024 * 1024,
+		SSEBufferSize:         sseBufferSize,
+		MaxConcurrentRequests: maxConcurrentRequests,
+		// 超出并发上限的请求最多排队的数量与时间，超出后返回 503
+		MaxQueuedRequests: maxQueuedRequests,
+		QueueTimeout:      time.Duration(queueTimeout) * time.Second,
+		// 从其他应用导入的会话
+		ImportsFile: importsFile,
+		// 不带认证头的 Ollama 接口请求使用的 key 名称，为空时要求认证
+		OllamaKey: os.Getenv("OLLAMA_KEY"),
+		// 检查 .env 与配置文件变化并重新加载的间隔，0 表示只在 SIGHUP 时重新加载
+		ConfigWatch: time.Duration(configWatch) * time.Second,
+		// 启动时加载的钩子插件
+		HookPlugins: parseListEnv(os.Getenv("HOOK_PLUGINS")),
+		// 内容审核规则文件与屏蔽关键词
+		ModerationRulesFile: os.Getenv("MODERATION_RULES_FILE"),
+		ModerationKeywords:  parseListEnv(os.Getenv("MODERATION_KEYWORDS")),
+		// 外部审核接口，兼容 OpenAI /v1/moderations
+		ModerationEndpoint: os.Getenv("MODERATION_ENDPOINT"),
+		ModerationAPIKey:   os.Getenv("MODERATION_API_KEY"),
+		ModerationModel:    os.Getenv("MODERATION_MODEL"),
+		// 审核接口出错时是否拒绝请求
+		ModerationFailClosed: os.Getenv("MODERATION_FAIL_CLOSED") == "true",
+		// 相同请求在有效期内直接返回缓存的回答，0 表示关闭
+		ResponseCacheTTL:  time.Duration(responseCacheTTL) * time.Second,
+		ResponseCacheSize: responseCacheSize,
+		// 合并同时到达的相同请求，只向上游发送一次
+		DedupInflight: os.Getenv("DEDUP_INFLIGHT") == "true",
+		// 流式请求在此时间内未开始响应时在另一个账号上同时发送，0 表示关闭
+		HedgeDelay: time.Duration(hedgeDelay) * time.Millisecond,
+		// 账号连续认证失败达到此次数后停用，0 表示只冷却不停用
+		AuthFailureThreshold: authFailureThreshold,
+		// 启动时检查所有账号，可用账号少于 MinUsableSessions 时拒绝启动（Strict）或降级启动
+		ValidateSessions:       os.Getenv("VALIDATE_SESSIONS") == "true",
+		MinUsableSessions:      minUsableSessions,
+		ValidateSessionsStrict: os.Getenv("VALIDATE_SESSIONS_STRICT") == "true",
+		// 按账号订阅等级分配请求：strict 只用等级足够的账号，overflow 在没有可用的此类账号时使用其他账号
+		TierRouting: tierRouting,
+		// 账号每日、每月的默认用量预算，超出后在窗口重置前不再使用该账号
+		SessionBudget: loadSessionBudget(),
+		// 通过固定代理遇到 Cloudflare 验证的账号暂停使用的时间
+		ChallengeCooldown: time.Duration(challengeCooldown) * time.Second,
+		// 遇到验证时调用的外部验证服务，返回的 cookie 用于之后经过同一出口的请求
+		ChallengeSolver:        os.Getenv("CHALLENGE_SOLVER"),
+		ChallengeSolverTimeout: time.Duration(challengeSolverTimeout) * time.Second,
+		// 上游客户端模拟的浏览器及其 TLS 指纹、HTTP/2 设置与请求头顺序
+		Fingerprint: loadFingerprint(),
+		// 各账号轮换使用的 User-Agent 与 sec-ch-* 请求头，同一账号始终使用同一组
+		HeaderProfiles: loadHeaderProfiles(file.HeaderProfiles),
+		// 上游站点、SSE 接口与附件上传地址，用于镜像站、企业代理或测试环境
+		Upstream: loadUpstream(),
+		// 内置的模拟上游，用于不消耗额度地测试客户端与重试逻辑
+		Mock: loadMockUpstream(),
+		// 接收运维告警的 webhook 地址，可加 slack= 或 discord= 前缀指定消息格式
+		WebhookURLs: parseListEnv(os.Getenv("WEBHOOK_URLS")),
+		// 同一事件（同一账号）两次告警的最小间隔
+		WebhookMinInterval: time.Duration(webhookMinInterval) * time.Second,
 	}
 
+	for i, s := range config.Sessions {
+		config.sessionSources = append(config.sessionSources, s.SessionKey)
+		config.assignHeaderProfile(&config.Sessions[i])
+	}
+	config.sessionKeys = sessionKeys(config.sessionSources)
 	// 如果地址为空，使用默认值
 	if config.Address == "" {
 		config.Address = "0.0.0.0:8080"
@@ -121,6 +1104,81 @@ func LoadConfig() *Config {
 	return config
 }
 
+// Memory profiles accepted by MEMORY_PROFILE
+const (
+	MemoryProfileDefault = "default"
+	MemoryProfileLow     = "low"
+)
+
+// Tier routing modes accepted by TIER_ROUTING
+const (
+	TierRoutingStrict   = "strict"
+	TierRoutingOverflow = "overflow"
+)
+
+// Progress channels accepted by PROGRESS_CHANNEL
+const (
+	ProgressContent   = "content"
+	ProgressReasoning = "reasoning"
+	ProgressOff       = "off"
+)
+
+// Conversation stores accepted by CONVERSATION_STORE
+const (
+	ConversationStoreOff    = "off"
+	ConversationStoreSQLite = "sqlite"
+	ConversationStoreFile   = "file"
+)
+
+// Partial result policies accepted by NON_STREAM_PARTIAL
+const (
+	PartialReturn = "return"
+	PartialFail   = "fail"
+)
+
+// Thread retentions accepted by THREAD_RETENTION besides a number of minutes
+const (
+	ThreadKeep   = "keep"
+	ThreadDelete = "delete"
+)
+
+// RetainThread is the retention of threads that are never deleted
+const RetainThread time.Duration = -1
+
+// ParseThreadRetention parses keep, delete or a number of minutes to keep
+// the thread for. Empty means keep.
+func ParseThreadRetention(s string) (time.Duration, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", ThreadKeep:
+		return RetainThread, nil
+	case ThreadDelete, "0":
+		return 0, nil
+	}
+	minutes, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || minutes < 0 {
+		return RetainThread, fmt.Errorf("%q is not keep, delete or a number of minutes", s)
+	}
+	return time.Duration(minutes) * time.Minute, nil
+}
+
+// FormatThreadRetention 返回保留方式的可读形式
+func FormatThreadRetention(d time.Duration) string {
+	switch {
+	case d < 0:
+		return ThreadKeep
+	case d == 0:
+		return ThreadDelete
+	}
+	return d.String()
+}
+
+// Reasoning outputs accepted by REASONING_OUTPUT
+const (
+	ReasoningThink   = "think"
+	ReasoningContent = "reasoning_content"
+	ReasoningStrip   = "strip"
+)
+
 var ConfigInstance *Config
 var Sr *SessionRagen
 
@@ -130,31 +1188,151 @@ func (sr *SessionRagen) NextIndex() int {
 
 	index := sr.Index
 	sr.Index = (index + 1) % len(ConfigInstance.Sessions)
+	// 多实例部署时使用共享的轮询计数，避免各实例同时选中同一个账号
+	if Shared != nil {
+		if n, err := Shared.NextIndex(); err == nil {
+			index = int(n % int64(len(ConfigInstance.Sessions)))
+		}
+	}
 	return index
 }
 func init() {
 	rand.Seed(time.Now().UnixNano())
+	snapshotEnv()
 	// 加载环境变量
-	_ = godotenv.Load()
+	loadDotenv()
 	Sr = &SessionRagen{
 		Index: 0,
 		Mutex: sync.Mutex{},
 	}
+	// 直接启动服务时解析命令行参数，子命令与测试程序有各自的参数
+	if len(os.Args) > 1 && strings.HasPrefix(os.Args[1], "-") && !strings.HasSuffix(os.Args[0], ".test") {
+		applyFlags(os.Args[1:])
+	}
 	ConfigInstance = LoadConfig()
+	// 日志设置也可以来自配置文件
+	if level, ok := logger.ParseLevel(os.Getenv("LOG_LEVEL")); ok {
+		logger.SetLevel(level)
+	}
+	logger.SetFormat(os.Getenv("LOG_FORMAT"))
 	logger.Info("Loaded config:")
+	if path := ConfigFilePath(); path != "" {
+		logger.Info(fmt.Sprintf("ConfigFile: %s", path))
+	}
 	logger.Info(fmt.Sprintf("Sessions count: %d", ConfigInstance.RetryCount))
 	for _, session := range ConfigInstance.Sessions {
 		logger.Info(fmt.Sprintf("Session: %s", session.SessionKey))
+		if session.Proxy != "" {
+			logger.Info(fmt.Sprintf("Session proxy: %s", session.Proxy))
+		}
 	}
 	logger.Info(fmt.Sprintf("Address: %s", ConfigInstance.Address))
+	if ConfigInstance.TLSCertFile != "" {
+		logger.Info(fmt.Sprintf("TLS: cert %s, client auth %s, reload every %v", ConfigInstance.TLSCertFile, ConfigInstance.TLSClientAuth, ConfigInstance.TLSReloadInterval))
+	}
 	logger.Info(fmt.Sprintf("APIKey: %s", ConfigInstance.APIKey))
+	for _, key := range ConfigInstance.Keys.List() {
+		logger.Info(fmt.Sprintf("Key: %s (admin %t, models %s)", key.Name, key.Admin, strings.Join(key.AllowedModels, ",")))
+	}
 	logger.Info(fmt.Sprintf("Proxy: %s", ConfigInstance.Proxy))
+	logger.Info(fmt.Sprintf("ProxyPool: %d proxies, cooldown %v", ConfigInstance.ProxyPool.Len(), ConfigInstance.ProxyPool.Cooldown))
 	logger.Info(fmt.Sprintf("IsIncognito: %t", ConfigInstance.IsIncognito))
 	logger.Info(fmt.Sprintf("MaxChatHistoryLength: %d", ConfigInstance.MaxChatHistoryLength))
 	logger.Info(fmt.Sprintf("NoRolePrefix: %t", ConfigInstance.NoRolePrefix))
+	logger.Info(fmt.Sprintf("Prompt: format %s, system %s, names %t", ConfigInstance.Prompt.Format, ConfigInstance.Prompt.SystemMerge, ConfigInstance.Prompt.IncludeNames))
 	logger.Info(fmt.Sprintf("SearchResultCompatible: %t", ConfigInstance.SearchResultCompatible))
 	logger.Info(fmt.Sprintf("PromptForFile: %s", ConfigInstance.PromptForFile))
 	logger.Info(fmt.Sprintf("IgnoreSerchResult: %t", ConfigInstance.IgnoreSerchResult))
 	logger.Info(fmt.Sprintf("IgnoreModelMonitoring: %t", ConfigInstance.IgnoreModelMonitoring))
 	logger.Info(fmt.Sprintf("IsMaxSubscribe: %t", ConfigInstance.IsMaxSubscribe))
+	logger.Info(fmt.Sprintf("RateLimitCooldown: %v", ConfigInstance.RateLimitCooldown))
+	logger.Info(fmt.Sprintf("FamilyCooldowns: %v, adaptive %t (max %v)", ConfigInstance.Cooldowns.Cooldowns, ConfigInstance.Cooldowns.Adaptive, ConfigInstance.Cooldowns.Max))
+	logger.Info(fmt.Sprintf("MaxFileSize: %d", ConfigInstance.MaxFileSize))
+	logger.Info(fmt.Sprintf("Compression: %v, min size %d bytes", ConfigInstance.Compression, ConfigInstance.CompressionMinSize))
+	logger.Info(fmt.Sprintf("RequestLimits: body %d bytes, image %d bytes, %d images, %d files, %d messages, %d prompt chars", ConfigInstance.MaxRequestBodySize, ConfigInstance.MaxImageSize, ConfigInstance.MaxImages, ConfigInstance.MaxFiles, ConfigInstance.MaxMessages, ConfigInstance.MaxPromptChars))
+	logger.Info(fmt.Sprintf("AllowedFileTypes: %s", strings.Join(ConfigInstance.AllowedFileTypes, ",")))
+	logger.Info(fmt.Sprintf("ModelsCacheTTL: %v", ConfigInstance.ModelsCacheTTL))
+	logger.Info(fmt.Sprintf("StreamResumeWindow: %v, buffer: %d events", ConfigInstance.StreamResumeWindow, ConfigInstance.StreamResumeBuffer))
+	logger.Info(fmt.Sprintf("AllowUserSession: %t", ConfigInstance.AllowUserSession))
+	logger.Info(fmt.Sprintf("UserSessionTTL: %v", ConfigInstance.UserSessionTTL))
+	logger.Info(fmt.Sprintf("DefaultTokenizer: %s", ConfigInstance.DefaultTokenizer))
+	for _, rule := range ConfigInstance.Tokenizers {
+		logger.Info(fmt.Sprintf("Tokenizer: %s=%s", rule.Pattern, rule.Tokenizer))
+	}
+	logger.Info(fmt.Sprintf("MaxChatHistoryTokens: %d", ConfigInstance.MaxChatHistoryTokens))
+	logger.Info(fmt.Sprintf("ShutdownTimeout: %v, session state file %s", ConfigInstance.ShutdownTimeout, ConfigInstance.SessionStateFile))
+	logger.Info(fmt.Sprintf("DeepResearchModels: %s", strings.Join(ConfigInstance.DeepResearchModels, ",")))
+	logger.Info(fmt.Sprintf("DeepResearchDrain: %v, handoff %t, jobs file %s", ConfigInstance.DeepResearchDrain, ConfigInstance.DeepResearchHandoff, ConfigInstance.ResearchJobsFile))
+	logger.Info(fmt.Sprintf("InjectionGuard: %s", ConfigInstance.InjectionGuard))
+	logger.Info(fmt.Sprintf("ImageOutput: %s", ConfigInstance.ImageOutput))
+	logger.Info(fmt.Sprintf("CORS: origins %s, credentials %t", strings.Join(ConfigInstance.CORS.AllowedOrigins, ","), ConfigInstance.CORS.AllowCredentials))
+	logger.Info(fmt.Sprintf("Context: budget %d tokens, strategy %s, keep last %d", ConfigInstance.Context.Budget, ConfigInstance.Context.Strategy, ConfigInstance.Context.KeepLast))
+	logger.Info(fmt.Sprintf("ProgressChannel: %s", ConfigInstance.ProgressChannel))
+	logger.Info(fmt.Sprintf("ReasoningOutput: %s, tag <%s>", ConfigInstance.ReasoningOutput, ConfigInstance.ThinkTag))
+	logger.Info(fmt.Sprintf("RefusalSignaling: %t", ConfigInstance.RefusalSignaling))
+	logger.Info(fmt.Sprintf("ThreadReuse: %t, ttl %v", ConfigInstance.ThreadReuse, ConfigInstance.ThreadTTL))
+	logger.Info(fmt.Sprintf("ExtractClaims: %t", ConfigInstance.ExtractClaims))
+	logger.Info(fmt.Sprintf("ConversationStore: %s, database %s, dir %s", ConfigInstance.ConversationStore, ConfigInstance.ConversationDB, ConfigInstance.ConversationDir))
+	logger.Info(fmt.Sprintf("RedactLogs: %t, types %s, patterns file %q", ConfigInstance.RedactLogs, strings.Join(ConfigInstance.RedactTypes, ","), ConfigInstance.RedactPatternsFile))
+	logger.Info(fmt.Sprintf("DateInjection: %t, timezone %s", ConfigInstance.DateInjection, ConfigInstance.Timezone))
+	logger.Info(fmt.Sprintf("ThreadRetention: %s", FormatThreadRetention(ConfigInstance.ThreadRetention)))
+	logger.Info(fmt.Sprintf("MemoryProfile: %s, limit %d MB, sse buffer %d, max concurrent requests %d, queue %d for %v", ConfigInstance.MemoryProfile, ConfigInstance.MemoryLimit>>20, ConfigInstance.SSEBufferSize, ConfigInstance.MaxConcurrentRequests, ConfigInstance.MaxQueuedRequests, ConfigInstance.QueueTimeout))
+	if ConfigInstance.MemoryLimit > 0 {
+		debug.SetMemoryLimit(ConfigInstance.MemoryLimit)
+	}
+	if ConfigInstance.UpdateCheck {
+		logger.Info(fmt.Sprintf("UpdateCheck: %s every %v, signed %t", ConfigInstance.UpdateRepo, ConfigInstance.UpdateCheckInterval, ConfigInstance.UpdatePublicKey != ""))
+	}
+	if ConfigInstance.RedisURL != "" {
+		logger.Info(fmt.Sprintf("SharedState: redis, prefix %s", ConfigInstance.RedisPrefix))
+	}
+	if ConfigInstance.DebugCapture > 0 {
+		logger.Info(fmt.Sprintf("DebugCapture: last %d requests", ConfigInstance.DebugCapture))
+	}
+	logger.Info(fmt.Sprintf("StreamStallThreshold: %v, slow below %g words/s", ConfigInstance.StreamStallThreshold, ConfigInstance.StreamSlowWPS))
+	logger.Info(fmt.Sprintf("SSEKeepalive: %v", ConfigInstance.SSEKeepalive))
+	if ConfigInstance.StreamFlushInterval > 0 {
+		logger.Info(fmt.Sprintf("StreamFlushInterval: %v, or every %d bytes", ConfigInstance.StreamFlushInterval, ConfigInstance.StreamFlushBytes))
+	}
+	logger.Info(fmt.Sprintf("NonStreamTimeout: %v, partial results: %s", ConfigInstance.NonStreamTimeout, ConfigInstance.NonStreamPartial))
+	logger.Info(fmt.Sprintf("StreamRecovery: %d attempts", ConfigInstance.StreamRecovery))
+	logger.Info(fmt.Sprintf("HookPlugins: %v", ConfigInstance.HookPlugins))
+	if ConfigInstance.TraceEndpoint != "" {
+		logger.Info(fmt.Sprintf("Tracing: exporting to %s as %s", ConfigInstance.TraceEndpoint, ConfigInstance.TraceServiceName))
+	}
+	if ConfigInstance.SessionMinInterval > 0 {
+		logger.Info(fmt.Sprintf("SessionPacing: min interval %v, jitter %g", ConfigInstance.SessionMinInterval, ConfigInstance.SessionPacingJitter))
+	}
+	if ConfigInstance.JWT.Enabled() {
+		logger.Info(fmt.Sprintf("JWT: hs256 %t, jwks %q, issuer %q, audience %q, name claim %s, admin scope %q", ConfigInstance.JWT.Secret != "", ConfigInstance.JWT.JWKSURL, ConfigInstance.JWT.Issuer, ConfigInstance.JWT.Audience, ConfigInstance.JWT.NameClaim, ConfigInstance.JWT.AdminScope))
+	}
+	logger.Info(fmt.Sprintf("RateLimit: %d rpm, %d tpm, by ip %t", ConfigInstance.RateLimitRPM, ConfigInstance.RateLimitTPM, ConfigInstance.RateLimitByIP))
+	if ConfigInstance.OllamaKey != "" {
+		logger.Info(fmt.Sprintf("OllamaKey: unauthenticated /api requests use key %s", ConfigInstance.OllamaKey))
+	}
+	if ConfigInstance.BreakerThreshold > 0 {
+		logger.Info(fmt.Sprintf("CircuitBreaker: open after %d consecutive upstream failures, probe after %v", ConfigInstance.BreakerThreshold, ConfigInstance.BreakerCooldown))
+	}
+	if ConfigInstance.ResponseCacheTTL > 0 {
+		logger.Info(fmt.Sprintf("ResponseCache: ttl %v, up to %d entries in memory", ConfigInstance.ResponseCacheTTL, ConfigInstance.ResponseCacheSize))
+	}
+	logger.Info(fmt.Sprintf("DedupInflight: %t", ConfigInstance.DedupInflight))
+	logger.Info(fmt.Sprintf("HedgeDelay: %v", ConfigInstance.HedgeDelay))
+	logger.Info(fmt.Sprintf("AuthFailureThreshold: %d", ConfigInstance.AuthFailureThreshold))
+	logger.Info(fmt.Sprintf("ValidateSessions: %t, min usable %d, strict %t", ConfigInstance.ValidateSessions, ConfigInstance.MinUsableSessions, ConfigInstance.ValidateSessionsStrict))
+	logger.Info(fmt.Sprintf("TierRouting: %s", ConfigInstance.TierRouting))
+	logger.Info(fmt.Sprintf("SessionBudget: %+v", ConfigInstance.SessionBudget))
+	logger.Info(fmt.Sprintf("Challenge: cooldown %v, solver %t", ConfigInstance.ChallengeCooldown, ConfigInstance.ChallengeSolver != ""))
+	logger.Info(fmt.Sprintf("Fingerprint: %+v", ConfigInstance.Fingerprint))
+	logger.Info(fmt.Sprintf("HeaderProfiles: %d", len(ConfigInstance.HeaderProfiles)))
+	logger.Info(fmt.Sprintf("Upstream: %+v", ConfigInstance.Upstream))
+	logger.Info(fmt.Sprintf("Webhooks: %d, min interval: %v", len(ConfigInstance.WebhookURLs), ConfigInstance.WebhookMinInterval))
+	if ConfigInstance.AnomalyDetection {
+		logger.Info(fmt.Sprintf("AnomalyDetection: %gx baseline and at least %d rpm, throttle for %v", ConfigInstance.AnomalyFactor, ConfigInstance.AnomalyMinRPM, ConfigInstance.AnomalyThrottle))
+	}
+	backoff := ConfigInstance.Backoff
+	logger.Info(fmt.Sprintf("Backoff: base %v, max %v, multiplier %g, jitter %g, max attempts %d", backoff.BaseDelay, backoff.MaxDelay, backoff.Multiplier, backoff.Jitter, backoff.MaxAttempts))
+	for alias, chain := range ConfigInstance.ModelChains {
+		logger.Info(fmt.Sprintf("ModelChain: %s -> %s", alias, strings.Join(chain, " -> ")))
+	}
 }
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"pplx2api/logger"
+	"strconv"
+	"strings"
+)
+
+// Context strategies accepted by CONTEXT_STRATEGY
+const (
+	ContextDropOldest = "drop_oldest"
+	ContextKeepLast   = "keep_last"
+	ContextSummarize  = "summarize"
+)
+
+// ContextPolicy decides what happens to a conversation whose estimated
+// prompt tokens exceed Budget.
+type ContextPolicy struct {
+	// Budget 提示词 token 预算，0 表示不限制
+	Budget int `json:"budget,omitempty"`
+	// Strategy drop_oldest 从最早的消息开始丢弃，keep_last 只保留 system 消息与最后 KeepLast 条，
+	// summarize 将较早的消息交给上游总结
+	Strategy string `json:"strategy,omitempty"`
+	KeepLast int    `json:"keep_last,omitempty"`
+	// SummaryModel 用于总结的模型，为空时使用请求的模型
+	SummaryModel string `json:"summary_model,omitempty"`
+}
+
+// Validate checks the strategy of the policy
+func (p ContextPolicy) Validate() error {
+	switch p.Strategy {
+	case "", ContextDropOldest, ContextKeepLast, ContextSummarize:
+	default:
+		return fmt.Errorf("invalid context strategy %q, use drop_oldest, keep_last or summarize", p.Strategy)
+	}
+	if p.Budget < 0 || p.KeepLast < 0 {
+		return fmt.Errorf("context budget and keep_last must not be negative")
+	}
+	return nil
+}
+
+// Merge returns the policy with the fields set in override replaced
+func (p ContextPolicy) Merge(override ContextPolicy) ContextPolicy {
+	if override.Budget > 0 {
+		p.Budget = override.Budget
+	}
+	if override.Strategy != "" {
+		p.Strategy = override.Strategy
+	}
+	if override.KeepLast > 0 {
+		p.KeepLast = override.KeepLast
+	}
+	if override.SummaryModel != "" {
+		p.SummaryModel = override.SummaryModel
+	}
+	return p
+}
+
+// loadContextPolicy 读取 CONTEXT_* 环境变量
+func loadContextPolicy() ContextPolicy {
+	p := ContextPolicy{
+		Strategy:     strings.ToLower(os.Getenv("CONTEXT_STRATEGY")),
+		SummaryModel: os.Getenv("CONTEXT_SUMMARY_MODEL"),
+	}
+	if budget, err := strconv.Atoi(os.Getenv("CONTEXT_BUDGET")); err == nil && budget > 0 {
+		p.Budget = budget
+	}
+	p.KeepLast = 6
+	if keepLast, err := strconv.Atoi(os.Getenv("CONTEXT_KEEP_LAST")); err == nil && keepLast > 0 {
+		p.KeepLast = keepLast
+	}
+	if p.Strategy == "" {
+		p.Strategy = ContextDropOldest
+	}
+	if err := p.Validate(); err != nil {
+		logger.Error(err.Error())
+		p.Strategy = ContextDropOldest
+	}
+	return p
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"pplx2api/logger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SessionCookieName is the cookie holding a Perplexity session key
+const SessionCookieName = "__Secure-next-auth.session-token"
+
+// errNoSessionCookie is returned when an export has no Perplexity session
+var errNoSessionCookie = errors.New("no Perplexity session cookie found")
+
+// exportedCookie is one cookie of a browser export
+type exportedCookie struct {
+	Domain string `json:"domain"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	// ExpirationDate 由 Cookie-Editor、EditThisCookie 导出，Expires 由 Playwright 等导出
+	ExpirationDate float64 `json:"expirationDate"`
+	Expires        float64 `json:"expires"`
+}
+
+// ParseCookieExport extracts the Perplexity session keys of a browser
+// cookie export, either a Netscape cookies.txt or the JSON of extensions
+// such as Cookie-Editor. Session cookies split into numbered chunks are
+// joined, and expired cookies are skipped.
+func ParseCookieExport(data []byte) ([]string, error) {
+	var cookies []exportedCookie
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		if err := json.Unmarshal(trimmed, &cookies); err != nil {
+			return nil, fmt.Errorf("invalid JSON cookie export: %w", err)
+		}
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var wrapped struct {
+			Cookies []exportedCookie `json:"cookies"`
+		}
+		if err := json.Unmarshal(trimmed, &wrapped); err != nil {
+			return nil, fmt.Errorf("invalid JSON cookie export: %w", err)
+		}
+		cookies = wrapped.Cookies
+	default:
+		cookies = parseNetscapeCookies(string(trimmed))
+	}
+
+	now := float64(time.Now().Unix())
+	var keys []string
+	seen := map[string]bool{}
+	current := ""
+	flush := func() {
+		if current != "" && !seen[current] {
+			seen[current] = true
+			keys = append(keys, current)
+		}
+		current = ""
+	}
+	for _, cookie := range cookies {
+		domain := strings.TrimPrefix(cookie.Domain, ".")
+		if domain != "perplexity.ai" && !strings.HasSuffix(domain, ".perplexity.ai") {
+			continue
+		}
+		if expires := cookie.ExpirationDate + cookie.Expires; expires > 0 && expires < now {
+			continue
+		}
+		// 过长的 cookie 被分为 .0、.1 等多段，.0 开始一个新的账号
+		switch {
+		case cookie.Name == SessionCookieName:
+			flush()
+			current = cookie.Value
+			flush()
+		case cookie.Name == SessionCookieName+".0":
+			flush()
+			current = cookie.Value
+		case strings.HasPrefix(cookie.Name, SessionCookieName+".") && current != "":
+			current += cookie.Value
+		}
+	}
+	flush()
+	if len(keys) == 0 {
+		return nil, errNoSessionCookie
+	}
+	return keys, nil
+}
+
+// parseNetscapeCookies 解析 cookies.txt：每行以制表符分隔 domain、flag、path、secure、expiration、name、value
+func parseNetscapeCookies(data string) []exportedCookie {
+	var cookies []exportedCookie
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		expires, _ := strconv.ParseFloat(fields[4], 64)
+		cookies = append(cookies, exportedCookie{Domain: fields[0], Name: fields[5], Value: strings.TrimSpace(fields[6]), Expires: expires})
+	}
+	return cookies
+}
+
+// appendCookieSessions 追加 COOKIES_FILE 中的账号，已存在的 session key 被忽略
+func appendCookieSessions(sessions []SessionInfo, path string) []SessionInfo {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to read COOKIES_FILE: %v", err))
+		return sessions
+	}
+	keys, err := ParseCookieExport(data)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to import COOKIES_FILE: %v", err))
+		return sessions
+	}
+	existing := map[string]bool{}
+	for _, s := range sessions {
+		existing[s.SessionKey] = true
+	}
+	for _, key := range keys {
+		if !existing[key] {
+			existing[key] = true
+			sessions = append(sessions, SessionInfo{SessionKey: key})
+		}
+	}
+	return sessions
+}
+
+// AddSessions appends sessions for the keys not configured yet and returns
+// the indexes of the added sessions. They are kept until the next reload,
+// which only restores configured sessions.
+func (c *Config) AddSessions(keys []string) []int {
+	c.RwMutex.Lock()
+	defer c.RwMutex.Unlock()
+	existing := map[string]bool{}
+	for _, s := range c.Sessions {
+		existing[s.SessionKey] = true
+	}
+	var added []int
+	for _, key := range keys {
+		if existing[key] {
+			continue
+		}
+		existing[key] = true
+		session := SessionInfo{SessionKey: key}
+		c.assignHeaderProfile(&session)
+		c.Sessions = append(c.Sessions, session)
+		c.sessionSources = append(c.sessionSources, key)
+		added = append(added, len(c.Sessions)-1)
+	}
+	c.RetryCount += len(added)
+	c.setSessionKeys()
+	return added
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"pplx2api/logger"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Model families that are rate limited on separate upstream quotas
+const (
+	FamilyDefault  = "default"
+	FamilyPro      = "pro"
+	FamilyResearch = "research"
+)
+
+// CooldownPolicy maps upstream models to families and families to the
+// cooldown used when a 429 carries no Retry-After. A 429 on the default
+// family takes the whole session out of rotation; a 429 on any other
+// family only blocks that family on the session.
+type CooldownPolicy struct {
+	// Families 上游模型 ID 到类别的映射，未列出的模型属于 default
+	Families map[string]string
+	// Cooldowns 各类别的默认冷却时间，未设置的类别使用 Fallback
+	Cooldowns map[string]time.Duration
+	Fallback  time.Duration
+	// Adaptive 按每个账号观察到的 Retry-After 与限流频率学习冷却时间
+	Adaptive bool
+	// Max 学习到的冷却时间上限
+	Max time.Duration
+}
+
+// adaptiveDecay 每次成功请求后学习到的冷却时间的衰减比例
+const adaptiveDecay = 0.8
+
+// learnedCooldown 一个账号在某模型类别上学习到的冷却时间
+type learnedCooldown struct {
+	duration  time.Duration
+	lastLimit time.Time
+}
+
+// Family returns the family of an upstream model
+func (p CooldownPolicy) Family(model string) string {
+	if family, ok := p.Families[strings.ToLower(model)]; ok {
+		return family
+	}
+	return FamilyDefault
+}
+
+// Cooldown returns the cooldown of a family when upstream didn't send Retry-After
+func (p CooldownPolicy) Cooldown(family string) time.Duration {
+	if d, ok := p.Cooldowns[family]; ok {
+		return d
+	}
+	return p.Fallback
+}
+
+// loadCooldownPolicy 读取模型类别与各类别的冷却时间。
+// MODEL_FAMILIES 格式：research=pplx_alpha;pro=pplx_pro,o3pro
+// FAMILY_COOLDOWNS 格式：research=3600,pro=300（秒）
+func loadCooldownPolicy(researchModels []string, fallback time.Duration) CooldownPolicy {
+	p := CooldownPolicy{
+		Families:  map[string]string{},
+		Cooldowns: map[string]time.Duration{},
+		Fallback:  fallback,
+		Adaptive:  os.Getenv("ADAPTIVE_COOLDOWN") == "true",
+		Max:       time.Hour,
+	}
+	if seconds, err := strconv.Atoi(os.Getenv("ADAPTIVE_COOLDOWN_MAX")); err == nil && seconds > 0 {
+		p.Max = time.Duration(seconds) * time.Second
+	}
+	for _, m := range researchModels {
+		p.Families[strings.ToLower(m)] = FamilyResearch
+	}
+	p.Families["pplx_pro"] = FamilyPro
+	for _, entry := range strings.Split(os.Getenv("MODEL_FAMILIES"), ";") {
+		family, models, ok := strings.Cut(entry, "=")
+		family = strings.ToLower(strings.TrimSpace(family))
+		if !ok || family == "" {
+			continue
+		}
+		for _, m := range parseListEnv(models) {
+			p.Families[strings.ToLower(ModelMapGet(m, m))] = family
+		}
+	}
+	for _, item := range parseListEnv(os.Getenv("FAMILY_COOLDOWNS")) {
+		family, raw, _ := strings.Cut(item, "=")
+		seconds, err := strconv.Atoi(strings.TrimSpace(raw))
+		if err != nil || seconds <= 0 {
+			logger.Error(fmt.Sprintf("Invalid family cooldown: %s", item))
+			continue
+		}
+		p.Cooldowns[strings.ToLower(strings.TrimSpace(family))] = time.Duration(seconds) * time.Second
+	}
+	return p
+}
+
+// NextCooldown returns how long the session should cool down after a 429
+// on family. Without ADAPTIVE_COOLDOWN it is Retry-After or the family's
+// configured cooldown. With it, Retry-After values are averaged into a
+// learned cooldown that is used when upstream sends none, and a 429 that
+// follows soon after the last one doubles it, up to the policy maximum.
+func (s *SessionState) NextCooldown(family string, retryAfter time.Duration) time.Duration {
+	p := ConfigInstance.Cooldowns
+	base := p.Cooldown(family)
+	if !p.Adaptive {
+		if retryAfter > 0 {
+			return retryAfter
+		}
+		return base
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.learned == nil {
+		s.learned = map[string]*learnedCooldown{}
+	}
+	l, ok := s.learned[family]
+	if !ok {
+		l = &learnedCooldown{duration: base}
+		s.learned[family] = l
+	}
+	now := time.Now()
+	repeated := !l.lastLimit.IsZero() && now.Sub(l.lastLimit) < 2*l.duration
+	l.lastLimit = now
+	if retryAfter > 0 {
+		l.duration = (l.duration + retryAfter) / 2
+		return retryAfter
+	}
+	if repeated {
+		l.duration *= 2
+	}
+	if l.duration > p.Max {
+		l.duration = p.Max
+	}
+	return l.duration
+}
+
+// DecayCooldown shrinks the learned cooldown of family after a success,
+// back towards the configured cooldown
+func (s *SessionState) DecayCooldown(family string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	l, ok := s.learned[family]
+	if !ok {
+		return
+	}
+	base := ConfigInstance.Cooldowns.Cooldown(family)
+	l.duration = time.Duration(float64(l.duration) * adaptiveDecay)
+	if l.duration <= base {
+		delete(s.learned, family)
+	}
+}
+
+// LearnedCooldowns returns the learned cooldown of each family that had a
+// rate limit since it last decayed back to the configured one
+func (s *SessionState) LearnedCooldowns() map[string]time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	learned := make(map[string]time.Duration, len(s.learned))
+	for family, l := range s.learned {
+		learned[family] = l.duration
+	}
+	return learned
+}
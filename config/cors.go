@@ -0,0 +1,79 @@
+package config
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// defaultCORSHeaders 默认允许浏览器发送的请求头
+var defaultCORSHeaders = []string{"Content-Type", "Content-Length", "Accept-Encoding", "Authorization", "X-Pplx-Session", "X-Session-Label", "Last-Event-ID", "X-Request-ID", "X-Goog-Api-Key"}
+
+// CORSPolicy decides which browser origins may call the API and what they
+// may send. An origin of * allows every origin; patterns like
+// https://*.example.com match subdomains.
+type CORSPolicy struct {
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	ExposedHeaders []string
+	// AllowCredentials 允许浏览器携带 cookie 等凭据，此时返回请求的 Origin 而不是 *
+	AllowCredentials bool
+	// MaxAge 预检结果的缓存时间（秒），0 表示不设置
+	MaxAge int
+}
+
+// AllowsOrigin reports whether a browser origin may call the API
+func (p CORSPolicy) AllowsOrigin(origin string) bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if strings.Contains(allowed, "*") {
+			if ok, _ := path.Match(strings.ToLower(allowed), strings.ToLower(origin)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// AllowsAnyOrigin reports whether every origin is allowed
+func (p CORSPolicy) AllowsAnyOrigin() bool {
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadCORSPolicy 从环境变量读取跨域设置
+func loadCORSPolicy() CORSPolicy {
+	p := CORSPolicy{
+		AllowedOrigins:   parseListEnv(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		AllowedMethods:   parseListEnv(strings.ToUpper(os.Getenv("CORS_ALLOWED_METHODS"))),
+		AllowedHeaders:   parseListEnv(os.Getenv("CORS_ALLOWED_HEADERS")),
+		ExposedHeaders:   parseListEnv(os.Getenv("CORS_EXPOSED_HEADERS")),
+		AllowCredentials: os.Getenv("CORS_ALLOW_CREDENTIALS") == "true",
+	}
+	if len(p.AllowedOrigins) == 0 {
+		p.AllowedOrigins = []string{"*"}
+	}
+	if len(p.AllowedMethods) == 0 {
+		p.AllowedMethods = []string{"POST", "GET", "OPTIONS", "PUT", "DELETE"}
+	}
+	if len(p.AllowedHeaders) == 0 {
+		p.AllowedHeaders = defaultCORSHeaders
+	}
+	if len(p.ExposedHeaders) == 0 {
+		p.ExposedHeaders = []string{"X-Request-ID", "X-Cache"}
+	}
+	maxAge, err := strconv.Atoi(os.Getenv("CORS_MAX_AGE"))
+	if err != nil || maxAge < 0 {
+		maxAge = 600 // 默认缓存10分钟
+	}
+	p.MaxAge = maxAge
+	return p
+}
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pplx2api/logger"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFiles 未设置 CONFIG_FILE 时在工作目录中查找的配置文件
+var defaultConfigFiles = []string{"config.yaml", "config.yml", "config.json"}
+
+// FileConfig is the structure of the YAML or JSON config file. Settings
+// from the environment take precedence over the file, command line flags
+// take precedence over both.
+type FileConfig struct {
+	// Env 任意环境变量的值，只在该变量未设置时生效
+	Env map[string]string `json:"env,omitempty"`
+	// Sessions 未设置 SESSIONS 时使用
+	Sessions []FileSession `json:"sessions,omitempty"`
+	// Proxy、Proxies 未设置 PROXY、PROXY_POOL 时使用
+	Proxy   string   `json:"proxy,omitempty"`
+	Proxies []string `json:"proxies,omitempty"`
+	// Keys 与 API_KEYS 合并，同名时环境变量优先
+	Keys []APIKey `json:"keys,omitempty"`
+	// Models 追加或覆盖的模型别名，别名 -> 上游模型
+	Models map[string]string `json:"models,omitempty"`
+	// ModelChains 与 MODEL_CHAINS 合并，同一别名时环境变量优先
+	ModelChains map[string][]string `json:"model_chains,omitempty"`
+	// HeaderProfiles 追加或替换同名内置 profile 的请求头 profile
+	HeaderProfiles []HeaderProfile `json:"header_profiles,omitempty"`
+}
+
+// FileSession is a session of the config file with its options
+type FileSession struct {
+	Token    string `json:"token"`
+	Proxy    string `json:"proxy,omitempty"`
+	Archived bool   `json:"archived,omitempty"`
+	// Labels 账号标签，用于按标签分配请求
+	Labels map[string]string `json:"labels,omitempty"`
+	// Budget 账号的用量预算，覆盖 SESSION_* 的默认预算
+	Budget *SessionBudget `json:"budget,omitempty"`
+	// Fingerprint 账号的客户端指纹，覆盖全局设置
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+	// HeaderProfile 账号使用的请求头 profile，未指定时自动分配
+	HeaderProfile string `json:"header_profile,omitempty"`
+	// Upstream 账号的上游地址，覆盖全局设置
+	Upstream *Upstream `json:"upstream,omitempty"`
+}
+
+var (
+	// fileEnv 由配置文件设置的环境变量，重新加载时可被覆盖或清除
+	fileEnv      = map[string]bool{}
+	fileEnvMutex sync.Mutex
+)
+
+// ConfigFilePath returns the config file in use, empty when there is none
+func ConfigFilePath() string {
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		return path
+	}
+	for _, path := range defaultConfigFiles {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// ReadConfigFile parses a config file, as JSON for .json files and as
+// YAML otherwise.
+func ReadConfigFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.EqualFold(filepath.Ext(path), ".json") {
+		// YAML 先转换为 JSON，与 keys.json 等文件共用字段名
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+		if doc == nil {
+			return &FileConfig{}, nil
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	var file FileConfig
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, s := range file.Sessions {
+		if strings.TrimSpace(s.Token) == "" {
+			return nil, fmt.Errorf("parse %s: session %d has no token", path, i+1)
+		}
+	}
+	for _, k := range file.Keys {
+		if k.Name == "" || k.Key == "" {
+			return nil, fmt.Errorf("parse %s: keys need a name and a key", path)
+		}
+	}
+	return &file, nil
+}
+
+// loadConfigFile 读取配置文件并把 env 与代理设置写入未设置的环境变量；
+// 没有配置文件或读取失败时返回空配置
+func loadConfigFile() *FileConfig {
+	file := &FileConfig{}
+	if path := ConfigFilePath(); path != "" {
+		parsed, err := ReadConfigFile(path)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to load config file: %v", err))
+		} else {
+			file = parsed
+		}
+	}
+	env := map[string]string{}
+	for k, v := range file.Env {
+		env[strings.ToUpper(k)] = v
+	}
+	if file.Proxy != "" {
+		env["PROXY"] = file.Proxy
+	}
+	if len(file.Proxies) > 0 {
+		env["PROXY_POOL"] = strings.Join(file.Proxies, ",")
+	}
+	fileEnvMutex.Lock()
+	defer fileEnvMutex.Unlock()
+	for k := range fileEnv {
+		if _, ok := env[k]; !ok {
+			os.Unsetenv(k)
+			delete(fileEnv, k)
+		}
+	}
+	for k, v := range env {
+		if _, set := os.LookupEnv(k); set && !fileEnv[k] {
+			continue // 环境变量优先
+		}
+		os.Setenv(k, v)
+		fileEnv[k] = true
+	}
+	return file
+}
+
+// sessions 返回配置文件中的 session
+func (f *FileConfig) sessions() []SessionInfo {
+	sessions := make([]SessionInfo, 0, len(f.Sessions))
+	for _, s := range f.Sessions {
+		sessions = append(sessions, SessionInfo{
+			SessionKey:    strings.TrimSpace(s.Token),
+			Proxy:         validProxyURL(s.Proxy),
+			Archived:      s.Archived,
+			Labels:        s.Labels,
+			Budget:        s.Budget,
+			Fingerprint:   validSessionFingerprint(s.Fingerprint),
+			HeaderProfile: s.HeaderProfile,
+			Upstream:      validSessionUpstream(s.Upstream),
+		})
+	}
+	return sessions
+}
+
+// mergeKeys 追加配置文件中的 key，与环境变量中的 key 同名时忽略
+func (f *FileConfig) mergeKeys(keys []APIKey) []APIKey {
+	names := map[string]bool{}
+	for _, k := range keys {
+		names[k.Name] = true
+	}
+	for _, k := range f.Keys {
+		if names[k.Name] {
+			logger.Info(fmt.Sprintf("Key %s in config file is overridden by the environment", k.Name))
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// mergeModelChains 合并配置文件中的回退链，环境变量中的同名链优先
+func (f *FileConfig) mergeModelChains(chains map[string][]string) map[string][]string {
+	for alias, chain := range f.ModelChains {
+		if _, ok := chains[alias]; !ok && len(chain) > 0 {
+			chains[alias] = chain
+		}
+	}
+	return chains
+}
+
+// builtinModelMap 内置的模型别名，重新加载时在此基础上应用配置文件
+var builtinModelMap = func() map[string]string {
+	m := make(map[string]string, len(ModelMap))
+	for alias, id := range ModelMap {
+		m[alias] = id
+	}
+	return m
+}()
+
+// applyModels 以内置别名加配置文件中的别名重建 ModelMap，整体替换以免与读取冲突
+func (f *FileConfig) applyModels() {
+	models := make(map[string]string, len(builtinModelMap)+len(f.Models))
+	reverse := make(map[string]string, len(models))
+	for alias, id := range builtinModelMap {
+		models[alias] = id
+		reverse[id] = alias
+	}
+	for alias, id := range f.Models {
+		models[alias] = id
+		reverse[id] = alias
+	}
+	ModelMap, ModelReverseMap = models, reverse
+}
+
+// listFlag collects a repeatable flag
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// applyFlags 解析命令行参数：-config 指定配置文件，-address 为监听地址，
+// -set KEY=VALUE 覆盖任意环境变量，优先级最高
+func applyFlags(args []string) {
+	fs := flag.NewFlagSet("pplx2api", flag.ExitOnError)
+	configFile := fs.String("config", "", "config file (YAML or JSON), overrides CONFIG_FILE")
+	address := fs.String("address", "", "listen address, overrides ADDRESS")
+	var sets listFlag
+	fs.Var(&sets, "set", "set an environment variable, KEY=VALUE, repeatable")
+	fs.Parse(args)
+	if *configFile != "" {
+		setFlagEnv("CONFIG_FILE", *configFile)
+	}
+	if *address != "" {
+		setFlagEnv("ADDRESS", *address)
+	}
+	for _, item := range sets {
+		key, value, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			fmt.Fprintf(os.Stderr, "invalid -set %q, use KEY=VALUE\n", item)
+			os.Exit(2)
+		}
+		setFlagEnv(strings.TrimSpace(key), value)
+	}
+}
+
+// setFlagEnv 设置命令行指定的环境变量，重新加载时不被 .env 与配置文件覆盖
+func setFlagEnv(key string, value string) {
+	os.Setenv(key, value)
+	processEnv[key] = true
+	delete(dotenvKeys, key)
+}
@@ -0,0 +1,148 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"pplx2api/logger"
+	"strconv"
+	"strings"
+)
+
+// Browsers the upstream client can impersonate
+const (
+	BrowserChrome  = "chrome"
+	BrowserFirefox = "firefox"
+	BrowserSafari  = "safari"
+	// BrowserNone 不模拟浏览器，使用 Go 默认的 TLS 与 HTTP/2 设置
+	BrowserNone = "none"
+)
+
+// TLSFingerprints are the TLS ClientHello fingerprints TLS may be set to
+var TLSFingerprints = []string{"chrome", "firefox", "edge", "safari", "ios", "android", "360", "qq", "randomized"}
+
+// http2SettingIDs HTTP/2 SETTINGS 帧中各参数的名称
+var http2SettingIDs = map[string]uint16{
+	"HEADER_TABLE_SIZE":      1,
+	"ENABLE_PUSH":            2,
+	"MAX_CONCURRENT_STREAMS": 3,
+	"INITIAL_WINDOW_SIZE":    4,
+	"MAX_FRAME_SIZE":         5,
+	"MAX_HEADER_LIST_SIZE":   6,
+}
+
+// Fingerprint is how the upstream HTTP client presents itself: the browser
+// it impersonates, optionally with the TLS fingerprint, HTTP/2 settings and
+// header order of that browser replaced
+type Fingerprint struct {
+	Browser string `json:"browser,omitempty"`
+	TLS     string `json:"tls,omitempty"`
+	// HTTP2Settings 如 HEADER_TABLE_SIZE=65536,INITIAL_WINDOW_SIZE=6291456
+	HTTP2Settings       string   `json:"http2_settings,omitempty"`
+	HTTP2ConnectionFlow uint32   `json:"http2_connection_flow,omitempty"`
+	HeaderOrder         []string `json:"header_order,omitempty"`
+}
+
+// HTTP2Setting is one parameter of the HTTP/2 SETTINGS frame
+type HTTP2Setting struct {
+	ID  uint16
+	Val uint32
+}
+
+// ParseHTTP2Settings parses settings written as NAME=value pairs separated
+// by commas, in the order they are sent
+func ParseHTTP2Settings(s string) ([]HTTP2Setting, error) {
+	var settings []HTTP2Setting
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(pair, "=")
+		id, ok := http2SettingIDs[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown HTTP/2 setting %q", name)
+		}
+		val, err := strconv.ParseUint(strings.TrimSpace(value), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value of HTTP/2 setting %s: %q", name, value)
+		}
+		settings = append(settings, HTTP2Setting{ID: id, Val: uint32(val)})
+	}
+	return settings, nil
+}
+
+// Validate checks the browser, TLS fingerprint and HTTP/2 settings names
+func (f Fingerprint) Validate() error {
+	switch f.Browser {
+	case "", BrowserChrome, BrowserFirefox, BrowserSafari, BrowserNone:
+	default:
+		return fmt.Errorf("unknown browser %q, use chrome, firefox, safari or none", f.Browser)
+	}
+	if f.TLS != "" {
+		valid := false
+		for _, t := range TLSFingerprints {
+			valid = valid || t == f.TLS
+		}
+		if !valid {
+			return fmt.Errorf("unknown TLS fingerprint %q, use one of %s", f.TLS, strings.Join(TLSFingerprints, ", "))
+		}
+	}
+	_, err := ParseHTTP2Settings(f.HTTP2Settings)
+	return err
+}
+
+// FingerprintFor returns the fingerprint of a session. A session setting
+// its own browser replaces the global fingerprint; otherwise only the
+// fields it sets override the global ones.
+func (c *Config) FingerprintFor(session SessionInfo) Fingerprint {
+	o := session.Fingerprint
+	if o == nil {
+		return c.Fingerprint
+	}
+	if o.Browser != "" {
+		return *o
+	}
+	fp := c.Fingerprint
+	if o.TLS != "" {
+		fp.TLS = o.TLS
+	}
+	if o.HTTP2Settings != "" {
+		fp.HTTP2Settings = o.HTTP2Settings
+	}
+	if o.HTTP2ConnectionFlow > 0 {
+		fp.HTTP2ConnectionFlow = o.HTTP2ConnectionFlow
+	}
+	if len(o.HeaderOrder) > 0 {
+		fp.HeaderOrder = o.HeaderOrder
+	}
+	return fp
+}
+
+// loadFingerprint 读取全局的客户端指纹设置，无效时使用默认的 Chrome 指纹
+func loadFingerprint() Fingerprint {
+	flow, _ := strconv.ParseUint(os.Getenv("HTTP2_CONNECTION_FLOW"), 10, 32)
+	fp := Fingerprint{
+		Browser:             strings.ToLower(os.Getenv("IMPERSONATE")),
+		TLS:                 strings.ToLower(os.Getenv("TLS_FINGERPRINT")),
+		HTTP2Settings:       os.Getenv("HTTP2_SETTINGS"),
+		HTTP2ConnectionFlow: uint32(flow),
+		HeaderOrder:         parseListEnv(os.Getenv("HEADER_ORDER")),
+	}
+	if err := fp.Validate(); err != nil {
+		logger.Error(fmt.Sprintf("Invalid client fingerprint: %v", err))
+		return Fingerprint{}
+	}
+	return fp
+}
+
+// validSessionFingerprint 丢弃无效的账号指纹设置
+func validSessionFingerprint(fp *Fingerprint) *Fingerprint {
+	if fp == nil {
+		return nil
+	}
+	if err := fp.Validate(); err != nil {
+		logger.Error(fmt.Sprintf("Ignoring session fingerprint: %v", err))
+		return nil
+	}
+	return fp
+}
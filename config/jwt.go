@@ -0,0 +1,64 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// JWTPolicy configures authentication with JWTs issued by an identity
+// provider. Tokens are accepted when Secret (HS256) or JWKSURL (RS256) is
+// set; the claims named here are mapped to the key identity.
+type JWTPolicy struct {
+	Secret      string
+	JWKSURL     string
+	JWKSRefresh time.Duration
+	// Issuer、Audience 不为空时要求 token 的 iss、aud 与之相同
+	Issuer   string
+	Audience string
+	// NameClaim 作为 key 名称的声明，ModelsClaim、ScopesClaim、RPMClaim、TPMClaim 为可选的权限与限流声明
+	NameClaim   string
+	ModelsClaim string
+	ScopesClaim string
+	RPMClaim    string
+	TPMClaim    string
+	// BaseKey 作为 token 权限、限流与默认值起点的 key 名称
+	BaseKey string
+	// AdminScope 授予管理权限的 scope 声明值，为空时声明不能授予管理权限
+	AdminScope string
+}
+
+// Enabled reports whether JWT authentication is configured
+func (p JWTPolicy) Enabled() bool {
+	return p.Secret != "" || p.JWKSURL != ""
+}
+
+// loadJWTPolicy 从环境变量读取 JWT 认证设置
+func loadJWTPolicy() JWTPolicy {
+	refresh, err := strconv.Atoi(os.Getenv("JWT_JWKS_REFRESH"))
+	if err != nil || refresh <= 0 {
+		refresh = 3600 // 默认每小时刷新一次公钥
+	}
+	return JWTPolicy{
+		Secret:      os.Getenv("JWT_SECRET"),
+		JWKSURL:     os.Getenv("JWT_JWKS_URL"),
+		JWKSRefresh: time.Duration(refresh) * time.Second,
+		Issuer:      os.Getenv("JWT_ISSUER"),
+		Audience:    os.Getenv("JWT_AUDIENCE"),
+		NameClaim:   envOr("JWT_NAME_CLAIM", "sub"),
+		ModelsClaim: envOr("JWT_MODELS_CLAIM", "models"),
+		ScopesClaim: envOr("JWT_SCOPES_CLAIM", "scope"),
+		RPMClaim:    envOr("JWT_RPM_CLAIM", "rpm"),
+		TPMClaim:    envOr("JWT_TPM_CLAIM", "tpm"),
+		BaseKey:     os.Getenv("JWT_BASE_KEY"),
+		AdminScope:  os.Getenv("JWT_ADMIN_SCOPE"),
+	}
+}
+
+// envOr 返回环境变量的值，未设置时返回默认值
+func envOr(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
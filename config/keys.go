@@ -0,0 +1,433 @@
+package config
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"pplx2api/logger"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultKeyName is the name of the key configured with APIKEY
+const DefaultKeyName = "default"
+
+// Endpoint scopes a key can be limited to
+const (
+	ScopeChat   = "chat"
+	ScopeModels = "models"
+	ScopeFiles  = "files"
+	ScopeBatch  = "batch"
+	ScopeAdmin  = "admin"
+)
+
+// System prompt modes of a key
+const (
+	SystemPromptPrepend = "prepend"
+	SystemPromptReplace = "replace"
+)
+
+// KeyDefaults are request options applied when the client doesn't set them
+type KeyDefaults struct {
+	Model string `json:"model,omitempty"`
+	// ForceModel 为 true 时忽略客户端指定的模型，总是使用 Model
+	ForceModel bool `json:"force_model,omitempty"`
+	// SystemPrompt 注入到请求中的系统提示词
+	SystemPrompt string `json:"system_prompt,omitempty"`
+	// SystemPromptMode prepend（默认）合并到客户端的 system 消息之前，replace 替换客户端的 system 消息
+	SystemPromptMode string `json:"system_prompt_mode,omitempty"`
+	// WebSearch、InjectDate、ExtractClaims 为客户端未设置对应扩展字段时的默认值
+	WebSearch     *bool `json:"web_search,omitempty"`
+	InjectDate    *bool `json:"inject_date,omitempty"`
+	ExtractClaims *bool `json:"extract_claims,omitempty"`
+	// Redact 覆盖 REDACT_LOGS，是否在记录该 key 的请求前遮盖个人信息与密钥
+	Redact *bool `json:"redact,omitempty"`
+	// HedgeDelay 覆盖 HEDGE_DELAY（毫秒），0 表示该 key 的请求不对冲
+	HedgeDelay *int `json:"hedge_delay,omitempty"`
+	// SessionLabels 该 key 的请求只使用带有这些标签的账号，优先于客户端指定的标签
+	SessionLabels map[string]string `json:"session_labels,omitempty"`
+	// Context 覆盖全局的上下文管理设置
+	Context ContextPolicy `json:"context,omitempty"`
+	// Timezone 注入日期与上游请求使用的时区，为空时使用 TIMEZONE
+	Timezone string `json:"timezone,omitempty"`
+	// ThreadRetention 回答后上游会话的保留方式：keep、delete 或分钟数，为空时使用 THREAD_RETENTION
+	ThreadRetention string `json:"thread_retention,omitempty"`
+}
+
+// APIKey is one client key with its own permissions and limits. Keys
+// added at runtime only keep a hash of their secret.
+type APIKey struct {
+	Name string `json:"name"`
+	// Key 明文密钥，只用于环境变量与配置文件中的 key，以及写入时的请求
+	Key string `json:"key,omitempty"`
+	// KeyHash 密钥的 SHA-256，Prefix 为密钥开头几位，便于辨认
+	KeyHash string `json:"key_hash,omitempty"`
+	Prefix  string `json:"prefix,omitempty"`
+	// ExpiresAt 过期时间，为空时不过期
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// PreviousHash 轮换前的密钥，在 PreviousExpiresAt 之前仍然有效
+	PreviousHash      string     `json:"previous_key_hash,omitempty"`
+	PreviousExpiresAt *time.Time `json:"previous_expires_at,omitempty"`
+	// Admin 是否允许访问 /admin 接口
+	Admin bool `json:"admin,omitempty"`
+	// Scopes 允许访问的接口范围，为空时允许除管理接口外的全部接口
+	Scopes []string `json:"scopes,omitempty"`
+	// AllowedModels 为空时允许所有模型
+	AllowedModels []string `json:"allowed_models,omitempty"`
+	// RPM、TPM 为每分钟请求数与 token 数上限，0 表示使用全局限制
+	RPM      int         `json:"rpm,omitempty"`
+	TPM      int         `json:"tpm,omitempty"`
+	Defaults KeyDefaults `json:"defaults,omitempty"`
+	// static 来自环境变量的 key 不写入文件，也不能在运行时修改
+	static bool
+}
+
+// AllowsModel reports whether the key may use a model
+func (k *APIKey) AllowsModel(model string) bool {
+	if len(k.AllowedModels) == 0 {
+		return true
+	}
+	model = strings.TrimSuffix(strings.TrimSuffix(model, "-search"), "-nosearch")
+	for _, allowed := range k.AllowedModels {
+		if strings.EqualFold(allowed, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope reports whether the key may access endpoints of scope. The
+// admin scope is only granted explicitly, by Admin or by listing it.
+func (k *APIKey) HasScope(scope string) bool {
+	if scope == ScopeAdmin && k.Admin {
+		return true
+	}
+	if len(k.Scopes) == 0 {
+		return scope != ScopeAdmin
+	}
+	for _, s := range k.Scopes {
+		if strings.EqualFold(s, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// Static reports whether the key comes from the environment
+func (k *APIKey) Static() bool {
+	return k.static
+}
+
+// Expired reports whether the key is past its expiry date
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// matches 判断 secret 是否为该 key 的当前密钥或仍在宽限期内的旧密钥
+func (k *APIKey) matches(secret string, hash string, now time.Time) bool {
+	if k.Key != "" && subtle.ConstantTimeCompare([]byte(k.Key), []byte(secret)) == 1 {
+		return true
+	}
+	if k.KeyHash != "" && subtle.ConstantTimeCompare([]byte(k.KeyHash), []byte(hash)) == 1 {
+		return true
+	}
+	return k.PreviousHash != "" && k.PreviousExpiresAt != nil && now.Before(*k.PreviousExpiresAt) &&
+		subtle.ConstantTimeCompare([]byte(k.PreviousHash), []byte(hash)) == 1
+}
+
+// hashSecret 返回密钥的 SHA-256
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// secretPrefix 返回用于辨认密钥的开头几位
+func secretPrefix(secret string) string {
+	if len(secret) <= 12 {
+		return ""
+	}
+	return secret[:8]
+}
+
+// GenerateSecret returns a new random key secret
+func GenerateSecret() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "sk-" + hex.EncodeToString(b), nil
+}
+
+// setSecret 保存密钥的哈希并清除明文
+func (k *APIKey) setSecret(secret string) {
+	k.KeyHash, k.Prefix, k.Key = hashSecret(secret), secretPrefix(secret), ""
+}
+
+// KeyStore holds the client keys. Keys from APIKEY and API_KEYS are fixed;
+// keys added at runtime are persisted to the keys file.
+type KeyStore struct {
+	mutex sync.RWMutex
+	keys  map[string]*APIKey
+	path  string
+}
+
+// ErrStaticKey is returned when changing a key defined in the environment
+var ErrStaticKey = errors.New("key is defined in the environment and can't be changed")
+
+// ErrKeyNotFound is returned when changing a key that doesn't exist
+var ErrKeyNotFound = errors.New("key not found")
+
+// NewKeyStore creates a store from the environment keys and the keys file at path
+func NewKeyStore(path string, static []APIKey) *KeyStore {
+	s := &KeyStore{keys: map[string]*APIKey{}, path: path}
+	for _, k := range static {
+		k := k
+		k.static = true
+		s.keys[k.Name] = &k
+	}
+	if err := s.load(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to load keys file: %v", err))
+	}
+	return s
+}
+
+func (s *KeyStore) load() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("parse %s: %w", s.path, err)
+	}
+	migrated := false
+	for _, k := range keys {
+		k := k
+		if existing, ok := s.keys[k.Name]; ok && existing.static {
+			logger.Error(fmt.Sprintf("Key %s in %s shadows an environment key, ignored", k.Name, s.path))
+			continue
+		}
+		if k.Key != "" {
+			// 旧版本保存的明文密钥改为只保存哈希
+			k.setSecret(k.Key)
+			migrated = true
+		}
+		s.keys[k.Name] = &k
+	}
+	if migrated {
+		logger.Info(fmt.Sprintf("Replacing plaintext keys in %s with their hashes", s.path))
+		return s.save()
+	}
+	return nil
+}
+
+// save 将运行时添加的 key 写入文件，调用方需持有锁
+func (s *KeyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	var keys []APIKey
+	for _, k := range s.sorted() {
+		if !k.static {
+			keys = append(keys, *k)
+		}
+	}
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(s.path, data, 0600)
+}
+
+func (s *KeyStore) sorted() []*APIKey {
+	keys := make([]*APIKey, 0, len(s.keys))
+	for _, k := range s.keys {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys
+}
+
+// Len returns the number of keys
+func (s *KeyStore) Len() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return len(s.keys)
+}
+
+// Lookup finds the key with the given secret. Expired keys are returned
+// too, callers check Expired.
+func (s *KeyStore) Lookup(secret string) (*APIKey, bool) {
+	if secret == "" {
+		return nil, false
+	}
+	hash, now := hashSecret(secret), time.Now()
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, k := range s.keys {
+		if k.matches(secret, hash, now) {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// Get finds the key with the given name
+func (s *KeyStore) Get(name string) (*APIKey, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	k, ok := s.keys[name]
+	return k, ok
+}
+
+// List returns copies of all keys sorted by name
+func (s *KeyStore) List() []APIKey {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var keys []APIKey
+	for _, k := range s.sorted() {
+		keys = append(keys, *k)
+	}
+	return keys
+}
+
+// Put adds a key or replaces the key with the same name. Without a secret
+// an existing key keeps its secret and a new key gets a generated one,
+// which is returned; only the hash of the secret is stored.
+func (s *KeyStore) Put(k APIKey) (string, error) {
+	secret, err := s.prepare(&k)
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	existing, ok := s.keys[k.Name]
+	if ok && existing.static {
+		return "", ErrStaticKey
+	}
+	generated := ""
+	switch {
+	case secret != "":
+		k.setSecret(secret)
+	case ok:
+		k.KeyHash, k.Prefix = existing.KeyHash, existing.Prefix
+		k.PreviousHash, k.PreviousExpiresAt = existing.PreviousHash, existing.PreviousExpiresAt
+	default:
+		if generated, err = GenerateSecret(); err != nil {
+			return "", err
+		}
+		k.setSecret(generated)
+	}
+	for _, other := range s.keys {
+		if other.Name != k.Name && other.matches(secret, k.KeyHash, time.Now()) {
+			return "", fmt.Errorf("key is already used by %s", other.Name)
+		}
+	}
+	k.static = false
+	s.keys[k.Name] = &k
+	return generated, s.save()
+}
+
+// prepare 校验 key 的设置并取出明文密钥
+func (s *KeyStore) prepare(k *APIKey) (string, error) {
+	if k.Name == "" {
+		return "", errors.New("name is required")
+	}
+	secret := k.Key
+	// 哈希字段只能由服务端设置
+	k.Key, k.KeyHash, k.Prefix, k.PreviousHash, k.PreviousExpiresAt = "", "", "", "", nil
+	return secret, k.validate()
+}
+
+// validate 校验 key 的默认值设置
+func (k *APIKey) validate() error {
+	if k.Defaults.Timezone != "" {
+		if _, err := time.LoadLocation(k.Defaults.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone %q", k.Defaults.Timezone)
+		}
+	}
+	if _, err := ParseThreadRetention(k.Defaults.ThreadRetention); err != nil {
+		return fmt.Errorf("invalid thread_retention: %w", err)
+	}
+	if k.Defaults.ForceModel && k.Defaults.Model == "" {
+		return errors.New("force_model requires a default model")
+	}
+	if err := k.Defaults.Context.Validate(); err != nil {
+		return err
+	}
+	switch k.Defaults.SystemPromptMode {
+	case "", SystemPromptPrepend, SystemPromptReplace:
+	default:
+		return fmt.Errorf("invalid system_prompt_mode %q, use prepend or replace", k.Defaults.SystemPromptMode)
+	}
+	return nil
+}
+
+// Rotate gives a key a new generated secret and returns it. The old
+// secret keeps working for grace, or stops working at once when grace is 0.
+func (s *KeyStore) Rotate(name string, grace time.Duration) (string, error) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	k, ok := s.keys[name]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	if k.static {
+		return "", ErrStaticKey
+	}
+	rotated := *k
+	rotated.PreviousHash, rotated.PreviousExpiresAt = "", nil
+	if grace > 0 {
+		until := time.Now().Add(grace)
+		rotated.PreviousHash, rotated.PreviousExpiresAt = k.KeyHash, &until
+	}
+	rotated.setSecret(secret)
+	s.keys[name] = &rotated
+	return secret, s.save()
+}
+
+// Delete removes the key with the given name, reporting whether it existed
+func (s *KeyStore) Delete(name string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	k, ok := s.keys[name]
+	if !ok {
+		return false, nil
+	}
+	if k.static {
+		return true, ErrStaticKey
+	}
+	delete(s.keys, name)
+	return true, s.save()
+}
+
+// parseAPIKeys 解析 API_KEYS 环境变量，格式：name=key,name2=key2
+func parseAPIKeys(envValue string) []APIKey {
+	var keys []APIKey
+	for _, item := range parseListEnv(envValue) {
+		name, key, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(name) == "" || strings.TrimSpace(key) == "" {
+			logger.Error(fmt.Sprintf("Invalid API key entry: %s", item))
+			continue
+		}
+		keys = append(keys, APIKey{Name: strings.TrimSpace(name), Key: strings.TrimSpace(key)})
+	}
+	return keys
+}
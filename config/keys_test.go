@@ -0,0 +1,131 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyStoreMigratesPlaintextKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(`[{"name":"alice","key":"sk-alice-plaintext-secret"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewKeyStore(path, nil)
+	k, ok := s.Lookup("sk-alice-plaintext-secret")
+	if !ok || k.Name != "alice" {
+		t.Fatalf("migrated key not found: %v %v", k, ok)
+	}
+	if k.Key != "" || k.KeyHash != hashSecret("sk-alice-plaintext-secret") {
+		t.Errorf("key kept in plaintext: %+v", k)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "sk-alice-plaintext-secret") {
+		t.Errorf("keys file still has the plaintext secret: %s", data)
+	}
+	if !strings.Contains(string(data), `"key_hash"`) {
+		t.Errorf("keys file has no hash: %s", data)
+	}
+}
+
+func TestKeyStorePutStoresOnlyHash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	s := NewKeyStore(path, nil)
+	if _, err := s.Put(APIKey{Name: "bob", Key: "sk-bob-chosen-secret"}); err != nil {
+		t.Fatal(err)
+	}
+	generated, err := s.Put(APIKey{Name: "carol"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(generated, "sk-") {
+		t.Errorf("generated secret = %q", generated)
+	}
+	for secret, name := range map[string]string{"sk-bob-chosen-secret": "bob", generated: "carol"} {
+		if k, ok := s.Lookup(secret); !ok || k.Name != name {
+			t.Errorf("Lookup(%s) = %v, %v", name, k, ok)
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"sk-bob-chosen-secret", generated} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("keys file has a plaintext secret: %s", data)
+		}
+	}
+	if _, err := s.Put(APIKey{Name: "dave", Key: "sk-bob-chosen-secret"}); err == nil {
+		t.Error("a secret already used by another key was accepted")
+	}
+}
+
+func TestKeyStoreRotate(t *testing.T) {
+	s := NewKeyStore("", nil)
+	old, err := s.Put(APIKey{Name: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := s.Rotate("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, valid := range []string{old, secret} {
+		if _, ok := s.Lookup(valid); !ok {
+			t.Errorf("secret not accepted during the grace period")
+		}
+	}
+	if _, err := s.Rotate("alice", 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, revoked := range []string{old, secret} {
+		if _, ok := s.Lookup(revoked); ok {
+			t.Errorf("secret still accepted after rotating without grace")
+		}
+	}
+}
+
+func TestKeyStoreStaticKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte(`[{"name":"env","key":"sk-from-the-keys-file"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewKeyStore(path, []APIKey{{Name: "env", Key: "sk-from-the-environment"}})
+	if _, ok := s.Lookup("sk-from-the-keys-file"); ok {
+		t.Error("keys file entry shadowed an environment key")
+	}
+	if k, ok := s.Lookup("sk-from-the-environment"); !ok || !k.Static() {
+		t.Errorf("environment key = %v, %v", k, ok)
+	}
+	if _, err := s.Put(APIKey{Name: "env"}); err != ErrStaticKey {
+		t.Errorf("Put on an environment key: %v", err)
+	}
+	if _, err := s.Rotate("env", 0); err != ErrStaticKey {
+		t.Errorf("Rotate on an environment key: %v", err)
+	}
+}
+
+func TestHasScopeGrantsAdminOnlyExplicitly(t *testing.T) {
+	for _, tc := range []struct {
+		key   APIKey
+		admin bool
+		chat  bool
+	}{
+		{APIKey{}, false, true},
+		{APIKey{Scopes: []string{ScopeChat}}, false, true},
+		{APIKey{Scopes: []string{ScopeAdmin}}, true, false},
+		{APIKey{Admin: true, Scopes: []string{ScopeModels}}, true, false},
+	} {
+		if got := tc.key.HasScope(ScopeAdmin); got != tc.admin {
+			t.Errorf("%+v HasScope(admin) = %t", tc.key, got)
+		}
+		if got := tc.key.HasScope(ScopeChat); got != tc.chat {
+			t.Errorf("%+v HasScope(chat) = %t", tc.key, got)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"pplx2api/logger"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ParseLabels parses labels written as key=value pairs separated by commas,
+// e.g. region=eu,team=research
+func ParseLabels(s string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		key := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || key == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid label %q, use key=value", pair)
+		}
+		labels[key] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// FormatLabels 按键排序输出标签，格式与 ParseLabels 相同
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// HasLabels reports whether the session carries all of labels
+func (s SessionInfo) HasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if s.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// HasSessionWithLabels reports whether any configured session, archived or
+// not, carries all of labels
+func (c *Config) HasSessionWithLabels(labels map[string]string) bool {
+	c.RwMutex.RLock()
+	defer c.RwMutex.RUnlock()
+	for _, s := range c.Sessions {
+		if s.HasLabels(labels) {
+			return true
+		}
+	}
+	return false
+}
+
+// applySessionLabels 解析 SESSION_LABELS（如 0:region=eu,team=research;1:region=us），
+// 按序号为账号设置标签，覆盖配置文件中的同名标签
+func applySessionLabels(env string, sessions []SessionInfo) {
+	for _, entry := range strings.Split(env, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		index, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || len(parts) != 2 || index < 0 || index >= len(sessions) {
+			logger.Error(fmt.Sprintf("Invalid SESSION_LABELS entry %q", entry))
+			continue
+		}
+		labels, err := ParseLabels(parts[1])
+		if err != nil {
+			logger.Error(fmt.Sprintf("Invalid SESSION_LABELS entry %q: %v", entry, err))
+			continue
+		}
+		if sessions[index].Labels == nil {
+			sessions[index].Labels = map[string]string{}
+		}
+		for k, v := range labels {
+			sessions[index].Labels[k] = v
+		}
+	}
+}
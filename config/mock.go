@@ -0,0 +1,44 @@
+package config
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// MockUpstream configures the built-in mock upstream of MOCK_UPSTREAM
+type MockUpstream struct {
+	Enabled bool
+	// FirstTokenDelay 返回第一段回答前的等待时间，Latency 为之后每段之间的平均间隔
+	FirstTokenDelay time.Duration
+	Latency         time.Duration
+	// RateLimitRate、ErrorRate 随机返回 429 与 500 的请求比例
+	RateLimitRate float64
+	ErrorRate     float64
+}
+
+// loadMockUpstream 读取 MOCK_* 设置
+func loadMockUpstream() MockUpstream {
+	firstTokenDelay, err := strconv.Atoi(os.Getenv("MOCK_FIRST_TOKEN_DELAY"))
+	if err != nil || firstTokenDelay < 0 {
+		firstTokenDelay = 600
+	}
+	latency, err := strconv.Atoi(os.Getenv("MOCK_LATENCY"))
+	if err != nil || latency < 0 {
+		latency = 40
+	}
+	rate := func(name string) float64 {
+		v, err := strconv.ParseFloat(os.Getenv(name), 64)
+		if err != nil || v < 0 || v > 1 {
+			return 0
+		}
+		return v
+	}
+	return MockUpstream{
+		Enabled:         os.Getenv("MOCK_UPSTREAM") == "true",
+		FirstTokenDelay: time.Duration(firstTokenDelay) * time.Millisecond,
+		Latency:         time.Duration(latency) * time.Millisecond,
+		RateLimitRate:   rate("MOCK_RATE_LIMIT_RATE"),
+		ErrorRate:       rate("MOCK_ERROR_RATE"),
+	}
+}
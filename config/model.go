@@ -9,12 +9,21 @@ var ModelMap = map[string]string{
 	"gpt-5":                   "gpt5",
 	"gpt-5-think":             "gpt5_thinking",
 	"claude-4.1-opus-think":   "claude41opusthinking",
+	"deep-research":           "pplx_alpha",
+	"pro-search":              "pplx_pro",
 }
 var MaxModelMap = map[string]string{
 	"o3-pro":                "o3pro",
 	"claude-4.1-opus-think": "claude41opusthinking",
 }
 
+// SearchModeModels are the upstream Deep Research and Pro Search modes.
+// They always browse the web, with or without the -search suffix.
+var SearchModeModels = map[string]bool{
+	"pplx_alpha": true,
+	"pplx_pro":   true,
+}
+
 // Get returns the value for the given key from the ModelMap.
 // If the key doesn't exist, it returns the provided default value.
 func ModelMapGet(key string, defaultValue string) string {
@@ -33,36 +42,23 @@ func ModelReverseMapGet(key string, defaultValue string) string {
 	return defaultValue
 }
 
-var ResponseModels []map[string]string
+// ResolveModelChain returns the upstream models to try for a requested model,
+// primary first. Models without a configured chain resolve to themselves.
+func ResolveModelChain(model string) []string {
+	chain, ok := ConfigInstance.ModelChains[model]
+	if !ok {
+		chain = []string{model}
+	}
+	resolved := make([]string, 0, len(chain))
+	for _, m := range chain {
+		resolved = append(resolved, ModelMapGet(m, m))
+	}
+	return resolved
+}
 
 func init() {
 	// 构建反向映射
 	for k, v := range ModelMap {
 		ModelReverseMap[v] = k
 	}
-	buildResponseModels()
-}
-
-// buildResponseModels 构建响应模型列表
-func buildResponseModels() {
-	ResponseModels = make([]map[string]string, 0, len(ModelMap)*2)
-
-	for modelID := range ModelMap {
-		// 如果不是最大订阅用户，跳过最大模型
-		if !ConfigInstance.IsMaxSubscribe {
-			if _, isMaxModel := MaxModelMap[modelID]; isMaxModel {
-				continue
-			}
-		}
-
-		// 添加普通模型
-		ResponseModels = append(ResponseModels, map[string]string{
-			"id": modelID,
-		})
-
-		// 添加搜索模型
-		ResponseModels = append(ResponseModels, map[string]string{
-			"id": modelID + "-search",
-		})
-	}
 }
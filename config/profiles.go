@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"pplx2api/logger"
+	"strings"
+)
+
+// HeaderProfile is a set of browser headers sent upstream: a User-Agent and
+// the client hints matching it. Profiles are only given to sessions whose
+// fingerprint impersonates the same browser.
+type HeaderProfile struct {
+	Name      string `json:"name"`
+	Browser   string `json:"browser"`
+	UserAgent string `json:"user_agent"`
+	// Headers 其他请求头，如 sec-ch-ua、sec-ch-ua-platform、accept-language
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// DefaultHeaderProfiles are the built-in profiles of common desktop browsers
+var DefaultHeaderProfiles = []HeaderProfile{
+	{
+		Name:      "chrome-windows",
+		Browser:   BrowserChrome,
+		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Safari/537.36",
+		Headers: map[string]string{
+			"sec-ch-ua":          `"Chromium";v="140", "Not=A?Brand";v="24", "Google Chrome";v="140"`,
+			"sec-ch-ua-mobile":   "?0",
+			"sec-ch-ua-platform": `"Windows"`,
+		},
+	},
+	{
+		Name:      "chrome-macos",
+		Browser:   BrowserChrome,
+		UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/139.0.0.0 Safari/537.36",
+		Headers: map[string]string{
+			"sec-ch-ua":          `"Not;A=Brand";v="99", "Google Chrome";v="139", "Chromium";v="139"`,
+			"sec-ch-ua-mobile":   "?0",
+			"sec-ch-ua-platform": `"macOS"`,
+		},
+	},
+	{
+		Name:      "chrome-linux",
+		Browser:   BrowserChrome,
+		UserAgent: "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/138.0.0.0 Safari/537.36",
+		Headers: map[string]string{
+			"sec-ch-ua":          `"Not)A;Brand";v="8", "Chromium";v="138", "Google Chrome";v="138"`,
+			"sec-ch-ua-mobile":   "?0",
+			"sec-ch-ua-platform": `"Linux"`,
+		},
+	},
+	{
+		Name:      "edge-windows",
+		Browser:   BrowserChrome,
+		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Safari/537.36 Edg/140.0.0.0",
+		Headers: map[string]string{
+			"sec-ch-ua":          `"Chromium";v="140", "Not=A?Brand";v="24", "Microsoft Edge";v="140"`,
+			"sec-ch-ua-mobile":   "?0",
+			"sec-ch-ua-platform": `"Windows"`,
+		},
+	},
+	{
+		Name:      "firefox-windows",
+		Browser:   BrowserFirefox,
+		UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:142.0) Gecko/20100101 Firefox/142.0",
+	},
+	{
+		Name:      "firefox-macos",
+		Browser:   BrowserFirefox,
+		UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:142.0) Gecko/20100101 Firefox/142.0",
+	},
+	{
+		Name:      "firefox-linux",
+		Browser:   BrowserFirefox,
+		UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:141.0) Gecko/20100101 Firefox/141.0",
+	},
+	{
+		Name:      "safari-macos",
+		Browser:   BrowserSafari,
+		UserAgent: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.6 Safari/605.1.15",
+	},
+}
+
+// loadHeaderProfiles 合并内置与配置文件中的 profile，按 HEADER_PROFILES 选出轮换使用的 profile；
+// HEADER_PROFILES 为 off 时不使用 profile
+func loadHeaderProfiles(custom []HeaderProfile) []HeaderProfile {
+	profiles := append([]HeaderProfile{}, DefaultHeaderProfiles...)
+	for _, p := range custom {
+		p.Browser = strings.ToLower(p.Browser)
+		if p.Name == "" || p.UserAgent == "" {
+			logger.Error("Ignoring header profile without a name or user_agent")
+			continue
+		}
+		if p.Browser != BrowserChrome && p.Browser != BrowserFirefox && p.Browser != BrowserSafari {
+			logger.Error(fmt.Sprintf("Ignoring header profile %s: browser must be chrome, firefox or safari", p.Name))
+			continue
+		}
+		replaced := false
+		for i := range profiles {
+			if profiles[i].Name == p.Name {
+				profiles[i], replaced = p, true
+			}
+		}
+		if !replaced {
+			profiles = append(profiles, p)
+		}
+	}
+	selected := parseListEnv(os.Getenv("HEADER_PROFILES"))
+	if len(selected) == 0 {
+		return profiles
+	}
+	if len(selected) == 1 && strings.EqualFold(selected[0], "off") {
+		return nil
+	}
+	var enabled []HeaderProfile
+	for _, name := range selected {
+		found := false
+		for _, p := range profiles {
+			if p.Name == name {
+				enabled, found = append(enabled, p), true
+			}
+		}
+		if !found {
+			logger.Error(fmt.Sprintf("Unknown header profile %q in HEADER_PROFILES", name))
+		}
+	}
+	return enabled
+}
+
+// HeaderProfileFor returns the header profile of a session, false when it
+// has none and the impersonated browser's own headers are sent
+func (c *Config) HeaderProfileFor(session SessionInfo) (HeaderProfile, bool) {
+	if session.HeaderProfile == "" {
+		return HeaderProfile{}, false
+	}
+	for _, p := range c.HeaderProfiles {
+		if p.Name == session.HeaderProfile {
+			return p, true
+		}
+	}
+	return HeaderProfile{}, false
+}
+
+// assignHeaderProfile 为未指定 profile 的账号按 cookie 的哈希选择与其模拟的浏览器一致的 profile，
+// 同一账号每次得到相同的 profile，cookie 轮换后保留
+func (c *Config) assignHeaderProfile(session *SessionInfo) {
+	if session.HeaderProfile != "" {
+		if _, ok := c.HeaderProfileFor(*session); !ok {
+			logger.Error(fmt.Sprintf("Unknown header profile %q of session, using the browser's own headers", session.HeaderProfile))
+		}
+		return
+	}
+	browser := c.FingerprintFor(*session).Browser
+	if browser == "" {
+		browser = BrowserChrome
+	}
+	var candidates []string
+	for _, p := range c.HeaderProfiles {
+		if browser == BrowserNone || p.Browser == browser {
+			candidates = append(candidates, p.Name)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	h := fnv.New32a()
+	h.Write([]byte(session.SessionKey))
+	session.HeaderProfile = candidates[h.Sum32()%uint32(len(candidates))]
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"pplx2api/logger"
+	"strings"
+	"text/template"
+)
+
+// Prompt formats accepted by PROMPT_FORMAT
+const (
+	PromptLabels   = "labels"
+	PromptPlain    = "plain"
+	PromptXML      = "xml"
+	PromptTemplate = "template"
+)
+
+// System message placements accepted by PROMPT_SYSTEM
+const (
+	SystemInline = "inline"
+	SystemTop    = "top"
+)
+
+// defaultRoleLabels 各角色的默认前缀
+var defaultRoleLabels = map[string]string{
+	"system":    "System",
+	"user":      "Human",
+	"assistant": "Assistant",
+}
+
+// PromptStrategy controls how the chat messages are flattened into the
+// single prompt sent to Perplexity. Models respond differently to the
+// format, so it can be tuned without code changes.
+type PromptStrategy struct {
+	// Format labels 在消息前加角色前缀，plain 只拼接内容，xml 用角色标签包裹，template 使用 Template
+	Format string
+	// SystemMerge inline 保持 system 消息原位，top 合并为开头的一条
+	SystemMerge string
+	// IncludeNames 在前缀或标签中带上消息的 name 字段
+	IncludeNames bool
+	// Labels 覆盖默认的角色前缀
+	Labels map[string]string
+	// Template 按消息渲染的模板，可用 .Role、.Label、.Name、.Content
+	Template *template.Template
+}
+
+// Label returns the prefix label of a role
+func (p PromptStrategy) Label(role string) string {
+	if label, ok := p.Labels[role]; ok {
+		return label
+	}
+	if label, ok := defaultRoleLabels[role]; ok {
+		return label
+	}
+	return "Unknown"
+}
+
+// loadPromptStrategy 读取 PROMPT_* 环境变量，NO_ROLE_PREFIX=true 时默认格式为 plain
+func loadPromptStrategy(noRolePrefix bool) PromptStrategy {
+	p := PromptStrategy{
+		Format:       strings.ToLower(os.Getenv("PROMPT_FORMAT")),
+		SystemMerge:  strings.ToLower(os.Getenv("PROMPT_SYSTEM")),
+		IncludeNames: os.Getenv("PROMPT_INCLUDE_NAMES") == "true",
+		Labels:       map[string]string{},
+	}
+	for _, item := range parseListEnv(os.Getenv("PROMPT_ROLE_LABELS")) {
+		role, label, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(role) == "" {
+			logger.Error(fmt.Sprintf("Invalid PROMPT_ROLE_LABELS entry: %s", item))
+			continue
+		}
+		p.Labels[strings.ToLower(strings.TrimSpace(role))] = strings.TrimSpace(label)
+	}
+	if text := os.Getenv("PROMPT_TEMPLATE"); text != "" {
+		// 模板中的 \n 按换行处理，便于在环境变量中书写
+		tmpl, err := template.New("prompt").Parse(strings.ReplaceAll(text, `\n`, "\n"))
+		if err != nil {
+			logger.Error(fmt.Sprintf("Invalid PROMPT_TEMPLATE: %v", err))
+		} else {
+			p.Template = tmpl
+		}
+	}
+	switch p.Format {
+	case PromptLabels, PromptPlain, PromptXML:
+	case PromptTemplate:
+		if p.Template == nil {
+			logger.Error("PROMPT_FORMAT=template requires a valid PROMPT_TEMPLATE, using labels")
+			p.Format = PromptLabels
+		}
+	case "":
+		switch {
+		case p.Template != nil:
+			p.Format = PromptTemplate
+		case noRolePrefix:
+			p.Format = PromptPlain
+		default:
+			p.Format = PromptLabels
+		}
+	default:
+		logger.Error(fmt.Sprintf("Invalid PROMPT_FORMAT %q, use labels, plain, xml or template", p.Format))
+		p.Format = PromptLabels
+	}
+	switch p.SystemMerge {
+	case SystemInline, SystemTop:
+	case "":
+		p.SystemMerge = SystemInline
+	default:
+		logger.Error(fmt.Sprintf("Invalid PROMPT_SYSTEM %q, use inline or top", p.SystemMerge))
+		p.SystemMerge = SystemInline
+	}
+	return p
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"pplx2api/logger"
+	"sync"
+	"time"
+)
+
+// poolProxy 代理池中的单个代理及其健康状态
+type poolProxy struct {
+	url          string
+	failures     int
+	ejectedUntil time.Time
+}
+
+// ProxyPool rotates through upstream proxies. A proxy that fails
+// FailureThreshold times in a row is ejected for Cooldown and then
+// re-added, the same way sessions cool down after a 429.
+type ProxyPool struct {
+	mutex            sync.Mutex
+	proxies          []*poolProxy
+	next             int
+	Cooldown         time.Duration
+	FailureThreshold int
+}
+
+// NewProxyPool creates a pool from a list of proxy URLs
+func NewProxyPool(urls []string, cooldown time.Duration, failureThreshold int) *ProxyPool {
+	pool := &ProxyPool{Cooldown: cooldown, FailureThreshold: failureThreshold}
+	for _, u := range urls {
+		if u = validProxyURL(u); u != "" {
+			pool.proxies = append(pool.proxies, &poolProxy{url: u})
+		}
+	}
+	return pool
+}
+
+// Len returns the number of proxies in the pool, ejected ones included
+func (p *ProxyPool) Len() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.proxies)
+}
+
+// Next returns the next healthy proxy in rotation. When every proxy is
+// ejected the one that is re-added soonest is returned instead of none.
+func (p *ProxyPool) Next() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(p.proxies) == 0 {
+		return ""
+	}
+	now := time.Now()
+	var soonest *poolProxy
+	for i := 0; i < len(p.proxies); i++ {
+		proxy := p.proxies[(p.next+i)%len(p.proxies)]
+		if now.After(proxy.ejectedUntil) {
+			p.next = (p.next + i + 1) % len(p.proxies)
+			return proxy.url
+		}
+		if soonest == nil || proxy.ejectedUntil.Before(soonest.ejectedUntil) {
+			soonest = proxy
+		}
+	}
+	return soonest.url
+}
+
+func (p *ProxyPool) find(url string) *poolProxy {
+	for _, proxy := range p.proxies {
+		if proxy.url == url {
+			return proxy
+		}
+	}
+	return nil
+}
+
+// ReportFailure records a connection error or challenge seen through url
+func (p *ProxyPool) ReportFailure(url string, reason string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	proxy := p.find(url)
+	if proxy == nil {
+		return
+	}
+	proxy.failures++
+	if proxy.failures >= p.FailureThreshold {
+		proxy.failures = 0
+		proxy.ejectedUntil = time.Now().Add(p.Cooldown)
+		logger.Warn(fmt.Sprintf("Proxy %s ejected for %v: %s", url, p.Cooldown, reason))
+	}
+}
+
+// ReportSuccess resets the failure count of url
+func (p *ProxyPool) ReportSuccess(url string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if proxy := p.find(url); proxy != nil {
+		proxy.failures = 0
+	}
+}
@@ -0,0 +1,141 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"pplx2api/logger"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+var (
+	// processEnv 进程启动时已有及命令行设置的环境变量，重新加载时不被 .env 覆盖
+	processEnv = map[string]bool{}
+	// dotenvKeys 由 .env 设置的环境变量
+	dotenvKeys  = map[string]bool{}
+	reloadMutex sync.Mutex
+)
+
+// snapshotEnv 记录进程自带的环境变量
+func snapshotEnv() {
+	for _, kv := range os.Environ() {
+		if k, _, ok := strings.Cut(kv, "="); ok {
+			processEnv[k] = true
+		}
+	}
+}
+
+// loadDotenv 重新读取 .env，应用变化并清除已删除的变量
+func loadDotenv() {
+	values, err := godotenv.Read()
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error(fmt.Sprintf("Failed to read .env: %v", err))
+		return
+	}
+	fileEnvMutex.Lock()
+	defer fileEnvMutex.Unlock()
+	for k := range dotenvKeys {
+		if _, ok := values[k]; !ok {
+			os.Unsetenv(k)
+			delete(dotenvKeys, k)
+		}
+	}
+	for k, v := range values {
+		if processEnv[k] {
+			continue
+		}
+		os.Setenv(k, v)
+		dotenvKeys[k] = true
+		// .env 优先于配置文件
+		delete(fileEnv, k)
+	}
+}
+
+// Reload re-reads .env and the config file and applies the settings that
+// can change at runtime: sessions, proxies, client keys and model mappings.
+// The fields are swapped under RwMutex, so in-flight requests finish with
+// the settings they started with. Other settings need a restart.
+func Reload() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	loadDotenv()
+	next := LoadConfig()
+	if len(next.Sessions) == 0 {
+		return errors.New("reloaded config has no sessions, keeping the current config")
+	}
+	c := ConfigInstance
+	c.RwMutex.Lock()
+	// 配置中仍有的 session 按标识而不是序号对应，调整顺序或删除其他账号后
+	// 仍保留轮换后的 cookie 与运行时归档状态
+	current := make(map[string]int, len(c.sessionKeys))
+	for i, key := range c.sessionKeys {
+		if i < len(c.Sessions) {
+			current[key] = i
+		}
+	}
+	for i, key := range next.sessionKeys {
+		if j, ok := current[key]; ok {
+			fresh := next.Sessions[i]
+			next.Sessions[i] = c.Sessions[j]
+			next.Sessions[i].Proxy, next.Sessions[i].Labels = fresh.Proxy, fresh.Labels
+			next.Sessions[i].Budget, next.Sessions[i].Fingerprint = fresh.Budget, fresh.Fingerprint
+			next.Sessions[i].HeaderProfile, next.Sessions[i].Upstream = fresh.HeaderProfile, fresh.Upstream
+		}
+	}
+	c.Sessions, c.sessionSources, c.RetryCount = next.Sessions, next.sessionSources, next.RetryCount
+	// 运行时状态按标识保存，随账号一起移动，已删除账号的状态丢弃
+	c.setSessionKeys()
+	c.APIKey = next.APIKey
+	c.Keys = next.Keys
+	c.Proxy, c.ProxyPool = next.Proxy, next.ProxyPool
+	c.HeaderProfiles = next.HeaderProfiles
+	c.ModelChains = next.ModelChains
+	c.RwMutex.Unlock()
+	logger.Info(fmt.Sprintf("Config reloaded: %d sessions, %d keys, %d proxies", len(next.Sessions), next.Keys.Len(), next.ProxyPool.Len()))
+	return nil
+}
+
+// Watch reloads the config whenever .env, the config file, COOKIES_FILE or
+// the files of SESSIONS_FILE change,
+// checking every interval until ctx is done.
+func Watch(ctx context.Context, interval time.Duration) {
+	modTimes := func() string {
+		var stamps []string
+		paths := []string{".env", ConfigFilePath()}
+		if sessionsFile := os.Getenv("SESSIONS_FILE"); sessionsFile != "" {
+			files, _ := sessionsFilePaths(sessionsFile)
+			paths = append(paths, files...)
+		}
+		if cookiesFile := os.Getenv("COOKIES_FILE"); cookiesFile != "" {
+			paths = append(paths, cookiesFile)
+		}
+		for _, path := range paths {
+			if info, err := os.Stat(path); err == nil && path != "" {
+				stamps = append(stamps, path+"@"+info.ModTime().String())
+			}
+		}
+		return strings.Join(stamps, ",")
+	}
+	last := modTimes()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if current := modTimes(); current != last {
+			last = current
+			logger.Info("Config files changed, reloading")
+			if err := Reload(); err != nil {
+				logger.Error(fmt.Sprintf("Failed to reload config: %v", err))
+			}
+		}
+	}
+}
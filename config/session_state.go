@@ -0,0 +1,505 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// HistorySlot is the resolution of the per-session availability history
+	HistorySlot = 5 * time.Minute
+	// HistoryWindow is how far back the availability history is kept
+	HistoryWindow = 24 * time.Hour
+
+	historySlots = int(HistoryWindow / HistorySlot)
+)
+
+// Session availability states reported by the history API
+const (
+	StatusAvailable   = "available"
+	StatusRateLimited = "rate_limited"
+	StatusErrored     = "errored"
+)
+
+// historySlot 记录一个时间片内的请求结果
+type historySlot struct {
+	start       int64
+	successes   int
+	rateLimited int
+	errors      int
+	stalls      int
+}
+
+type cooldownWindow struct {
+	from  time.Time
+	until time.Time
+}
+
+// SessionState holds the runtime health of one configured session.
+// It is keyed by the session's configured cookie, so it survives cookie
+// rotations and stays with the account when sessions are reordered or
+// removed on reload.
+type SessionState struct {
+	mutex            sync.Mutex
+	rateLimitedUntil time.Time
+	// familyUntil 各模型类别单独的冷却结束时间，不影响其他类别
+	familyUntil map[string]time.Time
+	// learned 各模型类别学习到的冷却时间，见 NextCooldown
+	learned   map[string]*learnedCooldown
+	slots     [historySlots]historySlot
+	cooldowns []cooldownWindow
+	// nextSend 按节流间隔下一次允许发送请求的时间
+	nextSend time.Time
+	// authFailures 连续认证失败的次数
+	authFailures int
+	// tier 检测到的订阅等级，未检测时为空；tierChecked 上次检测的时间
+	tier        string
+	tierChecked time.Time
+	// challenged 经过各代理遇到 Cloudflare 验证后暂停使用到的时间，直连时键为空字符串
+	challenged map[string]time.Time
+	// key session 的稳定标识，shared 为 false 时不参与多实例共享
+	key    string
+	shared bool
+}
+
+// SessionBucket is one aggregated time bucket of a session's history
+type SessionBucket struct {
+	Start              time.Time `json:"start"`
+	Status             string    `json:"status"`
+	Successes          int       `json:"successes"`
+	RateLimited        int       `json:"rate_limited"`
+	Errors             int       `json:"errors"`
+	Stalls             int       `json:"stalls"`
+	RateLimitedSeconds int       `json:"rate_limited_seconds"`
+}
+
+var (
+	sessionStates      = map[string]*SessionState{}
+	sessionStatesMutex sync.Mutex
+)
+
+// sessionKeys 返回各 session 的稳定标识，由配置中的原始 cookie 得出，不暴露
+// cookie 本身；相同的 cookie 依次加序号区分
+func sessionKeys(sources []string) []string {
+	keys := make([]string, len(sources))
+	seen := map[string]int{}
+	for i, source := range sources {
+		sum := sha256.Sum256([]byte(source))
+		key := hex.EncodeToString(sum[:8])
+		if seen[key]++; seen[key] > 1 {
+			key = fmt.Sprintf("%s-%d", key, seen[key])
+		}
+		keys[i] = key
+	}
+	return keys
+}
+
+// sessionKeyAt 返回序号 idx 的 session 的标识，调用方持有 sessionStatesMutex。
+// 超出配置范围的序号按序号区分，且不参与多实例共享
+func (c *Config) sessionKeyAt(idx int) (string, bool) {
+	if keys := c.sessionKeys; idx >= 0 && idx < len(keys) {
+		return keys[idx], true
+	}
+	return fmt.Sprintf("#%d", idx), false
+}
+
+// SessionStateAt returns the state of the session at idx, creating it on first use
+func SessionStateAt(idx int) *SessionState {
+	sessionStatesMutex.Lock()
+	defer sessionStatesMutex.Unlock()
+	return stateFor(ConfigInstance.sessionKeyAt(idx))
+}
+
+// stateFor 返回标识为 key 的 session 状态，不存在时创建，调用方持有 sessionStatesMutex
+func stateFor(key string, shared bool) *SessionState {
+	state, ok := sessionStates[key]
+	if !ok {
+		state = &SessionState{key: key, shared: shared}
+		sessionStates[key] = state
+	}
+	return state
+}
+
+// setSessionKeys 按 c.sessionSources 更新 session 标识并丢弃已不在配置中的
+// session 状态，调用方持有 c.RwMutex 的写锁
+func (c *Config) setSessionKeys() {
+	keys := sessionKeys(c.sessionSources)
+	sessionStatesMutex.Lock()
+	defer sessionStatesMutex.Unlock()
+	c.sessionKeys = keys
+	configured := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		configured[key] = true
+	}
+	for key := range sessionStates {
+		if !configured[key] {
+			delete(sessionStates, key)
+		}
+	}
+}
+
+func (s *SessionState) slotFor(t time.Time) *historySlot {
+	start := t.Truncate(HistorySlot).Unix()
+	slot := &s.slots[(start/int64(HistorySlot/time.Second))%int64(historySlots)]
+	if slot.start != start {
+		*slot = historySlot{start: start}
+	}
+	return slot
+}
+
+// IsAvailable reports whether the session is outside of any cooldown,
+// including cooldowns recorded by other replicas
+func (s *SessionState) IsAvailable() bool {
+	return time.Now().After(s.RateLimitedUntil())
+}
+
+// PacingDelay returns how long a request on the session would wait for
+// its pacing slot, zero when it can be sent right away.
+func (s *SessionState) PacingDelay() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if wait := time.Until(s.nextSend); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// ReservePacing takes the next pacing slot of the session and returns how
+// long to wait before sending. Each reservation pushes the following slot
+// out by interval, varied by up to ±jitter of it, so concurrent requests
+// on one account are spread out instead of sent as a burst.
+func (s *SessionState) ReservePacing(interval time.Duration, jitter float64) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	slot := s.nextSend
+	if slot.Before(now) {
+		slot = now
+	}
+	gap := float64(interval) * (1 + jitter*(2*rand.Float64()-1))
+	s.nextSend = slot.Add(time.Duration(gap))
+	return slot.Sub(now)
+}
+
+// IsAvailableFor reports whether the session can serve a model of the
+// given family: outside of any session cooldown and of the family's own
+func (s *SessionState) IsAvailableFor(family string) bool {
+	return time.Now().After(s.RateLimitedUntilFor(family))
+}
+
+// RateLimitedUntilFor returns the end of the cooldown that blocks family,
+// the later of the session cooldown and the family cooldown
+func (s *SessionState) RateLimitedUntilFor(family string) time.Time {
+	until := s.RateLimitedUntil()
+	if family == "" || family == FamilyDefault {
+		return until
+	}
+	s.mutex.Lock()
+	own := s.familyUntil[family]
+	s.mutex.Unlock()
+	if id := s.sharedID(); id != "" {
+		if shared := Shared.Cooldown(id + "/" + family); shared.After(own) {
+			own = shared
+		}
+	}
+	return maxTime(until, own)
+}
+
+// FamilyCooldowns returns the families cooling down on the session and the
+// end of each cooldown
+func (s *SessionState) FamilyCooldowns() map[string]time.Time {
+	now := time.Now()
+	active := map[string]time.Time{}
+	for family := range s.families() {
+		if until := s.RateLimitedUntilFor(family); until.After(now) {
+			active[family] = until
+		}
+	}
+	return active
+}
+
+// families 返回配置的与本地记录过冷却的模型类别，不含 default
+func (s *SessionState) families() map[string]bool {
+	families := map[string]bool{}
+	for _, family := range ConfigInstance.Cooldowns.Families {
+		families[family] = true
+	}
+	s.mutex.Lock()
+	for family := range s.familyUntil {
+		families[family] = true
+	}
+	s.mutex.Unlock()
+	delete(families, FamilyDefault)
+	return families
+}
+
+// RateLimitedUntil returns the end of the current cooldown, zero if none
+func (s *SessionState) RateLimitedUntil() time.Time {
+	s.mutex.Lock()
+	until := s.rateLimitedUntil
+	s.mutex.Unlock()
+	if id := s.sharedID(); id != "" {
+		if shared := Shared.Cooldown(id); shared.After(until) {
+			until = shared
+		}
+	}
+	return until
+}
+
+// ClearCooldown ends the current cooldown of the session early, on this
+// replica and in the shared state.
+func (s *SessionState) ClearCooldown() {
+	if id := s.sharedID(); id != "" {
+		Shared.ClearCooldown(id)
+		for family := range s.families() {
+			Shared.ClearCooldown(id + "/" + family)
+		}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	s.rateLimitedUntil = time.Time{}
+	s.familyUntil = nil
+	// 截断进行中的冷却窗口，可用性历史不再把之后的时间算作冷却
+	for i, w := range s.cooldowns {
+		if w.until.After(now) {
+			s.cooldowns[i].until = now
+		}
+	}
+}
+
+// Key returns the stable id of the session, derived from its cookie
+func (s *SessionState) Key() string {
+	return s.key
+}
+
+// sharedID 返回共享状态中的 session 标识，未启用共享时为空
+func (s *SessionState) sharedID() string {
+	if Shared == nil || !s.shared {
+		return ""
+	}
+	return s.key
+}
+
+// Tier returns the detected subscription tier, empty if unknown
+func (s *SessionState) Tier() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.tier
+}
+
+// MarkChallenged takes the session out of rotation through proxy for d
+// after a Cloudflare challenge
+func (s *SessionState) MarkChallenged(proxy string, d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.challenged == nil {
+		s.challenged = map[string]time.Time{}
+	}
+	s.challenged[proxy] = time.Now().Add(d)
+}
+
+// ClearChallenged 验证通过后恢复经过 proxy 使用该账号
+func (s *SessionState) ClearChallenged(proxy string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.challenged, proxy)
+}
+
+// ChallengedUntil returns until when the session is paused through proxy,
+// zero when it isn't
+func (s *SessionState) ChallengedUntil(proxy string) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if until := s.challenged[proxy]; time.Now().Before(until) {
+		return until
+	}
+	return time.Time{}
+}
+
+// SetTier records the detected subscription tier
+func (s *SessionState) SetTier(tier string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tier, s.tierChecked = tier, time.Now()
+}
+
+// StartTierCheck reports whether the tier should be detected now, i.e. it
+// is unknown and wasn't tried within interval, and marks it as tried
+func (s *SessionState) StartTierCheck(interval time.Duration) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.tier != "" || time.Since(s.tierChecked) < interval {
+		return false
+	}
+	s.tierChecked = time.Now()
+	return true
+}
+
+// RecordSuccess records a successful upstream request
+func (s *SessionState) RecordSuccess() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.slotFor(time.Now()).successes++
+	s.authFailures = 0
+}
+
+// RecordAuthFailure records a 401/403 from upstream and returns the number
+// of consecutive authentication failures of the session.
+func (s *SessionState) RecordAuthFailure() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.slotFor(time.Now()).errors++
+	s.authFailures++
+	return s.authFailures
+}
+
+// ResetAuthFailures clears the authentication failures, e.g. after an
+// operator re-enabled the session with a fixed cookie.
+func (s *SessionState) ResetAuthFailures() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.authFailures = 0
+}
+
+// RecordError records a failed upstream request that wasn't a rate limit
+func (s *SessionState) RecordError() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.slotFor(time.Now()).errors++
+}
+
+// RecordStalls records streams of the session that stalled mid-stream,
+// which usually points at a dying cookie or proxy rather than a slow model.
+func (s *SessionState) RecordStalls(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.slotFor(time.Now()).stalls += n
+}
+
+// Stalls returns the number of stalls recorded in the last 24h
+func (s *SessionState) Stalls() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cutoff := time.Now().Add(-HistoryWindow).Unix()
+	total := 0
+	for _, slot := range s.slots {
+		if slot.start > cutoff {
+			total += slot.stalls
+		}
+	}
+	return total
+}
+
+// RecordRateLimit records a 429 and puts the session into cooldown. For a
+// family other than default only that family cools down.
+func (s *SessionState) RecordRateLimit(family string, cooldown time.Duration) {
+	now := time.Now()
+	until := now.Add(cooldown)
+	if family != "" && family != FamilyDefault {
+		if id := s.sharedID(); id != "" {
+			Shared.SetCooldown(id+"/"+family, until)
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.slotFor(now).rateLimited++
+		if s.familyUntil == nil {
+			s.familyUntil = map[string]time.Time{}
+		}
+		if until.After(s.familyUntil[family]) {
+			s.familyUntil[family] = until
+		}
+		return
+	}
+	if id := s.sharedID(); id != "" {
+		Shared.SetCooldown(id, until)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.slotFor(now).rateLimited++
+	if until.After(s.rateLimitedUntil) {
+		s.rateLimitedUntil = until
+	}
+	s.cooldowns = append(s.cooldowns, cooldownWindow{from: now, until: until})
+	// 丢弃超出窗口的冷却记录
+	cutoff := now.Add(-HistoryWindow)
+	kept := s.cooldowns[:0]
+	for _, w := range s.cooldowns {
+		if w.until.After(cutoff) {
+			kept = append(kept, w)
+		}
+	}
+	s.cooldowns = kept
+}
+
+// Buckets aggregates the last 24h of history into buckets of the given size,
+// oldest first. bucket is rounded to a multiple of HistorySlot.
+func (s *SessionState) Buckets(now time.Time, bucket time.Duration) []SessionBucket {
+	if bucket < HistorySlot {
+		bucket = HistorySlot
+	}
+	bucket = bucket.Truncate(HistorySlot)
+	end := now.Truncate(HistorySlot).Add(HistorySlot)
+	start := end.Add(-HistoryWindow)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var buckets []SessionBucket
+	for from := start; from.Before(end); from = from.Add(bucket) {
+		to := from.Add(bucket)
+		if to.After(end) {
+			to = end
+		}
+		b := SessionBucket{Start: from}
+		for t := from; t.Before(to); t = t.Add(HistorySlot) {
+			slot := s.slots[(t.Unix()/int64(HistorySlot/time.Second))%int64(historySlots)]
+			if slot.start != t.Unix() {
+				continue
+			}
+			b.Successes += slot.successes
+			b.RateLimited += slot.rateLimited
+			b.Errors += slot.errors
+			b.Stalls += slot.stalls
+		}
+		for _, w := range s.cooldowns {
+			overlap := minTime(w.until, to).Sub(maxTime(w.from, from))
+			if overlap > 0 {
+				b.RateLimitedSeconds += int(overlap.Seconds())
+			}
+		}
+		if b.RateLimitedSeconds > int(to.Sub(from).Seconds()) {
+			b.RateLimitedSeconds = int(to.Sub(from).Seconds())
+		}
+		switch {
+		case b.RateLimited > 0 || b.RateLimitedSeconds > 0:
+			b.Status = StatusRateLimited
+		case b.Errors > 0 && b.Successes == 0:
+			b.Status = StatusErrored
+		default:
+			b.Status = StatusAvailable
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
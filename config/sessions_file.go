@@ -0,0 +1,117 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// loadSessionsFile reads the sessions of SESSIONS_FILE, a file or a
+// directory of files such as mounted Docker or Kubernetes secrets. Every
+// line that isn't empty or a comment holds a session token, optionally
+// followed by options separated by spaces: proxy=URL, labels=k=v,k=v,
+// impersonate=BROWSER, profile=NAME, upstream=URL and archived=true.
+func loadSessionsFile(path string) ([]SessionInfo, error) {
+	paths, err := sessionsFilePaths(path)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []SessionInfo
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+			session, err := parseSessionLine(text)
+			if err != nil {
+				f.Close()
+				return nil, fmt.Errorf("%s:%d: %w", p, line, err)
+			}
+			sessions = append(sessions, session)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sessions, nil
+}
+
+// sessionsFilePaths 返回 SESSIONS_FILE 对应的文件，目录按文件名排序并跳过隐藏文件
+func sessionsFilePaths(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		// Kubernetes 挂载的 ..data 等目录与隐藏文件不是账号
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		p := filepath.Join(path, e.Name())
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// parseSessionLine 解析一行账号：token 与可选的 proxy=、labels=、impersonate=、profile=、upstream=、archived= 选项
+func parseSessionLine(line string) (SessionInfo, error) {
+	fields := strings.Fields(line)
+	session := SessionInfo{SessionKey: fields[0]}
+	for _, option := range fields[1:] {
+		name, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return session, fmt.Errorf("invalid option %q, use name=value", option)
+		}
+		switch name {
+		case "proxy":
+			session.Proxy = validProxyURL(value)
+		case "labels":
+			labels, err := ParseLabels(value)
+			if err != nil {
+				return session, err
+			}
+			session.Labels = labels
+		case "impersonate":
+			fp := &Fingerprint{Browser: strings.ToLower(value)}
+			if err := fp.Validate(); err != nil {
+				return session, err
+			}
+			session.Fingerprint = fp
+		case "profile":
+			session.HeaderProfile = value
+		case "upstream":
+			upstream := &Upstream{URL: value}
+			if err := upstream.Validate(); err != nil {
+				return session, err
+			}
+			session.Upstream = validSessionUpstream(upstream)
+		case "archived":
+			session.Archived = value == "true"
+		default:
+			return session, fmt.Errorf("unknown option %q, use proxy, labels, impersonate, profile, upstream or archived", name)
+		}
+	}
+	return session, nil
+}
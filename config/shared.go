@@ -0,0 +1,20 @@
+package config
+
+import "time"
+
+// SharedState coordinates session state between replicas. Implementations
+// fall back to each replica's local state when the backend is unreachable,
+// so calls never fail a request.
+type SharedState interface {
+	// Cooldown returns the end of the shared cooldown of a session, zero if none
+	Cooldown(session string) time.Time
+	// SetCooldown extends the shared cooldown of a session to until
+	SetCooldown(session string, until time.Time)
+	// ClearCooldown ends the shared cooldown of a session early
+	ClearCooldown(session string)
+	// NextIndex returns the next value of the shared rotation counter
+	NextIndex() (int64, error)
+}
+
+// Shared is the state shared between replicas, nil when REDIS_URL is unset
+var Shared SharedState
@@ -0,0 +1,182 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"time"
+)
+
+// savedSlot is a non-empty history slot in the session state file
+type savedSlot struct {
+	Start       int64 `json:"start"`
+	Successes   int   `json:"successes,omitempty"`
+	RateLimited int   `json:"rate_limited,omitempty"`
+	Errors      int   `json:"errors,omitempty"`
+	Stalls      int   `json:"stalls,omitempty"`
+}
+
+// savedCooldown is a cooldown window in the session state file
+type savedCooldown struct {
+	From  time.Time `json:"from"`
+	Until time.Time `json:"until"`
+}
+
+// savedSessionState is the part of a SessionState kept across restarts;
+// pacing is not kept since it only spaces out requests of one process.
+// Key identifies the session; Index is its position when saved, used only
+// for files written before keys were saved.
+type savedSessionState struct {
+	Key              string               `json:"key,omitempty"`
+	Index            int                  `json:"index"`
+	RateLimitedUntil time.Time            `json:"rate_limited_until"`
+	Tier             string               `json:"tier,omitempty"`
+	FamilyCooldowns  map[string]time.Time `json:"family_cooldowns,omitempty"`
+	// LearnedCooldowns 学习到的冷却秒数
+	LearnedCooldowns map[string]int  `json:"learned_cooldowns,omitempty"`
+	Cooldowns        []savedCooldown `json:"cooldowns,omitempty"`
+	Slots            []savedSlot     `json:"slots,omitempty"`
+}
+
+// SaveSessionStates writes the cooldowns and history of all sessions to
+// path, so a restart doesn't send requests to accounts still cooling down.
+func SaveSessionStates(path string) error {
+	if path == "" {
+		return nil
+	}
+	sessionStatesMutex.Lock()
+	positions := make(map[string]int, len(ConfigInstance.sessionKeys))
+	for i, key := range ConfigInstance.sessionKeys {
+		positions[key] = i
+	}
+	states := make([]*SessionState, 0, len(sessionStates))
+	for key, state := range sessionStates {
+		// 超出配置范围的序号没有稳定标识，不保存
+		if _, ok := positions[key]; ok {
+			states = append(states, state)
+		}
+	}
+	sessionStatesMutex.Unlock()
+	sort.Slice(states, func(i, j int) bool { return positions[states[i].key] < positions[states[j].key] })
+
+	cutoff := time.Now().Add(-HistoryWindow).Unix()
+	saved := make([]savedSessionState, 0, len(states))
+	for _, s := range states {
+		s.mutex.Lock()
+		entry := savedSessionState{Key: s.key, Index: positions[s.key], RateLimitedUntil: s.rateLimitedUntil, Tier: s.tier}
+		for family, until := range s.familyUntil {
+			if until.After(time.Now()) {
+				if entry.FamilyCooldowns == nil {
+					entry.FamilyCooldowns = map[string]time.Time{}
+				}
+				entry.FamilyCooldowns[family] = until
+			}
+		}
+		for family, l := range s.learned {
+			if entry.LearnedCooldowns == nil {
+				entry.LearnedCooldowns = map[string]int{}
+			}
+			entry.LearnedCooldowns[family] = int(l.duration.Seconds())
+		}
+		for _, w := range s.cooldowns {
+			entry.Cooldowns = append(entry.Cooldowns, savedCooldown{From: w.from, Until: w.until})
+		}
+		for _, slot := range s.slots {
+			if slot.start > cutoff {
+				entry.Slots = append(entry.Slots, savedSlot{slot.start, slot.successes, slot.rateLimited, slot.errors, slot.stalls})
+			}
+		}
+		s.mutex.Unlock()
+		saved = append(saved, entry)
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadSessionStates restores the session states saved by SaveSessionStates.
+// A missing file is not an error. States follow their session by key, so
+// they carry over when sessions are reordered; states of sessions no longer
+// configured are dropped.
+func LoadSessionStates(path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []savedSessionState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-HistoryWindow).Unix()
+	for _, entry := range saved {
+		s := savedStateFor(entry)
+		if s == nil {
+			continue
+		}
+		s.mutex.Lock()
+		if entry.RateLimitedUntil.After(s.rateLimitedUntil) {
+			s.rateLimitedUntil = entry.RateLimitedUntil
+		}
+		if s.tier == "" {
+			s.tier = entry.Tier
+		}
+		for family, until := range entry.FamilyCooldowns {
+			if s.familyUntil == nil {
+				s.familyUntil = map[string]time.Time{}
+			}
+			if until.After(s.familyUntil[family]) {
+				s.familyUntil[family] = until
+			}
+		}
+		for family, seconds := range entry.LearnedCooldowns {
+			if s.learned == nil {
+				s.learned = map[string]*learnedCooldown{}
+			}
+			s.learned[family] = &learnedCooldown{duration: time.Duration(seconds) * time.Second}
+		}
+		for _, w := range entry.Cooldowns {
+			s.cooldowns = append(s.cooldowns, cooldownWindow{from: w.From, until: w.Until})
+		}
+		for _, slot := range entry.Slots {
+			if slot.Start <= cutoff {
+				continue
+			}
+			s.slots[(slot.Start/int64(HistorySlot/time.Second))%int64(historySlots)] = historySlot{
+				start:       slot.Start,
+				successes:   slot.Successes,
+				rateLimited: slot.RateLimited,
+				errors:      slot.Errors,
+				stalls:      slot.Stalls,
+			}
+		}
+		s.mutex.Unlock()
+	}
+	return nil
+}
+
+// savedStateFor 返回保存的条目对应的当前 session 状态，账号已不在配置中时为 nil。
+// 没有标识的旧文件按序号对应
+func savedStateFor(entry savedSessionState) *SessionState {
+	sessionStatesMutex.Lock()
+	defer sessionStatesMutex.Unlock()
+	key := entry.Key
+	if key == "" {
+		if k, ok := ConfigInstance.sessionKeyAt(entry.Index); ok {
+			key = k
+		}
+	}
+	for _, configured := range ConfigInstance.sessionKeys {
+		if configured == key {
+			return stateFor(key, true)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"pplx2api/logger"
+	"strings"
+)
+
+// Default upstream endpoints
+const (
+	DefaultUpstreamURL   = "https://www.perplexity.ai"
+	DefaultAskPath       = "/rest/sse/perplexity_ask"
+	DefaultUploadPath    = "/rest/uploads/create_upload_url"
+	DefaultFileUploadURL = "https://ppl-ai-file-upload.s3.amazonaws.com/"
+)
+
+// Upstream is where upstream requests are sent, to reach Perplexity
+// through a mirror, a corporate proxy or a test server
+type Upstream struct {
+	// URL 上游站点地址，其余接口与 Origin、Referer 都基于该地址
+	URL string `json:"url,omitempty"`
+	// AskPath 发送问题的 SSE 接口路径
+	AskPath string `json:"ask_path,omitempty"`
+	// UploadPath 申请附件上传地址的接口路径
+	UploadPath string `json:"upload_path,omitempty"`
+	// FileUploadURL 附件实际上传到的存储地址
+	FileUploadURL string `json:"file_upload_url,omitempty"`
+}
+
+// Validate checks that the URLs are absolute http(s) URLs and the paths
+// start with a slash
+func (u Upstream) Validate() error {
+	for _, v := range []string{u.URL, u.FileUploadURL} {
+		if v == "" {
+			continue
+		}
+		parsed, err := url.Parse(v)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid upstream URL %q", v)
+		}
+	}
+	for _, p := range []string{u.AskPath, u.UploadPath} {
+		if p != "" && !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("upstream path %q must start with /", p)
+		}
+	}
+	return nil
+}
+
+// UpstreamFor returns the upstream of a session, the global one with the
+// endpoints the session sets replaced. With MOCK_UPSTREAM all sessions use
+// the mock upstream.
+func (c *Config) UpstreamFor(session SessionInfo) Upstream {
+	u := c.Upstream
+	o := session.Upstream
+	if o == nil || c.Mock.Enabled {
+		return u
+	}
+	if o.URL != "" {
+		u.URL = o.URL
+	}
+	if o.AskPath != "" {
+		u.AskPath = o.AskPath
+	}
+	if o.UploadPath != "" {
+		u.UploadPath = o.UploadPath
+	}
+	if o.FileUploadURL != "" {
+		u.FileUploadURL = o.FileUploadURL
+	}
+	return u
+}
+
+// loadUpstream 读取全局的上游地址，未设置或无效时使用 Perplexity 官方地址
+func loadUpstream() Upstream {
+	u := Upstream{
+		URL:           strings.TrimSuffix(os.Getenv("UPSTREAM_URL"), "/"),
+		AskPath:       os.Getenv("UPSTREAM_ASK_PATH"),
+		UploadPath:    os.Getenv("UPSTREAM_UPLOAD_PATH"),
+		FileUploadURL: os.Getenv("UPSTREAM_FILE_UPLOAD_URL"),
+	}
+	if err := u.Validate(); err != nil {
+		logger.Error(fmt.Sprintf("Invalid upstream: %v", err))
+		u = Upstream{}
+	}
+	if u.URL == "" {
+		u.URL = DefaultUpstreamURL
+	}
+	if u.AskPath == "" {
+		u.AskPath = DefaultAskPath
+	}
+	if u.UploadPath == "" {
+		u.UploadPath = DefaultUploadPath
+	}
+	if u.FileUploadURL == "" {
+		u.FileUploadURL = DefaultFileUploadURL
+	}
+	return u
+}
+
+// validSessionUpstream 丢弃无效的账号上游设置
+func validSessionUpstream(u *Upstream) *Upstream {
+	if u == nil {
+		return nil
+	}
+	if err := u.Validate(); err != nil {
+		logger.Error(fmt.Sprintf("Ignoring session upstream: %v", err))
+		return nil
+	}
+	u.URL = strings.TrimSuffix(u.URL, "/")
+	return u
+}
@@ -0,0 +1,251 @@
+// Package conversation records chat completions for auditing: what a key
+// asked, the prompt the proxy actually sent to Perplexity, the answer with
+// its citations, and how long it took.
+//
+// Records are kept per API key and only that key can list or delete them.
+// The default backend is a SQLite database, using a pure Go driver so the
+// proxy still builds without cgo; the file backend stores one JSON file per
+// record. Other backends only need to implement Store.
+package conversation
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"pplx2api/redact"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Record states
+const (
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+)
+
+// Record is one recorded chat completion
+type Record struct {
+	ID             string                   `json:"id"`
+	RequestID      string                   `json:"request_id,omitempty"`
+	Key            string                   `json:"key"`
+	ConversationID string                   `json:"conversation_id,omitempty"`
+	Model          string                   `json:"model"`
+	Messages       []map[string]interface{} `json:"messages,omitempty"`
+	// Prompt 实际发送给 Perplexity 的提示词
+	Prompt    string   `json:"prompt,omitempty"`
+	Response  string   `json:"response,omitempty"`
+	Citations []string `json:"citations,omitempty"`
+	// Session 处理请求的账号（已脱敏）
+	Session    string    `json:"session,omitempty"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	DurationMs int64     `json:"duration_ms"`
+	// Redacted 保存前已遮盖个人信息与密钥
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// Redact masks personal data and secrets in the text of the record
+func (r *Record) Redact(s *redact.Scrubber) {
+	if r.Messages != nil {
+		messages := make([]map[string]interface{}, len(r.Messages))
+		for i, msg := range r.Messages {
+			messages[i] = s.Map(msg)
+		}
+		r.Messages = messages
+	}
+	r.Prompt = s.String(r.Prompt)
+	r.Response = s.String(r.Response)
+	r.Citations = s.Strings(r.Citations)
+	r.Error = s.String(r.Error)
+	r.Redacted = true
+}
+
+// Summary returns the record without messages, prompt and response
+func (r Record) Summary() Record {
+	r.Messages, r.Prompt, r.Response, r.Citations = nil, "", "", nil
+	return r
+}
+
+// Store persists records
+type Store interface {
+	Save(r Record) error
+	// List returns up to limit records of key, newest first, optionally of
+	// one conversation; limit <= 0 returns all of them
+	List(key string, conversationID string, limit int) ([]Record, error)
+	Get(key string, id string) (Record, bool, error)
+	Delete(key string, id string) (bool, error)
+}
+
+var (
+	defaultStore Store
+	storeOnce    sync.Once
+)
+
+// Default returns the configured store, nil when recording is off
+func Default() Store {
+	storeOnce.Do(func() {
+		switch config.ConfigInstance.ConversationStore {
+		case config.ConversationStoreSQLite:
+			store, err := NewSQLiteStore(config.ConfigInstance.ConversationDB)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Failed to open conversation database %s, recording is off: %v", config.ConfigInstance.ConversationDB, err))
+				return
+			}
+			defaultStore = store
+		case config.ConversationStoreFile:
+			defaultStore = NewFileStore(config.ConfigInstance.ConversationDir)
+		}
+	})
+	return defaultStore
+}
+
+// validID 记录 ID 只允许安全的文件名字符
+var validID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ErrInvalidID is returned for record ids that can't name a file
+var ErrInvalidID = errors.New("invalid record id")
+
+// fileStore keeps each record in <dir>/<key hash>/<id>.json
+type fileStore struct {
+	dir   string
+	mutex sync.Mutex
+}
+
+// NewFileStore creates a store in dir
+func NewFileStore(dir string) Store {
+	return &fileStore{dir: dir}
+}
+
+// keyHash 返回 key 名称的短哈希，记录按它区分 key 而不保存名称本身
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *fileStore) keyDir(key string) string {
+	return filepath.Join(s.dir, keyHash(key))
+}
+
+func (s *fileStore) path(key string, id string) (string, error) {
+	if !validID.MatchString(id) {
+		return "", ErrInvalidID
+	}
+	return filepath.Join(s.keyDir(key), id+".json"), nil
+}
+
+func (s *fileStore) Save(r Record) error {
+	path, err := s.path(r.Key, r.ID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// List 按文件修改时间从新到旧读取记录，凑够 limit 条后不再读取其余文件。
+// 记录写入后不再修改，修改时间即创建时间
+func (s *fileStore) List(key string, conversationID string, limit int) ([]Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entries, err := os.ReadDir(s.keyDir(key))
+	if os.IsNotExist(err) {
+		return []Record{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	type file struct {
+		name    string
+		modTime time.Time
+	}
+	files := make([]file, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{entry.Name(), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modTime.Equal(files[j].modTime) {
+			return files[i].modTime.After(files[j].modTime)
+		}
+		return files[i].name > files[j].name
+	})
+	records := []Record{}
+	for _, f := range files {
+		if limit > 0 && len(records) >= limit {
+			break
+		}
+		r, err := readRecord(filepath.Join(s.keyDir(key), f.name))
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to read conversation record %s: %v", f.name, err))
+			continue
+		}
+		if conversationID != "" && r.ConversationID != conversationID {
+			continue
+		}
+		records = append(records, r)
+	}
+	// 修改时间精度较低的文件系统上同时写入的记录再按创建时间排序
+	sort.SliceStable(records, func(i, j int) bool { return records[i].CreatedAt.After(records[j].CreatedAt) })
+	return records, nil
+}
+
+func (s *fileStore) Get(key string, id string) (Record, bool, error) {
+	path, err := s.path(key, id)
+	if err != nil {
+		return Record{}, false, nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r, err := readRecord(path)
+	if os.IsNotExist(err) {
+		return Record{}, false, nil
+	}
+	return r, err == nil, err
+}
+
+func (s *fileStore) Delete(key string, id string) (bool, error) {
+	path, err := s.path(key, id)
+	if err != nil {
+		return false, nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func readRecord(path string) (Record, error) {
+	var r Record
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(data, &r)
+	return r, err
+}
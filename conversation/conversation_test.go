@@ -0,0 +1,96 @@
+package conversation
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stores 返回在临时目录中创建的各内置存储
+func stores(t *testing.T) map[string]Store {
+	dir := t.TempDir()
+	db, err := NewSQLiteStore(filepath.Join(dir, "conversations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]Store{
+		"sqlite": db,
+		"file":   NewFileStore(filepath.Join(dir, "files")),
+	}
+}
+
+func TestStoreListNewestFirst(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now()
+			for i, id := range []string{"a1", "a2", "a3", "a4"} {
+				conv := "c1"
+				if i%2 == 1 {
+					conv = "c2"
+				}
+				r := Record{ID: id, Key: "alice", ConversationID: conv, Status: StatusCompleted, CreatedAt: start.Add(time.Duration(i) * time.Second)}
+				if err := store.Save(r); err != nil {
+					t.Fatal(err)
+				}
+				// 文件存储按修改时间排序，保证各文件的修改时间不同
+				time.Sleep(10 * time.Millisecond)
+			}
+			if err := store.Save(Record{ID: "b1", Key: "bob", CreatedAt: start}); err != nil {
+				t.Fatal(err)
+			}
+
+			assertIDs(t, store, "alice", "", 0, "a4", "a3", "a2", "a1")
+			assertIDs(t, store, "alice", "", 2, "a4", "a3")
+			assertIDs(t, store, "alice", "c1", 0, "a3", "a1")
+			assertIDs(t, store, "alice", "c2", 1, "a4")
+			assertIDs(t, store, "bob", "", 0, "b1")
+			assertIDs(t, store, "carol", "", 0)
+		})
+	}
+}
+
+func TestStoreGetAndDeleteArePerKey(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if err := store.Save(Record{ID: "r1", Key: "alice", Prompt: "hello", CreatedAt: time.Now()}); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok, err := store.Get("bob", "r1"); err != nil || ok {
+				t.Fatalf("another key got the record: ok %t, err %v", ok, err)
+			}
+			r, ok, err := store.Get("alice", "r1")
+			if err != nil || !ok || r.Prompt != "hello" {
+				t.Fatalf("Get = %+v, %t, %v", r, ok, err)
+			}
+			if deleted, err := store.Delete("bob", "r1"); err != nil || deleted {
+				t.Fatalf("another key deleted the record: %t, %v", deleted, err)
+			}
+			if deleted, err := store.Delete("alice", "r1"); err != nil || !deleted {
+				t.Fatalf("Delete = %t, %v", deleted, err)
+			}
+			if _, ok, _ := store.Get("alice", "r1"); ok {
+				t.Fatal("record still there after Delete")
+			}
+		})
+	}
+}
+
+func assertIDs(t *testing.T, store Store, key string, conversationID string, limit int, want ...string) {
+	t.Helper()
+	records, err := store.List(key, conversationID, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range records {
+		got = append(got, r.ID)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("List(%s, %q, %d) = %v, want %v", key, conversationID, limit, got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("List(%s, %q, %d) = %v, want %v", key, conversationID, limit, got, want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package conversation
+
+import (
+	"database/sql"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	// 纯 Go 实现的 SQLite 驱动，CGO_ENABLED=0 构建时也可使用
+	_ "modernc.org/sqlite"
+)
+
+// sqliteSchema 记录表：每个 key 的记录按创建时间倒序读取，可按会话过滤
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS records (
+	key_hash        TEXT    NOT NULL,
+	id              TEXT    NOT NULL,
+	conversation_id TEXT    NOT NULL DEFAULT '',
+	created_at      INTEGER NOT NULL,
+	data            TEXT    NOT NULL,
+	PRIMARY KEY (key_hash, id)
+);
+CREATE INDEX IF NOT EXISTS records_by_time ON records (key_hash, created_at DESC);
+CREATE INDEX IF NOT EXISTS records_by_conversation ON records (key_hash, conversation_id, created_at DESC);
+`
+
+// sqliteStore keeps the records in one SQLite database. The key column
+// holds a hash of the key name, as the file store's directory names do.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens or creates the database at path
+func NewSQLiteStore(path string) (Store, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite 同一时间只允许一个写入，单个连接避免 SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Save(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO records (key_hash, id, conversation_id, created_at, data) VALUES (?, ?, ?, ?, ?)`,
+		keyHash(r.Key), r.ID, r.ConversationID, r.CreatedAt.UnixNano(), string(data))
+	return err
+}
+
+func (s *sqliteStore) List(key string, conversationID string, limit int) ([]Record, error) {
+	if limit <= 0 {
+		limit = -1 // SQLite 中负数 LIMIT 表示不限
+	}
+	query := `SELECT data FROM records WHERE key_hash = ? ORDER BY created_at DESC LIMIT ?`
+	args := []interface{}{keyHash(key), limit}
+	if conversationID != "" {
+		query = `SELECT data FROM records WHERE key_hash = ? AND conversation_id = ? ORDER BY created_at DESC LIMIT ?`
+		args = []interface{}{keyHash(key), conversationID, limit}
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []Record{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var r Record
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqliteStore) Get(key string, id string) (Record, bool, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM records WHERE key_hash = ? AND id = ?`, keyHash(key), id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return Record{}, false, nil
+	}
+	if err != nil {
+		return Record{}, false, err
+	}
+	var r Record
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		return Record{}, false, err
+	}
+	return r, true, nil
+}
+
+func (s *sqliteStore) Delete(key string, id string) (bool, error) {
+	result, err := s.db.Exec(`DELETE FROM records WHERE key_hash = ? AND id = ?`, keyHash(key), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
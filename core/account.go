@@ -0,0 +1,114 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Perplexity subscription tiers, lowest first
+const (
+	TierFree = "free"
+	TierPro  = "pro"
+	TierMax  = "max"
+)
+
+var tierRanks = map[string]int{
+	TierFree: 0,
+	TierPro:  1,
+	TierMax:  2,
+}
+
+// TierAllows reports whether an account on tier may use a model requiring required
+func TierAllows(tier string, required string) bool {
+	return tierRanks[tier] >= tierRanks[required]
+}
+
+// UpstreamModel is a model preference advertised by Perplexity
+type UpstreamModel struct {
+	ID               string
+	SubscriptionTier string
+}
+
+type userSettingsResponse struct {
+	SubscriptionStatus string `json:"subscription_status"`
+	SubscriptionTier   string `json:"subscription_tier"`
+}
+
+type modelsConfigResponse struct {
+	Models map[string]struct {
+		SubscriptionTier string `json:"subscription_tier"`
+	} `json:"models"`
+}
+
+// GetSubscriptionTier queries the account settings and normalizes the tier
+func (c *Client) GetSubscriptionTier() (string, error) {
+	resp, err := c.client.R().Get(c.endpoint("/rest/user/settings?version=2.18&source=default"))
+	if err != nil {
+		c.log().Error(fmt.Sprintf("Error getting user settings: %v", err))
+		return "", err
+	}
+	// 验证页同样返回403，不能当作 cookie 失效
+	if challenge := c.challengeOf(resp); challenge != nil {
+		c.reportProxyFailure("cloudflare challenge")
+		return "", challenge
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", &AuthError{Status: resp.StatusCode}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	var settings userSettingsResponse
+	if err := json.Unmarshal(resp.Bytes(), &settings); err != nil {
+		return "", fmt.Errorf("error parsing user settings: %w", err)
+	}
+	return normalizeTier(settings.SubscriptionTier, settings.SubscriptionStatus), nil
+}
+
+func normalizeTier(tier string, status string) string {
+	tier = strings.ToLower(tier)
+	switch {
+	case strings.Contains(tier, "max"), strings.Contains(tier, "enterprise"):
+		return TierMax
+	case strings.Contains(tier, "pro"):
+		return TierPro
+	case tier == "" && strings.EqualFold(status, "active"):
+		return TierPro
+	}
+	return TierFree
+}
+
+// GetModels returns the model preferences the upstream currently offers
+func (c *Client) GetModels() ([]UpstreamModel, error) {
+	resp, err := c.client.R().Get(c.endpoint("/rest/models/config?config_schema=v1&version=2.18&source=default"))
+	if err != nil {
+		c.log().Error(fmt.Sprintf("Error getting models config: %v", err))
+		return nil, err
+	}
+	if challenge := c.challengeOf(resp); challenge != nil {
+		c.reportProxyFailure("cloudflare challenge")
+		return nil, challenge
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	var modelsConfig modelsConfigResponse
+	if err := json.Unmarshal(resp.Bytes(), &modelsConfig); err != nil {
+		return nil, fmt.Errorf("error parsing models config: %w", err)
+	}
+	if len(modelsConfig.Models) == 0 {
+		return nil, fmt.Errorf("models config is empty")
+	}
+	models := make([]UpstreamModel, 0, len(modelsConfig.Models))
+	for id, m := range modelsConfig.Models {
+		model := UpstreamModel{ID: id}
+		// 未标注订阅等级的模型由调用方决定默认等级
+		if m.SubscriptionTier != "" {
+			model.SubscriptionTier = normalizeTier(m.SubscriptionTier, "")
+		}
+		models = append(models, model)
+	}
+	return models, nil
+}
@@ -3,17 +3,24 @@ package core
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"pplx2api/claims"
 	"pplx2api/config"
 	"pplx2api/logger"
 	"pplx2api/model"
+	"pplx2api/redact"
+	"pplx2api/tracing"
 	"pplx2api/utils"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -24,10 +31,62 @@ import (
 // Client represents a Perplexity API client
 type Client struct {
 	sessionToken string
+	proxy        string
 	client       *req.Client
+	upstream     config.Upstream
 	Model        string
 	Attachments  []string
 	OpenSerch    bool
+	// RawOutput 跳过所有后处理（搜索结果、图片、模型监控等附加内容），只返回上游原文
+	RawOutput bool
+	// RequestID 发起调用的入站请求 ID，写入每条日志
+	RequestID string
+	// Scrubber 写入日志前遮盖请求内容中的个人信息与密钥，nil 时不遮盖
+	Scrubber *redact.Scrubber
+	// Search 联网搜索的时间与域名过滤，仅在 OpenSerch 时生效
+	Search SearchOptions
+	// Timezone 上游请求的时区，为空时使用 TIMEZONE
+	Timezone string
+	// Citations 最近一次回答引用的搜索结果链接
+	Citations []string
+	// ExtractClaims 在响应末尾返回从正文与引用中提取的陈述
+	ExtractClaims bool
+	// FollowUp 非空时作为该会话的追问发送
+	FollowUp *Thread
+	// Answered 本次回答所在的会话，可用于下一次追问
+	Answered Thread
+}
+
+// Thread identifies a Perplexity conversation a follow-up can continue
+type Thread struct {
+	BackendUUID    string `json:"backend_uuid"`
+	ReadWriteToken string `json:"read_write_token"`
+	ContextUUID    string `json:"context_uuid"`
+}
+
+// Search recency filters accepted by Perplexity
+var SearchRecencyFilters = []string{"hour", "day", "week", "month", "year"}
+
+// SearchOptions narrow down the web search of a request
+type SearchOptions struct {
+	// RecencyFilter 只使用该时间范围内的结果：hour、day、week、month、year
+	RecencyFilter string `json:"recency_filter,omitempty"`
+	// DomainFilter 限定搜索的域名，以 - 开头的域名被排除
+	DomainFilter []string `json:"domain_filter,omitempty"`
+}
+
+// domainQuery returns the site: operators for the domain filter. The web
+// API has no domain parameter, so the filter is expressed in the query.
+func (o SearchOptions) domainQuery() string {
+	var include, exclude []string
+	for _, domain := range o.DomainFilter {
+		if strings.HasPrefix(domain, "-") {
+			exclude = append(exclude, "-site:"+strings.TrimPrefix(domain, "-"))
+		} else {
+			include = append(include, "site:"+domain)
+		}
+	}
+	return strings.TrimSpace(strings.Join(include, " OR ") + " " + strings.Join(exclude, " "))
 }
 
 // Perplexity API structures
@@ -61,13 +120,17 @@ type PerplexityParams struct {
 	ClientCoordinates        interface{}   `json:"client_coordinates"`
 	IsNavSuggestionsDisabled bool          `json:"is_nav_suggestions_disabled"`
 	Version                  string        `json:"version"`
+	LastBackendUUID          string        `json:"last_backend_uuid,omitempty"`
+	ReadWriteToken           string        `json:"read_write_token,omitempty"`
 }
 
 // Response structures
 type PerplexityResponse struct {
-	Blocks       []Block `json:"blocks"`
-	Status       string  `json:"status"`
-	DisplayModel string  `json:"display_model"`
+	Blocks         []Block `json:"blocks"`
+	Status         string  `json:"status"`
+	DisplayModel   string  `json:"display_model"`
+	BackendUUID    string  `json:"backend_uuid"`
+	ReadWriteToken string  `json:"read_write_token"`
 }
 
 type Block struct {
@@ -75,6 +138,48 @@ type Block struct {
 	ReasoningPlanBlock *ReasoningPlanBlock `json:"reasoning_plan_block,omitempty"`
 	WebResultBlock     *WebResultBlock     `json:"web_result_block,omitempty"`
 	ImageModeBlock     *ImageModeBlock     `json:"image_mode_block,omitempty"`
+	PlanBlock          *PlanBlock          `json:"plan_block,omitempty"`
+}
+
+// PlanBlock lists the steps of a Deep Research or Pro Search run. Each
+// event carries all steps so far.
+type PlanBlock struct {
+	Progress string     `json:"progress"`
+	Steps    []PlanStep `json:"steps"`
+}
+
+type PlanStep struct {
+	StepType           string              `json:"step_type"`
+	SearchWebContent   *SearchWebContent   `json:"search_web_content,omitempty"`
+	ReadResultsContent *ReadResultsContent `json:"read_results_content,omitempty"`
+	WebResultsContent  *WebResultBlock     `json:"web_results_content,omitempty"`
+}
+
+type SearchWebContent struct {
+	Queries []struct {
+		Query string `json:"query"`
+	} `json:"queries"`
+}
+
+type ReadResultsContent struct {
+	URLs []string `json:"urls"`
+}
+
+// progressText 将新的计划步骤格式化为进度提示，不认识的步骤类型跳过
+func progressText(step PlanStep) string {
+	switch {
+	case step.SearchWebContent != nil && len(step.SearchWebContent.Queries) > 0:
+		queries := make([]string, 0, len(step.SearchWebContent.Queries))
+		for _, q := range step.SearchWebContent.Queries {
+			queries = append(queries, q.Query)
+		}
+		return "> Searching: " + strings.Join(queries, "; ") + "\n"
+	case step.ReadResultsContent != nil && len(step.ReadResultsContent.URLs) > 0:
+		return "> Reading: " + strings.Join(step.ReadResultsContent.URLs, ", ") + "\n"
+	case step.WebResultsContent != nil && len(step.WebResultsContent.WebResults) > 0:
+		return fmt.Sprintf("> Found %d sources\n", len(step.WebResultsContent.WebResults))
+	}
+	return ""
 }
 
 type MarkdownBlock struct {
@@ -112,9 +217,76 @@ type ImageModeBlock struct {
 	} `json:"media_items"`
 }
 
+// RateLimitError is returned by SendMessage when the upstream answers 429.
+// RetryAfter is zero when the response carried no usable Retry-After header.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return "rate limit exceeded"
+}
+
+// AuthError is returned when Perplexity rejects the session cookie with
+// 401 or 403, which usually means the cookie expired or was revoked.
+type AuthError struct {
+	Status int
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("session rejected by upstream (status %d)", e.Status)
+}
+
+// StreamBrokenError is returned when reading a streamed answer from
+// upstream failed midway
+type StreamBrokenError struct {
+	Err error
+}
+
+func (e *StreamBrokenError) Error() string {
+	return fmt.Sprintf("error reading response: %v", e.Err)
+}
+
+func (e *StreamBrokenError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError is returned when a non-streamed answer didn't finish within
+// NON_STREAM_TIMEOUT and no partial answer is returned instead.
+type TimeoutError struct {
+	After time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("upstream response didn't finish within %v", e.After)
+}
+
+// parseRetryAfter 解析 Retry-After 头，支持秒数和 HTTP 日期两种格式
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
 // NewClient creates a new Perplexity API client
 func NewClient(sessionToken string, proxy string, model string, openSerch bool) *Client {
-	client := req.C().ImpersonateChrome().SetTimeout(time.Minute * 10)
+	cfg := config.ConfigInstance
+	return newClient(sessionToken, proxy, cfg.Fingerprint, cfg.Upstream, model, openSerch)
+}
+
+// newClient 创建以 fp 指纹经过 proxy 向 upstream 发送请求的客户端
+func newClient(sessionToken string, proxy string, fp config.Fingerprint, upstream config.Upstream, model string, openSerch bool) *Client {
+	client := req.C().SetTimeout(time.Minute * 10)
+	impersonate(client, fp)
 	client.Transport.SetResponseHeaderTimeout(time.Second * 10)
 	if proxy != "" {
 		client.SetProxyURL(proxy)
@@ -124,10 +296,10 @@ func NewClient(sessionToken string, proxy string, model string, openSerch bool)
 	headers := map[string]string{
 		"accept-language": "en-US,en;q=0.9,zh-CN;q=0.8,zh;q=0.7,zh-TW;q=0.6",
 		"cache-control":   "no-cache",
-		"origin":          "https://www.perplexity.ai",
+		"origin":          upstream.URL,
 		"pragma":          "no-cache",
 		"priority":        "u=1, i",
-		"referer":         "https://www.perplexity.ai/",
+		"referer":         upstream.URL + "/",
 	}
 
 	for key, value := range headers {
@@ -141,11 +313,22 @@ func NewClient(sessionToken string, proxy string, model string, openSerch bool)
 			Value: sessionToken,
 		})
 	}
+	// 使用验证服务为该出口取得的 Cloudflare cookie
+	if clearance, ok := clearanceFor(proxy); ok {
+		for name, value := range clearance.Cookies {
+			client.SetCommonCookies(&http.Cookie{Name: name, Value: value})
+		}
+		if clearance.UserAgent != "" {
+			client.SetUserAgent(clearance.UserAgent)
+		}
+	}
 
 	// Create client with visitor ID
 	c := &Client{
 		sessionToken: sessionToken,
+		proxy:        proxy,
 		client:       client,
+		upstream:     upstream,
 		Model:        model,
 		Attachments:  []string{},
 		OpenSerch:    openSerch,
@@ -154,14 +337,39 @@ func NewClient(sessionToken string, proxy string, model string, openSerch bool)
 	return c
 }
 
-// SendMessage sends a message to Perplexity and returns the status and response
-func (c *Client) SendMessage(message string, stream bool, is_incognito bool, gc *gin.Context) (int, error) {
+// endpoint 返回上游站点上 path 的地址
+func (c *Client) endpoint(path string) string {
+	return c.upstream.URL + path
+}
+
+// log 返回带请求 ID 的日志记录器
+func (c *Client) log() logger.Entry {
+	return logger.WithRequestID(c.RequestID)
+}
+
+// Fork returns a client for another request that shares c's HTTP client,
+// so connections and cookies are reused while attachments start empty.
+func (c *Client) Fork(model string, openSerch bool) *Client {
+	return &Client{
+		sessionToken: c.sessionToken,
+		proxy:        c.proxy,
+		client:       c.client,
+		upstream:     c.upstream,
+		Model:        model,
+		Attachments:  []string{},
+		OpenSerch:    openSerch,
+	}
+}
+
+// SendMessage sends a message to Perplexity and returns the status and response.
+// Cancelling ctx aborts the upstream request, including an SSE stream in progress.
+func (c *Client) SendMessage(ctx context.Context, message string, stream bool, is_incognito bool, gc *gin.Context) (int, error) {
 	// Create request body
 	requestBody := PerplexityRequest{
 		Params: PerplexityParams{
 			Attachments: c.Attachments,
 			Language:    "en-US",
-			Timezone:    "America/New_York",
+			Timezone:    config.ConfigInstance.Timezone,
 			SearchFocus: "writing",
 			Sources:     []string{},
 			// SearchFocus:             "internet",
@@ -204,91 +412,236 @@ func (c *Client) SendMessage(message string, stream bool, is_incognito bool, gc
 	if c.OpenSerch {
 		requestBody.Params.SearchFocus = "internet"
 		requestBody.Params.Sources = append(requestBody.Params.Sources, "web")
+		if c.Search.RecencyFilter != "" {
+			requestBody.Params.SearchRecencyFilter = c.Search.RecencyFilter
+		}
+		if q := c.Search.domainQuery(); q != "" {
+			requestBody.QueryStr = message + "\n\n" + q
+		}
+	}
+	if c.Timezone != "" {
+		requestBody.Params.Timezone = c.Timezone
+	}
+	if c.FollowUp != nil {
+		// 在已有会话中追问，只发送新的一轮
+		requestBody.Params.LastBackendUUID = c.FollowUp.BackendUUID
+		requestBody.Params.ReadWriteToken = c.FollowUp.ReadWriteToken
+		requestBody.Params.FrontendContextUUID = c.FollowUp.ContextUUID
+		requestBody.Params.QuerySource = "followup"
+	}
+	c.Answered = Thread{ContextUUID: requestBody.Params.FrontendContextUUID}
+	// 请求体含完整提示词，只在调试级别遮盖后输出
+	c.log().Info(fmt.Sprintf("Perplexity request: model %s, query %d bytes, follow-up %t", c.Model, len(requestBody.QueryStr), c.FollowUp != nil))
+	if logger.GetLevel() <= logger.DEBUG {
+		if data, err := json.Marshal(c.redactBody(requestBody)); err == nil {
+			c.log().Debug(fmt.Sprintf("Perplexity request body: %s", data))
+		}
+	}
+	ctx, span := tracing.Start(ctx, "upstream.send_message", tracing.KindClient)
+	defer span.End()
+	span.SetAttr("model", c.Model)
+	span.SetAttr("stream", stream)
+	// 上游整体不可用时直接失败，不再逐个账号重试
+	if err := upstreamBreaker.allow(); err != nil {
+		span.SetError(err)
+		return http.StatusServiceUnavailable, err
 	}
-	logger.Info(fmt.Sprintf("Perplexity request body: %v", requestBody))
 	// Make the request
-	resp, err := c.client.R().DisableAutoReadResponse().
+	resp, err := c.client.R().SetContext(ctx).DisableAutoReadResponse().
 		SetBody(requestBody).
-		Post("https://www.perplexity.ai/rest/sse/perplexity_ask")
+		Post(c.endpoint(c.upstream.AskPath))
+	c.capture(resp, requestBody)
 
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error sending request: %v", err))
+		if ctx.Err() != nil {
+			upstreamBreaker.release()
+			return 499, ctx.Err()
+		}
+		c.log().Error(fmt.Sprintf("Error sending request: %v", err))
+		c.reportProxyFailure(err.Error())
+		upstreamBreaker.failure()
 		return 500, fmt.Errorf("request failed: %w", err)
 	}
 
-	logger.Info(fmt.Sprintf("Perplexity response status code: %d", resp.StatusCode))
+	c.log().Info(fmt.Sprintf("Perplexity response status code: %d", resp.StatusCode))
+
+	if challenge := c.challengeOf(resp); challenge != nil {
+		resp.Body.Close()
+		c.reportProxyFailure("cloudflare challenge")
+		// 验证页与代理有关，不说明上游不可用
+		upstreamBreaker.release()
+		return resp.StatusCode, challenge
+	}
+	c.reportProxySuccess()
+	if resp.StatusCode >= 500 {
+		upstreamBreaker.failure()
+	} else {
+		upstreamBreaker.success()
+	}
 
 	if resp.StatusCode == http.StatusTooManyRequests {
 		resp.Body.Close()
-		return http.StatusTooManyRequests, fmt.Errorf("rate limit exceeded")
+		return http.StatusTooManyRequests, &RateLimitError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		c.log().Error(fmt.Sprintf("Session rejected with status %d: %s", resp.StatusCode, resp.String()))
+		resp.Body.Close()
+		return resp.StatusCode, &AuthError{Status: resp.StatusCode}
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		logger.Error(fmt.Sprintf("Unexpected return data: %s", resp.String()))
+		c.log().Error(fmt.Sprintf("Unexpected return data: %s", resp.String()))
 		resp.Body.Close()
 		return resp.StatusCode, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
-	return 200, c.HandleResponse(resp.Body, stream, gc)
+	span.SetAttr("http.status_code", resp.StatusCode)
+	_, relaySpan := tracing.Start(ctx, "sse.relay", tracing.KindInternal)
+	err = c.HandleResponse(resp.Body, stream, gc)
+	relaySpan.SetError(err)
+	relaySpan.End()
+	if err != nil && ctx.Err() != nil {
+		c.log().Info("Upstream request cancelled")
+		return 499, ctx.Err()
+	}
+	return 200, err
+}
+
+// sseDataPrefix 上游事件数据行的前缀
+var sseDataPrefix = []byte("data: ")
+
+// sseBuffers 复用读取上游流的初始缓冲区，避免每个请求分配 SSE_BUFFER_SIZE
+var sseBuffers sync.Pool
+
+// getSSEBuffer 取出不小于 SSE_BUFFER_SIZE 的缓冲区，用完放回 sseBuffers
+func getSSEBuffer() *[]byte {
+	size := config.ConfigInstance.SSEBufferSize
+	if buffer, ok := sseBuffers.Get().(*[]byte); ok && cap(*buffer) >= size {
+		*buffer = (*buffer)[:cap(*buffer)]
+		return buffer
+	}
+	buffer := make([]byte, size)
+	return &buffer
 }
 
 func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context) error {
 	defer body.Close()
 	// Set headers for streaming
 	if stream {
-		gc.Writer.Header().Set("Content-Type", "text/event-stream")
-		gc.Writer.Header().Set("Cache-Control", "no-cache")
-		gc.Writer.Header().Set("Connection", "keep-alive")
-		gc.Writer.WriteHeader(http.StatusOK)
-		gc.Writer.Flush()
+		model.StartStream(gc)
 	}
 	scanner := bufio.NewScanner(body)
 	clientDone := gc.Request.Context().Done()
-	// 增大缓冲区大小
-	scanner.Buffer(make([]byte, 1024*1024), 1024*1024)
-	full_text := ""
-	inThinking := false
-	thinkShown := false
+	// 初始缓冲区按 SSE_BUFFER_SIZE 从池中取得，单行最长1MB
+	buffer := getSSEBuffer()
+	defer sseBuffers.Put(buffer)
+	scanner.Buffer(*buffer, max(config.ConfigInstance.SSEBufferSize, 1024*1024))
+	var full_text strings.Builder
+	reasoning := newReasoningWriter(stream, gc)
+	// answer_text 不含附加内容的回答正文，citations 为搜索结果链接
+	var answer_text strings.Builder
+	citations := []string{}
+	answer := newRefusalGate(c.refusalSignaling(), stream, gc)
+	// flushAnswer 输出拒答检测中暂存的正文
+	flushAnswer := func() {
+		if held := answer.Flush(); held != "" {
+			full_text.WriteString(held)
+			if stream {
+				model.ReturnOpenAIResponse(held, stream, gc)
+			}
+		}
+	}
 	final := false
-	for scanner.Scan() {
+	// progressSteps 已输出进度的计划步骤数
+	progressSteps := 0
+	progressShown := false
+	resumable := model.ResumableFrom(gc)
+	var detachedAt time.Time
+	// 停机时关闭上游响应体结束读取，已输出的内容照常收尾
+	var interrupted atomic.Bool
+	if stop := model.InterruptFrom(gc); stop != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-stop:
+				interrupted.Store(true)
+				body.Close()
+			case <-finished:
+			}
+		}()
+	}
+	// 非流式请求读取上游超过 NON_STREAM_TIMEOUT 时关闭响应体，按 NON_STREAM_PARTIAL 处理已收到的内容
+	var timedOut atomic.Bool
+	if !stream && config.ConfigInstance.NonStreamTimeout > 0 {
+		timer := time.AfterFunc(config.ConfigInstance.NonStreamTimeout, func() {
+			timedOut.Store(true)
+			body.Close()
+		})
+		defer timer.Stop()
+	}
+	// 停止序列或 max_tokens 结束输出后不再读取，返回时关闭响应体即取消上游请求
+	for !model.OutputEnded(gc) && scanner.Scan() {
 		select {
 		case <-clientDone:
-			logger.Info("Client connection closed")
-			return nil
+			// 可续传的流在客户端断开后继续读取上游，等待客户端重连
+			if resumable == nil {
+				c.log().Info("Client connection closed")
+				return nil
+			}
+			if detachedAt.IsZero() {
+				c.log().Info("Client connection closed, buffering for resume")
+				detachedAt = time.Now()
+				clientDone = nil
+			}
 		default:
 		}
-
-		line := scanner.Text()
-		// Skip empty lines
-		if line == "" {
-			continue
+		if !detachedAt.IsZero() && resumable.Abandoned(detachedAt) {
+			c.log().Info("No client resumed the stream, stopping")
+			return nil
 		}
-		if !strings.HasPrefix(line, "data: ") {
+
+		// 直接解析扫描器缓冲区中的行，不转换为字符串
+		line := scanner.Bytes()
+		if !bytes.HasPrefix(line, sseDataPrefix) {
 			continue
 		}
-		data := line[6:]
-		// logger.Info(fmt.Sprintf("Received data: %s", data))
+		data := line[len(sseDataPrefix):]
 		var response PerplexityResponse
-		if err := json.Unmarshal([]byte(data), &response); err != nil {
-			logger.Error(fmt.Sprintf("Error parsing JSON: %v", err))
+		if err := json.Unmarshal(data, &response); err != nil {
+			c.log().Error(fmt.Sprintf("Error parsing JSON: %v", err))
 			continue
 		}
+		if response.BackendUUID != "" {
+			c.Answered.BackendUUID = response.BackendUUID
+		}
+		if response.ReadWriteToken != "" {
+			c.Answered.ReadWriteToken = response.ReadWriteToken
+		}
 		// Check for completion and web results
 		if response.Status == "COMPLETED" {
 			final = true
+			flushAnswer()
 			for _, block := range response.Blocks {
 				if block.ImageModeBlock != nil && block.ImageModeBlock.Progress == "DONE" && len(block.ImageModeBlock.MediaItems) > 0 {
-					imageResultsText := ""
-					imageModelList := []string{}
-					for i, result := range block.ImageModeBlock.MediaItems {
-						imageResultsText += utils.ImageShow(i, result.Name, result.Image)
-						imageModelList = append(imageModelList, result.Name)
-
+					var images []model.Image
+					for _, item := range block.ImageModeBlock.MediaItems {
+						url := item.Image
+						if url == "" {
+							url = item.URL
+						}
+						if url != "" {
+							images = append(images, model.Image{URL: url, Name: item.Name})
+						}
 					}
-					if len(imageModelList) > 0 {
-						imageResultsText = imageResultsText + "\n\n---\n" + strings.Join(imageModelList, ", ")
+					model.AddImages(gc, images)
+					// 按 IMAGE_OUTPUT 写入正文，否则由响应以内容片段返回或不返回
+					if c.RawOutput || !model.ImagesInText(gc, stream) {
+						continue
 					}
-					full_text += imageResultsText
+					imageResultsText := model.ImagesMarkdown(images)
+					full_text.WriteString(imageResultsText)
 
 					if stream {
 						model.ReturnOpenAIResponse(imageResultsText, stream, gc)
@@ -296,12 +649,17 @@ func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context
 				}
 			}
 			for _, block := range response.Blocks {
-				if !config.ConfigInstance.IgnoreSerchResult && block.WebResultBlock != nil && len(block.WebResultBlock.WebResults) > 0 {
+				if block.WebResultBlock != nil {
+					for _, result := range block.WebResultBlock.WebResults {
+						citations = append(citations, result.URL)
+					}
+				}
+				if !c.RawOutput && !config.ConfigInstance.IgnoreSerchResult && block.WebResultBlock != nil && len(block.WebResultBlock.WebResults) > 0 {
 					webResultsText := "\n\n---\n"
 					for i, result := range block.WebResultBlock.WebResults {
 						webResultsText += "\n\n" + utils.SearchShow(i, result.Name, result.URL, result.Snippet)
 					}
-					full_text += webResultsText
+					full_text.WriteString(webResultsText)
 
 					if stream {
 						model.ReturnOpenAIResponse(webResultsText, stream, gc)
@@ -310,10 +668,10 @@ func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context
 
 			}
 
-			if !config.ConfigInstance.IgnoreModelMonitoring && response.DisplayModel != c.Model {
+			if !c.RawOutput && !config.ConfigInstance.IgnoreModelMonitoring && response.DisplayModel != c.Model {
 				res_text := "\n\n---\n"
 				res_text += fmt.Sprintf("Display Model: %s\n", config.ModelReverseMapGet(response.DisplayModel, response.DisplayModel))
-				full_text += res_text
+				full_text.WriteString(res_text)
 				if !stream {
 					break
 				}
@@ -323,24 +681,42 @@ func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context
 		if final {
 			break
 		}
+		// 深度研究与 Pro Search 的搜索步骤作为进度输出，避免长时间无响应
+		if stream && !c.RawOutput && config.ConfigInstance.ProgressChannel != config.ProgressOff {
+			for _, block := range response.Blocks {
+				if block.PlanBlock == nil || len(block.PlanBlock.Steps) <= progressSteps {
+					continue
+				}
+				res_text := ""
+				for _, step := range block.PlanBlock.Steps[progressSteps:] {
+					res_text += progressText(step)
+				}
+				progressSteps = len(block.PlanBlock.Steps)
+				if res_text == "" {
+					continue
+				}
+				if config.ConfigInstance.ProgressChannel == config.ProgressReasoning {
+					model.ReturnOpenAIReasoning(res_text, gc)
+					continue
+				}
+				progressShown = true
+				model.ReturnOpenAIResponse(res_text, stream, gc)
+			}
+		}
 		// Process each block in the response
 		for _, block := range response.Blocks {
 			// Handle reasoning plan blocks (thinking)
 			if block.ReasoningPlanBlock != nil && len(block.ReasoningPlanBlock.Goals) > 0 {
 
-				res_text := ""
-				if !inThinking && !thinkShown {
-					res_text += "<think>"
-					inThinking = true
-				}
-
+				goals_text := ""
 				for _, goal := range block.ReasoningPlanBlock.Goals {
 					if goal.Description != "" && goal.Description != "Beginning analysis" && goal.Description != "Wrapping up analysis" {
-						res_text += goal.Description
+						goals_text += goal.Description
 					}
 				}
-				full_text += res_text
-				if !stream {
+				res_text := reasoning.Reasoning(goals_text)
+				full_text.WriteString(res_text)
+				if !stream || res_text == "" {
 					continue
 				}
 				model.ReturnOpenAIResponse(res_text, stream, gc)
@@ -348,19 +724,25 @@ func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context
 		}
 		for _, block := range response.Blocks {
 			if block.MarkdownBlock != nil && len(block.MarkdownBlock.Chunks) > 0 {
-				res_text := ""
-				if inThinking {
-					res_text += "</think>\n\n"
-					inThinking = false
-					thinkShown = true
+				res_text := reasoning.AnswerStarts()
+				if progressShown {
+					// 进度与正文之间空一行
+					res_text += "\n"
+					progressShown = false
 				}
+				chunks_text := ""
 				for _, chunk := range block.MarkdownBlock.Chunks {
 					if chunk != "" {
-						res_text += chunk
+						chunks_text += chunk
 					}
 				}
-				full_text += res_text
+				answer_text.WriteString(chunks_text)
+				res_text += answer.Answer(chunks_text)
+				full_text.WriteString(res_text)
 				if !stream {
+					model.WatchOutput(gc, res_text)
+				}
+				if !stream || res_text == "" {
 					continue
 				}
 				model.ReturnOpenAIResponse(res_text, stream, gc)
@@ -369,21 +751,71 @@ func (c *Client) HandleResponse(body io.ReadCloser, stream bool, gc *gin.Context
 
 	}
 
-	if err := scanner.Err(); err != nil {
-		return fmt.Errorf("error reading response: %w", err)
+	readErr := scanner.Err()
+	if interrupted.Load() {
+		readErr = nil
+	}
+	if readErr != nil && stream {
+		return &StreamBrokenError{Err: readErr}
+	}
+	flushAnswer()
+	if readErr != nil {
+		if err := c.partialResult(gc, full_text.String(), timedOut.Load(), readErr); err != nil {
+			return err
+		}
+	}
+	if model.OutputEnded(gc) {
+		c.log().Info("Output limit reached, cancelling upstream request")
+	} else if readErr == nil && !final && !interrupted.Load() {
+		// 上游未发出 COMPLETED 就结束了响应，回答不完整
+		c.log().Error("Upstream response ended before the answer completed")
+		model.MarkPartial(gc, model.FinishError)
+	}
+	if interrupted.Load() {
+		c.log().Info("Ending stream early for shutdown")
+		notice := "\n\n> Server is restarting, this response was cut short.\n"
+		full_text.WriteString(notice)
+		if stream {
+			model.ReturnOpenAIResponse(notice, stream, gc)
+		}
+		model.SetFinishReason(gc, model.FinishLength)
+	}
+	c.Citations = citations
+	if c.ExtractClaims {
+		model.SetClaims(gc, claims.Extract(answer_text.String(), len(citations)), citations)
 	}
 
 	if !stream {
-		model.ReturnOpenAIResponse(full_text, stream, gc)
+		model.ReturnOpenAIMessage(full_text.String(), reasoning.Text(), gc)
 	} else {
 		// Send end marker for streaming mode
-		gc.Writer.Write([]byte("data: [DONE]\n\n"))
-		gc.Writer.Flush()
+		model.StreamDone(gc)
 	}
 
 	return nil
 }
 
+// partialResult decides whether a non-streamed answer whose upstream read
+// timed out or broke off is returned with what was received, per
+// NON_STREAM_PARTIAL, or fails. Nothing received always fails.
+func (c *Client) partialResult(gc *gin.Context, text string, timedOut bool, readErr error) error {
+	keep := text != "" && config.ConfigInstance.NonStreamPartial == config.PartialReturn
+	if timedOut {
+		if !keep {
+			return &TimeoutError{After: config.ConfigInstance.NonStreamTimeout}
+		}
+		c.log().Info(fmt.Sprintf("Upstream response didn't finish within %v, returning the partial answer", config.ConfigInstance.NonStreamTimeout))
+		model.MarkPartial(gc, model.FinishLength)
+		return nil
+	}
+	if !keep {
+		return fmt.Errorf("error reading response: %w", readErr)
+	}
+	c.log().Error(fmt.Sprintf("Upstream response broke off, returning the partial answer: %v", readErr))
+	model.MarkPartial(gc, model.FinishError)
+	return nil
+}
+
 // UploadURLResponse represents the response from the create_upload_url endpoint
 type UploadURLResponse struct {
 	S3BucketURL string               `json:"s3_bucket_url"`
@@ -413,56 +845,107 @@ type CloudinaryUploadInfo struct {
 }
 
 // UploadFile is a placeholder for file upload functionality
-func (c *Client) createUploadURL(filename string, contentType string) (*UploadURLResponse, error) {
+func (c *Client) createUploadURL(filename string, contentType string, fileSize int) (*UploadURLResponse, error) {
 	requestBody := map[string]interface{}{
 		"filename":     filename,
 		"content_type": contentType,
 		"source":       "default",
-		"file_size":    12000,
+		"file_size":    fileSize,
 		"force_image":  false,
 	}
 	resp, err := c.client.R().
 		SetBody(requestBody).
-		Post("https://www.perplexity.ai/rest/uploads/create_upload_url?version=2.18&source=default")
+		Post(c.endpoint(c.upstream.UploadPath + "?version=2.18&source=default"))
+	c.capture(resp, requestBody)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error creating upload URL: %v", err))
+		c.log().Error(fmt.Sprintf("Error creating upload URL: %v", err))
+		c.reportProxyFailure(err.Error())
 		return nil, err
 	}
+	if challenge := c.challengeOf(resp); challenge != nil {
+		c.reportProxyFailure("cloudflare challenge")
+		return nil, challenge
+	}
 	if resp.StatusCode != http.StatusOK {
-		logger.Error(fmt.Sprintf("Image Upload with status code %d: %s", resp.StatusCode, resp.String()))
+		c.log().Error(fmt.Sprintf("Image Upload with status code %d: %s", resp.StatusCode, resp.String()))
 		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 	var uploadURLResponse UploadURLResponse
-	logger.Info(fmt.Sprintf("Create upload with status code %d: %s", resp.StatusCode, resp.String()))
+	c.log().Info(fmt.Sprintf("Create upload with status code %d: %s", resp.StatusCode, resp.String()))
 	if err := json.Unmarshal(resp.Bytes(), &uploadURLResponse); err != nil {
-		logger.Error(fmt.Sprintf("Error unmarshalling upload URL response: %v", err))
+		c.log().Error(fmt.Sprintf("Error unmarshalling upload URL response: %v", err))
 		return nil, err
 	}
 	if uploadURLResponse.RateLimited {
-		logger.Error("Rate limit exceeded for upload URL")
+		c.log().Error("Rate limit exceeded for upload URL")
 		return nil, fmt.Errorf("rate limit exceeded")
 	}
 	return &uploadURLResponse, nil
 
 }
 
-func (c *Client) UploadImage(img_list []string) error {
-	logger.Info(fmt.Sprintf("Uploading %d images to Cloudinary", len(img_list)))
+// ImageData is a base64 encoded image to attach to the query
+type ImageData struct {
+	Base64   string
+	MimeType string
+}
+
+// imageExtensions 常见图片 MIME 类型对应的扩展名
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+func (c *Client) UploadImage(img_list []ImageData) error {
+	c.log().Info(fmt.Sprintf("Uploading %d images to Cloudinary", len(img_list)))
 
 	// Upload images to Cloudinary
 	for _, img := range img_list {
-		filename := utils.RandomString(5) + ".jpg"
+		mimeType := img.MimeType
+		ext, ok := imageExtensions[mimeType]
+		if !ok {
+			mimeType, ext = "image/jpeg", ".jpg"
+		}
+		filename := utils.RandomString(5) + ext
 		// Create upload URL
-		uploadURLResponse, err := c.createUploadURL(filename, "image/jpeg")
+		uploadURLResponse, err := c.createUploadURL(filename, mimeType, base64.StdEncoding.DecodedLen(len(img.Base64)))
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error creating upload URL: %v", err))
+			c.log().Error(fmt.Sprintf("Error creating upload URL: %v", err))
 			return err
 		}
-		logger.Info(fmt.Sprintf("Upload URL response: %v", uploadURLResponse))
+		c.log().Info(fmt.Sprintf("Upload URL response: %v", uploadURLResponse))
 		// Upload image to Cloudinary
-		err = c.UloadFileToCloudinary(uploadURLResponse.Fields, "img", img, filename)
+		err = c.UloadFileToCloudinary(uploadURLResponse.Fields, mimeType, img.Base64, filename)
 		if err != nil {
-			logger.Error(fmt.Sprintf("Error uploading image: %v", err))
+			c.log().Error(fmt.Sprintf("Error uploading image: %v", err))
+			return err
+		}
+	}
+	return nil
+}
+
+// FileData is a base64 encoded document to attach to the query
+type FileData struct {
+	Filename string
+	Base64   string
+	MimeType string
+}
+
+// UploadFile uploads documents (PDF, DOCX, CSV ...) and attaches them to the query
+func (c *Client) UploadFile(files []FileData) error {
+	c.log().Info(fmt.Sprintf("Uploading %d files to AWS", len(files)))
+	for _, file := range files {
+		uploadURLResponse, err := c.createUploadURL(file.Filename, file.MimeType, base64.StdEncoding.DecodedLen(len(file.Base64)))
+		if err != nil {
+			c.log().Error(fmt.Sprintf("Error creating upload URL: %v", err))
+			return err
+		}
+		c.log().Info(fmt.Sprintf("Upload URL response: %v", uploadURLResponse))
+		err = c.UloadFileToCloudinary(uploadURLResponse.Fields, file.MimeType, file.Base64, file.Filename)
+		if err != nil {
+			c.log().Error(fmt.Sprintf("Error uploading file: %v", err))
 			return err
 		}
 	}
@@ -472,12 +955,12 @@ func (c *Client) UploadImage(img_list []string) error {
 func (c *Client) UloadFileToCloudinary(uploadInfo CloudinaryUploadInfo, contentType string, filedata string, filename string) error {
 	// 更新为 AWS S3 上传
 	if len(filedata) > 100 {
-		logger.Info(fmt.Sprintf("filedata: %s ……", filedata[:50]))
+		c.log().Info(fmt.Sprintf("filedata: %s ……", filedata[:50]))
 	}
 	// Add form fields
-	logger.Info(fmt.Sprintf("Uploading file %s to Cloudinary", filename))
+	c.log().Info(fmt.Sprintf("Uploading file %s to Cloudinary", filename))
 	var formFields map[string]string
-	if contentType == "img" {
+	if strings.HasPrefix(contentType, "image/") {
 		formFields = map[string]string{
 			// "timestamp": fmt.Sprintf("%d", uploadInfo.Timestamp),
 			// "unique_filename":      uploadInfo.UniqueFilename,
@@ -497,12 +980,12 @@ func (c *Client) UloadFileToCloudinary(uploadInfo CloudinaryUploadInfo, contentT
 			"policy":               uploadInfo.Policy,
 			"x-amz-security-token": uploadInfo.Xamzsecuritytoken,
 			"acl":                  uploadInfo.ACL,
-			"Content-Type":         "image/jpeg", // Assuming image/jpeg for images
+			"Content-Type":         contentType,
 		}
 	} else {
 		formFields = map[string]string{
 			"acl":                  uploadInfo.ACL,
-			"Content-Type":         "text/plain",
+			"Content-Type":         contentType,
 			"tagging":              uploadInfo.Tagging,
 			"key":                  uploadInfo.Key,
 			"AWSAccessKeyId":       uploadInfo.AWSAccessKeyId,
@@ -515,7 +998,7 @@ func (c *Client) UloadFileToCloudinary(uploadInfo CloudinaryUploadInfo, contentT
 	writer := multipart.NewWriter(&requestBody)
 	for key, value := range formFields {
 		if err := writer.WriteField(key, value); err != nil {
-			logger.Error(fmt.Sprintf("Error writing form field %s: %v", key, err))
+			c.log().Error(fmt.Sprintf("Error writing form field %s: %v", key, err))
 			return err
 		}
 	}
@@ -523,25 +1006,25 @@ func (c *Client) UloadFileToCloudinary(uploadInfo CloudinaryUploadInfo, contentT
 	// Add the file,filedata 是base64编码的字符串
 	decodedData, err := base64.StdEncoding.DecodeString(filedata)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error decoding base64 data: %v", err))
+		c.log().Error(fmt.Sprintf("Error decoding base64 data: %v", err))
 		return err
 	}
 
 	// 创建一个文件部分
 	part, err := writer.CreateFormFile("file", filename) // 替换 filename.ext 为实际文件名
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error creating form file: %v", err))
+		c.log().Error(fmt.Sprintf("Error creating form file: %v", err))
 		return err
 	}
 
 	// 将解码后的数据写入文件部分
 	if _, err := part.Write(decodedData); err != nil {
-		logger.Error(fmt.Sprintf("Error writing file data: %v", err))
+		c.log().Error(fmt.Sprintf("Error writing file data: %v", err))
 		return err
 	}
 	// Close the writer to finalize the form
 	if err := writer.Close(); err != nil {
-		logger.Error(fmt.Sprintf("Error closing writer: %v", err))
+		c.log().Error(fmt.Sprintf("Error closing writer: %v", err))
 		return err
 	}
 
@@ -550,7 +1033,7 @@ func (c *Client) UloadFileToCloudinary(uploadInfo CloudinaryUploadInfo, contentT
 	// if contentType == "img" {
 	// 	uploadURL = fmt.Sprintf("https://api.cloudinary.com/v1_1/%s/image/upload", uploadInfo.CloudName)
 	// } else {
-	var uploadURL = "https://ppl-ai-file-upload.s3.amazonaws.com/"
+	var uploadURL = c.upstream.FileUploadURL
 	// }
 
 	resp, err := c.client.R().
@@ -559,10 +1042,10 @@ func (c *Client) UloadFileToCloudinary(uploadInfo CloudinaryUploadInfo, contentT
 		Post(uploadURL)
 
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error uploading file: %v", err))
+		c.log().Error(fmt.Sprintf("Error uploading file: %v", err))
 		return err
 	}
-	logger.Info(fmt.Sprintf("Image Upload with status code %d: %s", resp.StatusCode, resp.String()))
+	c.log().Info(fmt.Sprintf("Image Upload with status code %d: %s", resp.StatusCode, resp.String()))
 	// if contentType == "img" {
 	// 	var uploadResponse map[string]interface{}
 	// 	if err := json.Unmarshal(resp.Bytes(), &uploadResponse); err != nil {
@@ -572,41 +1055,69 @@ func (c *Client) UloadFileToCloudinary(uploadInfo CloudinaryUploadInfo, contentT
 	// 	imgUrl = "https://pplx-res.cloudinary.com/image/private" + imgUrl[strings.Index(imgUrl, "/user_uploads"):]
 	// 	c.Attachments = append(c.Attachments, imgUrl)
 	// } else {
-	c.Attachments = append(c.Attachments, "https://ppl-ai-file-upload.s3.amazonaws.com/"+uploadInfo.Key)
+	// 附件由 Perplexity 从存储中读取，引用始终使用存储的原始地址
+	c.Attachments = append(c.Attachments, config.DefaultFileUploadURL+uploadInfo.Key)
 	// }
 	return nil
 }
 
 // SetBigContext is a placeholder for setting context
 func (c *Client) UploadText(context string) error {
-	logger.Info("Uploading txt to AWS")
+	c.log().Info("Uploading txt to AWS")
 	filedata := base64.StdEncoding.EncodeToString([]byte(context))
 	filename := utils.RandomString(5) + ".txt"
 	// Upload images to Cloudinary
-	uploadURLResponse, err := c.createUploadURL(filename, "text/plain")
+	uploadURLResponse, err := c.createUploadURL(filename, "text/plain", len(context))
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error creating upload URL: %v", err))
+		c.log().Error(fmt.Sprintf("Error creating upload URL: %v", err))
 		return err
 	}
-	logger.Info(fmt.Sprintf("Upload URL response: %v", uploadURLResponse))
+	c.log().Info(fmt.Sprintf("Upload URL response: %v", uploadURLResponse))
 	// Upload txt to Cloudinary
-	err = c.UloadFileToCloudinary(uploadURLResponse.Fields, "txt", filedata, filename)
+	err = c.UloadFileToCloudinary(uploadURLResponse.Fields, "text/plain", filedata, filename)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error uploading image: %v", err))
+		c.log().Error(fmt.Sprintf("Error uploading image: %v", err))
 		return err
 	}
 
 	return nil
 }
 
+// DeleteThread deletes a Perplexity thread owned by the client's session
+func (c *Client) DeleteThread(ctx context.Context, t Thread) error {
+	requestBody := map[string]interface{}{
+		"entry_uuid":       t.BackendUUID,
+		"read_write_token": t.ReadWriteToken,
+	}
+	resp, err := c.client.R().
+		SetContext(ctx).
+		SetBody(requestBody).
+		Delete(c.endpoint("/rest/thread/delete_thread_by_entry_uuid?version=2.18&source=default"))
+	c.capture(resp, requestBody)
+	if err != nil {
+		c.log().Error(fmt.Sprintf("Error deleting thread: %v", err))
+		c.reportProxyFailure(err.Error())
+		return err
+	}
+	if challenge := c.challengeOf(resp); challenge != nil {
+		c.reportProxyFailure("cloudflare challenge")
+		return challenge
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.log().Error(fmt.Sprintf("Delete thread with status code %d: %s", resp.StatusCode, resp.String()))
+		return fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func (c *Client) GetNewCookie() (string, error) {
-	resp, err := c.client.R().Get("https://www.perplexity.ai/api/auth/session")
+	resp, err := c.client.R().Get(c.endpoint("/api/auth/session"))
 	if err != nil {
-		logger.Error(fmt.Sprintf("Error getting session cookie: %v", err))
+		c.log().Error(fmt.Sprintf("Error getting session cookie: %v", err))
 		return "", err
 	}
 	if resp.StatusCode != http.StatusOK {
-		logger.Error(fmt.Sprintf("Error getting session cookie: %s", resp.String()))
+		c.log().Error(fmt.Sprintf("Error getting session cookie: %s", resp.String()))
 		return "", fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 	for _, cookie := range resp.Cookies() {
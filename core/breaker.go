@@ -0,0 +1,129 @@
+package core
+
+import (
+	"fmt"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"pplx2api/notify"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+// CircuitOpenError is returned without contacting Perplexity while the
+// circuit breaker is open.
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("upstream unavailable, circuit breaker open (retry in %ds)", int(e.RetryAfter.Seconds())+1)
+}
+
+// breaker counts consecutive upstream failures across all sessions. It
+// opens after CIRCUIT_BREAKER_THRESHOLD of them, so an outage of Perplexity
+// itself fails fast instead of every request retrying through every session.
+// After CIRCUIT_BREAKER_COOLDOWN one probe request is let through; its
+// result closes the circuit or opens it again.
+type breaker struct {
+	mutex    sync.Mutex
+	failures int
+	state    string
+	openedAt time.Time
+	probing  bool
+}
+
+var upstreamBreaker = &breaker{state: BreakerClosed}
+
+// BreakerStatus is the circuit breaker state reported by the admin API
+type BreakerStatus struct {
+	State    string     `json:"state"`
+	Failures int        `json:"consecutive_failures"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// Breaker returns the current state of the upstream circuit breaker
+func Breaker() BreakerStatus {
+	b := upstreamBreaker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	status := BreakerStatus{State: b.state, Failures: b.failures}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// allow 判断是否可以发送请求，熔断冷却结束后只放行一个探测请求
+func (b *breaker) allow() error {
+	if config.ConfigInstance.BreakerThreshold <= 0 {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		wait := time.Until(b.openedAt.Add(config.ConfigInstance.BreakerCooldown))
+		if wait > 0 {
+			return &CircuitOpenError{RetryAfter: wait}
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		logger.Info("Circuit breaker half-open, sending probe request")
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return &CircuitOpenError{RetryAfter: time.Second}
+		}
+		b.probing = true
+	}
+	return nil
+}
+
+// success 上游有正常响应（包括限流等客户端错误）时关闭熔断
+func (b *breaker) success() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state != BreakerClosed {
+		logger.Info("Circuit breaker closed, upstream recovered")
+	}
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// failure 记录一次上游 5xx 或连接失败
+func (b *breaker) failure() {
+	threshold := config.ConfigInstance.BreakerThreshold
+	if threshold <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures++
+	b.probing = false
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= threshold) {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+		logger.Error(fmt.Sprintf("Circuit breaker open after %d consecutive upstream failures, failing fast for %v", b.failures, config.ConfigInstance.BreakerCooldown))
+		notify.Send(notify.Event{
+			Event:   notify.CircuitOpen,
+			Message: fmt.Sprintf("Upstream failed %d times in a row, requests fail fast for %v", b.failures, config.ConfigInstance.BreakerCooldown),
+			Data:    map[string]interface{}{"failures": b.failures, "cooldown_seconds": int(config.ConfigInstance.BreakerCooldown.Seconds())},
+		})
+	}
+}
+
+// release 探测请求未得到结果（如客户端取消）时允许下一个探测
+func (b *breaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.probing = false
+}
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imroc/req/v3"
+)
+
+// captureStringLimit 导出的请求体中单个字符串的最大长度，超出部分截断
+const captureStringLimit = 2000
+
+// UpstreamCall is a sanitized upstream request kept for debugging
+type UpstreamCall struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"headers"`
+	Body   string      `json:"body,omitempty"`
+	Status int         `json:"status"`
+	At     time.Time   `json:"at"`
+}
+
+// callLog keeps the upstream calls of the most recent request ids
+type callLog struct {
+	mutex sync.Mutex
+	calls map[string][]UpstreamCall
+	order []string
+}
+
+var upstreamCalls = &callLog{calls: map[string][]UpstreamCall{}}
+
+// UpstreamCalls returns the captured upstream calls of a request
+func UpstreamCalls(requestID string) []UpstreamCall {
+	upstreamCalls.mutex.Lock()
+	defer upstreamCalls.mutex.Unlock()
+	return append([]UpstreamCall(nil), upstreamCalls.calls[requestID]...)
+}
+
+// capture records the request behind resp when DEBUG_CAPTURE is set. The
+// session cookie, other credentials and the thread read_write_token are
+// replaced by placeholders, and the body is redacted like the logs.
+func (c *Client) capture(resp *req.Response, body interface{}) {
+	limit := config.ConfigInstance.DebugCapture
+	if limit <= 0 || c.RequestID == "" || resp == nil || resp.Request == nil || resp.Request.RawRequest == nil {
+		return
+	}
+	raw := resp.Request.RawRequest
+	call := UpstreamCall{
+		Method: raw.Method,
+		URL:    raw.URL.String(),
+		Header: sanitizeHeader(raw.Header),
+		At:     time.Now(),
+	}
+	if resp.Response != nil {
+		call.Status = resp.StatusCode
+	}
+	if body != nil {
+		if data, err := json.Marshal(truncateStrings(c.redactBody(body))); err == nil {
+			call.Body = string(data)
+		}
+	}
+	l := upstreamCalls
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, ok := l.calls[c.RequestID]; !ok {
+		l.order = append(l.order, c.RequestID)
+		for len(l.order) > limit {
+			delete(l.calls, l.order[0])
+			l.order = l.order[1:]
+		}
+	}
+	l.calls[c.RequestID] = append(l.calls[c.RequestID], call)
+}
+
+// sanitizeHeader 替换 cookie 与认证头，保留其余请求头
+func sanitizeHeader(header http.Header) http.Header {
+	out := http.Header{}
+	for name, values := range header {
+		switch http.CanonicalHeaderKey(name) {
+		case "Cookie":
+			out.Set(name, "__Secure-next-auth.session-token=$PPLX_SESSION")
+		case "Authorization", "Proxy-Authorization":
+			out.Set(name, "<redacted>")
+		default:
+			out[name] = append([]string(nil), values...)
+		}
+	}
+	return out
+}
+
+// secretFields 请求体中可用于读写会话的字段，输出前替换为占位符
+var secretFields = map[string]bool{"read_write_token": true}
+
+// redactBody 返回遮盖了个人信息与会话令牌的请求体副本，用于日志与调试抓包
+func (c *Client) redactBody(body interface{}) interface{} {
+	return maskSecretFields(c.Scrubber.Value(toJSONValue(body)))
+}
+
+// maskSecretFields 把 secretFields 中非空的字段替换为占位符
+func maskSecretFields(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, item := range t {
+			if s, ok := item.(string); ok && secretFields[k] && s != "" {
+				t[k] = "REDACTED"
+				continue
+			}
+			t[k] = maskSecretFields(item)
+		}
+	case []interface{}:
+		for i, item := range t {
+			t[i] = maskSecretFields(item)
+		}
+	}
+	return v
+}
+
+// toJSONValue 将请求体转换为通用 JSON 值
+func toJSONValue(body interface{}) interface{} {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil
+	}
+	var v interface{}
+	json.Unmarshal(data, &v)
+	return v
+}
+
+// truncateStrings 截断过长的字符串，保留请求体结构
+func truncateStrings(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		if len(t) > captureStringLimit {
+			return fmt.Sprintf("%s…(%d bytes truncated)", t[:captureStringLimit], len(t)-captureStringLimit)
+		}
+	case map[string]interface{}:
+		for k, item := range t {
+			t[k] = truncateStrings(item)
+		}
+	case []interface{}:
+		for i, item := range t {
+			t[i] = truncateStrings(item)
+		}
+	}
+	return v
+}
+
+// Curl returns the call as a curl command; set PPLX_SESSION to replay it
+func (u UpstreamCall) Curl() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "curl -X %s %s", u.Method, shellQuote(u.URL))
+	names := make([]string, 0, len(u.Header))
+	for name := range u.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range u.Header[name] {
+			if name == "Cookie" {
+				// 占位符需要由 shell 展开
+				fmt.Fprintf(&b, " \\\n  -H \"%s: %s\"", name, value)
+				continue
+			}
+			fmt.Fprintf(&b, " \\\n  -H %s", shellQuote(name+": "+value))
+		}
+	}
+	if u.Body != "" {
+		fmt.Fprintf(&b, " \\\n  --data-raw %s", shellQuote(u.Body))
+	}
+	return b.String()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
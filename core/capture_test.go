@@ -0,0 +1,43 @@
+package core
+
+import (
+	"encoding/json"
+	"pplx2api/redact"
+	"strings"
+	"testing"
+)
+
+func TestRedactBodyMasksTokenAndPrompt(t *testing.T) {
+	scrubber, err := redact.New([]string{redact.TypeEmail}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{Scrubber: scrubber}
+	body := PerplexityRequest{QueryStr: "write to bob@example.com"}
+	body.Params.ReadWriteToken = "rw-secret"
+	data, err := json.Marshal(c.redactBody(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := string(data)
+	for _, leaked := range []string{"rw-secret", "bob@example.com"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("redacted body still contains %q: %s", leaked, out)
+		}
+	}
+	if !strings.Contains(out, `"read_write_token":"REDACTED"`) {
+		t.Errorf("read_write_token not replaced by a placeholder: %s", out)
+	}
+	if body.Params.ReadWriteToken != "rw-secret" {
+		t.Error("redactBody modified the request body")
+	}
+}
+
+func TestRedactBodyWithoutScrubberKeepsPrompt(t *testing.T) {
+	c := &Client{}
+	body := PerplexityRequest{QueryStr: "write to bob@example.com"}
+	data, _ := json.Marshal(c.redactBody(body))
+	if !strings.Contains(string(data), "bob@example.com") {
+		t.Errorf("prompt changed without redaction: %s", data)
+	}
+}
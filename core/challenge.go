@@ -0,0 +1,94 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imroc/req/v3"
+)
+
+// ChallengeError is returned when Cloudflare answers with a challenge page
+// instead of the API, which depends on the egress IP rather than the session
+type ChallengeError struct {
+	Status int
+	// Proxy 发出请求使用的代理，直连时为空
+	Proxy string
+}
+
+func (e *ChallengeError) Error() string {
+	return fmt.Sprintf("cloudflare challenge (status %d)", e.Status)
+}
+
+// challengeMarkers 出现在 Cloudflare 验证页中的内容
+var challengeMarkers = [][]byte{
+	[]byte("cf-chl"),
+	[]byte("challenge-platform"),
+	[]byte("<title>Just a moment"),
+	[]byte("<title>Attention Required! | Cloudflare"),
+}
+
+// challengeOf returns a ChallengeError when resp is a Cloudflare challenge
+// or block page. HTML error pages are recognized by the Server header or
+// their content, so an interstitial isn't mistaken for a rejected cookie.
+func (c *Client) challengeOf(resp *req.Response) *ChallengeError {
+	if resp.Header.Get("cf-mitigated") == "challenge" {
+		return &ChallengeError{Status: resp.StatusCode, Proxy: c.proxy}
+	}
+	switch resp.StatusCode {
+	case http.StatusForbidden, http.StatusServiceUnavailable, http.StatusTooManyRequests:
+	default:
+		return nil
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		return nil
+	}
+	if resp.Header.Get("Server") == "cloudflare" {
+		return &ChallengeError{Status: resp.StatusCode, Proxy: c.proxy}
+	}
+	body, _ := resp.ToBytes()
+	for _, marker := range challengeMarkers {
+		if bytes.Contains(body, marker) {
+			return &ChallengeError{Status: resp.StatusCode, Proxy: c.proxy}
+		}
+	}
+	return nil
+}
+
+// Clearance is what a challenge solver obtained for one egress IP: the
+// cookies Cloudflare set, such as cf_clearance, and the User-Agent they are
+// bound to
+type Clearance struct {
+	Cookies   map[string]string
+	UserAgent string
+	Expires   time.Time
+}
+
+var (
+	// clearances 按代理保存的验证结果，直连时键为空字符串
+	clearances      = map[string]Clearance{}
+	clearancesMutex sync.Mutex
+)
+
+// SetClearance makes clients egressing through proxy send the cookies and
+// User-Agent of a solved challenge until it expires
+func SetClearance(proxy string, clearance Clearance) {
+	clearancesMutex.Lock()
+	defer clearancesMutex.Unlock()
+	clearances[proxy] = clearance
+}
+
+// clearanceFor 返回代理尚未过期的验证结果
+func clearanceFor(proxy string) (Clearance, bool) {
+	clearancesMutex.Lock()
+	defer clearancesMutex.Unlock()
+	clearance, ok := clearances[proxy]
+	if ok && !clearance.Expires.IsZero() && time.Now().After(clearance.Expires) {
+		delete(clearances, proxy)
+		return Clearance{}, false
+	}
+	return clearance, ok
+}
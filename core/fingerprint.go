@@ -0,0 +1,77 @@
+package core
+
+import (
+	"pplx2api/config"
+
+	"github.com/imroc/req/v3"
+	"github.com/imroc/req/v3/http2"
+)
+
+// NewSessionClient creates a client for a configured session, egressing
+// through its proxy to its upstream and presenting its fingerprint and
+// header profile
+func NewSessionClient(session config.SessionInfo, model string, openSerch bool) *Client {
+	cfg := config.ConfigInstance
+	client := newClient(session.SessionKey, cfg.ProxyFor(session), cfg.FingerprintFor(session), cfg.UpstreamFor(session), model, openSerch)
+	if profile, ok := cfg.HeaderProfileFor(session); ok {
+		client.useProfile(profile)
+	}
+	return client
+}
+
+// useProfile 发送 profile 中的 User-Agent 与请求头；验证服务返回的 User-Agent 优先
+func (c *Client) useProfile(profile config.HeaderProfile) {
+	for key, value := range profile.Headers {
+		c.client.SetCommonHeader(key, value)
+	}
+	if clearance, ok := clearanceFor(c.proxy); !ok || clearance.UserAgent == "" {
+		c.client.SetUserAgent(profile.UserAgent)
+	}
+}
+
+// impersonate 按指纹设置客户端模拟的浏览器，并替换其中单独配置的部分
+func impersonate(client *req.Client, fp config.Fingerprint) {
+	switch fp.Browser {
+	case config.BrowserFirefox:
+		client.ImpersonateFirefox()
+	case config.BrowserSafari:
+		client.ImpersonateSafari()
+	case config.BrowserNone:
+	default:
+		client.ImpersonateChrome()
+	}
+	switch fp.TLS {
+	case "chrome":
+		client.SetTLSFingerprintChrome()
+	case "firefox":
+		client.SetTLSFingerprintFirefox()
+	case "edge":
+		client.SetTLSFingerprintEdge()
+	case "safari":
+		client.SetTLSFingerprintSafari()
+	case "ios":
+		client.SetTLSFingerprintIOS()
+	case "android":
+		client.SetTLSFingerprintAndroid()
+	case "360":
+		client.SetTLSFingerprint360()
+	case "qq":
+		client.SetTLSFingerprintQQ()
+	case "randomized":
+		client.SetTLSFingerprintRandomized()
+	}
+	// 配置加载时已校验
+	if settings, _ := config.ParseHTTP2Settings(fp.HTTP2Settings); len(settings) > 0 {
+		frame := make([]http2.Setting, 0, len(settings))
+		for _, s := range settings {
+			frame = append(frame, http2.Setting{ID: http2.SettingID(s.ID), Val: s.Val})
+		}
+		client.SetHTTP2SettingsFrame(frame...)
+	}
+	if fp.HTTP2ConnectionFlow > 0 {
+		client.SetHTTP2ConnectionFlow(fp.HTTP2ConnectionFlow)
+	}
+	if len(fp.HeaderOrder) > 0 {
+		client.SetCommonHeaderOrder(fp.HeaderOrder...)
+	}
+}
@@ -0,0 +1,18 @@
+package core
+
+import (
+	"pplx2api/config"
+)
+
+// reportProxyFailure ejects the client's proxy from the pool after repeated failures
+func (c *Client) reportProxyFailure(reason string) {
+	if c.proxy != "" && config.ConfigInstance.ProxyPool != nil {
+		config.ConfigInstance.ProxyPool.ReportFailure(c.proxy, reason)
+	}
+}
+
+func (c *Client) reportProxySuccess() {
+	if c.proxy != "" && config.ConfigInstance.ProxyPool != nil {
+		config.ConfigInstance.ProxyPool.ReportSuccess(c.proxy)
+	}
+}
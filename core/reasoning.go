@@ -0,0 +1,72 @@
+package core
+
+import (
+	"pplx2api/config"
+	"pplx2api/model"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reasoningWriter routes the thinking of reasoning models according to
+// REASONING_OUTPUT: wrapped in think tags inside the answer, sent on the
+// reasoning_content channel, or dropped.
+type reasoningWriter struct {
+	mode   string
+	tag    string
+	stream bool
+	gc     *gin.Context
+	// open 正文中的思考标签尚未闭合，shown 思考部分已经结束
+	open  bool
+	shown bool
+	// text 非流式请求累积的推理内容
+	text strings.Builder
+}
+
+func newReasoningWriter(stream bool, gc *gin.Context) *reasoningWriter {
+	return &reasoningWriter{
+		mode:   config.ConfigInstance.ReasoningOutput,
+		tag:    config.ConfigInstance.ThinkTag,
+		stream: stream,
+		gc:     gc,
+	}
+}
+
+// Reasoning handles a piece of thinking and returns the text to add to
+// the answer, if any.
+func (w *reasoningWriter) Reasoning(text string) string {
+	switch w.mode {
+	case config.ReasoningStrip:
+		return ""
+	case config.ReasoningContent:
+		if text == "" {
+			return ""
+		}
+		if w.stream {
+			model.ReturnOpenAIReasoning(text, w.gc)
+		} else {
+			w.text.WriteString(text)
+		}
+		return ""
+	}
+	if !w.open && !w.shown {
+		w.open = true
+		return "<" + w.tag + ">" + text
+	}
+	return text
+}
+
+// AnswerStarts returns the closing tag when the answer follows thinking
+func (w *reasoningWriter) AnswerStarts() string {
+	if !w.open {
+		return ""
+	}
+	w.open = false
+	w.shown = true
+	return "</" + w.tag + ">\n\n"
+}
+
+// Text returns the reasoning collected for a non-streamed response
+func (w *reasoningWriter) Text() string {
+	return w.text.String()
+}
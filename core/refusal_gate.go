@@ -0,0 +1,73 @@
+package core
+
+import (
+	"pplx2api/config"
+	"pplx2api/model"
+	"pplx2api/refusal"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// refusalGate holds back the opening of the answer until it can tell
+// whether the model refused. A refusal is then written to the refusal
+// field rather than the content.
+type refusalGate struct {
+	enabled bool
+	stream  bool
+	gc      *gin.Context
+	held    strings.Builder
+	decided bool
+	kind    string
+}
+
+func newRefusalGate(enabled bool, stream bool, gc *gin.Context) *refusalGate {
+	return &refusalGate{enabled: enabled, stream: stream, gc: gc}
+}
+
+// Answer takes answer text and returns the part to write as content now
+func (g *refusalGate) Answer(text string) string {
+	if !g.enabled {
+		return text
+	}
+	if g.decided {
+		if g.kind != "" {
+			model.ReturnOpenAIRefusal(text, g.stream, g.gc)
+			return ""
+		}
+		return text
+	}
+	g.held.WriteString(text)
+	if g.held.Len() < refusal.Window {
+		return ""
+	}
+	return g.decide()
+}
+
+// Flush decides on what is still held back, at the end of the answer
+func (g *refusalGate) Flush() string {
+	if !g.enabled || g.decided {
+		return ""
+	}
+	return g.decide()
+}
+
+func (g *refusalGate) decide() string {
+	g.decided = true
+	held := g.held.String()
+	g.held.Reset()
+	g.kind = refusal.Detect(held)
+	if g.kind == "" {
+		return held
+	}
+	if g.kind == refusal.KindContentFilter {
+		model.SetFinishReason(g.gc, model.FinishContentFilter)
+	}
+	model.ReturnOpenAIRefusal(held, g.stream, g.gc)
+	return ""
+}
+
+// refusalSignaling reports whether refusals are detected for this client
+func (c *Client) refusalSignaling() bool {
+	return config.ConfigInstance.RefusalSignaling && !c.RawOutput
+}
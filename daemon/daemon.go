@@ -0,0 +1,164 @@
+// Package daemon installs pplx2api as a managed background service: a
+// systemd unit on Linux, a launchd job on macOS and a Windows service.
+//
+//	pplx2api service install   [-name NAME] [-system SYSTEM] [-log FILE]
+//	pplx2api service uninstall [-name NAME] [-system SYSTEM]
+//	pplx2api service print     [-name NAME] [-system SYSTEM] [-log FILE] [-o FILE]
+//	pplx2api service run       [-name NAME] [-dir DIR] [-log FILE]
+//
+// The service runs `pplx2api service run` from the directory install was
+// called in, so the .env file and relative paths there keep working.
+package daemon
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Supported service managers
+const (
+	SystemSystemd = "systemd"
+	SystemLaunchd = "launchd"
+	SystemWindows = "windows"
+)
+
+// Options describe the service to install or run
+type Options struct {
+	Name string
+	// Executable 服务启动的程序路径，Dir 为工作目录
+	Executable string
+	Dir        string
+	// Log 日志文件，为空时使用服务管理器的默认日志
+	Log string
+}
+
+// runArgs 服务管理器启动程序时使用的参数；systemd 与 launchd 自行重定向输出，
+// 不需要传入日志文件
+func (o Options) runArgs() []string {
+	return []string{"service", "run", "-name", o.Name, "-dir", o.Dir}
+}
+
+// defaultSystem 当前平台的服务管理器
+func defaultSystem() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return SystemLaunchd
+	case "windows":
+		return SystemWindows
+	}
+	return SystemSystemd
+}
+
+// Main implements the `pplx2api service` subcommand. serve runs the proxy
+// until its context is cancelled.
+func Main(args []string, serve func(ctx context.Context)) int {
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	name := fs.String("name", "pplx2api", "service name")
+	system := fs.String("system", defaultSystem(), "service manager: systemd, launchd or windows")
+	dir := fs.String("dir", "", "working directory, defaults to the current directory")
+	logFile := fs.String("log", "", "log file, defaults to the service manager's log")
+	out := fs.String("o", "", "print: write the unit file to this file instead of stdout")
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: pplx2api service install|uninstall|print|run [-name NAME] [-system SYSTEM] [-dir DIR] [-log FILE]")
+		return 2
+	}
+	command := args[0]
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	opts, err := resolveOptions(*name, *dir, *logFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	switch command {
+	case "run":
+		err = run(opts, serve)
+	case "print":
+		var text string
+		if text, err = render(*system, opts); err == nil {
+			if *out != "" {
+				err = os.WriteFile(*out, []byte(text), 0644)
+			} else {
+				fmt.Print(text)
+			}
+		}
+	case "install":
+		err = install(*system, opts)
+	case "uninstall":
+		err = uninstall(*system, opts)
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func resolveOptions(name string, dir string, logFile string) (Options, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return Options{}, fmt.Errorf("locate executable: %w", err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return Options{}, fmt.Errorf("locate executable: %w", err)
+	}
+	if dir == "" {
+		if dir, err = os.Getwd(); err != nil {
+			return Options{}, err
+		}
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return Options{}, err
+	}
+	if logFile != "" {
+		if logFile, err = filepath.Abs(logFile); err != nil {
+			return Options{}, err
+		}
+	}
+	return Options{Name: name, Executable: exe, Dir: dir, Log: logFile}, nil
+}
+
+// render 返回服务管理器的配置文件内容；Windows 服务没有配置文件
+func render(system string, opts Options) (string, error) {
+	switch system {
+	case SystemSystemd:
+		return systemdUnit(opts), nil
+	case SystemLaunchd:
+		return launchdPlist(opts), nil
+	case SystemWindows:
+		return "", fmt.Errorf("windows services have no unit file, use install")
+	}
+	return "", fmt.Errorf("unknown service manager %q, use systemd, launchd or windows", system)
+}
+
+func install(system string, opts Options) error {
+	switch system {
+	case SystemSystemd:
+		return installSystemd(opts)
+	case SystemLaunchd:
+		return installLaunchd(opts)
+	case SystemWindows:
+		return installWindows(opts)
+	}
+	return fmt.Errorf("unknown service manager %q, use systemd, launchd or windows", system)
+}
+
+func uninstall(system string, opts Options) error {
+	switch system {
+	case SystemSystemd:
+		return uninstallSystemd(opts)
+	case SystemLaunchd:
+		return uninstallLaunchd(opts)
+	case SystemWindows:
+		return uninstallWindows(opts)
+	}
+	return fmt.Errorf("unknown service manager %q, use systemd, launchd or windows", system)
+}
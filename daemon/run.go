@@ -0,0 +1,35 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"pplx2api/config"
+	"pplx2api/logger"
+
+	"github.com/gin-gonic/gin"
+	"github.com/joho/godotenv"
+)
+
+// run serves in the service's working directory, routing logs to the log
+// file when one is set.
+func run(opts Options, serve func(ctx context.Context)) error {
+	if cwd, _ := os.Getwd(); cwd != opts.Dir {
+		// 配置在启动时按当前目录加载，切换目录后重新加载 .env 与配置
+		if err := os.Chdir(opts.Dir); err != nil {
+			return err
+		}
+		_ = godotenv.Load()
+		config.ConfigInstance = config.LoadConfig()
+	}
+	if opts.Log != "" {
+		f, err := os.OpenFile(opts.Log, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("open log file: %w", err)
+		}
+		defer f.Close()
+		logger.SetOutput(f)
+		gin.DefaultWriter, gin.DefaultErrorWriter = f, f
+	}
+	return runService(opts, serve)
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package daemon
+
+import (
+	"context"
+	"errors"
+	"os/signal"
+	"syscall"
+)
+
+var errNotWindows = errors.New("windows services can only be managed on Windows")
+
+// runService 在前台运行，由 systemd 或 launchd 通过 SIGTERM 停止
+func runService(opts Options, serve func(ctx context.Context)) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	serve(ctx)
+	return nil
+}
+
+func installWindows(opts Options) error {
+	return errNotWindows
+}
+
+func uninstallWindows(opts Options) error {
+	return errNotWindows
+}
@@ -0,0 +1,118 @@
+//go:build windows
+
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"os/signal"
+	"pplx2api/logger"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// handler reports the service state to the service control manager and
+// cancels serve when it asks the service to stop.
+type handler struct {
+	serve func(ctx context.Context)
+}
+
+func (h *handler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.serve(ctx)
+		close(done)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-done:
+			cancel()
+			return false, 0
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				logger.Info("Service stop requested")
+				status <- svc.Status{State: svc.StopPending}
+				cancel()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// runService 由服务控制管理器启动时以服务方式运行，否则在前台运行
+func runService(opts Options, serve func(ctx context.Context)) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+		serve(ctx)
+		return nil
+	}
+	return svc.Run(opts.Name, &handler{serve: serve})
+}
+
+func installWindows(opts Options) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(opts.Name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", opts.Name)
+	}
+	args := opts.runArgs()
+	if opts.Log != "" {
+		// 服务没有控制台，日志需要写入文件
+		args = append(args, "-log", opts.Log)
+	}
+	s, err := m.CreateService(opts.Name, opts.Executable, mgr.Config{
+		DisplayName: opts.Name,
+		Description: "pplx2api Perplexity to OpenAI proxy",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("create service: %w", err)
+	}
+	defer s.Close()
+	// 异常退出后自动重启
+	s.SetRecoveryActions([]mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 5 * time.Second}}, 86400)
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("start service: %w", err)
+	}
+	fmt.Printf("Installed and started service %s\n", opts.Name)
+	return nil
+}
+
+func uninstallWindows(opts Options) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(opts.Name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", opts.Name)
+	}
+	defer s.Close()
+	// 服务可能已停止，忽略错误
+	s.Control(svc.Stop)
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("delete service: %w", err)
+	}
+	fmt.Printf("Removed service %s\n", opts.Name)
+	return nil
+}
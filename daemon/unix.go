@@ -0,0 +1,150 @@
+package daemon
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// systemdUnit returns a unit running the proxy with restart on failure.
+// Without -log the output goes to the journal.
+func systemdUnit(opts Options) string {
+	var b strings.Builder
+	b.WriteString("[Unit]\n")
+	b.WriteString("Description=pplx2api Perplexity to OpenAI proxy\n")
+	b.WriteString("After=network-online.target\n")
+	b.WriteString("Wants=network-online.target\n\n")
+	b.WriteString("[Service]\n")
+	b.WriteString("Type=simple\n")
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", opts.Dir)
+	fmt.Fprintf(&b, "ExecStart=%s %s\n", systemdQuote(opts.Executable), strings.Join(mapStrings(opts.runArgs(), systemdQuote), " "))
+	b.WriteString("Restart=on-failure\n")
+	b.WriteString("RestartSec=5\n")
+	// 停机时等待进行中的请求完成
+	b.WriteString("KillSignal=SIGTERM\n")
+	b.WriteString("TimeoutStopSec=120\n")
+	if opts.Log != "" {
+		fmt.Fprintf(&b, "StandardOutput=append:%s\n", opts.Log)
+		fmt.Fprintf(&b, "StandardError=append:%s\n", opts.Log)
+	}
+	b.WriteString("\n[Install]\n")
+	b.WriteString("WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+func systemdQuote(s string) string {
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func systemdPath(opts Options) string {
+	return filepath.Join("/etc/systemd/system", opts.Name+".service")
+}
+
+func installSystemd(opts Options) error {
+	path := systemdPath(opts)
+	if err := os.WriteFile(path, []byte(systemdUnit(opts)), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	fmt.Printf("Wrote %s\n", path)
+	if err := runCommand("systemctl", "daemon-reload"); err != nil {
+		return err
+	}
+	return runCommand("systemctl", "enable", "--now", opts.Name)
+}
+
+func uninstallSystemd(opts Options) error {
+	// 服务可能已停止，忽略错误
+	runCommand("systemctl", "disable", "--now", opts.Name)
+	if err := os.Remove(systemdPath(opts)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return runCommand("systemctl", "daemon-reload")
+}
+
+// launchdLabel 反向域名形式的 launchd 任务名
+func launchdLabel(opts Options) string {
+	return "com.github.miraserver." + opts.Name
+}
+
+// launchdPlist returns a job that starts at load and is restarted when it
+// exits. Without -log the output goes to ~/Library/Logs.
+func launchdPlist(opts Options) string {
+	logFile := opts.Log
+	if logFile == "" {
+		home, _ := os.UserHomeDir()
+		logFile = filepath.Join(home, "Library", "Logs", opts.Name+".log")
+	}
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	b.WriteString(`<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">` + "\n")
+	b.WriteString(`<plist version="1.0">` + "\n<dict>\n")
+	fmt.Fprintf(&b, "\t<key>Label</key>\n\t<string>%s</string>\n", xmlEscape(launchdLabel(opts)))
+	b.WriteString("\t<key>ProgramArguments</key>\n\t<array>\n")
+	for _, arg := range append([]string{opts.Executable}, opts.runArgs()...) {
+		fmt.Fprintf(&b, "\t\t<string>%s</string>\n", xmlEscape(arg))
+	}
+	b.WriteString("\t</array>\n")
+	fmt.Fprintf(&b, "\t<key>WorkingDirectory</key>\n\t<string>%s</string>\n", xmlEscape(opts.Dir))
+	b.WriteString("\t<key>RunAtLoad</key>\n\t<true/>\n")
+	b.WriteString("\t<key>KeepAlive</key>\n\t<dict>\n\t\t<key>SuccessfulExit</key>\n\t\t<false/>\n\t</dict>\n")
+	fmt.Fprintf(&b, "\t<key>StandardOutPath</key>\n\t<string>%s</string>\n", xmlEscape(logFile))
+	fmt.Fprintf(&b, "\t<key>StandardErrorPath</key>\n\t<string>%s</string>\n", xmlEscape(logFile))
+	b.WriteString("</dict>\n</plist>\n")
+	return b.String()
+}
+
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// launchdPath root 安装为系统守护进程，否则安装为当前用户的代理
+func launchdPath(opts Options) string {
+	if os.Geteuid() == 0 {
+		return filepath.Join("/Library/LaunchDaemons", launchdLabel(opts)+".plist")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, "Library", "LaunchAgents", launchdLabel(opts)+".plist")
+}
+
+func installLaunchd(opts Options) error {
+	path := launchdPath(opts)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(launchdPlist(opts)), 0644); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	fmt.Printf("Wrote %s\n", path)
+	return runCommand("launchctl", "load", "-w", path)
+}
+
+func uninstallLaunchd(opts Options) error {
+	path := launchdPath(opts)
+	runCommand("launchctl", "unload", "-w", path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func runCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+func mapStrings(items []string, f func(string) string) []string {
+	out := make([]string, len(items))
+	for i, item := range items {
+		out[i] = f(item)
+	}
+	return out
+}
@@ -0,0 +1,44 @@
+package golden
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// DefaultDir is where the repository keeps its upstream fixtures
+const DefaultDir = "testdata/golden"
+
+// Main implements the `pplx2api golden` subcommand:
+//
+//	pplx2api golden record NAME FILE  sanitize a captured upstream stream into a new fixture
+//
+// Fixtures are replayed and their golden files written by the package
+// tests: go test ./golden [-update]
+func Main(args []string) int {
+	fs := flag.NewFlagSet("golden", flag.ContinueOnError)
+	dir := fs.String("dir", DefaultDir, "fixture directory")
+	if len(args) == 0 || args[0] != "record" {
+		fmt.Fprintln(os.Stderr, "usage: pplx2api golden record [-dir DIR] NAME FILE")
+		fmt.Fprintln(os.Stderr, "verify or regenerate fixtures with: go test ./golden [-update]")
+		return 2
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if fs.NArg() != 2 {
+		fmt.Fprintln(os.Stderr, "usage: pplx2api golden record [-dir DIR] NAME FILE")
+		return 2
+	}
+	raw, err := os.ReadFile(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := Record(*dir, fs.Arg(0), raw); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("recorded %s, generate its golden files with: go test ./golden -update\n", fs.Arg(0))
+	return 0
+}
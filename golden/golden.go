@@ -0,0 +1,154 @@
+// Package golden manages recorded upstream SSE streams that the package
+// tests replay through the response parser, comparing the translated
+// output with stored golden files.
+//
+// A fixture directory holds, per fixture, the sanitized upstream stream
+// <name>.sse, the expected stream output <name>.stream.golden, the expected
+// non-stream output <name>.golden and an entry in checksums.json. The
+// checksum pins the recorded input so a fixture can't silently drift from
+// what the expected output was generated from. Golden files are written by
+// `go test ./golden -update`, which keeps the replay code and its test
+// dependencies out of the server binary.
+package golden
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ChecksumFile is the name of the checksum manifest inside a fixture directory
+const ChecksumFile = "checksums.json"
+
+// Fixture is one recorded upstream stream
+type Fixture struct {
+	Name           string
+	Input          []byte
+	Expected       string
+	ExpectedStream string
+}
+
+var sanitizers = []struct {
+	pattern *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`), "00000000-0000-0000-0000-000000000000"},
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "user@example.com"},
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]{10,}(\.[A-Za-z0-9_.-]+)*`), "SESSION_TOKEN"},
+	{regexp.MustCompile(`("(?:backend_uuid|context_uuid|thread_url_slug|user_id|uuid)"\s*:\s*)"[^"]*"`), `$1"REDACTED"`},
+}
+
+// Sanitize removes ids, e-mail addresses and session tokens from a captured stream
+func Sanitize(raw []byte) []byte {
+	for _, s := range sanitizers {
+		raw = s.pattern.ReplaceAll(raw, []byte(s.replace))
+	}
+	return raw
+}
+
+// Checksum returns the hex sha256 of a fixture input
+func Checksum(input []byte) string {
+	sum := sha256.Sum256(input)
+	return hex.EncodeToString(sum[:])
+}
+
+func readChecksums(dir string) (map[string]string, error) {
+	checksums := map[string]string{}
+	data, err := os.ReadFile(filepath.Join(dir, ChecksumFile))
+	if os.IsNotExist(err) {
+		return checksums, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &checksums); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", ChecksumFile, err)
+	}
+	return checksums, nil
+}
+
+func writeChecksums(dir string, checksums map[string]string) error {
+	data, err := json.MarshalIndent(checksums, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ChecksumFile), append(data, '\n'), 0644)
+}
+
+// Load reads all fixtures of dir and verifies their checksums. Golden files
+// not generated yet are read as empty.
+func Load(dir string) ([]Fixture, error) {
+	checksums, err := readChecksums(dir)
+	if err != nil {
+		return nil, err
+	}
+	inputs, err := filepath.Glob(filepath.Join(dir, "*.sse"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(inputs)
+	var fixtures []Fixture
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".sse")
+		data, err := os.ReadFile(input)
+		if err != nil {
+			return nil, err
+		}
+		want, ok := checksums[name]
+		if !ok {
+			return nil, fmt.Errorf("fixture %s has no checksum, record it with `pplx2api golden record`", name)
+		}
+		if got := Checksum(data); got != want {
+			return nil, fmt.Errorf("fixture %s checksum mismatch: got %s, want %s", name, got, want)
+		}
+		expected, err := readGolden(filepath.Join(dir, name+".golden"))
+		if err != nil {
+			return nil, err
+		}
+		expectedStream, err := readGolden(filepath.Join(dir, name+".stream.golden"))
+		if err != nil {
+			return nil, err
+		}
+		fixtures = append(fixtures, Fixture{
+			Name:           name,
+			Input:          data,
+			Expected:       string(expected),
+			ExpectedStream: string(expectedStream),
+		})
+	}
+	return fixtures, nil
+}
+
+// readGolden 读取 golden 文件，尚未生成时返回空
+func readGolden(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Record sanitizes a captured upstream stream and stores it as fixture
+// name with its checksum. Its golden files are generated by running the
+// package tests with -update.
+func Record(dir string, name string, raw []byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	input := Sanitize(raw)
+	if err := os.WriteFile(filepath.Join(dir, name+".sse"), input, 0644); err != nil {
+		return err
+	}
+	checksums, err := readChecksums(dir)
+	if err != nil {
+		return err
+	}
+	checksums[name] = Checksum(input)
+	return writeChecksums(dir, checksums)
+}
@@ -0,0 +1,28 @@
+package golden
+
+import (
+	"flag"
+	"testing"
+)
+
+// update regenerates the golden files after an intended change of the
+// translation output: go test ./golden -update
+var update = flag.Bool("update", false, "regenerate golden files")
+
+// fixtureDir is the repository's fixture directory, relative to this package
+const fixtureDir = "../testdata/golden"
+
+func TestGolden(t *testing.T) {
+	if *update {
+		if err := Update(fixtureDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mismatches, err := Verify(fixtureDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range mismatches {
+		t.Errorf("%s (stream=%t) changed, run go test ./golden -update if intended\nexpected:\n%s\nactual:\n%s", m.Name, m.Stream, m.Expected, m.Actual)
+	}
+}
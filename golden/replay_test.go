@@ -0,0 +1,166 @@
+package golden
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"pplx2api/config"
+	"pplx2api/core"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// replayModel is the model preference fixtures are replayed with
+const replayModel = "claude45sonnet"
+
+// Mismatch describes a fixture whose replay differs from its golden file
+type Mismatch struct {
+	Name     string
+	Stream   bool
+	Expected string
+	Actual   string
+}
+
+// Replay runs input through core's response handler and returns the
+// assistant text the client would have received.
+func Replay(input []byte, stream bool) (string, error) {
+	defer pinConfig()()
+	gin.SetMode(gin.ReleaseMode)
+	recorder := httptest.NewRecorder()
+	gc, _ := gin.CreateTestContext(recorder)
+	gc.Request = httptest.NewRequest("POST", "/v1/chat/completions", nil)
+
+	client := core.NewClient("", "", replayModel, false)
+	if err := client.HandleResponse(io.NopCloser(bytes.NewReader(input)), stream, gc); err != nil {
+		return "", err
+	}
+	return extractContent(recorder.Body.Bytes(), stream)
+}
+
+// pinConfig 固定影响输出格式的配置，使回放结果不受环境变量影响，返回恢复函数
+func pinConfig() func() {
+	cfg := config.ConfigInstance
+	ignoreSearch, ignoreMonitoring, compatible := cfg.IgnoreSerchResult, cfg.IgnoreModelMonitoring, cfg.SearchResultCompatible
+	cfg.IgnoreSerchResult = false
+	cfg.IgnoreModelMonitoring = false
+	cfg.SearchResultCompatible = false
+	return func() {
+		cfg.IgnoreSerchResult = ignoreSearch
+		cfg.IgnoreModelMonitoring = ignoreMonitoring
+		cfg.SearchResultCompatible = compatible
+	}
+}
+
+// extractContent 去掉随机的 id 与时间戳，只保留模型输出内容
+func extractContent(body []byte, stream bool) (string, error) {
+	if !stream {
+		var resp struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return "", fmt.Errorf("parse response: %w", err)
+		}
+		if len(resp.Choices) == 0 {
+			return "", fmt.Errorf("response has no choices")
+		}
+		return resp.Choices[0].Message.Content, nil
+	}
+	var out strings.Builder
+	for _, line := range strings.Split(string(body), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			out.WriteString("\n[DONE]\n")
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", fmt.Errorf("parse chunk: %w", err)
+		}
+		for _, choice := range chunk.Choices {
+			// 每个 delta 单独一行，便于在 diff 中看出分块变化；结束块带上 finish_reason
+			out.WriteString(fmt.Sprintf("%q", choice.Delta.Content))
+			if choice.FinishReason != nil {
+				out.WriteString(" finish_reason=" + *choice.FinishReason)
+			}
+			out.WriteString("\n")
+		}
+	}
+	return out.String(), nil
+}
+
+// Verify replays every fixture of dir and returns the ones that changed
+func Verify(dir string) ([]Mismatch, error) {
+	fixtures, err := Load(dir)
+	if err != nil {
+		return nil, err
+	}
+	var mismatches []Mismatch
+	for _, f := range fixtures {
+		for _, stream := range []bool{false, true} {
+			actual, err := Replay(f.Input, stream)
+			if err != nil {
+				return nil, fmt.Errorf("replay %s: %w", f.Name, err)
+			}
+			expected := f.Expected
+			if stream {
+				expected = f.ExpectedStream
+			}
+			if actual != expected {
+				mismatches = append(mismatches, Mismatch{Name: f.Name, Stream: stream, Expected: expected, Actual: actual})
+			}
+		}
+	}
+	return mismatches, nil
+}
+
+// Update regenerates the golden files of all fixtures after an intended
+// change of the translation output. Inputs must still match their checksums.
+func Update(dir string) error {
+	fixtures, err := Load(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range fixtures {
+		if err := regenerate(dir, f.Name, f.Input); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// regenerate 回放 input 并写入 name 的两个 golden 文件
+func regenerate(dir string, name string, input []byte) error {
+	for _, stream := range []bool{false, true} {
+		out, err := Replay(input, stream)
+		if err != nil {
+			return fmt.Errorf("replay %s: %w", name, err)
+		}
+		path := filepath.Join(dir, name+".golden")
+		if stream {
+			path = filepath.Join(dir, name+".stream.golden")
+		}
+		if err := os.WriteFile(path, []byte(out), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
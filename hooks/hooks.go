@@ -0,0 +1,210 @@
+// Package hooks lets custom code observe and change chat completions
+// without forking the service package: filtering or rejecting requests,
+// rewriting the prompt sent upstream, editing the streamed output and
+// logging the outcome.
+//
+// Hooks are registered in code with Register, or built as Go plugins and
+// listed in HOOK_PLUGINS. A plugin is a main package built with
+// -buildmode=plugin that exports a variable named Hook implementing Hook;
+// it must be built with the same Go version and dependencies as the
+// server, and the server itself needs cgo to load it.
+package hooks
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"plugin"
+	"pplx2api/logger"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hook is called at each step of a chat completion. Embed Base to only
+// implement the methods a hook needs.
+type Hook interface {
+	// OnRequest runs after the request was parsed and validated. It may
+	// change the messages; returning an error rejects the request.
+	OnRequest(req *Request) error
+	// OnPromptBuilt may rewrite the prompt sent upstream
+	OnPromptBuilt(req *Request, prompt string) (string, error)
+	// OnDelta may rewrite each piece of output text before it is sent
+	OnDelta(req *Request, text string) string
+	// OnComplete runs after the response was sent, with the full output
+	OnComplete(req *Request, output string)
+	// OnError runs when the request failed after OnRequest
+	OnError(req *Request, err error)
+}
+
+// Base implements every Hook method as a no-op
+type Base struct{}
+
+func (Base) OnRequest(req *Request) error { return nil }
+
+func (Base) OnPromptBuilt(req *Request, prompt string) (string, error) { return prompt, nil }
+
+func (Base) OnDelta(req *Request, text string) string { return text }
+
+func (Base) OnComplete(req *Request, output string) {}
+
+func (Base) OnError(req *Request, err error) {}
+
+// Request is the view of one chat completion passed to the hooks
+type Request struct {
+	Context *gin.Context
+	// Key 发起请求的 API key 名称
+	Key   string
+	Model string
+	// Messages 客户端发送的消息，OnRequest 中可以修改
+	Messages []map[string]interface{}
+	Stream   bool
+}
+
+// RejectError rejects a request from OnRequest or OnPromptBuilt with the
+// given HTTP status; other errors are reported as internal errors.
+type RejectError struct {
+	Status int
+	// Code 返回给客户端的错误码，为空时按状态码给出
+	Code    string
+	Message string
+}
+
+func (e *RejectError) Error() string {
+	return e.Message
+}
+
+// Reject returns a RejectError with a formatted message
+func Reject(status int, format string, args ...interface{}) error {
+	return &RejectError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// RejectWithCode returns a RejectError with a machine-readable code
+func RejectWithCode(status int, code string, format string, args ...interface{}) error {
+	return &RejectError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+type namedHook struct {
+	name string
+	hook Hook
+}
+
+var (
+	registered []namedHook
+	mutex      sync.RWMutex
+)
+
+// Register adds a hook; hooks run in the order they were registered
+func Register(name string, hook Hook) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	registered = append(registered, namedHook{name, hook})
+	logger.Info(fmt.Sprintf("Registered hook %s", name))
+}
+
+// Enabled reports whether any hook is registered
+func Enabled() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return len(registered) > 0
+}
+
+func all() []namedHook {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return registered
+}
+
+// LoadPlugins opens the Go plugins at paths and registers the Hook each
+// one exports. Plugins that fail to load are logged and skipped. Builds
+// without cgo, such as the Docker image, can't load plugins at all; the
+// configured plugins are then reported as an error instead.
+func LoadPlugins(paths []string) {
+	if len(paths) > 0 && !pluginsSupported {
+		logger.Error(fmt.Sprintf("HOOK_PLUGINS is set but this build can't load Go plugins (it needs cgo on Linux, macOS or FreeBSD), %d hook plugins not loaded: %s", len(paths), strings.Join(paths, ", ")))
+		return
+	}
+	for _, path := range paths {
+		hook, err := loadPlugin(path)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to load hook plugin %s: %v", path, err))
+			continue
+		}
+		Register(strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)), hook)
+	}
+}
+
+func loadPlugin(path string) (Hook, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup("Hook")
+	if err != nil {
+		return nil, err
+	}
+	// var Hook hooks.Hook = ... 查找到的是接口的指针
+	if h, ok := sym.(*Hook); ok && *h != nil {
+		return *h, nil
+	}
+	if h, ok := sym.(Hook); ok {
+		return h, nil
+	}
+	return nil, errors.New("exported Hook does not implement hooks.Hook")
+}
+
+// OnRequest runs the OnRequest hooks, stopping at the first error
+func OnRequest(req *Request) error {
+	for _, h := range all() {
+		if err := h.hook.OnRequest(req); err != nil {
+			return wrap(h.name, err)
+		}
+	}
+	return nil
+}
+
+// OnPromptBuilt passes the prompt through every OnPromptBuilt hook
+func OnPromptBuilt(req *Request, prompt string) (string, error) {
+	for _, h := range all() {
+		var err error
+		if prompt, err = h.hook.OnPromptBuilt(req, prompt); err != nil {
+			return "", wrap(h.name, err)
+		}
+	}
+	return prompt, nil
+}
+
+// Filter passes output text through every OnDelta hook, so a Request can
+// be attached to the response as an output filter.
+func (req *Request) Filter(text string) string {
+	for _, h := range all() {
+		if text = h.hook.OnDelta(req, text); text == "" {
+			return ""
+		}
+	}
+	return text
+}
+
+// OnComplete runs the OnComplete hooks
+func OnComplete(req *Request, output string) {
+	for _, h := range all() {
+		h.hook.OnComplete(req, output)
+	}
+}
+
+// OnError runs the OnError hooks
+func OnError(req *Request, err error) {
+	for _, h := range all() {
+		h.hook.OnError(req, err)
+	}
+}
+
+// wrap 为普通错误带上钩子名，RejectError 原样返回给客户端
+func wrap(name string, err error) error {
+	var reject *RejectError
+	if errors.As(err, &reject) {
+		return err
+	}
+	return fmt.Errorf("hook %s: %w", name, err)
+}
@@ -0,0 +1,6 @@
+//go:build !cgo || !(linux || darwin || freebsd)
+
+package hooks
+
+// pluginsSupported 当前构建能否加载 Go 插件：插件需要 cgo，且只支持 Linux、macOS 与 FreeBSD
+const pluginsSupported = false
@@ -0,0 +1,6 @@
+//go:build cgo && (linux || darwin || freebsd)
+
+package hooks
+
+// pluginsSupported 当前构建能否加载 Go 插件
+const pluginsSupported = true
@@ -2,6 +2,7 @@ package job
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"log"
 	"os"
@@ -114,6 +115,14 @@ func (su *SessionUpdater) saveSessionsToFile() error {
 	return nil
 }
 
+// SaveSessions persists the current sessions, e.g. after an admin change
+func SaveSessions() error {
+	if sessionUpdaterInstance == nil {
+		return errors.New("session updater is not initialized")
+	}
+	return sessionUpdaterInstance.saveSessionsToFile()
+}
+
 // Start 启动定时更新任务
 func (su *SessionUpdater) Start() {
 	su.runningLock.Lock()
@@ -165,7 +174,6 @@ func (su *SessionUpdater) updateAllSessions() {
 	config.ConfigInstance.RwMutex.RLock()
 	sessionsCopy := make([]config.SessionInfo, len(config.ConfigInstance.Sessions))
 	copy(sessionsCopy, config.ConfigInstance.Sessions)
-	proxy := config.ConfigInstance.Proxy
 	config.ConfigInstance.RwMutex.RUnlock()
 	// 如果没有会话需要更新，直接返回
 	if len(sessionsCopy) == 0 {
@@ -182,7 +190,7 @@ func (su *SessionUpdater) updateAllSessions() {
 			defer wg.Done()
 			// 创建客户端并更新 cookie
 			// 写死 model 和 openSearch 参数
-			client := core.NewClient(origSession.SessionKey, proxy, "claude-3-opus-20240229", false)
+			client := core.NewSessionClient(origSession, "claude-3-opus-20240229", false)
 			newCookie, err := client.GetNewCookie()
 			if err != nil {
 				log.Printf("Failed to update session %d: %v", index, err)
@@ -190,10 +198,10 @@ func (su *SessionUpdater) updateAllSessions() {
 				updatedSessions[index] = origSession
 				return
 			}
-			// 创建更新后的会话对象
-			updatedSessions[index] = config.SessionInfo{
-				SessionKey: newCookie,
-			}
+			// 创建更新后的会话对象，保留归档等其他属性
+			updatedSession := origSession
+			updatedSession.SessionKey = newCookie
+			updatedSessions[index] = updatedSession
 		}(i, session)
 	}
 	// 等待所有更新完成
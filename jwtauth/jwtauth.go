@@ -0,0 +1,300 @@
+// Package jwtauth authenticates clients with JWTs issued by an existing
+// identity provider, as an alternative to static API keys.
+//
+// Tokens are verified with a shared HS256 secret or with the RS256 keys of
+// a JWKS URL. Claims are mapped to a key identity: the name claim becomes
+// the key name used for rate limits, usage and conversation records, and
+// optional claims restrict the models and scopes or set rate limits.
+package jwtauth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NamePrefix is prepended to the name claim to form the key name, so token
+// identities can't collide with configured keys
+const NamePrefix = "jwt:"
+
+// leeway 校验过期与生效时间时允许的时钟偏差
+const leeway = time.Minute
+
+// minJWKSRefresh 遇到未知 kid 时两次刷新 JWKS 的最小间隔
+const minJWKSRefresh = time.Minute
+
+// LooksLikeJWT reports whether a bearer token has the shape of a JWT
+func LooksLikeJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Authenticate verifies token and returns the key identity of its claims
+func Authenticate(token string) (*config.APIKey, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	if err := verify(h, signed, signature); err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if err := validateClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return keyFromClaims(claims)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verify 按 alg 校验签名，只接受已配置的算法
+func verify(h header, signed, signature []byte) error {
+	cfg := config.ConfigInstance.JWT
+	switch h.Alg {
+	case "HS256":
+		if cfg.Secret == "" {
+			return errors.New("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, []byte(cfg.Secret))
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case "RS256":
+		if cfg.JWKSURL == "" {
+			return errors.New("RS256 tokens are not accepted")
+		}
+		key, err := jwks.key(cfg.JWKSURL, h.Kid)
+		if err != nil {
+			return err
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", h.Alg)
+}
+
+// validateClaims 校验有效期、签发者与受众
+func validateClaims(claims map[string]interface{}, now time.Time) error {
+	cfg := config.ConfigInstance.JWT
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("token has no exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(leeway)) {
+		return errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(leeway).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not valid yet")
+	}
+	if cfg.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != cfg.Issuer {
+			return errors.New("unexpected issuer")
+		}
+	}
+	if cfg.Audience != "" {
+		found := false
+		for _, aud := range stringClaim(claims["aud"]) {
+			found = found || aud == cfg.Audience
+		}
+		if !found {
+			return errors.New("unexpected audience")
+		}
+	}
+	return nil
+}
+
+// keyFromClaims 将声明映射为 key：名称、允许的模型、scope 与限流设置
+func keyFromClaims(claims map[string]interface{}) (*config.APIKey, error) {
+	cfg := config.ConfigInstance.JWT
+	names := stringClaim(claims[cfg.NameClaim])
+	if len(names) == 0 || names[0] == "" {
+		return nil, fmt.Errorf("token has no %s claim", cfg.NameClaim)
+	}
+	key := &config.APIKey{Name: NamePrefix + names[0]}
+	if base, ok := config.ConfigInstance.Keys.Get(cfg.BaseKey); ok && cfg.BaseKey != "" {
+		// 以基础 key 的权限、限流与默认值为起点，声明可以覆盖
+		key.Admin, key.Scopes, key.AllowedModels = base.Admin, base.Scopes, base.AllowedModels
+		key.RPM, key.TPM, key.Defaults = base.RPM, base.TPM, base.Defaults
+	}
+	if models := stringClaim(claims[cfg.ModelsClaim]); len(models) > 0 {
+		key.AllowedModels = models
+	}
+	claimed := stringClaim(claims[cfg.ScopesClaim])
+	if scopes := knownScopes(claimed); len(scopes) > 0 {
+		key.Scopes = scopes
+	}
+	// 管理权限只来自基础 key，或显式配置的 JWT_ADMIN_SCOPE
+	if cfg.AdminScope != "" {
+		for _, s := range claimed {
+			if s == cfg.AdminScope {
+				key.Admin = true
+			}
+		}
+	}
+	if rpm, ok := claims[cfg.RPMClaim].(float64); ok && rpm > 0 {
+		key.RPM = int(rpm)
+	}
+	if tpm, ok := claims[cfg.TPMClaim].(float64); ok && tpm > 0 {
+		key.TPM = int(tpm)
+	}
+	return key, nil
+}
+
+// knownScopes 只保留代理定义的非管理 scope，忽略 openid、profile 等身份提供方的
+// scope；admin 不从声明中接受，身份提供方的用户可能自行获得同名 scope
+func knownScopes(scopes []string) []string {
+	var known []string
+	for _, s := range scopes {
+		switch strings.ToLower(s) {
+		case config.ScopeChat, config.ScopeModels, config.ScopeFiles, config.ScopeBatch:
+			known = append(known, strings.ToLower(s))
+		}
+	}
+	return known
+}
+
+// stringClaim 读取字符串或字符串数组声明，空格分隔的字符串（如 OAuth scope）拆分为多项
+func stringClaim(v interface{}) []string {
+	switch t := v.(type) {
+	case string:
+		return strings.Fields(t)
+	case []interface{}:
+		var items []string
+		for _, item := range t {
+			if s, ok := item.(string); ok {
+				items = append(items, s)
+			}
+		}
+		return items
+	}
+	return nil
+}
+
+// keySet caches the RSA keys of a JWKS URL by kid
+type keySet struct {
+	mutex   sync.Mutex
+	url     string
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+var (
+	jwks       = &keySet{}
+	httpClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// key 返回 kid 对应的公钥；缓存过期或遇到未知 kid 时重新获取
+func (s *keySet) key(url string, kid string) (*rsa.PublicKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.url != url {
+		s.url, s.keys, s.fetched = url, nil, time.Time{}
+	}
+	key, ok := s.lookup(kid)
+	stale := time.Since(s.fetched) > config.ConfigInstance.JWT.JWKSRefresh
+	if (!ok && time.Since(s.fetched) > minJWKSRefresh) || stale {
+		if err := s.fetch(); err != nil {
+			logger.Error(fmt.Sprintf("Failed to fetch JWKS: %v", err))
+			if s.keys == nil {
+				return nil, errors.New("signing keys are unavailable")
+			}
+		}
+		key, ok = s.lookup(kid)
+	}
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	return key, nil
+}
+
+// lookup 查找 kid 对应的公钥，token 未指定 kid 且只有一个公钥时使用该公钥
+func (s *keySet) lookup(kid string) (*rsa.PublicKey, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// fetch 下载 JWKS 并解析其中的 RSA 公钥
+func (s *keySet) fetch() error {
+	s.fetched = time.Now()
+	resp, err := httpClient.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var doc struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return fmt.Errorf("decode JWKS: %w", err)
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil || len(e) == 0 {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if len(keys) == 0 {
+		return errors.New("JWKS has no RSA signing keys")
+	}
+	s.keys = keys
+	return nil
+}
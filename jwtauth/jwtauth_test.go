@@ -0,0 +1,108 @@
+package jwtauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"pplx2api/config"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+// useJWT 在测试期间使用 HS256 密钥与 policy 的设置
+func useJWT(t *testing.T, policy config.JWTPolicy, keys *config.KeyStore) {
+	previous, previousKeys := config.ConfigInstance.JWT, config.ConfigInstance.Keys
+	policy.Secret = testSecret
+	policy.NameClaim, policy.ScopesClaim, policy.ModelsClaim = "sub", "scope", "models"
+	policy.RPMClaim, policy.TPMClaim = "rpm", "tpm"
+	config.ConfigInstance.JWT = policy
+	if keys == nil {
+		keys = config.NewKeyStore("", nil)
+	}
+	config.ConfigInstance.Keys = keys
+	t.Cleanup(func() {
+		config.ConfigInstance.JWT, config.ConfigInstance.Keys = previous, previousKeys
+	})
+}
+
+func sign(t *testing.T, claims map[string]interface{}) string {
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(header{Alg: "HS256"}) + "." + segment(claims)
+	mac := hmac.New(sha256.New, []byte(testSecret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func claims(scope string) map[string]interface{} {
+	return map[string]interface{}{"sub": "alice", "scope": scope, "exp": float64(time.Now().Add(time.Hour).Unix())}
+}
+
+func TestAdminScopeClaimIgnoredByDefault(t *testing.T) {
+	useJWT(t, config.JWTPolicy{}, nil)
+	key, err := Authenticate(sign(t, claims("openid chat admin")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Name != NamePrefix+"alice" {
+		t.Errorf("name = %q", key.Name)
+	}
+	if key.Admin || key.HasScope(config.ScopeAdmin) {
+		t.Error("admin scope claim granted admin access without JWT_ADMIN_SCOPE")
+	}
+	if len(key.Scopes) != 1 || key.Scopes[0] != config.ScopeChat {
+		t.Errorf("scopes = %v, want only chat", key.Scopes)
+	}
+}
+
+func TestAdminScopeClaimWithAdminScope(t *testing.T) {
+	useJWT(t, config.JWTPolicy{AdminScope: "pplx:admin"}, nil)
+	for scope, admin := range map[string]bool{"chat pplx:admin": true, "chat admin": false} {
+		key, err := Authenticate(sign(t, claims(scope)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.HasScope(config.ScopeAdmin) != admin {
+			t.Errorf("scope %q: admin = %t, want %t", scope, key.HasScope(config.ScopeAdmin), admin)
+		}
+	}
+}
+
+func TestAdminFromBaseKey(t *testing.T) {
+	keys := config.NewKeyStore("", []config.APIKey{{Name: "ops", Key: "sk-ops-environment-key", Admin: true, RPM: 5}})
+	useJWT(t, config.JWTPolicy{BaseKey: "ops"}, keys)
+	key, err := Authenticate(sign(t, claims("")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Admin || key.RPM != 5 {
+		t.Errorf("key = %+v, want the admin access and limits of the base key", key)
+	}
+}
+
+func TestAuthenticateRejectsInvalidTokens(t *testing.T) {
+	useJWT(t, config.JWTPolicy{}, nil)
+	expired := claims("chat")
+	expired["exp"] = float64(time.Now().Add(-time.Hour).Unix())
+	// 声明被改过的 token 沿用原来的签名
+	signed, forged := sign(t, claims("chat")), sign(t, claims("chat batch"))
+	tampered := forged[:strings.LastIndex(forged, ".")] + signed[strings.LastIndex(signed, "."):]
+	for name, token := range map[string]string{
+		"expired":    sign(t, expired),
+		"tampered":   tampered,
+		"no subject": sign(t, map[string]interface{}{"exp": float64(time.Now().Add(time.Hour).Unix())}),
+	} {
+		if _, err := Authenticate(token); err == nil {
+			t.Errorf("%s token accepted", name)
+		}
+	}
+}
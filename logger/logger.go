@@ -1,8 +1,13 @@
 package logger
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fatih/color"
@@ -36,6 +41,32 @@ var levelColors = map[int]func(format string, a ...interface{}) string{
 // 全局日志级别，默认为INFO
 var logLevel = INFO
 
+// jsonOutput 为 true 时每行输出一个 JSON 对象，便于日志系统采集
+var jsonOutput = false
+
+// output 日志输出目标，默认为标准输出
+var output io.Writer = os.Stdout
+
+// SetOutput 设置日志输出目标，如以服务方式运行时的日志文件
+func SetOutput(w io.Writer) {
+	output = w
+}
+
+// SetFormat 设置输出格式，支持 text 和 json
+func SetFormat(format string) {
+	jsonOutput = strings.EqualFold(format, "json")
+}
+
+// ParseLevel 将级别名称解析为日志级别
+func ParseLevel(name string) (int, bool) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, true
+		}
+	}
+	return INFO, false
+}
+
 // SetLevel 设置日志级别
 func SetLevel(level int) {
 	if level >= DEBUG && level <= FATAL {
@@ -56,21 +87,79 @@ func GetLevelName(level int) string {
 	return "UNKNOWN"
 }
 
+// recentSize 保留在内存中的最近日志行数，供管理面板查看
+const recentSize = 500
+
+// Line is one log line kept for the admin dashboard
+type Line struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`
+	RequestID string    `json:"request_id,omitempty"`
+	Message   string    `json:"message"`
+}
+
+var (
+	recent      = make([]Line, 0, recentSize)
+	recentNext  int
+	recentMutex sync.Mutex
+)
+
+// remember 将日志行写入环形缓冲区
+func remember(line Line) {
+	recentMutex.Lock()
+	defer recentMutex.Unlock()
+	if len(recent) < recentSize {
+		recent = append(recent, line)
+		return
+	}
+	recent[recentNext] = line
+	recentNext = (recentNext + 1) % recentSize
+}
+
+// Recent returns up to n of the most recent log lines, oldest first
+func Recent(n int) []Line {
+	recentMutex.Lock()
+	defer recentMutex.Unlock()
+	lines := make([]Line, 0, len(recent))
+	lines = append(lines, recent[recentNext:]...)
+	lines = append(lines, recent[:recentNext]...)
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
 // 基础日志打印函数
-func log(level int, format string, args ...interface{}) {
+func log(level int, requestID string, format string, args ...interface{}) {
 	if level < logLevel {
 		return
 	}
 
-	now := time.Now().Format("2006-01-02 15:04:05.000")
+	now := time.Now()
 	levelName := levelNames[level]
-	colorFunc := levelColors[level]
-
 	logContent := fmt.Sprintf(format, args...)
-	logPrefix := fmt.Sprintf("[%s] [%s] ", now, levelName)
-
-	// 使用颜色输出日志级别
-	fmt.Fprintf(os.Stdout, "%s%s\n", logPrefix, colorFunc(logContent))
+	remember(Line{Time: now, Level: levelName, RequestID: requestID, Message: logContent})
+
+	if jsonOutput {
+		line := map[string]string{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": levelName,
+			"msg":   logContent,
+		}
+		if requestID != "" {
+			line["request_id"] = requestID
+		}
+		data, _ := json.Marshal(line)
+		fmt.Fprintf(output, "%s\n", data)
+	} else {
+		colorFunc := levelColors[level]
+		logPrefix := fmt.Sprintf("[%s] [%s] ", now.Format("2006-01-02 15:04:05.000"), levelName)
+		if requestID != "" {
+			logPrefix += fmt.Sprintf("[%s] ", requestID)
+		}
+		// 使用颜色输出日志级别
+		fmt.Fprintf(output, "%s%s\n", logPrefix, colorFunc(logContent))
+	}
 
 	// 如果是致命错误，则退出程序
 	if level == FATAL {
@@ -80,25 +169,68 @@ func log(level int, format string, args ...interface{}) {
 
 // Debug 打印调试日志
 func Debug(format string, args ...interface{}) {
-	log(DEBUG, format, args...)
+	log(DEBUG, "", format, args...)
 }
 
 // Info 打印信息日志
 func Info(format string, args ...interface{}) {
-	log(INFO, format, args...)
+	log(INFO, "", format, args...)
 }
 
 // Warn 打印警告日志
 func Warn(format string, args ...interface{}) {
-	log(WARN, format, args...)
+	log(WARN, "", format, args...)
 }
 
 // Error 打印错误日志
 func Error(format string, args ...interface{}) {
-	log(ERROR, format, args...)
+	log(ERROR, "", format, args...)
 }
 
 // Fatal 打印致命错误日志并退出程序
 func Fatal(format string, args ...interface{}) {
-	log(FATAL, format, args...)
+	log(FATAL, "", format, args...)
+}
+
+// Entry logs on behalf of one inbound request, tagging every line with its request ID
+type Entry struct {
+	RequestID string
+}
+
+// WithRequestID returns an Entry for the given request ID
+func WithRequestID(requestID string) Entry {
+	return Entry{RequestID: requestID}
+}
+
+// Debug 打印调试日志
+func (e Entry) Debug(format string, args ...interface{}) {
+	log(DEBUG, e.RequestID, format, args...)
+}
+
+// Info 打印信息日志
+func (e Entry) Info(format string, args ...interface{}) {
+	log(INFO, e.RequestID, format, args...)
+}
+
+// Warn 打印警告日志
+func (e Entry) Warn(format string, args ...interface{}) {
+	log(WARN, e.RequestID, format, args...)
+}
+
+// Error 打印错误日志
+func (e Entry) Error(format string, args ...interface{}) {
+	log(ERROR, e.RequestID, format, args...)
+}
+
+type requestIDKey struct{}
+
+// ContextWithRequestID stores a request ID in ctx
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// FromContext returns an Entry for the request ID stored in ctx, if any
+func FromContext(ctx context.Context) Entry {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return Entry{RequestID: requestID}
 }
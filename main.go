@@ -1,17 +1,58 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"pplx2api/bench"
+	"pplx2api/certs"
 	"pplx2api/config"
+	"pplx2api/daemon"
+	"pplx2api/golden"
+	"pplx2api/hooks"
 	"pplx2api/job"
+	"pplx2api/logger"
+	"pplx2api/mock"
+	"pplx2api/moderation"
 	"pplx2api/router"
+	"pplx2api/service"
+	"pplx2api/shared"
+	"pplx2api/tracing"
+	"pplx2api/update"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "golden" {
+		os.Exit(golden.Main(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(bench.Main(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		os.Exit(daemon.Main(os.Args[2:], serve))
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serve(ctx)
+}
+
+// serve 启动服务，直到 ctx 取消后停机
+func serve(ctx context.Context) {
 	r := gin.Default()
 	// Load configuration
+	// 多实例部署时连接共享状态
+	shared.Setup()
+	// 内容审核先于插件钩子执行
+	moderation.Setup()
+	// 加载钩子插件
+	hooks.LoadPlugins(config.ConfigInstance.HookPlugins)
 
 	// Setup all routes
 	router.SetupRoutes(r)
@@ -21,7 +62,138 @@ func main() {
 	// 启动会话更新器
 	sessionUpdater.Start()
 	defer sessionUpdater.Stop()
+	// 模拟上游需在检查账号前启动
+	if config.ConfigInstance.Mock.Enabled {
+		if err := mock.Start(ctx); err != nil {
+			logger.Error(fmt.Sprintf("Failed to start mock upstream: %v", err))
+			return
+		}
+	}
+	// 恢复上次停机时保存的账号冷却状态
+	if err := config.LoadSessionStates(config.ConfigInstance.SessionStateFile); err != nil {
+		logger.Error(fmt.Sprintf("Failed to load session state: %v", err))
+	}
+	// 启动前检查账号，提前发现失效的 cookie
+	if err := service.ValidateSessions(); err != nil {
+		logger.Error(fmt.Sprintf("Refusing to start: %v", err))
+		return
+	}
+
+	// 完成上个实例停机时移交的深度研究任务
+	service.ResumeResearchJobs()
+	update.Start(ctx)
+	// 收到 SIGHUP 或配置文件变化时重新加载账号、密钥、代理与模型映射
+	go reloadOnSignal(ctx)
+	if config.ConfigInstance.ConfigWatch > 0 {
+		go config.Watch(ctx, config.ConfigInstance.ConfigWatch)
+	}
 
 	// Run the server on 0.0.0.0:8080
-	r.Run(config.ConfigInstance.Address)
+	srv := &http.Server{Addr: config.ConfigInstance.Address, Handler: r}
+	if err := setupTLS(ctx, srv); err != nil {
+		logger.Error(fmt.Sprintf("Failed to set up TLS: %v", err))
+		return
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if srv.TLSConfig != nil {
+			// 证书由 TLSConfig 提供
+			serveErr <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if !errors.Is(err, http.ErrServerClosed) {
+			logger.Error(fmt.Sprintf("Server error: %v", err))
+		}
+		return
+	case <-ctx.Done():
+	}
+	shutdown(srv)
+}
+
+// setupTLS 设置了证书时让 srv 提供 HTTPS，并在证书文件变化时重新加载
+func setupTLS(ctx context.Context, srv *http.Server) error {
+	cfg := config.ConfigInstance
+	if cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" {
+		return nil
+	}
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	reloader, err := certs.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile, cfg.TLSClientCAFile, cfg.TLSClientAuth)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = reloader.TLSConfig()
+	if cfg.TLSReloadInterval > 0 {
+		go reloader.Watch(ctx, cfg.TLSReloadInterval)
+	}
+	return nil
+}
+
+// reloadOnSignal 每次收到 SIGHUP 时重新加载配置
+func reloadOnSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("Received SIGHUP, reloading config")
+			if err := config.Reload(); err != nil {
+				logger.Error(fmt.Sprintf("Failed to reload config: %v", err))
+			}
+		}
+	}
+}
+
+// shutdown 停止接收新请求并等待进行中的请求完成，深度研究请求额外等待；
+// 超时后其余请求以结束标记收尾，退出前保存账号状态
+func shutdown(srv *http.Server) {
+	logger.Info("Shutting down, draining in-flight requests")
+	defer flushTraces()
+	defer saveState()
+	done := make(chan struct{})
+	go func() {
+		srv.Shutdown(context.Background())
+		close(done)
+	}()
+	cfg := config.ConfigInstance
+	select {
+	case <-done:
+		return
+	case <-time.After(cfg.ShutdownTimeout):
+	}
+	endCtx, endCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer endCancel()
+	if !service.InterruptRequests(endCtx) {
+		logger.Info("Some requests didn't finish after interrupt, they will be cut")
+	}
+	drainCtx, cancel := context.WithTimeout(context.Background(), cfg.DeepResearchDrain)
+	defer cancel()
+	service.DrainResearch(drainCtx)
+	logger.Info("Drain timeout reached, exiting")
+}
+
+// saveState 保存轮换后的 cookie 与账号冷却、历史，供下一个实例使用
+func saveState() {
+	if err := job.SaveSessions(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to save sessions: %v", err))
+	}
+	if err := config.SaveSessionStates(config.ConfigInstance.SessionStateFile); err != nil {
+		logger.Error(fmt.Sprintf("Failed to save session state: %v", err))
+	}
+}
+
+// flushTraces 退出前导出尚未发送的 span
+func flushTraces() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tracing.Flush(ctx)
 }
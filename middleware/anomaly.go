@@ -0,0 +1,193 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"pplx2api/model"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// anomalyAlpha 每分钟请求数基线的指数平均系数，约等于最近一小时的均值
+	anomalyAlpha = 1.0 / 60
+	// anomalyWarmup 学习基线的最短时间，之前不判定异常
+	anomalyWarmup = 30 * time.Minute
+)
+
+// keyBaseline is the learned request rate of one key and its throttle
+type keyBaseline struct {
+	firstSeen time.Time
+	minute    time.Time
+	count     int
+	// baseline 每分钟请求数的指数平均，不含当前分钟
+	baseline float64
+	// throttleRPM、throttledUntil 异常后临时限制的每分钟请求数及截止时间
+	throttleRPM    int
+	throttledUntil time.Time
+	spikeRPM       int
+}
+
+// roll 将已结束的分钟计入基线，期间没有请求的分钟按 0 计
+func (b *keyBaseline) roll(now time.Time) {
+	minute := now.Truncate(time.Minute)
+	if !minute.After(b.minute) {
+		return
+	}
+	elapsed := int(minute.Sub(b.minute) / time.Minute)
+	b.baseline = b.baseline*(1-anomalyAlpha) + float64(b.count)*anomalyAlpha
+	if elapsed > 1 {
+		b.baseline *= math.Pow(1-anomalyAlpha, float64(elapsed-1))
+	}
+	b.minute, b.count = minute, 0
+}
+
+var (
+	baselines      = map[string]*keyBaseline{}
+	baselinesMutex sync.Mutex
+)
+
+// KeyAnomaly is the learned rate and throttle state of one key
+type KeyAnomaly struct {
+	Key string `json:"key"`
+	// BaselineRPM 学习到的每分钟请求数，CurrentRPM 为当前分钟的请求数
+	BaselineRPM    float64    `json:"baseline_rpm"`
+	CurrentRPM     int        `json:"current_rpm"`
+	Learning       bool       `json:"learning"`
+	ThrottleRPM    int        `json:"throttle_rpm,omitempty"`
+	SpikeRPM       int        `json:"spike_rpm,omitempty"`
+	ThrottledUntil *time.Time `json:"throttled_until,omitempty"`
+}
+
+// Anomalies returns the state of every key seen since startup
+func Anomalies() []KeyAnomaly {
+	now := time.Now()
+	baselinesMutex.Lock()
+	defer baselinesMutex.Unlock()
+	list := make([]KeyAnomaly, 0, len(baselines))
+	for name, b := range baselines {
+		b.roll(now)
+		a := KeyAnomaly{
+			Key:         name,
+			BaselineRPM: math.Round(b.baseline*100) / 100,
+			CurrentRPM:  b.count,
+			Learning:    now.Sub(b.firstSeen) < anomalyWarmup,
+		}
+		if now.Before(b.throttledUntil) {
+			until := b.throttledUntil
+			a.ThrottleRPM, a.SpikeRPM, a.ThrottledUntil = b.throttleRPM, b.spikeRPM, &until
+		}
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
+
+// LiftThrottle ends the throttle of a key, reporting whether it had one
+func LiftThrottle(name string) bool {
+	baselinesMutex.Lock()
+	defer baselinesMutex.Unlock()
+	b, ok := baselines[name]
+	if !ok || !time.Now().Before(b.throttledUntil) {
+		return false
+	}
+	b.throttledUntil = time.Time{}
+	logger.Info(fmt.Sprintf("Throttle of key %s lifted", name))
+	return true
+}
+
+// AnomalyMiddleware learns the usual request rate of each key and, when a
+// key's rate in the current minute exceeds ANOMALY_FACTOR times its
+// baseline and ANOMALY_MIN_RPM, throttles the key to its baseline for
+// ANOMALY_THROTTLE. It must run after AuthMiddleware.
+func AnomalyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey := APIKeyFrom(c)
+		if apiKey == nil || !config.ConfigInstance.AnomalyDetection {
+			c.Next()
+			return
+		}
+		now := time.Now()
+		baselinesMutex.Lock()
+		b, ok := baselines[apiKey.Name]
+		if !ok {
+			b = &keyBaseline{firstSeen: now, minute: now.Truncate(time.Minute)}
+			baselines[apiKey.Name] = b
+		}
+		b.roll(now)
+		throttled := now.Before(b.throttledUntil)
+		if throttled && b.count >= b.throttleRPM {
+			until, retryAfter := b.throttledUntil, b.minute.Add(time.Minute).Sub(now)
+			baselinesMutex.Unlock()
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, model.ErrorBody(c, http.StatusTooManyRequests, model.CodeKeyThrottled,
+				fmt.Sprintf("Key %s is throttled after unusual traffic until %s", apiKey.Name, until.Format(time.RFC3339))))
+			c.Abort()
+			return
+		}
+		b.count++
+		var event *anomalyEvent
+		if !throttled && now.Sub(b.firstSeen) >= anomalyWarmup {
+			threshold := math.Max(float64(config.ConfigInstance.AnomalyMinRPM), b.baseline*config.ConfigInstance.AnomalyFactor)
+			if float64(b.count) > threshold {
+				b.throttleRPM = int(math.Max(1, math.Ceil(b.baseline)))
+				b.throttledUntil = now.Add(config.ConfigInstance.AnomalyThrottle)
+				b.spikeRPM = b.count
+				event = &anomalyEvent{
+					Event:       "key.throttled",
+					Key:         apiKey.Name,
+					RPM:         b.count,
+					BaselineRPM: math.Round(b.baseline*100) / 100,
+					ThrottleRPM: b.throttleRPM,
+					Until:       b.throttledUntil,
+				}
+			}
+		}
+		baselinesMutex.Unlock()
+		if event != nil {
+			logger.Error(fmt.Sprintf("Unusual traffic on key %s: %d requests this minute, baseline %.2f, throttled to %d rpm until %s",
+				event.Key, event.RPM, event.BaselineRPM, event.ThrottleRPM, event.Until.Format(time.RFC3339)))
+			go notifyAnomaly(*event)
+		}
+		c.Next()
+	}
+}
+
+// anomalyEvent is posted to ANOMALY_WEBHOOK when a key is throttled
+type anomalyEvent struct {
+	Event       string    `json:"event"`
+	Key         string    `json:"key"`
+	RPM         int       `json:"rpm"`
+	BaselineRPM float64   `json:"baseline_rpm"`
+	ThrottleRPM int       `json:"throttle_rpm"`
+	Until       time.Time `json:"until"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifyAnomaly 将异常事件以 JSON 发送到 ANOMALY_WEBHOOK
+func notifyAnomaly(event anomalyEvent) {
+	url := config.ConfigInstance.AnomalyWebhook
+	if url == "" {
+		return
+	}
+	body, _ := json.Marshal(event)
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to send anomaly webhook: %v", err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Error(fmt.Sprintf("Anomaly webhook returned status %d", resp.StatusCode))
+	}
+}
@@ -1,31 +1,125 @@
 package middleware
 
 import (
+	"fmt"
 	"pplx2api/config"
+	"pplx2api/jwtauth"
+	"pplx2api/model"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
+// apiKeyContextKey is the gin context key of the authenticated APIKey
+const apiKeyContextKey = "api_key"
+
+// endpointScopes maps routes to the key scope they require; routes not
+// listed only need a valid key.
+var endpointScopes = map[string]string{
+	"/v1/chat/completions":    config.ScopeChat,
+	"/hf/v1/chat/completions": config.ScopeChat,
+	"/v1/completions":         config.ScopeChat,
+	"/v1/tokenize":            config.ScopeChat,
+	"/v1/images/generations":  config.ScopeChat,
+	"/v1beta/models/:action":  config.ScopeChat,
+	"/api/chat":               config.ScopeChat,
+	"/api/generate":           config.ScopeChat,
+	"/api/tags":               config.ScopeModels,
+	"/v1/research/jobs/:id":   config.ScopeChat,
+	"/v1/conversations":       config.ScopeChat,
+	"/v1/conversations/:id":   config.ScopeChat,
+	"/v1/models":              config.ScopeModels,
+	"/hf/v1/models":           config.ScopeModels,
+}
+
+// publicPaths are routes served without a key, for probes and the
+// dashboard page, which asks for a key itself
+var publicPaths = map[string]bool{
+	"/healthz":  true,
+	"/readyz":   true,
+	"/admin/ui": true,
+}
+
+// scopeFor 返回请求路由所需的 scope
+func scopeFor(c *gin.Context) string {
+	path := c.FullPath()
+	if strings.HasPrefix(path, "/admin") {
+		return config.ScopeAdmin
+	}
+	return endpointScopes[path]
+}
+
 // AuthMiddleware initializes the Claude client from the request header
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if publicPaths[c.FullPath()] {
+			c.Next()
+			return
+		}
 		Key := c.GetHeader("Authorization")
-		if Key != "" {
+		if Key == "" {
+			Key = geminiKey(c)
+		}
+		var apiKey *config.APIKey
+		ok := false
+		if Key == "" && strings.HasPrefix(c.FullPath(), "/api/") && config.ConfigInstance.OllamaKey != "" {
+			// Ollama 客户端通常不发送认证头，使用 OLLAMA_KEY 指定的 key
+			apiKey, ok = config.ConfigInstance.Keys.Get(config.ConfigInstance.OllamaKey)
+		}
+		if Key != "" || ok {
 			Key = strings.TrimPrefix(Key, "Bearer ")
-			if Key != config.ConfigInstance.APIKey {
-				c.JSON(401, gin.H{
-					"error": "Invalid API key",
-				})
+			if !ok {
+				apiKey, ok = config.ConfigInstance.Keys.Lookup(Key)
+			}
+			if !ok && config.ConfigInstance.JWT.Enabled() && jwtauth.LooksLikeJWT(Key) {
+				token, err := jwtauth.Authenticate(Key)
+				if err != nil {
+					c.JSON(401, model.ErrorBody(c, 401, model.CodeInvalidAPIKey, fmt.Sprintf("Invalid token: %v", err)))
+					c.Abort()
+					return
+				}
+				apiKey, ok = token, true
+			}
+			if !ok {
+				c.JSON(401, model.ErrorBody(c, 401, model.CodeInvalidAPIKey, "Invalid API key"))
+				c.Abort()
+				return
+			}
+			if apiKey.Expired(time.Now()) {
+				c.JSON(401, model.ErrorBody(c, 401, model.CodeExpiredAPIKey, "API key expired"))
+				c.Abort()
+				return
+			}
+			if scope := scopeFor(c); scope != "" && !apiKey.HasScope(scope) {
+				c.JSON(403, model.ErrorBody(c, 403, model.CodePermissionDenied, fmt.Sprintf("API key is not allowed to access %s endpoints", scope)))
 				c.Abort()
 				return
 			}
+			c.Set(apiKeyContextKey, apiKey)
 			c.Next()
 			return
 		}
-		c.JSON(401, gin.H{
-			"error": "Missing or invalid Authorization header",
-		})
+		c.JSON(401, model.ErrorBody(c, 401, model.CodeMissingAPIKey, "Missing or invalid Authorization header"))
 		c.Abort()
 	}
 }
+
+// geminiKey 返回 Gemini SDK 通过 x-goog-api-key 头或 key 查询参数传入的密钥
+func geminiKey(c *gin.Context) string {
+	if key := c.GetHeader("X-Goog-Api-Key"); key != "" {
+		return key
+	}
+	if strings.HasPrefix(c.FullPath(), "/v1beta/") {
+		return c.Query("key")
+	}
+	return ""
+}
+
+// APIKeyFrom returns the key the request authenticated with
+func APIKeyFrom(c *gin.Context) *config.APIKey {
+	if v, ok := c.Get(apiKeyContextKey); ok {
+		return v.(*config.APIKey)
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/model"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BodyLimitMiddleware rejects request bodies over MAX_REQUEST_BODY_SIZE.
+// Bodies that declare their length are rejected before they are read,
+// others are cut off at the limit and fail to parse. Admin endpoints, e.g.
+// the import of conversation exports, are not limited.
+func BodyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := config.ConfigInstance.MaxRequestBodySize
+		if limit <= 0 || c.Request.Body == nil || strings.HasPrefix(c.Request.URL.Path, "/admin/") {
+			c.Next()
+			return
+		}
+		if c.Request.ContentLength > limit {
+			message := fmt.Sprintf("Request body of %d bytes exceeds the limit of %d bytes", c.Request.ContentLength, limit)
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, model.ErrorBody(c, http.StatusRequestEntityTooLarge, model.CodeRequestTooLarge, message))
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
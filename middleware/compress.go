@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"pplx2api/config"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// Content encodings COMPRESSION may enable
+const (
+	EncodingGzip   = "gzip"
+	EncodingBrotli = "br"
+)
+
+// CompressMiddleware compresses responses with gzip or brotli, as accepted
+// by the client and enabled by COMPRESSION. Responses smaller than
+// COMPRESSION_MIN_SIZE, already encoded or streamed as SSE or NDJSON are
+// sent as they are, so streams keep flushing event by event.
+func CompressMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := config.ConfigInstance
+		encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"), cfg.Compression)
+		if encoding == "" || c.Request.Method == http.MethodHead {
+			c.Next()
+			return
+		}
+		c.Header("Vary", "Accept-Encoding")
+		w := &compressWriter{ResponseWriter: c.Writer, encoding: encoding, minSize: cfg.CompressionMinSize}
+		c.Writer = w
+		defer w.close()
+		c.Next()
+	}
+}
+
+// negotiateEncoding 返回客户端接受且已启用的编码，同时接受时优先 br
+func negotiateEncoding(accept string, enabled []string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				continue
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = true
+	}
+	for _, encoding := range []string{EncodingBrotli, EncodingGzip} {
+		for _, e := range enabled {
+			if e == encoding && (accepted[encoding] || accepted["*"]) {
+				return encoding
+			}
+		}
+	}
+	return ""
+}
+
+// compressWriter 缓冲响应开头，超过 minSize 后开始压缩；流式响应与已编码的响应直接写出
+type compressWriter struct {
+	gin.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+	buffer   bytes.Buffer
+	// decided 已决定是否压缩，encoder 为 nil 时直接写出
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if !w.decided {
+		w.status = code
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressWriter) WriteHeaderNow() {
+	if !w.decided {
+		w.passthrough()
+	}
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.decided {
+		if !w.compressible() {
+			w.passthrough()
+		} else {
+			w.buffer.Write(data)
+			if w.buffer.Len() < w.minSize {
+				return len(data), nil
+			}
+			if err := w.startEncoder(); err != nil {
+				return 0, err
+			}
+			return len(data), nil
+		}
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *compressWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		// 调用方要求立即发送，不再等待
+		w.passthrough()
+	}
+	if f, ok := w.encoder.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *compressWriter) Status() int {
+	if !w.decided && w.status != 0 {
+		return w.status
+	}
+	return w.ResponseWriter.Status()
+}
+
+func (w *compressWriter) Written() bool {
+	return w.buffer.Len() > 0 || w.ResponseWriter.Written()
+}
+
+// compressible 根据响应头判断是否可以压缩
+func (w *compressWriter) compressible() bool {
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	switch w.status {
+	case http.StatusNoContent, http.StatusNotModified:
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	return !strings.HasPrefix(contentType, "text/event-stream") && !strings.HasPrefix(contentType, "application/x-ndjson")
+}
+
+// passthrough 不压缩，写出状态码与已缓冲的内容
+func (w *compressWriter) passthrough() {
+	w.decided = true
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.buffer.Len() > 0 {
+		w.ResponseWriter.Write(w.buffer.Bytes())
+		w.buffer.Reset()
+	}
+}
+
+// startEncoder 设置编码响应头并压缩已缓冲的内容
+func (w *compressWriter) startEncoder() error {
+	w.decided = true
+	header := w.Header()
+	header.Set("Content-Encoding", w.encoding)
+	header.Del("Content-Length")
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.encoding == EncodingBrotli {
+		w.encoder = brotli.NewWriterLevel(w.ResponseWriter, brotli.DefaultCompression)
+	} else {
+		w.encoder, _ = gzip.NewWriterLevel(w.ResponseWriter, gzip.DefaultCompression)
+	}
+	_, err := w.encoder.Write(w.buffer.Bytes())
+	w.buffer.Reset()
+	return err
+}
+
+// close 结束压缩，未达到 minSize 的响应原样写出
+func (w *compressWriter) close() {
+	if !w.decided {
+		w.passthrough()
+	}
+	if w.encoder != nil {
+		w.encoder.Close()
+	}
+}
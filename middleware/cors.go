@@ -1,17 +1,64 @@
 package middleware
 
-import "github.com/gin-gonic/gin"
+import (
+	"net/http"
+	"pplx2api/config"
+	"strconv"
+	"strings"
 
-// CORSMiddleware handles CORS headers
+	"github.com/gin-gonic/gin"
+)
+
+// CORSMiddleware handles CORS headers according to the CORS_* settings.
+// Requests from origins that aren't allowed get no CORS headers, so the
+// browser blocks them; their preflight requests are rejected with 403.
 func CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, Authorization")
-		if c.Request.Method == "OPTIONS" {
-			c.AbortWithStatus(204)
+		policy := config.ConfigInstance.CORS
+		origin := c.GetHeader("Origin")
+		preflight := c.Request.Method == http.MethodOptions
+		if origin != "" && !policy.AllowsOrigin(origin) {
+			if preflight {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+			c.Next()
+			return
+		}
+		header := c.Writer.Header()
+		if policy.AllowsAnyOrigin() && !policy.AllowCredentials {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else if origin != "" {
+			// 返回具体的 Origin 时缓存需要按 Origin 区分
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Add("Vary", "Origin")
+		}
+		if policy.AllowCredentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+		header.Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+		if preflight {
+			header.Set("Access-Control-Allow-Methods", strings.Join(policy.AllowedMethods, ", "))
+			header.Set("Access-Control-Allow-Headers", allowedHeaders(c, policy))
+			if policy.MaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(policy.MaxAge))
+			}
+			c.AbortWithStatus(http.StatusNoContent)
 			return
 		}
 		c.Next()
 	}
 }
+
+// allowedHeaders 返回允许的请求头，配置为 * 时允许预检请求列出的全部请求头
+func allowedHeaders(c *gin.Context, policy config.CORSPolicy) string {
+	for _, h := range policy.AllowedHeaders {
+		if h == "*" {
+			if requested := c.GetHeader("Access-Control-Request-Headers"); requested != "" {
+				return requested
+			}
+			break
+		}
+	}
+	return strings.Join(policy.AllowedHeaders, ", ")
+}
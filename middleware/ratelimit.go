@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/model"
+	"pplx2api/usage"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tokenBucket refills continuously up to capacity over one minute. Tokens
+// may go negative when a request used more than was left; the debt is
+// paid off by later refills.
+type tokenBucket struct {
+	capacity float64
+	tokens   float64
+	updated  time.Time
+}
+
+func newTokenBucket(capacity int, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: float64(capacity), tokens: float64(capacity), updated: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	rate := b.capacity / time.Minute.Seconds()
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+}
+
+// wait 返回令牌数恢复到 n 所需的时间
+func (b *tokenBucket) wait(n float64) time.Duration {
+	if b.tokens >= n {
+		return 0
+	}
+	rate := b.capacity / time.Minute.Seconds()
+	return time.Duration((n - b.tokens) / rate * float64(time.Second))
+}
+
+// reset 返回令牌补满所需的时间
+func (b *tokenBucket) reset() time.Duration {
+	return b.wait(b.capacity)
+}
+
+// clientLimiter holds the request and token buckets of one client
+type clientLimiter struct {
+	mutex    sync.Mutex
+	requests *tokenBucket
+	tokens   *tokenBucket
+	lastSeen time.Time
+}
+
+var (
+	limiters      = map[string]*clientLimiter{}
+	limitersMutex sync.Mutex
+	lastSweep     time.Time
+)
+
+// limiterFor 返回客户端的限流器，空闲超过10分钟的限流器会被清理
+func limiterFor(identity string, now time.Time) *clientLimiter {
+	limitersMutex.Lock()
+	defer limitersMutex.Unlock()
+	if now.Sub(lastSweep) > time.Minute {
+		for id, l := range limiters {
+			l.mutex.Lock()
+			idle := now.Sub(l.lastSeen) > 10*time.Minute
+			l.mutex.Unlock()
+			if idle {
+				delete(limiters, id)
+			}
+		}
+		lastSweep = now
+	}
+	l, ok := limiters[identity]
+	if !ok {
+		l = &clientLimiter{}
+		limiters[identity] = l
+	}
+	return l
+}
+
+// limitsFor 返回 key 的每分钟请求数与 token 数上限，key 未设置时使用全局配置
+func limitsFor(apiKey *config.APIKey) (rpm int, tpm int) {
+	rpm, tpm = config.ConfigInstance.RateLimitRPM, config.ConfigInstance.RateLimitTPM
+	if apiKey.RPM > 0 {
+		rpm = apiKey.RPM
+	}
+	if apiKey.TPM > 0 {
+		tpm = apiKey.TPM
+	}
+	return rpm, tpm
+}
+
+// RateLimitMiddleware limits requests and estimated tokens per minute for
+// each API key, optionally per key and client IP, so one client can't use
+// up every session. It must run after AuthMiddleware.
+func RateLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		apiKey := APIKeyFrom(c)
+		if apiKey == nil {
+			c.Next()
+			return
+		}
+		rpm, tpm := limitsFor(apiKey)
+		if rpm <= 0 && tpm <= 0 {
+			c.Next()
+			return
+		}
+		identity := apiKey.Name
+		if config.ConfigInstance.RateLimitByIP {
+			identity += "|" + c.ClientIP()
+		}
+		now := time.Now()
+		l := limiterFor(identity, now)
+
+		l.mutex.Lock()
+		l.lastSeen = now
+		// 上限变化（如运行时修改 key）时重建令牌桶
+		if rpm > 0 && (l.requests == nil || l.requests.capacity != float64(rpm)) {
+			l.requests = newTokenBucket(rpm, now)
+		}
+		if tpm > 0 && (l.tokens == nil || l.tokens.capacity != float64(tpm)) {
+			l.tokens = newTokenBucket(tpm, now)
+		}
+		var retryAfter time.Duration
+		if rpm > 0 {
+			l.requests.refill(now)
+			retryAfter = l.requests.wait(1)
+		}
+		if tpm > 0 {
+			l.tokens.refill(now)
+			// token 用量在请求结束后才知道，只要余额为正就放行
+			if w := l.tokens.wait(1); w > retryAfter {
+				retryAfter = w
+			}
+		}
+		if retryAfter == 0 && rpm > 0 {
+			l.requests.tokens--
+		}
+		setRateLimitHeaders(c, l, rpm, tpm)
+		l.mutex.Unlock()
+
+		if retryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			c.JSON(http.StatusTooManyRequests, model.ErrorBody(c, http.StatusTooManyRequests, model.CodeRateLimitExceeded,
+				fmt.Sprintf("Rate limit exceeded for key %s, retry in %ds", apiKey.Name, int(math.Ceil(retryAfter.Seconds())))))
+			c.Abort()
+			return
+		}
+
+		c.Next()
+
+		if tpm > 0 {
+			if meter := usage.MeterFrom(c); meter != nil {
+				used := meter.Usage().TotalTokens
+				l.mutex.Lock()
+				l.tokens.refill(time.Now())
+				l.tokens.tokens -= float64(used)
+				l.mutex.Unlock()
+			}
+		}
+	}
+}
+
+// setRateLimitHeaders 设置 OpenAI 风格的 x-ratelimit-* 响应头，调用方需持有锁
+func setRateLimitHeaders(c *gin.Context, l *clientLimiter, rpm int, tpm int) {
+	if rpm > 0 {
+		c.Header("X-RateLimit-Limit-Requests", strconv.Itoa(rpm))
+		c.Header("X-RateLimit-Remaining-Requests", strconv.Itoa(int(math.Max(0, math.Floor(l.requests.tokens)))))
+		c.Header("X-RateLimit-Reset-Requests", l.requests.reset().Round(time.Millisecond).String())
+	}
+	if tpm > 0 {
+		c.Header("X-RateLimit-Limit-Tokens", strconv.Itoa(tpm))
+		c.Header("X-RateLimit-Remaining-Tokens", strconv.Itoa(int(math.Max(0, math.Floor(l.tokens.tokens)))))
+		c.Header("X-RateLimit-Reset-Tokens", l.tokens.reset().Round(time.Millisecond).String())
+	}
+}
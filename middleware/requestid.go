@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"pplx2api/logger"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// RequestIDHeader carries the request correlation ID
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID 只接受格式安全的客户端请求 ID，避免日志注入
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// RequestIDMiddleware assigns each request an ID, taken from X-Request-ID
+// when the client sent a valid one. The ID is returned in the response
+// header and stored in the request context for logging.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = strings.ReplaceAll(uuid.New().String(), "-", "")
+		}
+		c.Header(RequestIDHeader, requestID)
+		c.Request = c.Request.WithContext(logger.ContextWithRequestID(c.Request.Context(), requestID))
+		c.Next()
+	}
+}
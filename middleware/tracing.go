@@ -0,0 +1,32 @@
+package middleware
+
+import (
+	"fmt"
+	"pplx2api/logger"
+	"pplx2api/tracing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TracingMiddleware starts the server span of each request, continuing the
+// caller's trace when a traceparent header is present.
+func TracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !tracing.Enabled() {
+			c.Next()
+			return
+		}
+		ctx, span := tracing.StartRemote(c.Request.Context(), c.Request.Method+" "+c.FullPath(), c.GetHeader("traceparent"))
+		span.SetAttr("http.method", c.Request.Method)
+		span.SetAttr("http.route", c.FullPath())
+		span.SetAttr("request_id", logger.FromContext(ctx).RequestID)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		status := c.Writer.Status()
+		span.SetAttr("http.status_code", status)
+		if status >= 500 {
+			span.SetError(fmt.Errorf("status %d", status))
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,235 @@
+// Package mock serves a fake Perplexity upstream, so client integrations
+// and the retry logic can be tried without using real quota.
+//
+// Answers stream in small chunks after a first-token delay, carry web
+// results when the request searches the web and reasoning steps for
+// thinking models. A prompt containing one of the markers below triggers
+// the matching upstream failure:
+//
+//	[mock:rate_limit]  429 with Retry-After
+//	[mock:error]       500
+//	[mock:auth]        401, as for an expired cookie
+//	[mock:challenge]   403 Cloudflare challenge
+//	[mock:break]       the stream breaks off halfway
+package mock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/logger"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scenario markers recognized in prompts
+const (
+	ScenarioRateLimit = "[mock:rate_limit]"
+	ScenarioError     = "[mock:error]"
+	ScenarioAuth      = "[mock:auth]"
+	ScenarioChallenge = "[mock:challenge]"
+	ScenarioBreak     = "[mock:break]"
+)
+
+// retryAfter 模拟限流时返回的 Retry-After 秒数
+const retryAfter = 10
+
+// Start serves the mock upstream on a local port until ctx is done and
+// sends the requests of all sessions to it
+func Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	base := "http://" + listener.Addr().String()
+	srv := &http.Server{Handler: Handler()}
+	go srv.Serve(listener)
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	cfg := config.ConfigInstance
+	cfg.RwMutex.Lock()
+	cfg.Upstream = config.Upstream{
+		URL:           base,
+		AskPath:       config.DefaultAskPath,
+		UploadPath:    config.DefaultUploadPath,
+		FileUploadURL: base + "/upload",
+	}
+	cfg.RwMutex.Unlock()
+	logger.Info(fmt.Sprintf("Mock upstream listening on %s, no requests reach Perplexity", base))
+	return nil
+}
+
+// Handler returns the HTTP handler of the mock upstream
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.DefaultAskPath, ask)
+	mux.HandleFunc(config.DefaultUploadPath, uploadURL)
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/rest/user/settings", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"subscription_tier": "pro", "subscription_status": "active"})
+	})
+	mux.HandleFunc("/rest/models/config", modelsConfig)
+	mux.HandleFunc("/rest/thread/delete_thread_by_entry_uuid", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{"status": "success"})
+	})
+	mux.HandleFunc("/api/auth/session", func(w http.ResponseWriter, r *http.Request) {
+		// 返回请求带来的 cookie，账号刷新后保持不变
+		if cookie, err := r.Cookie(config.SessionCookieName); err == nil {
+			http.SetCookie(w, &http.Cookie{Name: config.SessionCookieName, Value: cookie.Value})
+		}
+		writeJSON(w, map[string]string{})
+	})
+	return mux
+}
+
+// ask 按提示词中的场景标记返回错误，否则流式返回预设的回答
+func ask(w http.ResponseWriter, r *http.Request) {
+	var body core.PerplexityRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	mock := config.ConfigInstance.Mock
+	query := body.QueryStr
+	switch {
+	case strings.Contains(query, ScenarioRateLimit) || rand.Float64() < mock.RateLimitRate:
+		w.Header().Set("Retry-After", fmt.Sprint(retryAfter))
+		http.Error(w, `{"detail":"rate limited"}`, http.StatusTooManyRequests)
+		return
+	case strings.Contains(query, ScenarioError) || rand.Float64() < mock.ErrorRate:
+		http.Error(w, `{"detail":"internal error"}`, http.StatusInternalServerError)
+		return
+	case strings.Contains(query, ScenarioAuth):
+		http.Error(w, `{"detail":"unauthorized"}`, http.StatusUnauthorized)
+		return
+	case strings.Contains(query, ScenarioChallenge):
+		w.Header().Set("cf-mitigated", "challenge")
+		w.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, "<html><head><title>Just a moment...</title></head><body>challenge-platform</body></html>")
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	response := core.PerplexityResponse{
+		Status:         "PENDING",
+		DisplayModel:   body.Params.ModelPreference,
+		BackendUUID:    uuid.New().String(),
+		ReadWriteToken: uuid.New().String(),
+	}
+	send := func(blocks ...core.Block) bool {
+		response.Blocks = blocks
+		data, _ := json.Marshal(response)
+		if _, err := fmt.Fprintf(w, "event: message\r\ndata: %s\r\n\r\n", data); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	wait := func(d time.Duration) bool {
+		// 间隔在平均值上下浮动一半
+		if d > 0 {
+			d = d/2 + time.Duration(rand.Int63n(int64(d)))
+		}
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-time.After(d):
+			return true
+		}
+	}
+
+	if strings.Contains(body.Params.ModelPreference, "thinking") {
+		goals := []core.Goal{{Description: "Understanding the question. "}, {Description: "Drafting a short answer."}}
+		if !wait(mock.FirstTokenDelay/2) || !send(core.Block{ReasoningPlanBlock: &core.ReasoningPlanBlock{Goals: goals}}) {
+			return
+		}
+	}
+	if !wait(mock.FirstTokenDelay) {
+		return
+	}
+	chunks := answerChunks(query, body.Params.ModelPreference)
+	for i, chunk := range chunks {
+		if strings.Contains(query, ScenarioBreak) && i == len(chunks)/2 {
+			// 不结束分块编码直接断开连接，客户端读取时出错
+			panic(http.ErrAbortHandler)
+		}
+		if !send(core.Block{MarkdownBlock: &core.MarkdownBlock{Chunks: []string{chunk}}}) || !wait(mock.Latency) {
+			return
+		}
+	}
+	response.Status = "COMPLETED"
+	var blocks []core.Block
+	for _, source := range body.Params.Sources {
+		if source == "web" {
+			blocks = append(blocks, core.Block{WebResultBlock: &core.WebResultBlock{WebResults: webResults}})
+			break
+		}
+	}
+	send(blocks...)
+}
+
+var webResults = []core.WebResult{
+	{Name: "Example Domain", URL: "https://example.com/", Snippet: "This domain is for use in illustrative examples in documents."},
+	{Name: "Mock upstream - pplx2api", URL: "https://example.org/pplx2api/mock", Snippet: "Canned answers for testing clients without using quota."},
+}
+
+// answerChunks 把预设回答切成几个字一段的片段
+func answerChunks(query string, model string) []string {
+	prompt := []rune(strings.TrimSpace(query))
+	answer := fmt.Sprintf("This is a canned answer from the mock upstream for model %s. "+
+		"It streams in small chunks with realistic timing, so clients and retries can be tested without using Perplexity quota[1]. "+
+		"Your prompt was %d characters long[2].", model, len(prompt))
+	words := strings.SplitAfter(answer, " ")
+	var chunks []string
+	for i := 0; i < len(words); i += 3 {
+		chunks = append(chunks, strings.Join(words[i:min(i+3, len(words))], ""))
+	}
+	return chunks
+}
+
+// uploadURL 返回模拟的附件上传地址
+func uploadURL(w http.ResponseWriter, r *http.Request) {
+	key := "mock/" + uuid.New().String()
+	writeJSON(w, core.UploadURLResponse{
+		S3BucketURL: "http://" + r.Host + "/upload",
+		S3ObjectURL: "http://" + r.Host + "/upload/" + key,
+		Fields:      core.CloudinaryUploadInfo{Key: key},
+	})
+}
+
+// modelsConfig 返回内置模型映射中的上游模型及其订阅等级
+func modelsConfig(w http.ResponseWriter, r *http.Request) {
+	type modelInfo struct {
+		SubscriptionTier string `json:"subscription_tier"`
+	}
+	models := map[string]modelInfo{}
+	for _, id := range config.ModelMap {
+		models[id] = modelInfo{SubscriptionTier: "pro"}
+	}
+	for _, id := range config.MaxModelMap {
+		models[id] = modelInfo{SubscriptionTier: "max"}
+	}
+	writeJSON(w, map[string]interface{}{"models": models})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,94 @@
+package model
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// coalescingWriter delays the flushes of a streamed response, so the
+// chunks written within one interval reach the client in a single write.
+type coalescingWriter struct {
+	gin.ResponseWriter
+	mutex    sync.Mutex
+	interval time.Duration
+	minBytes int
+	// pending 上次发送后写入的字节数
+	pending int
+	last    time.Time
+	timer   *time.Timer
+	stopped bool
+}
+
+func (w *coalescingWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	n, err := w.ResponseWriter.Write(data)
+	w.pending += n
+	return n, err
+}
+
+func (w *coalescingWriter) WriteString(s string) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	n, err := w.ResponseWriter.WriteString(s)
+	w.pending += n
+	return n, err
+}
+
+// Flush 距上次发送已满 interval 或积累了 minBytes 字节时立即发送，否则在间隔结束时发送
+func (w *coalescingWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	wait := w.interval - time.Since(w.last)
+	if w.stopped || wait <= 0 || (w.minBytes > 0 && w.pending >= w.minBytes) {
+		w.flush()
+		return
+	}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(wait, func() {
+			w.mutex.Lock()
+			defer w.mutex.Unlock()
+			// 处理函数已返回时不再写出
+			if w.stopped {
+				return
+			}
+			w.timer = nil
+			w.flush()
+		})
+	}
+}
+
+// flush 发送已写入的数据，调用方需持有锁
+func (w *coalescingWriter) flush() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.ResponseWriter.Flush()
+	w.pending = 0
+	w.last = time.Now()
+}
+
+// StartCoalescing batches the chunks of streamed responses: flushes within
+// interval of the last one are held back and sent together when it ends,
+// or as soon as minBytes are waiting. Fewer, larger writes cut the syscalls
+// and reverse proxy overhead of very chatty streams at the cost of up to
+// interval extra latency. The returned function sends what is still held
+// back and must be called before the handler returns.
+func StartCoalescing(gc *gin.Context, interval time.Duration, minBytes int) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	w := &coalescingWriter{ResponseWriter: gc.Writer, interval: interval, minBytes: minBytes}
+	gc.Writer = w
+	return func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+		w.stopped = true
+		if w.timer != nil {
+			w.flush()
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package model
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Error types of the OpenAI error envelope
+const (
+	ErrInvalidRequest = "invalid_request_error"
+	ErrAuthentication = "authentication_error"
+	ErrRateLimit      = "rate_limit_error"
+	ErrUpstream       = "upstream_error"
+	ErrServer         = "server_error"
+)
+
+// Machine-readable error codes that clients may act on
+const (
+	CodeInvalidRequest    = "invalid_request"
+	CodeMissingAPIKey     = "missing_api_key"
+	CodeInvalidAPIKey     = "invalid_api_key"
+	CodeExpiredAPIKey     = "expired_api_key"
+	CodePermissionDenied  = "permission_denied"
+	CodeModelNotAllowed   = "model_not_allowed"
+	CodeContentFilter     = "content_filter"
+	CodeRequestTooLarge   = "request_too_large"
+	CodeLimitExceeded     = "limit_exceeded"
+	CodeNotFound          = "not_found"
+	CodeStreamExpired     = "stream_expired"
+	CodeRateLimitExceeded = "rate_limit_exceeded"
+	CodeKeyThrottled      = "key_throttled"
+	CodeSessionsExhausted = "sessions_exhausted"
+	CodeUpstreamError     = "upstream_error"
+	CodeCircuitOpen       = "circuit_open"
+	CodeOverloaded        = "overloaded"
+	CodeUpstreamTimeout   = "upstream_timeout"
+	CodeInternalError     = "internal_error"
+)
+
+// APIError is the body of an OpenAI error response
+type APIError struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    string  `json:"code"`
+}
+
+// ErrorResponse is the OpenAI error envelope
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// ErrorType returns the error type of an HTTP status
+func ErrorType(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return ErrAuthentication
+	case status == http.StatusTooManyRequests:
+		return ErrRateLimit
+	case status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout:
+		return ErrUpstream
+	case status >= 500:
+		return ErrServer
+	}
+	return ErrInvalidRequest
+}
+
+// defaultCode 未指定错误码时按状态码给出
+func defaultCode(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeInvalidAPIKey
+	case http.StatusForbidden:
+		return CodePermissionDenied
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusTooManyRequests:
+		return CodeRateLimitExceeded
+	case http.StatusRequestEntityTooLarge:
+		return CodeRequestTooLarge
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return CodeUpstreamError
+	}
+	if status >= 500 {
+		return CodeInternalError
+	}
+	return CodeInvalidRequest
+}
+
+// NewError returns the error envelope for status; an empty code is derived
+// from the status
+func NewError(status int, code string, message string) ErrorResponse {
+	if code == "" {
+		code = defaultCode(status)
+	}
+	return ErrorResponse{Error: APIError{Message: message, Type: ErrorType(status), Code: code}}
+}
+
+// ErrorBody returns the error response body for the API the request came
+// in on. Ollama clients only understand a plain string error.
+func ErrorBody(gc *gin.Context, status int, code string, message string) interface{} {
+	if strings.HasPrefix(gc.FullPath(), "/api/") {
+		return gin.H{"error": message}
+	}
+	return NewError(status, code, message)
+}
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// frameBuffers 复用序列化流式数据帧的缓冲区
+var frameBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// maxPooledFrame 超过此大小的缓冲区不放回池中，避免个别大数据帧长期占用内存
+const maxPooledFrame = 64 * 1024
+
+// writeFrame writes prefix, the JSON of v and suffix as one frame and
+// flushes it. Resumable frames are also kept for clients that reconnect.
+func writeFrame(gc *gin.Context, prefix string, v interface{}, suffix string, resumable bool) error {
+	buf := frameBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledFrame {
+			frameBuffers.Put(buf)
+		}
+	}()
+	buf.WriteString(prefix)
+	if err := json.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	// Encode 在末尾多写一个换行，去掉后与 json.Marshal 的结果相同
+	buf.Truncate(buf.Len() - 1)
+	buf.WriteString(suffix)
+	frame := buf.Bytes()
+	if resumable {
+		if rs := ResumableFrom(gc); rs != nil {
+			// append 复制一份保存，缓冲区可以放回池中
+			frame = rs.append(frame)
+		}
+	}
+	gc.Writer.Write(frame)
+	gc.Writer.Flush()
+	return nil
+}
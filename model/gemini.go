@@ -0,0 +1,193 @@
+package model
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// GeminiPart is one part of a Gemini content; Thought marks reasoning
+type GeminiPart struct {
+	Text    string `json:"text"`
+	Thought bool   `json:"thought,omitempty"`
+}
+
+// GeminiContent is the content of a Gemini candidate
+type GeminiContent struct {
+	Role  string       `json:"role"`
+	Parts []GeminiPart `json:"parts"`
+}
+
+// GeminiCandidate is one candidate of a Gemini response
+type GeminiCandidate struct {
+	Content      GeminiContent `json:"content"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	Index        int           `json:"index"`
+}
+
+// GeminiUsage is the usageMetadata of a Gemini response
+type GeminiUsage struct {
+	PromptTokenCount     int `json:"promptTokenCount"`
+	CandidatesTokenCount int `json:"candidatesTokenCount"`
+	TotalTokenCount      int `json:"totalTokenCount"`
+}
+
+// GeminiResponse is a generateContent response or streamGenerateContent chunk
+type GeminiResponse struct {
+	Candidates    []GeminiCandidate `json:"candidates"`
+	UsageMetadata *GeminiUsage      `json:"usageMetadata,omitempty"`
+	ModelVersion  string            `json:"modelVersion"`
+}
+
+// geminiKey is the gin context key of the Gemini response format
+const geminiKey = "gemini"
+
+// geminiFormat 记录请求的模型名与流式输出方式
+type geminiFormat struct {
+	model string
+	// sse 为 false 时流式响应是一个逐步写出的 JSON 数组（未指定 alt=sse）
+	sse     bool
+	started bool
+}
+
+// SetGemini makes the response writers of gc emit Gemini generateContent
+// responses for model. Streams are written as SSE when sse is set and as
+// a JSON array otherwise, like the Gemini API without alt=sse.
+func SetGemini(gc *gin.Context, model string, sse bool) {
+	gc.Set(geminiKey, &geminiFormat{model: model, sse: sse})
+}
+
+// IsGemini reports whether gc responds in the Gemini format
+func IsGemini(gc *gin.Context) bool {
+	return geminiFrom(gc) != nil
+}
+
+func geminiFrom(gc *gin.Context) *geminiFormat {
+	if v, ok := gc.Get(geminiKey); ok {
+		return v.(*geminiFormat)
+	}
+	return nil
+}
+
+// StreamContentType returns the content type of a streamed response
+func StreamContentType(gc *gin.Context) string {
+	if ollamaFrom(gc) != nil {
+		return "application/x-ndjson"
+	}
+	if f := geminiFrom(gc); f != nil && !f.sse {
+		return "application/json"
+	}
+	return "text/event-stream"
+}
+
+// IsSSEStream reports whether a streamed response is written as SSE
+// frames, which is required to resume it with Last-Event-ID.
+func IsSSEStream(gc *gin.Context) bool {
+	f := geminiFrom(gc)
+	return (f == nil || f.sse) && ollamaFrom(gc) == nil
+}
+
+// geminiFinishReason 将 finish_reason 转换为 Gemini 的 finishReason
+func geminiFinishReason(reason string) string {
+	switch reason {
+	case FinishLength:
+		return "MAX_TOKENS"
+	case FinishContentFilter:
+		return "SAFETY"
+	case FinishError:
+		return "OTHER"
+	}
+	return "STOP"
+}
+
+// geminiChunk 将聊天补全数据块转换为 Gemini 数据块，没有内容时返回 nil
+func geminiChunk(chunk *OpenAISrteamResponse, f *geminiFormat) *GeminiResponse {
+	var parts []GeminiPart
+	finishReason := ""
+	for _, choice := range chunk.Choices {
+		if choice.Delta.ReasoningContent != "" {
+			parts = append(parts, GeminiPart{Text: choice.Delta.ReasoningContent, Thought: true})
+		}
+		if text := choice.Delta.Content + choice.Delta.Refusal; text != "" {
+			parts = append(parts, GeminiPart{Text: text})
+		}
+		if reason, ok := choice.FinishReason.(string); ok {
+			finishReason = geminiFinishReason(reason)
+		}
+	}
+	if len(parts) == 0 && finishReason == "" {
+		return nil
+	}
+	return &GeminiResponse{
+		Candidates:   []GeminiCandidate{{Content: GeminiContent{Role: "model", Parts: parts}, FinishReason: finishReason}},
+		ModelVersion: f.model,
+	}
+}
+
+// writeGeminiFrame 按 SSE 或 JSON 数组格式写出一个数据块
+func writeGeminiFrame(resp *GeminiResponse, f *geminiFormat, gc *gin.Context) error {
+	var err error
+	switch {
+	case f.sse:
+		err = writeFrame(gc, "data: ", resp, "\n\n", true)
+	case !f.started:
+		err = writeFrame(gc, "[", resp, "", false)
+	default:
+		err = writeFrame(gc, ",\r\n", resp, "", false)
+	}
+	if err != nil {
+		return err
+	}
+	f.started = true
+	return nil
+}
+
+// geminiStreamDone 发送带 finishReason 与 usageMetadata 的最后一个数据块
+func geminiStreamDone(gc *gin.Context, f *geminiFormat) {
+	resp := &GeminiResponse{
+		Candidates: []GeminiCandidate{{
+			Content:      GeminiContent{Role: "model", Parts: []GeminiPart{{Text: ""}}},
+			FinishReason: geminiFinishReason(finishReasonFrom(gc)),
+		}},
+		ModelVersion: f.model,
+	}
+	if meter := UsageMeterFrom(gc); meter != nil {
+		resp.UsageMetadata = geminiUsage(meter.Usage())
+	}
+	writeGeminiFrame(resp, f, gc)
+	if !f.sse {
+		gc.Writer.Write([]byte("]"))
+		gc.Writer.Flush()
+	}
+	if rs := ResumableFrom(gc); rs != nil {
+		rs.Finish()
+	}
+}
+
+func geminiUsage(usage Usage) *GeminiUsage {
+	return &GeminiUsage{
+		PromptTokenCount:     usage.PromptTokens,
+		CandidatesTokenCount: usage.CompletionTokens,
+		TotalTokenCount:      usage.TotalTokens,
+	}
+}
+
+func noStreamGeminiResponse(text string, reasoning string, gc *gin.Context, f *geminiFormat) error {
+	text += gc.GetString(refusalKey)
+	parts := []GeminiPart{}
+	if reasoning != "" {
+		parts = append(parts, GeminiPart{Text: reasoning, Thought: true})
+	}
+	parts = append(parts, GeminiPart{Text: text})
+	resp := &GeminiResponse{
+		Candidates: []GeminiCandidate{{
+			Content:      GeminiContent{Role: "model", Parts: parts},
+			FinishReason: geminiFinishReason(finishReasonFrom(gc)),
+		}},
+		ModelVersion: f.model,
+	}
+	if meter := UsageMeterFrom(gc); meter != nil {
+		meter.AddCompletion(reasoning + text)
+		resp.UsageMetadata = geminiUsage(meter.Usage())
+	}
+	gc.JSON(200, resp)
+	return nil
+}
@@ -0,0 +1,106 @@
+package model
+
+import (
+	"pplx2api/config"
+	"pplx2api/utils"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// imagesKey is the gin context key of the images of the answer
+const imagesKey = "images"
+
+// Image outputs accepted by IMAGE_OUTPUT
+const (
+	ImageOutputMarkdown = "markdown"
+	ImageOutputParts    = "image_url"
+	ImageOutputOff      = "off"
+)
+
+// Image is an image Perplexity generated or retrieved for the answer
+type Image struct {
+	URL string `json:"url"`
+	// Name 生成图片的模型名或图片标题
+	Name string `json:"name,omitempty"`
+}
+
+// ContentPart is one part of a multimodal assistant message
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+// ImageURL is the image of an image_url content part
+type ImageURL struct {
+	URL string `json:"url"`
+}
+
+// AddImages records images of the answer written to gc
+func AddImages(gc *gin.Context, images []Image) {
+	gc.Set(imagesKey, append(ImagesFrom(gc), images...))
+}
+
+// ImagesFrom returns the images recorded for gc
+func ImagesFrom(gc *gin.Context) []Image {
+	if v, ok := gc.Get(imagesKey); ok {
+		return v.([]Image)
+	}
+	return nil
+}
+
+// ImagesInText reports whether the images of the answer are written into
+// the text as markdown. Content parts only exist in non-streamed OpenAI
+// chat responses, other responses fall back to markdown.
+func ImagesInText(gc *gin.Context, stream bool) bool {
+	switch config.ConfigInstance.ImageOutput {
+	case ImageOutputOff:
+		return false
+	case ImageOutputParts:
+		return stream || !imagePartsSupported(gc)
+	}
+	return true
+}
+
+// imagePartsSupported 只有非流式的 OpenAI 聊天响应支持 image_url 内容片段
+func imagePartsSupported(gc *gin.Context) bool {
+	return !isTextCompletion(gc) && geminiFrom(gc) == nil && ollamaFrom(gc) == nil
+}
+
+// imageParts 返回 image_url 模式下作为内容片段返回的图片，其他模式返回 nil
+func imageParts(gc *gin.Context) []Image {
+	if config.ConfigInstance.ImageOutput != ImageOutputParts || !imagePartsSupported(gc) {
+		return nil
+	}
+	return ImagesFrom(gc)
+}
+
+// ImagesMarkdown renders images as markdown image links followed by their names
+func ImagesMarkdown(images []Image) string {
+	if len(images) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	names := make([]string, 0, len(images))
+	for i, image := range images {
+		b.WriteString(utils.ImageShow(i, image.Name, image.URL))
+		names = append(names, image.Name)
+	}
+	return b.String() + "\n\n---\n" + strings.Join(names, ", ")
+}
+
+// messageContent 返回消息内容，有图片片段时为文本加 image_url 片段的数组
+func messageContent(text string, images []Image) interface{} {
+	if len(images) == 0 {
+		return text
+	}
+	parts := []ContentPart{}
+	if text != "" {
+		parts = append(parts, ContentPart{Type: "text", Text: text})
+	}
+	for _, image := range images {
+		parts = append(parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: image.URL}})
+	}
+	return parts
+}
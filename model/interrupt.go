@@ -0,0 +1,34 @@
+package model
+
+import "github.com/gin-gonic/gin"
+
+// interruptKey is the gin context key of the shutdown interrupt channel
+const interruptKey = "interrupt"
+
+// SetInterrupt attaches a channel that is closed when the response must end
+// early, e.g. at the shutdown drain timeout.
+func SetInterrupt(gc *gin.Context, ch <-chan struct{}) {
+	gc.Set(interruptKey, ch)
+}
+
+// InterruptFrom returns the interrupt channel attached to gc, nil if none
+func InterruptFrom(gc *gin.Context) <-chan struct{} {
+	if v, ok := gc.Get(interruptKey); ok {
+		return v.(<-chan struct{})
+	}
+	return nil
+}
+
+// Interrupted reports whether the response of gc was ended early
+func Interrupted(gc *gin.Context) bool {
+	stop := InterruptFrom(gc)
+	if stop == nil {
+		return false
+	}
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,102 @@
+package model
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keepaliveComment SSE 注释行，客户端会忽略，但能让代理认为连接仍在活动
+var keepaliveComment = []byte(": keepalive\n\n")
+
+// keepaliveWriter serializes the writes of the handler with the heartbeat
+// and remembers when the last bytes were written.
+type keepaliveWriter struct {
+	gin.ResponseWriter
+	mutex sync.Mutex
+	last  time.Time
+	// sse 响应已作为 SSE 流开始输出
+	sse bool
+}
+
+// touch 记录写入时间，调用方需持有锁
+func (w *keepaliveWriter) touch() {
+	w.last = time.Now()
+	if !w.sse && w.ResponseWriter.Written() {
+		w.sse = strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream")
+	}
+}
+
+func (w *keepaliveWriter) Write(data []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	n, err := w.ResponseWriter.Write(data)
+	w.touch()
+	return n, err
+}
+
+func (w *keepaliveWriter) WriteString(s string) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	n, err := w.ResponseWriter.WriteString(s)
+	w.touch()
+	return n, err
+}
+
+func (w *keepaliveWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.ResponseWriter.Flush()
+	w.touch()
+}
+
+// beat 空闲超过 interval 时写入一条注释行
+func (w *keepaliveWriter) beat(interval time.Duration) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.sse || time.Since(w.last) < interval {
+		return
+	}
+	w.ResponseWriter.Write(keepaliveComment)
+	w.ResponseWriter.Flush()
+	w.last = time.Now()
+}
+
+// StartKeepalive writes an SSE comment line whenever a streamed response
+// has been idle for interval, e.g. while Deep Research or a reasoning model
+// works without emitting tokens, so reverse proxies and clients don't drop
+// the connection. Nothing is written before the stream started or for
+// responses that aren't SSE. The returned function stops the heartbeat and
+// must be called before the handler returns.
+func StartKeepalive(gc *gin.Context, interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+	w := &keepaliveWriter{ResponseWriter: gc.Writer, last: time.Now()}
+	gc.Writer = w
+	ctx := gc.Request.Context()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// 以较小的步长检查，使注释行在空闲满 interval 后尽快发出
+		ticker := time.NewTicker(interval / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.beat(interval)
+			case <-stop:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
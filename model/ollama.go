@@ -0,0 +1,120 @@
+package model
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OllamaMessage is a message of an Ollama /api/chat response
+type OllamaMessage struct {
+	Role     string `json:"role"`
+	Content  string `json:"content"`
+	Thinking string `json:"thinking,omitempty"`
+}
+
+// OllamaResponse is an /api/chat or /api/generate response line. Chat
+// responses carry Message, generate responses Response and Thinking.
+type OllamaResponse struct {
+	Model           string         `json:"model"`
+	CreatedAt       time.Time      `json:"created_at"`
+	Message         *OllamaMessage `json:"message,omitempty"`
+	Response        *string        `json:"response,omitempty"`
+	Thinking        string         `json:"thinking,omitempty"`
+	Done            bool           `json:"done"`
+	DoneReason      string         `json:"done_reason,omitempty"`
+	TotalDuration   int64          `json:"total_duration,omitempty"`
+	PromptEvalCount int            `json:"prompt_eval_count,omitempty"`
+	EvalCount       int            `json:"eval_count,omitempty"`
+}
+
+// ollamaKey is the gin context key of the Ollama response format
+const ollamaKey = "ollama"
+
+type ollamaFormat struct {
+	model string
+	// generate 为 true 时按 /api/generate 格式输出
+	generate bool
+	started  time.Time
+}
+
+// SetOllama makes the response writers of gc emit Ollama /api/chat
+// responses for model, or /api/generate responses when generate is set.
+// Streams are newline delimited JSON.
+func SetOllama(gc *gin.Context, model string, generate bool) {
+	gc.Set(ollamaKey, &ollamaFormat{model: model, generate: generate, started: time.Now()})
+}
+
+func ollamaFrom(gc *gin.Context) *ollamaFormat {
+	if v, ok := gc.Get(ollamaKey); ok {
+		return v.(*ollamaFormat)
+	}
+	return nil
+}
+
+// response 返回只含推理与正文的一行响应
+func (f *ollamaFormat) response(text string, thinking string) *OllamaResponse {
+	resp := &OllamaResponse{Model: f.model, CreatedAt: time.Now().UTC()}
+	if f.generate {
+		resp.Response, resp.Thinking = &text, thinking
+	} else {
+		resp.Message = &OllamaMessage{Role: "assistant", Content: text, Thinking: thinking}
+	}
+	return resp
+}
+
+// ollamaDoneReason 将 finish_reason 转换为 Ollama 的 done_reason，被过滤或上游出错的回答不报告为 stop
+func ollamaDoneReason(reason string) string {
+	switch reason {
+	case FinishLength, FinishContentFilter, FinishError:
+		return reason
+	}
+	return "stop"
+}
+
+// done 在响应中填入结束原因、耗时与 token 数
+func (f *ollamaFormat) done(resp *OllamaResponse, gc *gin.Context) {
+	resp.Done = true
+	resp.DoneReason = ollamaDoneReason(finishReasonFrom(gc))
+	resp.TotalDuration = time.Since(f.started).Nanoseconds()
+	if meter := UsageMeterFrom(gc); meter != nil {
+		usage := meter.Usage()
+		resp.PromptEvalCount, resp.EvalCount = usage.PromptTokens, usage.CompletionTokens
+	}
+}
+
+// ollamaChunk 将聊天补全数据块转换为一行 Ollama 响应，没有内容时返回 nil
+func ollamaChunk(chunk *OpenAISrteamResponse, f *ollamaFormat) *OllamaResponse {
+	var text, thinking string
+	for _, choice := range chunk.Choices {
+		text += choice.Delta.Content + choice.Delta.Refusal
+		thinking += choice.Delta.ReasoningContent
+	}
+	if text == "" && thinking == "" {
+		return nil
+	}
+	return f.response(text, thinking)
+}
+
+// writeOllamaLine 写出一行 JSON
+func writeOllamaLine(resp *OllamaResponse, gc *gin.Context) error {
+	return writeFrame(gc, "", resp, "\n", false)
+}
+
+// ollamaStreamDone 发送 done 为 true 的最后一行
+func ollamaStreamDone(gc *gin.Context, f *ollamaFormat) {
+	resp := f.response("", "")
+	f.done(resp, gc)
+	writeOllamaLine(resp, gc)
+}
+
+func noStreamOllamaResponse(text string, reasoning string, gc *gin.Context, f *ollamaFormat) error {
+	text += gc.GetString(refusalKey)
+	if meter := UsageMeterFrom(gc); meter != nil {
+		meter.AddCompletion(reasoning + text)
+	}
+	resp := f.response(text, reasoning)
+	f.done(resp, gc)
+	gc.JSON(200, resp)
+	return nil
+}
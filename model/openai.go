@@ -1,9 +1,9 @@
 package model
 
 import (
-	"encoding/json"
 	"fmt"
 	"pplx2api/logger"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -24,6 +24,10 @@ type OpenAISrteamResponse struct {
 	Created int64          `json:"created"`
 	Model   string         `json:"model"`
 	Choices []StreamChoice `json:"choices"`
+	Usage   *Usage         `json:"usage,omitempty"`
+	// Claims、Citations 为扩展字段，在最后一个数据块中返回
+	Claims    []Claim  `json:"claims,omitempty"`
+	Citations []string `json:"citations,omitempty"`
 }
 
 // Choice 结构表示 OpenAI 返回的单个选项
@@ -44,12 +48,17 @@ type NoStreamChoice struct {
 // Delta 结构用于存储返回的文本内容
 type Delta struct {
 	Content string `json:"content"`
+	// ReasoningContent DeepSeek 风格的推理内容通道
+	ReasoningContent string `json:"reasoning_content,omitempty"`
+	Refusal          string `json:"refusal,omitempty"`
 }
 type Message struct {
-	Role       string        `json:"role"`
-	Content    string        `json:"content"`
-	Refusal    interface{}   `json:"refusal"`
-	Annotation []interface{} `json:"annotation"`
+	Role string `json:"role"`
+	// Content 文本，或 IMAGE_OUTPUT=image_url 且回答含图片时的内容片段数组
+	Content          interface{}   `json:"content"`
+	ReasoningContent string        `json:"reasoning_content,omitempty"`
+	Refusal          interface{}   `json:"refusal"`
+	Annotation       []interface{} `json:"annotation"`
 }
 
 type OpenAIResponse struct {
@@ -59,22 +68,311 @@ type OpenAIResponse struct {
 	Model   string           `json:"model"`
 	Choices []NoStreamChoice `json:"choices"`
 	Usage   Usage            `json:"usage"`
+	// Claims、Citations 为扩展字段，仅在请求提取时返回
+	Claims    []Claim  `json:"claims,omitempty"`
+	Citations []string `json:"citations,omitempty"`
 }
+
+// Claim is a statement of the answer and the citations supporting it
+type Claim struct {
+	Statement string `json:"statement"`
+	// Sources 支持该陈述的引用在 citations 中的索引
+	Sources []int `json:"sources"`
+}
+
+// claimsKey is the gin context key of the extracted claims
+const claimsKey = "claims"
+
+type extractedClaims struct {
+	claims    []Claim
+	citations []string
+}
+
+// SetClaims attaches the claims extracted from the answer and the
+// citation URLs they refer to, returned with the end of the response.
+func SetClaims(gc *gin.Context, claims []Claim, citations []string) {
+	gc.Set(claimsKey, extractedClaims{claims: claims, citations: citations})
+}
+
+func claimsFrom(gc *gin.Context) (extractedClaims, bool) {
+	if v, ok := gc.Get(claimsKey); ok {
+		return v.(extractedClaims), true
+	}
+	return extractedClaims{}, false
+}
+
 type Usage struct {
 	PromptTokens     int `json:"prompt_tokens"`
 	CompletionTokens int `json:"completion_tokens"`
 	TotalTokens      int `json:"total_tokens"`
 }
 
+// UsageMeter counts the tokens of one completion as it is written
+type UsageMeter interface {
+	AddCompletion(text string)
+	Usage() Usage
+	// IncludeInStream 对应 stream_options.include_usage
+	IncludeInStream() bool
+}
+
+// usageMeterKey is the gin context key of the current UsageMeter
+const usageMeterKey = "usage_meter"
+
+// SetUsageMeter attaches a meter to gc so responses report usage
+func SetUsageMeter(gc *gin.Context, meter UsageMeter) {
+	gc.Set(usageMeterKey, meter)
+}
+
+// UsageMeterFrom returns the meter attached to gc, if any
+func UsageMeterFrom(gc *gin.Context) UsageMeter {
+	if v, ok := gc.Get(usageMeterKey); ok {
+		return v.(UsageMeter)
+	}
+	return nil
+}
+
+// OutputFilter rewrites completion text before it is written. Returning
+// an empty string drops the text.
+type OutputFilter interface {
+	Filter(text string) string
+}
+
+// outputFilterKey is the gin context key of the current OutputFilter
+const outputFilterKey = "output_filter"
+
+// SetOutputFilter attaches a filter to gc
+func SetOutputFilter(gc *gin.Context, filter OutputFilter) {
+	gc.Set(outputFilterKey, filter)
+}
+
+func outputFilterFrom(gc *gin.Context) OutputFilter {
+	if v, ok := gc.Get(outputFilterKey); ok {
+		return v.(OutputFilter)
+	}
+	return nil
+}
+
+// OutputFlusher is implemented by output filters that hold back text, such
+// as a possible start of a stop sequence, until the response ends.
+type OutputFlusher interface {
+	Flush() string
+}
+
+// PrependOutputFilter attaches a filter applied before the filter already
+// attached to gc, if any
+func PrependOutputFilter(gc *gin.Context, filter OutputFilter) {
+	if next := outputFilterFrom(gc); next != nil {
+		filter = chainedFilter{first: filter, second: next}
+	}
+	SetOutputFilter(gc, filter)
+}
+
+// AddOutputFilter attaches a filter applied to the output of the filter
+// already attached to gc, if any
+func AddOutputFilter(gc *gin.Context, filter OutputFilter) {
+	if prev := outputFilterFrom(gc); prev != nil {
+		filter = chainedFilter{first: prev, second: filter}
+	}
+	SetOutputFilter(gc, filter)
+}
+
+type chainedFilter struct {
+	first, second OutputFilter
+}
+
+func (f chainedFilter) Filter(text string) string {
+	if text = f.first.Filter(text); text == "" {
+		return ""
+	}
+	return f.second.Filter(text)
+}
+
+func (f chainedFilter) Flush() string {
+	var text string
+	if flusher, ok := f.first.(OutputFlusher); ok {
+		if text = flusher.Flush(); text != "" {
+			text = f.second.Filter(text)
+		}
+	}
+	if flusher, ok := f.second.(OutputFlusher); ok {
+		text += flusher.Flush()
+	}
+	return text
+}
+
+// flushOutput 取出输出过滤器保留的文本
+func flushOutput(gc *gin.Context) string {
+	if flusher, ok := outputFilterFrom(gc).(OutputFlusher); ok {
+		return flusher.Flush()
+	}
+	return ""
+}
+
+// outputEndedKey is set on gc once the output filters ended the response
+const outputEndedKey = "output_ended"
+
+// EndOutput marks the response as complete, e.g. at a stop sequence, so
+// the upstream request is cancelled instead of read to the end.
+func EndOutput(gc *gin.Context) {
+	gc.Set(outputEndedKey, true)
+}
+
+// OutputEnded reports whether EndOutput was called for gc
+func OutputEnded(gc *gin.Context) bool {
+	return gc.GetBool(outputEndedKey)
+}
+
+// outputWatcherKey is the gin context key of the OutputWatcher filter
+const outputWatcherKey = "output_watcher"
+
+// SetOutputWatcher attaches a filter that sees the text of a non-streamed
+// response as it arrives, which is otherwise only filtered once complete,
+// so it can call EndOutput early. Its output is discarded.
+func SetOutputWatcher(gc *gin.Context, filter OutputFilter) {
+	gc.Set(outputWatcherKey, filter)
+}
+
+// WatchOutput passes text of a non-streamed response to the watcher
+func WatchOutput(gc *gin.Context, text string) {
+	if v, ok := gc.Get(outputWatcherKey); ok {
+		v.(OutputFilter).Filter(text)
+	}
+}
+
+// StreamObserver is notified of every delta written to a stream
+type StreamObserver interface {
+	OnDelta(text string)
+}
+
+// streamObserverKey is the gin context key of the current StreamObserver
+const streamObserverKey = "stream_observer"
+
+// SetStreamObserver attaches an observer to gc
+func SetStreamObserver(gc *gin.Context, observer StreamObserver) {
+	gc.Set(streamObserverKey, observer)
+}
+
+// Finish reasons of a completion
+const (
+	FinishStop          = "stop"
+	FinishLength        = "length"
+	FinishContentFilter = "content_filter"
+	// FinishError 上游中途出错，只返回了已收到的部分
+	FinishError = "error"
+)
+
+// openAIFinishReason 转换为 OpenAI 定义的结束原因，上游出错而不完整的回答报告为 length
+func openAIFinishReason(reason string) string {
+	if reason == FinishError {
+		return FinishLength
+	}
+	return reason
+}
+
+const (
+	// finishReasonKey is the gin context key of a finish reason other than stop
+	finishReasonKey = "finish_reason"
+	// refusalKey is the gin context key of the refusal of a non-streamed response
+	refusalKey = "refusal"
+)
+
+// streamedKey is the gin context key of the answer text streamed so far
+const streamedKey = "streamed_content"
+
+// TrackStreamed keeps the answer text written to a stream, so a broken
+// upstream stream can be continued from where the client is
+func TrackStreamed(gc *gin.Context) {
+	gc.Set(streamedKey, &strings.Builder{})
+}
+
+// Streamed returns the answer text streamed so far, empty unless tracked
+func Streamed(gc *gin.Context) string {
+	if v, ok := gc.Get(streamedKey); ok {
+		return v.(*strings.Builder).String()
+	}
+	return ""
+}
+
+// SetFinishReason sets the finish_reason reported when the response ends
+func SetFinishReason(gc *gin.Context, reason string) {
+	gc.Set(finishReasonKey, reason)
+}
+
+// partialKey is the gin context key set when a response was cut short
+const partialKey = "partial_response"
+
+// MarkPartial ends a non-streamed response with the text received so far,
+// after an upstream timeout or failure, and tells the client with the
+// X-Partial-Response header.
+func MarkPartial(gc *gin.Context, reason string) {
+	gc.Set(partialKey, true)
+	SetFinishReason(gc, reason)
+	gc.Header("X-Partial-Response", "true")
+}
+
+// Partial reports whether the response was cut short by MarkPartial
+func Partial(gc *gin.Context) bool {
+	return gc.GetBool(partialKey)
+}
+
+func finishReasonFrom(gc *gin.Context) string {
+	if v, ok := gc.Get(finishReasonKey); ok {
+		return v.(string)
+	}
+	return FinishStop
+}
+
+// ReturnOpenAIRefusal writes text in the refusal field instead of the
+// content. Streams send it as refusal deltas; for non-streamed responses
+// it is collected and set on the message.
+func ReturnOpenAIRefusal(text string, stream bool, gc *gin.Context) error {
+	if stream {
+		return streamDelta(Delta{Refusal: text}, text, gc)
+	}
+	refusal := gc.GetString(refusalKey)
+	gc.Set(refusalKey, refusal+text)
+	return nil
+}
+
 func ReturnOpenAIResponse(text string, stream bool, gc *gin.Context) error {
+	if filter := outputFilterFrom(gc); filter != nil {
+		text = filter.Filter(text)
+		if text == "" && stream {
+			return nil
+		}
+	}
 	if stream {
 		return streamRespose(text, gc)
 	} else {
-		return noStreamResponse(text, gc)
+		return noStreamResponse(text, "", gc)
+	}
+}
+
+// ReturnOpenAIMessage writes a non-streamed completion with its reasoning
+// in the reasoning_content field.
+func ReturnOpenAIMessage(text string, reasoning string, gc *gin.Context) error {
+	if filter := outputFilterFrom(gc); filter != nil {
+		text = filter.Filter(text) + flushOutput(gc)
 	}
+	return noStreamResponse(text, reasoning, gc)
 }
 
 func streamRespose(text string, gc *gin.Context) error {
+	return streamDelta(Delta{Content: text}, text, gc)
+}
+
+// ReturnOpenAIReasoning streams text on the reasoning_content channel.
+// Output filters only apply to the answer, so reasoning is written as is.
+func ReturnOpenAIReasoning(text string, gc *gin.Context) error {
+	return streamDelta(Delta{ReasoningContent: text}, text, gc)
+}
+
+// streamDelta 发送一个增量数据块，text 计入用量并通知观察者
+func streamDelta(delta Delta, text string, gc *gin.Context) error {
+	if isTextCompletion(gc) && delta.Content == "" && delta.Refusal == "" {
+		// 文本补全没有推理通道
+		return nil
+	}
 	openAIResp := &OpenAISrteamResponse{
 		ID:      uuid.New().String(),
 		Object:  "chat.completion.chunk",
@@ -82,31 +380,122 @@ func streamRespose(text string, gc *gin.Context) error {
 		Model:   "claude-3-7-sonnet-20250219",
 		Choices: []StreamChoice{
 			{
-				Index: 0,
-				Delta: Delta{
-					Content: text,
-				},
+				Index:        0,
+				Delta:        delta,
 				Logprobs:     nil,
 				FinishReason: nil,
 			},
 		},
 	}
 
-	jsonBytes, err := json.Marshal(openAIResp)
-	jsonBytes = append([]byte("data: "), jsonBytes...)
-	jsonBytes = append(jsonBytes, []byte("\n\n")...)
-	if err != nil {
+	if meter := UsageMeterFrom(gc); meter != nil {
+		meter.AddCompletion(text)
+	}
+	if v, ok := gc.Get(streamedKey); ok {
+		v.(*strings.Builder).WriteString(delta.Content)
+	}
+	if v, ok := gc.Get(streamObserverKey); ok {
+		v.(StreamObserver).OnDelta(text)
+	}
+	recordDelta(gc, delta)
+	return writeStreamChunk(openAIResp, gc)
+}
+
+// writeStreamChunk 序列化并发送一个 SSE 数据帧
+func writeStreamChunk(chunk *OpenAISrteamResponse, gc *gin.Context) error {
+	if f := geminiFrom(gc); f != nil {
+		if resp := geminiChunk(chunk, f); resp != nil {
+			return writeGeminiFrame(resp, f, gc)
+		}
+		return nil
+	}
+	if f := ollamaFrom(gc); f != nil {
+		if resp := ollamaChunk(chunk, f); resp != nil {
+			return writeOllamaLine(resp, gc)
+		}
+		return nil
+	}
+	var payload interface{} = chunk
+	if isTextCompletion(gc) {
+		payload = textChunk(chunk)
+	}
+	if err := writeFrame(gc, "data: ", payload, "\n\n", true); err != nil {
 		logger.Error(fmt.Sprintf("Error marshalling JSON: %v", err))
 		return err
 	}
+	return nil
+}
 
-	// 发送数据
-	gc.Writer.Write(jsonBytes)
+// StreamDone writes the end marker of a streamed response
+func StreamDone(gc *gin.Context) {
+	// 输出过滤器保留的文本在结束前发出
+	if text := flushOutput(gc); text != "" {
+		streamRespose(text, gc)
+	}
+	recordFinish(gc)
+	if f := geminiFrom(gc); f != nil {
+		geminiStreamDone(gc, f)
+		return
+	}
+	if f := ollamaFrom(gc); f != nil {
+		ollamaStreamDone(gc, f)
+		return
+	}
+	// 与 OpenAI 一致，以带 finish_reason 的空增量结束
+	writeStreamChunk(&OpenAISrteamResponse{
+		ID:      uuid.New().String(),
+		Object:  "chat.completion.chunk",
+		Created: time.Now().Unix(),
+		Model:   "claude-3-7-sonnet-20250219",
+		Choices: []StreamChoice{{Index: 0, Delta: Delta{}, FinishReason: openAIFinishReason(finishReasonFrom(gc))}},
+	}, gc)
+	// 按 stream_options.include_usage 在结束前发送仅含 usage 的数据块
+	if meter := UsageMeterFrom(gc); meter != nil && meter.IncludeInStream() {
+		usage := meter.Usage()
+		writeStreamChunk(&OpenAISrteamResponse{
+			ID:      uuid.New().String(),
+			Object:  "chat.completion.chunk",
+			Created: time.Now().Unix(),
+			Model:   "claude-3-7-sonnet-20250219",
+			Choices: []StreamChoice{},
+			Usage:   &usage,
+		}, gc)
+	}
+	if extracted, ok := claimsFrom(gc); ok {
+		writeStreamChunk(&OpenAISrteamResponse{
+			ID:        uuid.New().String(),
+			Object:    "chat.completion.chunk",
+			Created:   time.Now().Unix(),
+			Model:     "claude-3-7-sonnet-20250219",
+			Choices:   []StreamChoice{},
+			Claims:    extracted.claims,
+			Citations: extracted.citations,
+		}, gc)
+	}
+	frame := []byte("data: [DONE]\n\n")
+	rs := ResumableFrom(gc)
+	if rs != nil {
+		frame = rs.append(frame)
+	}
+	gc.Writer.Write(frame)
 	gc.Writer.Flush()
-	return nil
+	if rs != nil {
+		rs.Finish()
+	}
 }
 
-func noStreamResponse(text string, gc *gin.Context) error {
+func noStreamResponse(text string, reasoning string, gc *gin.Context) error {
+	recordMessage(gc, text, reasoning, gc.GetString(refusalKey))
+	recordFinish(gc)
+	if isTextCompletion(gc) {
+		return noStreamTextResponse(text, gc)
+	}
+	if f := geminiFrom(gc); f != nil {
+		return noStreamGeminiResponse(text, reasoning, gc, f)
+	}
+	if f := ollamaFrom(gc); f != nil {
+		return noStreamOllamaResponse(text, reasoning, gc, f)
+	}
 	openAIResp := &OpenAIResponse{
 		ID:      uuid.New().String(),
 		Object:  "chat.completion",
@@ -116,14 +505,27 @@ func noStreamResponse(text string, gc *gin.Context) error {
 			{
 				Index: 0,
 				Message: Message{
-					Role:    "assistant",
-					Content: text,
+					Role:             "assistant",
+					Content:          messageContent(text, imageParts(gc)),
+					ReasoningContent: reasoning,
 				},
 				Logprobs:     nil,
-				FinishReason: "stop",
+				FinishReason: openAIFinishReason(finishReasonFrom(gc)),
 			},
 		},
 	}
+	if extracted, ok := claimsFrom(gc); ok {
+		openAIResp.Claims = extracted.claims
+		openAIResp.Citations = extracted.citations
+	}
+	refusal := gc.GetString(refusalKey)
+	if refusal != "" {
+		openAIResp.Choices[0].Message.Refusal = refusal
+	}
+	if meter := UsageMeterFrom(gc); meter != nil {
+		meter.AddCompletion(reasoning + text + refusal)
+		openAIResp.Usage = meter.Usage()
+	}
 
 	gc.JSON(200, openAIResp)
 	return nil
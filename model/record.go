@@ -0,0 +1,224 @@
+package model
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recordingKey is the gin context key of the current Recording
+const recordingKey = "recording"
+
+// replayChunkRunes 重放缓存的流式响应时每个数据块的字符数
+const replayChunkRunes = 16
+
+// Recording is the completion written to a client, kept so an identical
+// request can be answered again without calling Perplexity. While it is
+// being written other requests can follow it with Follow.
+type Recording struct {
+	mutex        sync.Mutex
+	Content      string `json:"content"`
+	Reasoning    string `json:"reasoning,omitempty"`
+	Refusal      string `json:"refusal,omitempty"`
+	FinishReason string `json:"finish_reason"`
+	// Images 作为内容片段返回、未写入正文的图片
+	Images []Image `json:"images,omitempty"`
+	// updated 每次追加内容时关闭并替换，closed 为 true 时不会再有内容
+	updated chan struct{}
+	closed  bool
+}
+
+// Record starts recording the response written to gc
+func Record(gc *gin.Context) *Recording {
+	rec := &Recording{updated: make(chan struct{})}
+	gc.Set(recordingKey, rec)
+	return rec
+}
+
+// notify 唤醒等待新内容的请求，调用方需持有锁
+func (rec *Recording) notify() {
+	if rec.updated != nil {
+		close(rec.updated)
+		rec.updated = make(chan struct{})
+	}
+}
+
+// Close marks the recording complete, whether or not the response finished
+func (rec *Recording) Close() {
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	rec.closed = true
+	rec.notify()
+}
+
+func recordingFrom(gc *gin.Context) *Recording {
+	if v, ok := gc.Get(recordingKey); ok {
+		return v.(*Recording)
+	}
+	return nil
+}
+
+// recordDelta 记录一个已发送的增量数据块
+func recordDelta(gc *gin.Context, delta Delta) {
+	if rec := recordingFrom(gc); rec != nil {
+		rec.mutex.Lock()
+		rec.Content += delta.Content
+		rec.Reasoning += delta.ReasoningContent
+		rec.Refusal += delta.Refusal
+		rec.notify()
+		rec.mutex.Unlock()
+	}
+}
+
+// recordMessage 记录非流式响应与结束原因
+func recordMessage(gc *gin.Context, text string, reasoning string, refusal string) {
+	if rec := recordingFrom(gc); rec != nil {
+		rec.mutex.Lock()
+		rec.Content, rec.Reasoning, rec.Refusal = text, reasoning, refusal
+		rec.Images = imageParts(gc)
+		rec.notify()
+		rec.mutex.Unlock()
+	}
+}
+
+// recordFinish 记录响应的结束原因
+func recordFinish(gc *gin.Context) {
+	if rec := recordingFrom(gc); rec != nil {
+		rec.mutex.Lock()
+		rec.FinishReason = finishReasonFrom(gc)
+		rec.closed = true
+		rec.notify()
+		rec.mutex.Unlock()
+	}
+}
+
+// StartStream writes the headers of a streamed response. It does nothing
+// when the stream already started, e.g. when a broken upstream stream is
+// continued by another request.
+func StartStream(gc *gin.Context) {
+	if gc.Writer.Written() {
+		return
+	}
+	gc.Writer.Header().Set("Content-Type", StreamContentType(gc))
+	gc.Writer.Header().Set("Cache-Control", "no-cache")
+	gc.Writer.Header().Set("Connection", "keep-alive")
+	gc.Writer.WriteHeader(http.StatusOK)
+	gc.Writer.Flush()
+}
+
+// Replay writes a recorded completion in the response format set on gc.
+// Streams are replayed in small chunks, like a live response. Output
+// filters were applied when the completion was recorded and are skipped.
+func Replay(gc *gin.Context, rec *Recording, stream bool) {
+	if rec.FinishReason != "" && rec.FinishReason != FinishStop {
+		SetFinishReason(gc, rec.FinishReason)
+	}
+	if !stream {
+		if rec.Refusal != "" {
+			gc.Set(refusalKey, rec.Refusal)
+		}
+		noStreamResponse(rec.Content+replayImages(gc, rec, false), rec.Reasoning, gc)
+		return
+	}
+	StartStream(gc)
+	for _, part := range splitRunes(rec.Reasoning, replayChunkRunes) {
+		ReturnOpenAIReasoning(part, gc)
+	}
+	if rec.Refusal != "" {
+		streamDelta(Delta{Refusal: rec.Refusal}, rec.Refusal, gc)
+	}
+	for _, part := range splitRunes(rec.Content+replayImages(gc, rec, true), replayChunkRunes) {
+		streamRespose(part, gc)
+	}
+	StreamDone(gc)
+}
+
+// replayImages 处理录制时作为内容片段返回的图片：当前响应支持片段时照常附加，
+// 否则返回要追加到正文的 markdown
+func replayImages(gc *gin.Context, rec *Recording, stream bool) string {
+	if len(rec.Images) == 0 {
+		return ""
+	}
+	if ImagesInText(gc, stream) {
+		return ImagesMarkdown(rec.Images)
+	}
+	AddImages(gc, rec.Images)
+	return ""
+}
+
+// Follow writes a recording that is still being written to gc as it grows,
+// in the response format set on gc. It returns false without writing
+// anything when the recording closed before any output, so the caller can
+// send the request itself, or when ctx is done first.
+func Follow(ctx context.Context, gc *gin.Context, rec *Recording, stream bool) bool {
+	var content, reasoning, refusal int
+	started := false
+	for {
+		rec.mutex.Lock()
+		newContent, newReasoning, newRefusal := rec.Content[content:], rec.Reasoning[reasoning:], rec.Refusal[refusal:]
+		content, reasoning, refusal = len(rec.Content), len(rec.Reasoning), len(rec.Refusal)
+		finish, closed, updated := rec.FinishReason, rec.closed, rec.updated
+		rec.mutex.Unlock()
+
+		if closed && finish == "" && !started && content+reasoning+refusal == 0 {
+			return false
+		}
+		if !stream {
+			if closed {
+				Replay(gc, rec, false)
+				return true
+			}
+		} else if newContent != "" || newReasoning != "" || newRefusal != "" || closed {
+			if !started {
+				StartStream(gc)
+				started = true
+			}
+			if newReasoning != "" {
+				ReturnOpenAIReasoning(newReasoning, gc)
+			}
+			if newRefusal != "" {
+				streamDelta(Delta{Refusal: newRefusal}, newRefusal, gc)
+			}
+			if closed {
+				newContent += replayImages(gc, rec, true)
+			}
+			if newContent != "" {
+				streamRespose(newContent, gc)
+			}
+			if closed {
+				if finish != "" && finish != FinishStop {
+					SetFinishReason(gc, finish)
+				}
+				StreamDone(gc)
+				return true
+			}
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return started
+		}
+	}
+}
+
+// splitRunes 按字符数切分文本
+func splitRunes(text string, n int) []string {
+	var parts []string
+	var b strings.Builder
+	count := 0
+	for _, r := range text {
+		b.WriteRune(r)
+		if count++; count == n {
+			parts = append(parts, b.String())
+			b.Reset()
+			count = 0
+		}
+	}
+	if b.Len() > 0 {
+		parts = append(parts, b.String())
+	}
+	return parts
+}
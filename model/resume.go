@@ -0,0 +1,210 @@
+package model
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// resumableKey is the gin context key of the current ResumableStream
+const resumableKey = "resumable_stream"
+
+// ResumableStream buffers the SSE frames of one streamed completion so a
+// client that drops the connection can reconnect with Last-Event-ID and get
+// the frames it missed, followed by the live remainder. Only the most
+// recent frames are kept, a client that fell further behind can't resume.
+type ResumableStream struct {
+	ID string
+	// owner 创建该流的 API key 名称，只有同一个 key 可以续传
+	owner  string
+	window time.Duration
+	// limit 最多缓冲的帧数；frames 是按序号取模存放的环形缓冲，total 为已写入的帧数
+	limit     int
+	total     int
+	mutex     sync.Mutex
+	frames    [][]byte
+	done      bool
+	updated   chan struct{}
+	followers int
+	touched   time.Time
+}
+
+var (
+	streams      = map[string]*ResumableStream{}
+	streamsMutex sync.Mutex
+)
+
+// NewResumableStream registers a buffered stream of the key named owner and
+// attaches it to gc. Streams are dropped once idle for longer than window;
+// at most limit frames are buffered.
+func NewResumableStream(gc *gin.Context, owner string, window time.Duration, limit int) *ResumableStream {
+	rs := &ResumableStream{
+		ID:      strings.ReplaceAll(uuid.New().String(), "-", ""),
+		owner:   owner,
+		window:  window,
+		limit:   max(limit, 1),
+		updated: make(chan struct{}),
+		touched: time.Now(),
+	}
+	streamsMutex.Lock()
+	for id, s := range streams {
+		if s.expired() {
+			delete(streams, id)
+		}
+	}
+	streams[rs.ID] = rs
+	streamsMutex.Unlock()
+	gc.Set(resumableKey, rs)
+	return rs
+}
+
+// ResumableFrom returns the stream attached to gc, if any
+func ResumableFrom(gc *gin.Context) *ResumableStream {
+	if v, ok := gc.Get(resumableKey); ok {
+		return v.(*ResumableStream)
+	}
+	return nil
+}
+
+// LookupStream parses a Last-Event-ID of the form <stream>:<seq>. ok is
+// false when the id isn't ours; rs is nil when the stream already expired.
+func LookupStream(lastEventID string) (rs *ResumableStream, seq int, ok bool) {
+	streamID, rawSeq, found := strings.Cut(lastEventID, ":")
+	if !found {
+		return nil, 0, false
+	}
+	seq, err := strconv.Atoi(rawSeq)
+	if err != nil {
+		return nil, 0, false
+	}
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	rs = streams[streamID]
+	if rs != nil && rs.expired() {
+		delete(streams, streamID)
+		rs = nil
+	}
+	return rs, seq, true
+}
+
+// OwnedBy reports whether the key named owner created the stream. The
+// stream id is sent in every frame, so it doesn't authorize a resume alone.
+func (rs *ResumableStream) OwnedBy(owner string) bool {
+	return rs.owner == owner
+}
+
+func (rs *ResumableStream) expired() bool {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return rs.followers == 0 && time.Since(rs.touched) > rs.window
+}
+
+// append 记录一帧并返回带 id 行的完整 SSE 帧
+func (rs *ResumableStream) append(payload []byte) []byte {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	frame := make([]byte, 0, len(payload)+len(rs.ID)+16)
+	frame = append(frame, "id: "+rs.ID+":"+strconv.Itoa(rs.total+1)+"\n"...)
+	frame = append(frame, payload...)
+	if rs.frames == nil {
+		rs.frames = make([][]byte, rs.limit)
+	}
+	// 缓冲满后覆盖最早的一帧
+	rs.frames[rs.total%rs.limit] = frame
+	rs.total++
+	rs.touched = time.Now()
+	close(rs.updated)
+	rs.updated = make(chan struct{})
+	return frame
+}
+
+// dropped 返回已被覆盖的最早帧数，调用方持有 rs.mutex
+func (rs *ResumableStream) dropped() int {
+	return max(rs.total-rs.limit, 0)
+}
+
+// framesAfter 复制序号 seq 之后仍在缓冲中的帧，调用方持有 rs.mutex。
+// 返回新的切片，之后的 append 覆盖缓冲不会影响正在写出的帧
+func (rs *ResumableStream) framesAfter(seq int) [][]byte {
+	from := max(seq, rs.dropped())
+	if from >= rs.total {
+		return nil
+	}
+	pending := make([][]byte, 0, rs.total-from)
+	for s := from; s < rs.total; s++ {
+		pending = append(pending, rs.frames[s%rs.limit])
+	}
+	return pending
+}
+
+// Covers reports whether every frame after seq is still buffered
+func (rs *ResumableStream) Covers(seq int) bool {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return seq >= rs.dropped()
+}
+
+// Finish marks the stream complete after the final frame
+func (rs *ResumableStream) Finish() {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	rs.done = true
+	rs.touched = time.Now()
+	close(rs.updated)
+	rs.updated = make(chan struct{})
+}
+
+// Abandoned reports whether the original client is gone and nobody resumed
+// within the window, i.e. there is no point in reading upstream further.
+func (rs *ResumableStream) Abandoned(detachedAt time.Time) bool {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return rs.followers == 0 && time.Since(detachedAt) > rs.window
+}
+
+// Follow writes every frame after seq to gc and then the live remainder
+// until the stream finishes or this client disconnects too.
+func (rs *ResumableStream) Follow(gc *gin.Context, seq int) {
+	rs.mutex.Lock()
+	rs.followers++
+	rs.mutex.Unlock()
+	defer func() {
+		rs.mutex.Lock()
+		rs.followers--
+		rs.touched = time.Now()
+		rs.mutex.Unlock()
+	}()
+
+	gc.Writer.Header().Set("Content-Type", "text/event-stream")
+	gc.Writer.Header().Set("Cache-Control", "no-cache")
+	gc.Writer.Header().Set("Connection", "keep-alive")
+	gc.Writer.WriteHeader(200)
+	gc.Writer.Flush()
+	clientDone := gc.Request.Context().Done()
+	next := seq
+	for {
+		rs.mutex.Lock()
+		pending := rs.framesAfter(next)
+		next = rs.total
+		done := rs.done
+		updated := rs.updated
+		rs.mutex.Unlock()
+
+		for _, frame := range pending {
+			gc.Writer.Write(frame)
+		}
+		gc.Writer.Flush()
+		if done {
+			return
+		}
+		select {
+		case <-updated:
+		case <-clientDone:
+			return
+		}
+	}
+}
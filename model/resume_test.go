@@ -0,0 +1,133 @@
+package model
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newTestStream 创建一个缓冲 limit 帧的流
+func newTestStream(limit int) *ResumableStream {
+	gin.SetMode(gin.ReleaseMode)
+	gc, _ := gin.CreateTestContext(httptest.NewRecorder())
+	return NewResumableStream(gc, "owner", time.Minute, limit)
+}
+
+// followFrames 从 seq 之后跟随 rs 直到结束，返回收到的帧序号，并检查每帧内容与序号一致
+func followFrames(t *testing.T, rs *ResumableStream, seq int) []int {
+	recorder := httptest.NewRecorder()
+	gc, _ := gin.CreateTestContext(recorder)
+	gc.Request = httptest.NewRequest("GET", "/", nil)
+	rs.Follow(gc, seq)
+
+	var seqs []int
+	for _, frame := range strings.Split(strings.TrimSpace(recorder.Body.String()), "\n\n") {
+		if frame == "" {
+			continue
+		}
+		id, data, ok := strings.Cut(frame, "\n")
+		if !ok {
+			t.Fatalf("frame without data: %q", frame)
+		}
+		_, rawSeq, _ := strings.Cut(strings.TrimPrefix(id, "id: "), ":")
+		n, err := strconv.Atoi(rawSeq)
+		if err != nil {
+			t.Fatalf("bad frame id %q", id)
+		}
+		if want := "data: " + strconv.Itoa(n); data != want {
+			t.Fatalf("frame %d carries %q, want %q", n, data, want)
+		}
+		seqs = append(seqs, n)
+	}
+	return seqs
+}
+
+func produce(rs *ResumableStream, from, to int) {
+	for i := from; i <= to; i++ {
+		rs.append([]byte("data: " + strconv.Itoa(i) + "\n\n"))
+	}
+}
+
+func TestResumableStreamReplaysMissedFrames(t *testing.T) {
+	rs := newTestStream(10)
+	produce(rs, 1, 5)
+	rs.Finish()
+	got := followFrames(t, rs, 2)
+	if len(got) != 3 || got[0] != 3 || got[2] != 5 {
+		t.Fatalf("got frames %v, want 3..5", got)
+	}
+}
+
+func TestResumableStreamDropsOldestFrames(t *testing.T) {
+	rs := newTestStream(4)
+	produce(rs, 1, 10)
+	rs.Finish()
+	if rs.Covers(5) {
+		t.Fatal("Covers(5) = true after frames 1..6 were dropped")
+	}
+	if !rs.Covers(6) {
+		t.Fatal("Covers(6) = false, frames 7..10 are buffered")
+	}
+	got := followFrames(t, rs, 6)
+	if len(got) != 4 || got[0] != 7 || got[3] != 10 {
+		t.Fatalf("got frames %v, want 7..10", got)
+	}
+}
+
+// TestResumableStreamConcurrentFollow runs a producer and followers at the
+// same time; run with -race. A buffer large enough for the whole stream must
+// deliver every frame exactly once, a small one may skip frames a slow
+// follower fell behind on but never repeats or reorders them.
+func TestResumableStreamConcurrentFollow(t *testing.T) {
+	const frames = 2000
+	for _, limit := range []int{frames, 8} {
+		rs := newTestStream(limit)
+		var wg sync.WaitGroup
+		results := make([][]int, 4)
+		for i := range results {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = followFrames(t, rs, 0)
+			}(i)
+		}
+		for i := 1; i <= frames; i++ {
+			produce(rs, i, i)
+			if i%50 == 0 {
+				// 让跟随者在生产过程中读取缓冲
+				time.Sleep(time.Millisecond)
+			}
+		}
+		rs.Finish()
+		wg.Wait()
+
+		for _, got := range results {
+			for i := 1; i < len(got); i++ {
+				if got[i] <= got[i-1] {
+					t.Fatalf("limit %d: frame %d after %d", limit, got[i], got[i-1])
+				}
+			}
+			if len(got) == 0 || got[len(got)-1] != frames {
+				t.Fatalf("limit %d: follower missed the end of the stream", limit)
+			}
+			if limit == frames && len(got) != frames {
+				t.Fatalf("limit %d: got %d frames, want %d", limit, len(got), frames)
+			}
+		}
+	}
+}
+
+func TestResumableStreamOwner(t *testing.T) {
+	rs := newTestStream(4)
+	if !rs.OwnedBy("owner") {
+		t.Fatal("stream not owned by the key that created it")
+	}
+	if rs.OwnedBy("other") {
+		t.Fatal("stream owned by another key")
+	}
+}
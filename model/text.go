@@ -0,0 +1,88 @@
+package model
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// TextChoice is one choice of a legacy text completion
+type TextChoice struct {
+	Text         string      `json:"text"`
+	Index        int         `json:"index"`
+	Logprobs     interface{} `json:"logprobs"`
+	FinishReason interface{} `json:"finish_reason"`
+}
+
+// TextCompletionResponse is a legacy /v1/completions response or stream chunk
+type TextCompletionResponse struct {
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int64        `json:"created"`
+	Model   string       `json:"model"`
+	Choices []TextChoice `json:"choices"`
+	Usage   *Usage       `json:"usage,omitempty"`
+	// Claims、Citations 为扩展字段，与聊天补全相同
+	Claims    []Claim  `json:"claims,omitempty"`
+	Citations []string `json:"citations,omitempty"`
+}
+
+// textCompletionKey marks a response written as a legacy text completion
+const textCompletionKey = "text_completion"
+
+// SetTextCompletion makes the response writers of gc emit text_completion
+// objects instead of chat completions. Reasoning has no field there and
+// is dropped unless it is inlined in the text.
+func SetTextCompletion(gc *gin.Context) {
+	gc.Set(textCompletionKey, true)
+}
+
+func isTextCompletion(gc *gin.Context) bool {
+	return gc.GetBool(textCompletionKey)
+}
+
+// textChunk 将聊天补全数据块转换为文本补全数据块
+func textChunk(chunk *OpenAISrteamResponse) *TextCompletionResponse {
+	out := &TextCompletionResponse{
+		ID:        chunk.ID,
+		Object:    "text_completion",
+		Created:   chunk.Created,
+		Model:     chunk.Model,
+		Choices:   []TextChoice{},
+		Usage:     chunk.Usage,
+		Claims:    chunk.Claims,
+		Citations: chunk.Citations,
+	}
+	for _, choice := range chunk.Choices {
+		out.Choices = append(out.Choices, TextChoice{
+			Text:         choice.Delta.Content + choice.Delta.Refusal,
+			Index:        choice.Index,
+			FinishReason: choice.FinishReason,
+		})
+	}
+	return out
+}
+
+func noStreamTextResponse(text string, gc *gin.Context) error {
+	refusal := gc.GetString(refusalKey)
+	resp := &TextCompletionResponse{
+		ID:      uuid.New().String(),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   "claude-3-7-sonnet-20250219",
+		Choices: []TextChoice{{Text: text + refusal, FinishReason: openAIFinishReason(finishReasonFrom(gc))}},
+		Usage:   &Usage{},
+	}
+	if extracted, ok := claimsFrom(gc); ok {
+		resp.Claims = extracted.claims
+		resp.Citations = extracted.citations
+	}
+	if meter := UsageMeterFrom(gc); meter != nil {
+		meter.AddCompletion(text + refusal)
+		usage := meter.Usage()
+		resp.Usage = &usage
+	}
+	gc.JSON(200, resp)
+	return nil
+}
@@ -0,0 +1,277 @@
+// Package moderation screens chat requests before they are sent upstream.
+//
+// Rules match message text by regular expression or keyword and either
+// block the request or redact the match. Requests can also be checked by
+// an external OpenAI compatible /v1/moderations endpoint. Blocked requests
+// get an OpenAI style content_filter error.
+package moderation
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"pplx2api/config"
+	"pplx2api/hooks"
+	"pplx2api/logger"
+	"pplx2api/model"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rule actions
+const (
+	ActionBlock  = "block"
+	ActionRedact = "redact"
+)
+
+// defaultReplacement 未设置 replacement 时替换匹配内容的文本
+const defaultReplacement = "[REDACTED]"
+
+// Rule matches message text by pattern or keywords
+type Rule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern,omitempty"`
+	// Keywords 不区分大小写匹配的关键词
+	Keywords []string `json:"keywords,omitempty"`
+	// Action block（默认）拒绝请求，redact 替换匹配内容
+	Action      string `json:"action,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// compile 将 pattern 与关键词合并为一个正则
+func (r *Rule) compile() error {
+	var parts []string
+	if r.Pattern != "" {
+		parts = append(parts, "(?:"+r.Pattern+")")
+	}
+	for _, k := range r.Keywords {
+		if k = strings.TrimSpace(k); k != "" {
+			parts = append(parts, `(?i:`+regexp.QuoteMeta(k)+`)`)
+		}
+	}
+	if len(parts) == 0 {
+		return fmt.Errorf("rule %s has no pattern or keywords", r.Name)
+	}
+	re, err := regexp.Compile(strings.Join(parts, "|"))
+	if err != nil {
+		return fmt.Errorf("rule %s: %w", r.Name, err)
+	}
+	r.re = re
+	switch r.Action {
+	case "":
+		r.Action = ActionBlock
+	case ActionBlock, ActionRedact:
+	default:
+		return fmt.Errorf("rule %s: invalid action %q, use block or redact", r.Name, r.Action)
+	}
+	if r.Replacement == "" {
+		r.Replacement = defaultReplacement
+	}
+	return nil
+}
+
+// LoadRules reads the rules file at path and adds a blocking rule for the
+// keywords, if any
+func LoadRules(path string, keywords []string) ([]Rule, error) {
+	var rules []Rule
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &rules); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", path, err)
+		}
+	}
+	if len(keywords) > 0 {
+		rules = append(rules, Rule{Name: "keywords", Keywords: keywords})
+	}
+	for i := range rules {
+		if rules[i].Name == "" {
+			rules[i].Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if err := rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// Filter is a hook applying the rules and the moderation endpoint to
+// every request
+type Filter struct {
+	hooks.Base
+	Rules []Rule
+	// Endpoint 外部审核接口地址，为空时只使用规则
+	Endpoint string
+	APIKey   string
+	Model    string
+	// FailClosed 审核接口出错时拒绝请求，否则放行
+	FailClosed bool
+}
+
+// Setup registers the moderation hook when rules or an endpoint are
+// configured
+func Setup() {
+	cfg := config.ConfigInstance
+	rules, err := LoadRules(cfg.ModerationRulesFile, cfg.ModerationKeywords)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to load moderation rules: %v", err))
+		return
+	}
+	if len(rules) == 0 && cfg.ModerationEndpoint == "" {
+		return
+	}
+	hooks.Register("moderation", &Filter{
+		Rules:      rules,
+		Endpoint:   cfg.ModerationEndpoint,
+		APIKey:     cfg.ModerationAPIKey,
+		Model:      cfg.ModerationModel,
+		FailClosed: cfg.ModerationFailClosed,
+	})
+	logger.Info(fmt.Sprintf("Moderation: %d rules, endpoint: %q", len(rules), cfg.ModerationEndpoint))
+}
+
+// OnRequest blocks or redacts the messages of a request
+func (f *Filter) OnRequest(req *hooks.Request) error {
+	var texts []string
+	for _, msg := range req.Messages {
+		if err := f.screen(msg, &texts); err != nil {
+			logger.Info(fmt.Sprintf("Request from key %s blocked by moderation: %v", req.Key, err))
+			return hooks.RejectWithCode(http.StatusBadRequest, model.CodeContentFilter, "%v", err)
+		}
+	}
+	if f.Endpoint == "" || len(texts) == 0 {
+		return nil
+	}
+	categories, err := f.check(texts)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Moderation endpoint failed: %v", err))
+		if f.FailClosed {
+			return hooks.RejectWithCode(http.StatusServiceUnavailable, model.CodeContentFilter, "Moderation is unavailable, request rejected")
+		}
+		return nil
+	}
+	if categories != nil {
+		logger.Info(fmt.Sprintf("Request from key %s flagged by moderation endpoint: %s", req.Key, strings.Join(categories, ", ")))
+		return hooks.RejectWithCode(http.StatusBadRequest, model.CodeContentFilter, "Request was flagged by content moderation (%s)", strings.Join(categories, ", "))
+	}
+	return nil
+}
+
+// screen 对消息中的每段文本应用规则，已替换的文本写回消息并收集到 texts
+func (f *Filter) screen(msg map[string]interface{}, texts *[]string) error {
+	switch content := msg["content"].(type) {
+	case string:
+		text, err := f.apply(content)
+		if err != nil {
+			return err
+		}
+		msg["content"] = text
+		*texts = append(*texts, text)
+	case []interface{}:
+		for _, item := range content {
+			part, ok := item.(map[string]interface{})
+			if !ok || part["type"] != "text" {
+				continue
+			}
+			s, _ := part["text"].(string)
+			text, err := f.apply(s)
+			if err != nil {
+				return err
+			}
+			part["text"] = text
+			*texts = append(*texts, text)
+		}
+	}
+	return nil
+}
+
+// apply returns text with the redact rules applied, or an error naming the
+// first block rule that matched
+func (f *Filter) apply(text string) (string, error) {
+	for _, r := range f.Rules {
+		if !r.re.MatchString(text) {
+			continue
+		}
+		if r.Action == ActionBlock {
+			return "", fmt.Errorf("Request was blocked by content filter rule %q", r.Name)
+		}
+		text = r.re.ReplaceAllLiteralString(text, r.Replacement)
+	}
+	return text, nil
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// check sends texts to the moderation endpoint and returns the flagged
+// categories, nil when nothing was flagged
+func (f *Filter) check(texts []string) ([]string, error) {
+	payload := map[string]interface{}{"input": texts}
+	if f.Model != "" {
+		payload["model"] = f.Model
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, f.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+f.APIKey)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var result struct {
+		Results []struct {
+			Flagged    bool            `json:"flagged"`
+			Categories map[string]bool `json:"categories"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	if len(result.Results) == 0 {
+		return nil, errors.New("empty results")
+	}
+	flagged := map[string]bool{}
+	for _, r := range result.Results {
+		if !r.Flagged {
+			continue
+		}
+		flagged["flagged"] = true
+		for name, hit := range r.Categories {
+			if hit {
+				flagged[name] = true
+			}
+		}
+	}
+	if len(flagged) == 0 {
+		return nil, nil
+	}
+	if len(flagged) > 1 {
+		delete(flagged, "flagged")
+	}
+	categories := make([]string, 0, len(flagged))
+	for name := range flagged {
+		categories = append(categories, name)
+	}
+	sort.Strings(categories)
+	return categories, nil
+}
@@ -0,0 +1,136 @@
+// Package notify alerts operators about events that need attention, such
+// as sessions hitting their quota or a cookie that stopped working, by
+// posting them to the webhooks listed in WEBHOOK_URLS.
+//
+// A webhook URL prefixed with slack= or discord= receives a chat message in
+// that service's format; any other URL receives the event as JSON. Repeats
+// of the same event for the same session within WEBHOOK_MIN_INTERVAL are
+// dropped, and events are sent in the background, so a webhook that is down
+// only costs a log line, never a request.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types
+const (
+	SessionRateLimited = "session.rate_limited"
+	SessionQuarantined = "session.quarantined"
+	SessionChallenged  = "session.challenged"
+	SessionsExhausted  = "sessions.exhausted"
+	CircuitOpen        = "circuit.open"
+)
+
+// Webhook formats selected by the URL prefix
+const (
+	FormatJSON    = "json"
+	FormatSlack   = "slack"
+	FormatDiscord = "discord"
+)
+
+// Event is one alert posted to the webhooks
+type Event struct {
+	Event   string                 `json:"event"`
+	Time    time.Time              `json:"time"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// webhook is one target parsed from WEBHOOK_URLS
+type webhook struct {
+	format string
+	url    string
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	lastSent      = map[string]time.Time{}
+	lastSentMutex sync.Mutex
+)
+
+// parseWebhook 解析 format=url 形式的地址，没有可识别前缀时按 JSON 发送
+func parseWebhook(entry string) webhook {
+	if format, url, ok := strings.Cut(entry, "="); ok {
+		switch format = strings.ToLower(strings.TrimSpace(format)); format {
+		case FormatJSON, FormatSlack, FormatDiscord:
+			return webhook{format: format, url: strings.TrimSpace(url)}
+		}
+	}
+	return webhook{format: FormatJSON, url: entry}
+}
+
+// throttled 同一事件（同一账号）在最小间隔内已发送过时返回 true
+func throttled(event Event) bool {
+	interval := config.ConfigInstance.WebhookMinInterval
+	if interval <= 0 {
+		return false
+	}
+	key := event.Event
+	if session, ok := event.Data["session"]; ok {
+		key += fmt.Sprintf("|%v", session)
+	}
+	lastSentMutex.Lock()
+	defer lastSentMutex.Unlock()
+	if last, ok := lastSent[key]; ok && event.Time.Sub(last) < interval {
+		return true
+	}
+	lastSent[key] = event.Time
+	return false
+}
+
+// Send posts an event to every configured webhook
+func Send(event Event) {
+	urls := config.ConfigInstance.WebhookURLs
+	if len(urls) == 0 {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if throttled(event) {
+		return
+	}
+	for _, entry := range urls {
+		hook := parseWebhook(entry)
+		body, err := json.Marshal(payload(hook.format, event))
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to encode %s event: %v", event.Event, err))
+			return
+		}
+		go post(hook.url, event.Event, body)
+	}
+}
+
+// payload 按 webhook 格式生成请求体
+func payload(format string, event Event) interface{} {
+	text := fmt.Sprintf("[pplx2api] %s: %s", event.Event, event.Message)
+	switch format {
+	case FormatSlack:
+		return map[string]string{"text": text}
+	case FormatDiscord:
+		return map[string]string{"content": text}
+	}
+	return event
+}
+
+func post(url string, event string, body []byte) {
+	resp, err := httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to send %s webhook: %v", event, err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Error(fmt.Sprintf("Webhook for %s returned status %d", event, resp.StatusCode))
+	}
+}
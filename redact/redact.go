@@ -0,0 +1,189 @@
+// Package redact masks personal data and secrets in text before it is
+// written to the conversation records or the logs.
+//
+// Built-in patterns cover emails, phone numbers and API keys or bearer
+// tokens; more patterns are read from REDACT_PATTERNS_FILE, one regular
+// expression per line. Scrubbing is switched on for all keys by
+// REDACT_LOGS and can be turned on or off per key with defaults.redact.
+package redact
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Built-in pattern types accepted by REDACT_TYPES
+const (
+	TypeEmail  = "email"
+	TypePhone  = "phone"
+	TypeAPIKey = "api_key"
+)
+
+// builtins 内置的匹配规则与替换文本
+var builtins = map[string]struct {
+	pattern     string
+	replacement string
+}{
+	TypeEmail: {`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`, "[EMAIL]"},
+	TypePhone: {`\+\d[\d\s().\-]{7,}\d|(?:\(\d{3}\)\s?|\b\d{3}[\s.\-])\d{3}[\s.\-]\d{4}\b`, "[PHONE]"},
+	TypeAPIKey: {strings.Join([]string{
+		`(?i)\bbearer\s+[A-Za-z0-9._~+/\-]{8,}=*`,
+		`\b(?:sk|pk|rk|pplx|ghp|gho|github_pat|xox[abpr])[-_][A-Za-z0-9_\-]{16,}`,
+		`\bAKIA[0-9A-Z]{16}\b`,
+		`\beyJ[A-Za-z0-9_\-]{10,}(?:\.[A-Za-z0-9_\-]*){1,4}`,
+	}, "|"), "[API_KEY]"},
+}
+
+// customReplacement 自定义规则匹配内容的替换文本
+const customReplacement = "[REDACTED]"
+
+type rule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// Scrubber masks the matches of its rules. A nil Scrubber returns text
+// unchanged.
+type Scrubber struct {
+	rules []rule
+}
+
+// New creates a scrubber from built-in types and custom patterns
+func New(types []string, patterns []string) (*Scrubber, error) {
+	s := &Scrubber{}
+	for _, t := range types {
+		b, ok := builtins[strings.ToLower(t)]
+		if !ok {
+			return nil, fmt.Errorf("unknown redact type %q, use email, phone or api_key", t)
+		}
+		s.rules = append(s.rules, rule{regexp.MustCompile(b.pattern), b.replacement})
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %q: %w", p, err)
+		}
+		s.rules = append(s.rules, rule{re, customReplacement})
+	}
+	return s, nil
+}
+
+// LoadPatterns reads one pattern per line from path, skipping blank lines
+// and lines starting with #
+func LoadPatterns(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// String returns text with every match masked
+func (s *Scrubber) String(text string) string {
+	if s == nil {
+		return text
+	}
+	for _, r := range s.rules {
+		text = r.re.ReplaceAllLiteralString(text, r.replacement)
+	}
+	return text
+}
+
+// Strings masks each item, returning a new slice
+func (s *Scrubber) Strings(items []string) []string {
+	if s == nil || items == nil {
+		return items
+	}
+	out := make([]string, len(items))
+	for i, item := range items {
+		out[i] = s.String(item)
+	}
+	return out
+}
+
+// Value masks the strings of a decoded JSON value, returning a copy so the
+// original, e.g. the messages of a request, is left untouched
+func (s *Scrubber) Value(v interface{}) interface{} {
+	if s == nil {
+		return v
+	}
+	switch t := v.(type) {
+	case string:
+		return s.String(t)
+	case map[string]interface{}:
+		return s.Map(t)
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, item := range t {
+			out[i] = s.Value(item)
+		}
+		return out
+	}
+	return v
+}
+
+// Map masks the string values of m, returning a copy
+func (s *Scrubber) Map(m map[string]interface{}) map[string]interface{} {
+	if s == nil || m == nil {
+		return m
+	}
+	out := make(map[string]interface{}, len(m))
+	for k, item := range m {
+		out[k] = s.Value(item)
+	}
+	return out
+}
+
+var (
+	defaultScrubber *Scrubber
+	scrubberOnce    sync.Once
+)
+
+// scrubber 按配置创建，配置有误时退回只使用内置规则
+func scrubber() *Scrubber {
+	scrubberOnce.Do(func() {
+		cfg := config.ConfigInstance
+		patterns, err := LoadPatterns(cfg.RedactPatternsFile)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to load redact patterns: %v", err))
+		}
+		s, err := New(cfg.RedactTypes, patterns)
+		if err != nil {
+			logger.Error(fmt.Sprintf("Invalid redact config, using built-in patterns only: %v", err))
+			s, _ = New([]string{TypeEmail, TypePhone, TypeAPIKey}, nil)
+		}
+		defaultScrubber = s
+	})
+	return defaultScrubber
+}
+
+// For returns the scrubber to apply to what key sends and receives, nil
+// when the key opted out or redaction is off and the key didn't opt in
+func For(key *config.APIKey) *Scrubber {
+	enabled := config.ConfigInstance.RedactLogs
+	if key != nil && key.Defaults.Redact != nil {
+		enabled = *key.Defaults.Redact
+	}
+	if !enabled {
+		return nil
+	}
+	return scrubber()
+}
@@ -0,0 +1,81 @@
+package redact
+
+import (
+	"pplx2api/config"
+	"testing"
+)
+
+func TestStringMasksBuiltinTypes(t *testing.T) {
+	s, err := New([]string{TypeEmail, TypePhone, TypeAPIKey}, []string{`order-\d+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.String("mail bob@example.com or call +1 415 555 0100 with sk-abcdefghijklmnop1234 about order-42")
+	want := "mail [EMAIL] or call [PHONE] with [API_KEY] about [REDACTED]"
+	if got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	if _, err := New([]string{"ssn"}, nil); err == nil {
+		t.Error("unknown type accepted")
+	}
+	if _, err := New(nil, []string{"("}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
+
+func TestValueReturnsMaskedCopy(t *testing.T) {
+	s, err := New([]string{TypeEmail}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := map[string]interface{}{
+		"messages": []interface{}{map[string]interface{}{"content": "to bob@example.com"}},
+		"n":        float64(1),
+	}
+	masked := s.Value(original).(map[string]interface{})
+	if got := masked["messages"].([]interface{})[0].(map[string]interface{})["content"]; got != "to [EMAIL]" {
+		t.Errorf("masked content = %v", got)
+	}
+	if masked["n"] != float64(1) {
+		t.Errorf("non-string value changed: %v", masked["n"])
+	}
+	if got := original["messages"].([]interface{})[0].(map[string]interface{})["content"]; got != "to bob@example.com" {
+		t.Errorf("original modified: %v", got)
+	}
+}
+
+func TestNilScrubberKeepsText(t *testing.T) {
+	var s *Scrubber
+	if got := s.String("bob@example.com"); got != "bob@example.com" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := s.Strings([]string{"a"}); len(got) != 1 || got[0] != "a" {
+		t.Errorf("Strings() = %v", got)
+	}
+}
+
+func TestForFollowsKeyOverride(t *testing.T) {
+	previous := config.ConfigInstance.RedactLogs
+	t.Cleanup(func() { config.ConfigInstance.RedactLogs = previous })
+	on, off := true, false
+	optIn := &config.APIKey{Defaults: config.KeyDefaults{Redact: &on}}
+	optOut := &config.APIKey{Defaults: config.KeyDefaults{Redact: &off}}
+
+	config.ConfigInstance.RedactLogs = false
+	if For(nil) != nil || For(&config.APIKey{}) != nil {
+		t.Error("scrubbing enabled while REDACT_LOGS is off")
+	}
+	if For(optIn) == nil {
+		t.Error("key opted in but got no scrubber")
+	}
+	config.ConfigInstance.RedactLogs = true
+	if For(&config.APIKey{}) == nil {
+		t.Error("REDACT_LOGS is on but a key without override got no scrubber")
+	}
+	if For(optOut) != nil {
+		t.Error("key opted out but got a scrubber")
+	}
+}
@@ -0,0 +1,50 @@
+// Package refusal recognises answers in which the model declined the
+// request, so they can be reported in the OpenAI refusal field instead of
+// as a normal answer.
+//
+// Perplexity doesn't flag refusals, so detection looks at how the answer
+// opens. Only the beginning is checked: a refusal comes first, while an
+// answer that mentions a policy further down is still an answer.
+package refusal
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Kinds of detected refusals
+const (
+	// KindRefusal the model declined to answer
+	KindRefusal = "refusal"
+	// KindContentFilter the request or answer was blocked by a content policy
+	KindContentFilter = "content_filter"
+)
+
+// Window is how much of the answer is checked
+const Window = 240
+
+var patterns = []struct {
+	kind    string
+	pattern *regexp.Regexp
+}{
+	{KindContentFilter, regexp.MustCompile(`(?i)\b(violates?|against|breach(es)?)\s+(our|the|my)\s+(content|usage|safety)\s+(policy|policies|guidelines)\b`)},
+	{KindContentFilter, regexp.MustCompile(`(?i)\b(blocked|flagged|filtered)\s+by\s+(the\s+)?(content|safety|moderation)\s+(filter|system|policy)\b`)},
+	{KindRefusal, regexp.MustCompile(`(?i)^\W*(i'?m\s+sorry|sorry|i\s+apologi[sz]e)[,.!]?\s+(but\s+)?i\s+(can(no|')t|cannot|am\s+(not\s+able|unable)|won'?t)\s+(help|assist|provide|comply|do\s+that|create|write|generate|fulfil)`)},
+	{KindRefusal, regexp.MustCompile(`(?i)^\W*i\s+(can(no|')t|cannot|won'?t|am\s+(not\s+able|unable)\s+to)\s+(help|assist|provide|comply|fulfil)\s+(with\s+)?(that|this|your)\b`)},
+	{KindRefusal, regexp.MustCompile(`^\W*(抱歉|对不起|很抱歉)[，,。]?\s*(我)?(无法|不能)(提供|协助|帮助|回答|满足)`)},
+}
+
+// Detect returns the kind of refusal the answer opens with, or "" when the
+// answer is not a refusal.
+func Detect(answer string) string {
+	head := strings.TrimSpace(answer)
+	if len(head) > Window {
+		head = head[:Window]
+	}
+	for _, p := range patterns {
+		if p.pattern.MatchString(head) {
+			return p.kind
+		}
+	}
+	return ""
+}
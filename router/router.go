@@ -9,15 +9,69 @@ import (
 
 func SetupRoutes(r *gin.Engine) {
 	// Apply middleware
+	r.Use(middleware.RequestIDMiddleware())
+	r.Use(middleware.TracingMiddleware())
 	r.Use(middleware.CORSMiddleware())
+	r.Use(middleware.CompressMiddleware())
+	r.Use(middleware.BodyLimitMiddleware())
 	r.Use(middleware.AuthMiddleware())
+	r.Use(middleware.RateLimitMiddleware())
+	r.Use(middleware.AnomalyMiddleware())
 
 	// Health check endpoint
 	r.GET("/health", service.HealthCheckHandler)
+	// Kubernetes 与负载均衡的存活、就绪探针，无需认证
+	r.GET("/healthz", service.HealthzHandler)
+	r.GET("/readyz", service.ReadyzHandler)
 
 	// Chat completions endpoint (OpenAI-compatible)
 	r.POST("/v1/chat/completions", service.ChatCompletionsHandler)
+	r.POST("/v1/completions", service.CompletionsHandler)
+	r.POST("/v1/tokenize", service.TokenizeHandler)
+	r.POST("/v1/images/generations", service.ImageGenerationsHandler)
 	r.GET("/v1/models", service.ModelsHandler)
+	// Gemini compatible generateContent and streamGenerateContent
+	r.POST("/v1beta/models/:action", service.GeminiHandler)
+	// Ollama compatible API
+	r.POST("/api/chat", service.OllamaChatHandler)
+	r.POST("/api/generate", service.OllamaGenerateHandler)
+	r.GET("/api/tags", service.OllamaTagsHandler)
+	r.GET("/api/version", service.OllamaVersionHandler)
+	r.GET("/v1/research/jobs/:id", service.ResearchJobHandler)
+	r.GET("/v1/conversations", service.ListConversationsHandler)
+	r.GET("/v1/conversations/:id", service.GetConversationHandler)
+	r.DELETE("/v1/conversations/:id", service.DeleteConversationHandler)
+
+	// Admin endpoints
+	adminRouter := r.Group("/admin")
+	{
+		adminRouter.GET("/ui", service.DashboardHandler)
+		adminRouter.GET("/stats", service.StatsHandler)
+		adminRouter.GET("/logs", service.LogsHandler)
+		adminRouter.GET("/keys", service.KeysHandler)
+		adminRouter.POST("/keys", service.PutKeyHandler)
+		adminRouter.DELETE("/keys/:name", service.DeleteKeyHandler)
+		adminRouter.POST("/keys/:name/rotate", service.RotateKeyHandler)
+		adminRouter.GET("/sessions", service.SessionsHandler)
+		adminRouter.GET("/usage", service.UsageHandler)
+		adminRouter.GET("/usage/keys", service.UsageKeysHandler)
+		adminRouter.GET("/usage/sessions", service.UsageSessionsHandler)
+		adminRouter.GET("/usage/export", service.UsageExportHandler)
+		adminRouter.GET("/anomalies", service.AnomaliesHandler)
+		adminRouter.DELETE("/anomalies/:name", service.LiftThrottleHandler)
+		adminRouter.GET("/memory", service.MemoryHandler)
+		adminRouter.POST("/config/reload", service.ReloadConfigHandler)
+		adminRouter.POST("/conversations/import/chatgpt", service.ImportChatGPTHandler)
+		adminRouter.GET("/debug/requests/:id", service.DebugRequestHandler)
+		adminRouter.GET("/update", service.UpdateStatusHandler)
+		adminRouter.POST("/update/check", service.UpdateCheckHandler)
+		adminRouter.POST("/update/apply", service.UpdateApplyHandler)
+		adminRouter.GET("/sessions/calendar", service.SessionCalendarHandler)
+		adminRouter.POST("/sessions/import", service.ImportCookiesHandler)
+		adminRouter.POST("/sessions/:index/archive", service.ArchiveSessionHandler)
+		adminRouter.POST("/sessions/:index/reactivate", service.ReactivateSessionHandler)
+		adminRouter.DELETE("/sessions/:index/cooldown", service.ClearCooldownHandler)
+	}
 	// HuggingFace compatible routes
 	hfRouter := r.Group("/hf")
 	{
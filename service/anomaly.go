@@ -0,0 +1,24 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"pplx2api/middleware"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AnomaliesHandler lists the learned request rates and throttles of keys
+func AnomaliesHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": middleware.Anomalies()})
+}
+
+// LiftThrottleHandler ends the anomaly throttle of a key
+func LiftThrottleHandler(c *gin.Context) {
+	name := c.Param("name")
+	if !middleware.LiftThrottle(name) {
+		respondError(c, http.StatusNotFound, "", fmt.Sprintf("Key %s is not throttled", name))
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"key": name, "throttled": false})
+}
@@ -0,0 +1,476 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/logger"
+	"pplx2api/model"
+	"pplx2api/redact"
+	"pplx2api/tokenizer"
+	"pplx2api/tracing"
+	"pplx2api/usage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// chatAttempt is the upstream payload of one chat completion. It is built
+// once per request and replayed against each session the retry loop picks.
+type chatAttempt struct {
+	// RequestModel is the model name the client asked for
+	RequestModel string
+	// Models is the fallback chain, primary first
+	Models     []string
+	OpenSearch bool
+	Search     core.SearchOptions
+	Prompt     string
+	Images     []core.ImageData
+	Files      []core.FileData
+	Stream     bool
+	RawOutput  bool
+	// ExtractClaims 是否返回提取的陈述与引用
+	ExtractClaims bool
+	Timezone      string
+	// Thread 非空时在该账号上以 FollowUp 追问已有会话
+	Thread   *threadRef `json:"-"`
+	FollowUp *chatTurn  `json:"-"`
+	// base 非空时复用其连接，用于自带账号模式
+	base *core.Client
+	// answered 成功后回答所在的会话，answeredBy 为发送该回答的客户端
+	answered   *threadRef
+	answeredBy *core.Client
+	// sent 实际发送的提示词，citations 回答引用的搜索结果
+	sent      string
+	citations []string
+	// basePrompt 续写断开的流之前的原始提示词
+	basePrompt string
+	// lastModel 最近一次发送使用的上游模型，限流时按其类别冷却
+	lastModel string
+	// HedgeDelay 首个账号在此时间内未开始响应时在第二个账号上同时发送，0 表示不对冲
+	HedgeDelay time.Duration `json:"-"`
+	// Labels 只使用带有这些标签的账号
+	Labels map[string]string `json:"-"`
+}
+
+// family returns the cooldown family of the attempt's primary model
+func (a *chatAttempt) family() string {
+	if len(a.Models) == 0 {
+		return config.FamilyDefault
+	}
+	return config.ConfigInstance.Cooldowns.Family(a.Models[0])
+}
+
+// requestLog 返回带当前请求 ID 的日志记录器
+func requestLog(c *gin.Context) logger.Entry {
+	return logger.FromContext(c.Request.Context())
+}
+
+// errAllRetriesFailed is returned when no session could serve the attempt
+var errAllRetriesFailed = errors.New("failed for all retries")
+
+// errSessionsExhausted is returned when every session tried was rate
+// limited or unavailable, rather than failing upstream
+var errSessionsExhausted = errors.New("no session available")
+
+// sendWithRetry rotates through the configured sessions until one serves
+// the attempt. A continued conversation is first sent to the session that
+// owns its thread, waiting for its pacing interval if needed; only when that
+// session can't be used does it rotate, restarting the conversation with
+// the full history. It gives up once the client is gone or response bytes were
+// written, and waits per the backoff policy after consecutive rate limits.
+func (a *chatAttempt) sendWithRetry(c *gin.Context) error {
+	// 切号重试机制，连续遇到限流时按退避策略等待后再换号
+	index := config.Sr.NextIndex()
+	// pinned 会话所属的账号，首次尝试总是使用该账号
+	pinned := -1
+	if a.Thread != nil {
+		pinned = sessionIndexOf(a.Thread.SessionKey)
+	}
+	rateLimited, failed, recovered := 0, 0, 0
+	// solved 本次请求已通过验证服务重试过
+	solved := false
+	// continuing 下一次尝试是断流后的续写
+	continuing := false
+	route := a.route()
+	family := route.family
+	_, retries := config.ConfigInstance.SessionCount()
+	for i := 0; i < retries; i++ {
+		if pinned >= 0 {
+			index, pinned = pinned, -1
+		} else {
+			index, continuing = nextSessionIndex(index, route), false
+		}
+		_, selectSpan := tracing.Start(c.Request.Context(), "select_session", tracing.KindInternal)
+		selectSpan.SetAttr("session.index", index)
+		// 账号与其状态一并取出，之后按状态中的稳定标识记录结果，不受热重载调整序号的影响
+		session, state, err := config.ConfigInstance.SessionWithState(index)
+		if err != nil {
+			requestLog(c).Error(fmt.Sprintf("Failed to get session for model %s: %v", a.RequestModel, err))
+			requestLog(c).Info("Retrying another session")
+			selectSpan.SetError(err)
+			selectSpan.End()
+			continue
+		}
+		if session.Archived {
+			selectSpan.SetAttr("skipped", "archived")
+			selectSpan.End()
+			continue
+		}
+		if !route.labelled(index) {
+			requestLog(c).Info(fmt.Sprintf("Session %d doesn't have labels %s, skipping", index, config.FormatLabels(route.labels)))
+			selectSpan.SetAttr("skipped", "labels")
+			selectSpan.End()
+			continue
+		}
+		if exceeded, resets := overBudget(session); exceeded != "" {
+			requestLog(c).Info(fmt.Sprintf("Session %d used up its %s until %s, skipping", index, exceeded, resets.Format(time.RFC3339)))
+			selectSpan.SetAttr("skipped", "budget")
+			selectSpan.End()
+			continue
+		}
+		if !route.fits(index) {
+			requestLog(c).Info(fmt.Sprintf("Session %d is on the %s tier, %s needs %s, skipping", index, state.Tier(), a.RequestModel, route.required))
+			selectSpan.SetAttr("skipped", "tier")
+			selectSpan.End()
+			continue
+		}
+		if proxy, fixed := config.ConfigInstance.FixedProxyFor(session); fixed {
+			if until := state.ChallengedUntil(proxy); !until.IsZero() {
+				requestLog(c).Info(fmt.Sprintf("Session %d got a Cloudflare challenge through %s, skipping until %s", index, redactProxy(proxy), until.Format(time.RFC3339)))
+				selectSpan.SetAttr("skipped", "challenged")
+				selectSpan.End()
+				continue
+			}
+		}
+		if !state.IsAvailableFor(family) {
+			requestLog(c).Info(fmt.Sprintf("Session %d is rate limited for %s models until %s, skipping", index, family, state.RateLimitedUntilFor(family).Format(time.RFC3339)))
+			selectSpan.SetAttr("skipped", "rate_limited")
+			selectSpan.End()
+			continue
+		}
+		if continuing {
+			// 续写属于同一个回答，不等待节流间隔
+			continuing = false
+		} else if wait := state.ReservePacing(config.ConfigInstance.SessionMinInterval, config.ConfigInstance.SessionPacingJitter); wait > 0 {
+			// 所有可用账号都在节流间隔内，等待该账号的发送时间
+			requestLog(c).Info(fmt.Sprintf("Session %d is paced, sending in %v", index, wait.Round(time.Millisecond)))
+			selectSpan.SetAttr("pacing_wait_ms", wait.Milliseconds())
+			if !waitBackoff(c, wait) {
+				selectSpan.End()
+				requestLog(c).Info("Client disconnected, stop retrying")
+				return c.Request.Context().Err()
+			}
+		}
+		selectSpan.End()
+		requestLog(c).Info(fmt.Sprintf("Using session for model %s: %s", a.RequestModel, session.SessionKey))
+		if meter := usage.MeterFrom(c); meter != nil {
+			meter.Session = maskSessionKey(session.SessionKey)
+		}
+		if i == 0 && a.hedgeable(c) {
+			index, err = a.sendHedged(session, state, index, i+1, route, c)
+		} else {
+			err = a.sendTraced(session, state, index, i+1, c)
+			recordResult(index, state, config.ConfigInstance.Cooldowns.Family(a.lastModel), err)
+		}
+		if c.Request.Context().Err() != nil {
+			requestLog(c).Info("Client disconnected, stop retrying")
+			return c.Request.Context().Err()
+		}
+		var broken *core.StreamBrokenError
+		if errors.As(err, &broken) && recovered < config.ConfigInstance.StreamRecovery {
+			// 上游流中途断开，固定用同一账号请求从已输出内容的末尾续写，不经过轮询与节流跳过
+			recovered++
+			requestLog(c).Error(fmt.Sprintf("Upstream stream broke off, asking to continue the answer (%d/%d): %v", recovered, config.ConfigInstance.StreamRecovery, err))
+			a.continueStream(c)
+			pinned, continuing = index, true
+			i-- // 续写不占用重试次数
+			continue
+		}
+		if err != nil && c.Writer.Written() {
+			// 已经向客户端输出内容，无法再切换账号重试
+			requestLog(c).Error(fmt.Sprintf("Failed after response started: %v", err))
+			return err
+		}
+		if err != nil {
+			requestLog(c).Error(fmt.Sprintf("Failed to send message: %v", err))
+			var circuitErr *core.CircuitOpenError
+			if errors.As(err, &circuitErr) {
+				// 熔断时换号也无济于事
+				return err
+			}
+			var timeoutErr *core.TimeoutError
+			if errors.As(err, &timeoutErr) {
+				// 已等待了完整的超时时间，不再换号重试
+				return err
+			}
+			var challengeErr *core.ChallengeError
+			if errors.As(err, &challengeErr) {
+				if handleChallenge(c, index, state, challengeErr) && !solved {
+					// 取得验证 cookie 后在同一账号上重试一次，不占用重试次数
+					solved = true
+					pinned = index
+					i--
+				}
+				failed++
+				continue
+			}
+			var rateLimitErr *core.RateLimitError
+			if errors.As(err, &rateLimitErr) {
+				rateLimited++
+				delay := config.ConfigInstance.Backoff.Delay(rateLimited)
+				requestLog(c).Info(fmt.Sprintf("Retrying another session in %v", delay))
+				if !waitBackoff(c, delay) {
+					requestLog(c).Info("Client disconnected, stop retrying")
+					return c.Request.Context().Err()
+				}
+				continue
+			}
+			failed++
+			requestLog(c).Info("Retrying another session")
+			continue // Retry on error
+		}
+		return nil
+	}
+	requestLog(c).Error("Failed for all retries")
+	if failed == 0 {
+		return errSessionsExhausted
+	}
+	return errAllRetriesFailed
+}
+
+// sessionIndexOf 返回 session key 在配置中的索引，不存在时返回 -1
+func sessionIndexOf(sessionKey string) int {
+	config.ConfigInstance.RwMutex.RLock()
+	defer config.ConfigInstance.RwMutex.RUnlock()
+	for i, s := range config.ConfigInstance.Sessions {
+		if s.SessionKey == sessionKey {
+			return i
+		}
+	}
+	return -1
+}
+
+// nextSessionIndex returns the session after index in rotation order that
+// the route allows. With pacing enabled, sessions still inside their pacing
+// interval are passed over in favour of one that can send right away; when
+// every usable session is paced the plain rotation order is kept and the
+// attempt waits instead.
+func nextSessionIndex(index int, route sessionRoute) int {
+	n, _ := config.ConfigInstance.SessionCount()
+	next := -1
+	for i := 1; i <= n; i++ {
+		candidate := (index + i) % n
+		if !route.fits(candidate) {
+			continue
+		}
+		if next < 0 {
+			next = candidate
+			if config.ConfigInstance.SessionMinInterval <= 0 {
+				return next
+			}
+		}
+		session, state, err := config.ConfigInstance.SessionWithState(candidate)
+		if err != nil || session.Archived {
+			continue
+		}
+		if state.IsAvailableFor(route.family) && state.PacingDelay() == 0 {
+			return candidate
+		}
+	}
+	if next < 0 {
+		return (index + 1) % n
+	}
+	return next
+}
+
+// sendTraced runs one retry attempt inside its own span, so the upstream
+// spans of the attempt are grouped under the session that served it.
+func (a *chatAttempt) sendTraced(session config.SessionInfo, state *config.SessionState, index int, attempt int, c *gin.Context) error {
+	parent := c.Request.Context()
+	ctx, span := tracing.Start(parent, "attempt", tracing.KindInternal)
+	span.SetAttr("session.index", index)
+	span.SetAttr("session", maskSessionKey(session.SessionKey))
+	span.SetAttr("attempt", attempt)
+	c.Request = c.Request.WithContext(ctx)
+	err := a.sendObserved(session, state, c)
+	c.Request = c.Request.WithContext(parent)
+	span.SetError(err)
+	span.End()
+	return err
+}
+
+// sendObserved sends the attempt on a session and, for streams, records
+// the stalls seen while relaying it on the session's state.
+func (a *chatAttempt) sendObserved(session config.SessionInfo, state *config.SessionState, c *gin.Context) error {
+	if !a.Stream {
+		return a.sendWithFallback(session, c)
+	}
+	stats := startStreamStats(c)
+	err := a.sendWithFallback(session, c)
+	if stalls := stats.finish(); stalls > 0 {
+		state.RecordStalls(stalls)
+	}
+	return err
+}
+
+// sendWithFallback tries each model of the chain on the given session. It
+// stops early on rate limits, which apply to the session, and once any
+// response bytes were written since those can't be retracted.
+func (a *chatAttempt) sendWithFallback(session config.SessionInfo, c *gin.Context) error {
+	var err error
+	for i, modelPreference := range a.Models {
+		if i > 0 {
+			requestLog(c).Info(fmt.Sprintf("Falling back to model %s", modelPreference))
+		}
+		err = a.send(session, modelPreference, c)
+		var rateLimitErr *core.RateLimitError
+		var authErr *core.AuthError
+		var circuitErr *core.CircuitOpenError
+		var timeoutErr *core.TimeoutError
+		if err == nil || errors.As(err, &rateLimitErr) || errors.As(err, &authErr) || errors.As(err, &circuitErr) || errors.As(err, &timeoutErr) || c.Writer.Written() || c.Request.Context().Err() != nil {
+			return err
+		}
+		requestLog(c).Error(fmt.Sprintf("Model %s failed: %v", modelPreference, err))
+	}
+	return err
+}
+
+// send uploads the attachments and sends the prompt with the given session
+func (a *chatAttempt) send(session config.SessionInfo, modelPreference string, c *gin.Context) error {
+	a.lastModel = modelPreference
+	var pplxClient *core.Client
+	if a.base != nil {
+		pplxClient = a.base.Fork(modelPreference, a.OpenSearch)
+	} else {
+		pplxClient = core.NewSessionClient(session, modelPreference, a.OpenSearch)
+	}
+	turn := chatTurn{Prompt: a.Prompt, Images: a.Images, Files: a.Files}
+	if a.Thread != nil && a.FollowUp != nil && a.Thread.SessionKey == session.SessionKey {
+		requestLog(c).Info("Continuing existing thread with the new message only")
+		turn = *a.FollowUp
+		pplxClient.FollowUp = &a.Thread.Thread
+	} else if a.Thread != nil {
+		// 会话所属的账号不可用，在此账号上以完整历史重新开始，之后的追问固定到此账号
+		requestLog(c).Info("Session of the thread is unavailable, restarting the conversation with the full history")
+	}
+	if len(turn.Images) > 0 {
+		if err := pplxClient.UploadImage(turn.Images); err != nil {
+			return fmt.Errorf("upload image: %w", err)
+		}
+	}
+	if len(turn.Files) > 0 {
+		if err := pplxClient.UploadFile(turn.Files); err != nil {
+			return fmt.Errorf("upload file: %w", err)
+		}
+	}
+	pplxClient.RawOutput = a.RawOutput
+	pplxClient.Search = a.Search
+	pplxClient.ExtractClaims = a.ExtractClaims
+	pplxClient.Timezone = a.Timezone
+	pplxClient.RequestID = requestLog(c).RequestID
+	pplxClient.Scrubber = redact.For(requestKey(c))
+	prompt := turn.Prompt
+	if a.exceedsHistoryLimit(prompt) {
+		if err := pplxClient.UploadText(prompt); err != nil {
+			return fmt.Errorf("upload text: %w", err)
+		}
+		prompt = config.ConfigInstance.PromptForFile
+	}
+	a.sent = prompt
+	// 客户端断开时取消上游请求；可续传的流需要在断开后继续读取，不跟随取消
+	ctx := c.Request.Context()
+	if model.ResumableFrom(c) != nil {
+		ctx = context.WithoutCancel(ctx)
+		// 停机移交深度研究任务时仍需中止上游
+		if rr := researchFrom(c); rr != nil {
+			var stop context.CancelFunc
+			ctx, stop = context.WithCancel(ctx)
+			defer stop()
+			defer context.AfterFunc(rr.ctx, stop)()
+		}
+	}
+	// 上游临时性 5xx 错误在同一 session 内按退避策略重试
+	policy := config.ConfigInstance.Backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var status int
+		status, err = pplxClient.SendMessage(ctx, prompt, a.Stream, config.ConfigInstance.IsIncognito, c)
+		if err == nil {
+			a.citations = pplxClient.Citations
+		}
+		if err == nil && pplxClient.Answered.BackendUUID != "" {
+			a.answered = &threadRef{SessionKey: session.SessionKey, Thread: pplxClient.Answered}
+			a.answeredBy = pplxClient
+		}
+		var circuitErr *core.CircuitOpenError
+		if err == nil || attempt >= policy.MaxAttempts || !policy.IsRetryable(status) || c.Writer.Written() || errors.As(err, &circuitErr) {
+			return err
+		}
+		delay := policy.Delay(attempt)
+		requestLog(c).Info(fmt.Sprintf("Upstream returned %d, retrying in %v (attempt %d/%d)", status, delay, attempt+1, policy.MaxAttempts))
+		if !waitBackoff(c, delay) {
+			return ctx.Err()
+		}
+	}
+}
+
+// waitBackoff sleeps for delay, returning false if the client disconnects first
+func waitBackoff(c *gin.Context, delay time.Duration) bool {
+	if delay <= 0 {
+		return c.Request.Context().Err() == nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.Request.Context().Done():
+		return false
+	}
+}
+
+// exceedsHistoryLimit 判断上下文是否需要作为文件上传
+func (a *chatAttempt) exceedsHistoryLimit(prompt string) bool {
+	if len(prompt) > config.ConfigInstance.MaxChatHistoryLength {
+		return true
+	}
+	maxTokens := config.ConfigInstance.MaxChatHistoryTokens
+	return maxTokens > 0 && tokenizer.ForModel(a.RequestModel).Count(prompt) > maxTokens
+}
+
+// recordResult updates the session state after an attempt. A request the
+// client cancelled says nothing about the session and isn't recorded. A
+// rate limit cools down the model family that hit it.
+func recordResult(index int, state *config.SessionState, family string, err error) {
+	var circuitErr *core.CircuitOpenError
+	if errors.Is(err, context.Canceled) || errors.As(err, &circuitErr) {
+		return
+	}
+	if err == nil {
+		state.RecordSuccess()
+		state.DecayCooldown(family)
+		return
+	}
+	var authErr *core.AuthError
+	if errors.As(err, &authErr) {
+		failures := state.RecordAuthFailure()
+		if index >= 0 {
+			quarantineOnAuthFailure(index, state.Key(), failures, authErr)
+		}
+		return
+	}
+	var rateLimitErr *core.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		cooldown := state.NextCooldown(family, rateLimitErr.RetryAfter)
+		state.RecordRateLimit(family, cooldown)
+		logger.Info(fmt.Sprintf("Session %d rate limited for %s models, cooling down for %v", index, family, cooldown))
+		if index >= 0 {
+			notifyRateLimited(index, family, cooldown)
+		}
+		return
+	}
+	state.RecordError()
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"fmt"
+	"pplx2api/config"
+	"pplx2api/usage"
+	"time"
+)
+
+// overBudget returns which budget of the session is used up and when its
+// window resets, or an empty string while the session is within budget.
+// Usage is counted by this replica only.
+func overBudget(session config.SessionInfo) (string, time.Time) {
+	b := config.ConfigInstance.BudgetFor(session)
+	if !b.Limited() {
+		return "", time.Time{}
+	}
+	name := maskSessionKey(session.SessionKey)
+	now := time.Now().UTC()
+	if b.DailyRequests > 0 || b.DailyTokens > 0 {
+		day := now.Truncate(24 * time.Hour)
+		if exceeded := budgetExceeded(usage.SessionSince(name, day), b.DailyRequests, b.DailyTokens); exceeded != "" {
+			return "daily " + exceeded, day.AddDate(0, 0, 1)
+		}
+	}
+	if b.MonthlyRequests > 0 || b.MonthlyTokens > 0 {
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if exceeded := budgetExceeded(usage.SessionSince(name, month), b.MonthlyRequests, b.MonthlyTokens); exceeded != "" {
+			return "monthly " + exceeded, month.AddDate(0, 1, 0)
+		}
+	}
+	return "", time.Time{}
+}
+
+// budgetExceeded 返回用完的预算，失败的请求同样计入请求数
+func budgetExceeded(used usage.Totals, requests int, tokens int) string {
+	switch {
+	case requests > 0 && used.Requests+used.Errors >= requests:
+		return fmt.Sprintf("request budget of %d", requests)
+	case tokens > 0 && used.TotalTokens >= tokens:
+		return fmt.Sprintf("token budget of %d", tokens)
+	}
+	return ""
+}
@@ -0,0 +1,103 @@
+package service
+
+import (
+	"pplx2api/cache"
+	"pplx2api/config"
+	"pplx2api/model"
+	"pplx2api/usage"
+	"strings"
+)
+
+// cacheSessionLabel 缓存命中的请求在会话记录中的账号标签
+const cacheSessionLabel = "cache"
+
+// Response cache stage names
+const (
+	StageCache      = "cache"
+	StageCacheStore = "cache_store"
+)
+
+func init() {
+	addChatStage(StageDispatch, chatStage{StageCache, cacheStage})
+	addChatStage(StagePostProcess, chatStage{StageCacheStore, cacheStoreStage})
+}
+
+// cacheRequest is the normalized request a cached response is keyed on:
+// the endpoint, the key and everything sent upstream, but not whether the
+// response is streamed, so either form can replay the other.
+type cacheRequest struct {
+	Path      string      `json:"path"`
+	Key       string      `json:"key"`
+	Attempt   chatAttempt `json:"attempt"`
+	Stops     []string    `json:"stops,omitempty"`
+	MaxTokens int         `json:"max_tokens,omitempty"`
+}
+
+// normalizedKey 返回请求的缓存键，相同请求在流式与非流式下相同
+func normalizedKey(r *chatRequest) string {
+	attempt := *r.Attempt
+	attempt.Stream = false
+	return cache.Key(cacheRequest{
+		Path:      r.c.FullPath(),
+		Key:       apiKeyLabel(r.c),
+		Attempt:   attempt,
+		Stops:     r.Limits.stops,
+		MaxTokens: r.Limits.maxTokens,
+	})
+}
+
+// cacheable 深度研究、提取陈述与要求不使用缓存的请求不缓存
+func cacheable(r *chatRequest) bool {
+	if r.Attempt.ExtractClaims || r.UserSession != "" {
+		return false
+	}
+	if config.ConfigInstance.IsDeepResearch(append([]string{r.Attempt.RequestModel}, r.Attempt.Models...)...) {
+		return false
+	}
+	control := strings.ToLower(r.c.GetHeader("Cache-Control"))
+	return !strings.Contains(control, "no-cache") && !strings.Contains(control, "no-store")
+}
+
+// cacheStage 命中缓存时重放之前的回答，未命中时录制本次回答
+func cacheStage(r *chatRequest) error {
+	if !cache.Enabled() || !cacheable(r) {
+		return nil
+	}
+	r.CacheKey = normalizedKey(r)
+	if rec, ok := cache.Get(r.CacheKey); ok {
+		requestLog(r.c).Info("Serving response from cache")
+		r.c.Header("X-Cache", "HIT")
+		r.Meter = usage.Start(r.c, r.Model, r.Attempt.Prompt, r.Body.Stream && r.Body.StreamOptions != nil && r.Body.StreamOptions.IncludeUsage)
+		// 命中的回答不消耗账号额度，不计入用量统计
+		r.Meter.Session = cacheSessionLabel
+		model.Replay(r.c, rec, r.Body.Stream)
+		r.Done = true
+		return nil
+	}
+	r.c.Header("X-Cache", "MISS")
+	r.record()
+	return nil
+}
+
+// cacheStoreStage 缓存完整结束的回答；被截断、拦截或客户端中途断开的不缓存
+func cacheStoreStage(r *chatRequest) error {
+	rec := r.Recording
+	if rec == nil || r.CacheKey == "" || r.c.Request.Context().Err() != nil || model.Interrupted(r.c) || model.Partial(r.c) {
+		return nil
+	}
+	switch rec.FinishReason {
+	case model.FinishStop:
+	case model.FinishLength:
+		// 只有 max_tokens 造成的截断是确定的
+		if r.Limits.maxTokens == 0 {
+			return nil
+		}
+	default:
+		return nil
+	}
+	if rec.Content == "" && rec.Refusal == "" {
+		return nil
+	}
+	cache.Put(r.CacheKey, rec)
+	return nil
+}
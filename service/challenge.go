@@ -0,0 +1,144 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/notify"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// clearanceTTL 验证服务未返回 cf_clearance 过期时间时使用的有效期
+const clearanceTTL = 30 * time.Minute
+
+var (
+	// solverMutex 同一时间只调用一次验证服务，solvedAt 记录各出口最近一次验证通过的时间
+	solverMutex sync.Mutex
+	solvedAt    = map[string]time.Time{}
+)
+
+// handleChallenge takes the session out of rotation through the proxy that
+// got a Cloudflare challenge and alerts the operators. With CHALLENGE_SOLVER
+// set it asks the solver for clearance cookies for that egress and reports
+// whether the session can be retried right away.
+func handleChallenge(c *gin.Context, index int, state *config.SessionState, challenge *core.ChallengeError) bool {
+	cfg := config.ConfigInstance
+	log := requestLog(c)
+	proxy := redactProxy(challenge.Proxy)
+	state.MarkChallenged(challenge.Proxy, cfg.ChallengeCooldown)
+	log.Error(fmt.Sprintf("Session %d got a Cloudflare challenge (status %d) through %s, pausing it for %v", index, challenge.Status, proxy, cfg.ChallengeCooldown))
+	notify.Send(notify.Event{
+		Event:   notify.SessionChallenged,
+		Message: fmt.Sprintf("Session %d got a Cloudflare challenge through %s", index, proxy),
+		Data:    map[string]interface{}{"session": index, "status": challenge.Status, "proxy": proxy},
+	})
+	if cfg.ChallengeSolver == "" {
+		return false
+	}
+	if err := solveChallenge(c.Request.Context(), challenge.Proxy); err != nil {
+		log.Error(fmt.Sprintf("Challenge solver failed for %s: %v", proxy, err))
+		return false
+	}
+	state.ClearChallenged(challenge.Proxy)
+	log.Info(fmt.Sprintf("Challenge solved for %s, retrying session %d", proxy, index))
+	return true
+}
+
+// solverRequest is the request sent to CHALLENGE_SOLVER, in the format of
+// FlareSolverr's request.get command
+type solverRequest struct {
+	Cmd        string       `json:"cmd"`
+	URL        string       `json:"url"`
+	MaxTimeout int64        `json:"maxTimeout"`
+	Proxy      *solverProxy `json:"proxy,omitempty"`
+}
+
+type solverProxy struct {
+	URL string `json:"url"`
+}
+
+// solverResponse 验证服务返回的 cookie 与对应的 User-Agent
+type solverResponse struct {
+	Status   string `json:"status"`
+	Message  string `json:"message"`
+	Solution struct {
+		Cookies []struct {
+			Name    string  `json:"name"`
+			Value   string  `json:"value"`
+			Expires float64 `json:"expires"`
+		} `json:"cookies"`
+		UserAgent string `json:"userAgent"`
+	} `json:"solution"`
+}
+
+// solveChallenge 通过验证服务为 proxy 出口取得 Cloudflare cookie，
+// 其他请求刚刚完成同一出口的验证时直接返回
+func solveChallenge(ctx context.Context, proxy string) error {
+	solverMutex.Lock()
+	defer solverMutex.Unlock()
+	if time.Since(solvedAt[proxy]) < time.Minute {
+		return nil
+	}
+	timeout := config.ConfigInstance.ChallengeSolverTimeout
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	body := solverRequest{Cmd: "request.get", URL: config.ConfigInstance.Upstream.URL + "/", MaxTimeout: timeout.Milliseconds()}
+	if proxy != "" {
+		body.Proxy = &solverProxy{URL: proxy}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.ConfigInstance.ChallengeSolver, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result solverResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("invalid solver response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || (result.Status != "" && result.Status != "ok") {
+		return fmt.Errorf("solver returned status %d: %s", resp.StatusCode, result.Message)
+	}
+	clearance := core.Clearance{Cookies: map[string]string{}, UserAgent: result.Solution.UserAgent, Expires: time.Now().Add(clearanceTTL)}
+	for _, cookie := range result.Solution.Cookies {
+		clearance.Cookies[cookie.Name] = cookie.Value
+		if cookie.Name == "cf_clearance" && cookie.Expires > 0 {
+			clearance.Expires = time.Unix(int64(cookie.Expires), 0)
+		}
+	}
+	if len(clearance.Cookies) == 0 {
+		return errors.New("solver returned no cookies")
+	}
+	core.SetClearance(proxy, clearance)
+	solvedAt[proxy] = time.Now()
+	return nil
+}
+
+// redactProxy 去掉代理地址中的密码，直连时返回 direct
+func redactProxy(proxy string) string {
+	if proxy == "" {
+		return "direct"
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "proxy"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,210 @@
+package service
+
+import (
+	"net/http"
+	"pplx2api/model"
+	"pplx2api/tokenizer"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TextCompletionRequest is the legacy OpenAI completions request
+type TextCompletionRequest struct {
+	Model string `json:"model"`
+	// Prompt 字符串或只含一个字符串的数组
+	Prompt    interface{} `json:"prompt"`
+	MaxTokens int         `json:"max_tokens,omitempty"`
+	// Stop 字符串或最多4个字符串的数组
+	Stop          interface{}    `json:"stop,omitempty"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+}
+
+// CompletionsHandler handles the legacy text completions endpoint. The
+// prompt is sent as a single user message through the chat pipeline and
+// the answer is returned as text_completion objects.
+func CompletionsHandler(c *gin.Context) {
+	runPipeline(c, withParseStage(parseCompletionStage))
+}
+
+// parseCompletionStage 解析文本补全请求并转换为聊天请求
+func parseCompletionStage(r *chatRequest) error {
+	var req TextCompletionRequest
+	if err := r.c.ShouldBindJSON(&req); err != nil {
+		return invalidBody(err)
+	}
+	prompts, ok := stringList(req.Prompt)
+	if !ok || len(prompts) == 0 || strings.TrimSpace(strings.Join(prompts, "")) == "" {
+		return abortWith(http.StatusBadRequest, "prompt must be a non-empty string")
+	}
+	if len(prompts) > 1 {
+		return abortWith(http.StatusBadRequest, "Only one prompt per request is supported")
+	}
+	stops, ok := stringList(req.Stop)
+	if !ok || len(stops) > 4 {
+		return abortWith(http.StatusBadRequest, "stop must be a string or an array of up to 4 strings")
+	}
+	if req.MaxTokens < 0 {
+		return abortWith(http.StatusBadRequest, "max_tokens must not be negative")
+	}
+	r.Limits = outputLimits{stops: stops, maxTokens: req.MaxTokens}
+	r.Body = ChatCompletionRequest{
+		Model:         req.Model,
+		Messages:      []map[string]interface{}{{"role": "user", "content": prompts[0]}},
+		Stream:        req.Stream,
+		StreamOptions: req.StreamOptions,
+	}
+	model.SetTextCompletion(r.c)
+	return nil
+}
+
+// stringList 解析字符串或字符串数组，nil 返回空列表
+func stringList(v interface{}) ([]string, bool) {
+	switch t := v.(type) {
+	case nil:
+		return nil, true
+	case string:
+		return []string{t}, true
+	case []interface{}:
+		list := make([]string, 0, len(t))
+		for _, item := range t {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			if s != "" {
+				list = append(list, s)
+			}
+		}
+		return list, true
+	}
+	return nil, false
+}
+
+// outputLimits are the stop sequences and token limit of a completion
+type outputLimits struct {
+	stops     []string
+	maxTokens int
+}
+
+// limitsStage 在输出过滤链末尾加入停止序列与长度限制
+func limitsStage(r *chatRequest) error {
+	l := r.Limits
+	if len(l.stops) == 0 && l.maxTokens == 0 {
+		return nil
+	}
+	model.AddOutputFilter(r.c, newStopFilter(r, l))
+	if !r.Body.Stream {
+		// 非流式回答结束后才过滤，另用一个过滤器在读取时判断能否提前结束
+		model.SetOutputWatcher(r.c, newStopFilter(r, l))
+	}
+	return nil
+}
+
+func newStopFilter(r *chatRequest, l outputLimits) *stopFilter {
+	return &stopFilter{
+		gc:        r.c,
+		stops:     l.stops,
+		maxTokens: l.maxTokens,
+		tokenizer: tokenizer.ForModel(r.Model),
+	}
+}
+
+// stopFilter ends the output at the first stop sequence, which is not
+// included, or once maxTokens were written, and then ends the upstream
+// request. Text that may be the start of a stop sequence split across
+// chunks is held back until it is decided.
+type stopFilter struct {
+	gc        *gin.Context
+	stops     []string
+	maxTokens int
+	tokenizer tokenizer.Tokenizer
+
+	mutex   sync.Mutex
+	held    string
+	written strings.Builder
+	done    bool
+}
+
+func (f *stopFilter) Filter(text string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.done {
+		return ""
+	}
+	text, f.held = f.held+text, ""
+	if i := firstStop(text, f.stops); i >= 0 {
+		text = text[:i]
+		f.done = true
+		model.EndOutput(f.gc)
+	} else if keep := partialStop(text, f.stops); keep > 0 {
+		text, f.held = text[:len(text)-keep], text[len(text)-keep:]
+	}
+	return f.limit(text)
+}
+
+// Flush releases the held back text once the response ends
+func (f *stopFilter) Flush() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.done {
+		return ""
+	}
+	text := f.held
+	f.held = ""
+	return f.limit(text)
+}
+
+// limit 截断超出 maxTokens 的文本，调用方需持有锁
+func (f *stopFilter) limit(text string) string {
+	if f.maxTokens <= 0 || text == "" {
+		return text
+	}
+	written := f.written.String()
+	if f.tokenizer.Count(written+text) <= f.maxTokens {
+		f.written.WriteString(text)
+		return text
+	}
+	// 二分查找不超过上限的最长前缀
+	runes := []rune(text)
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if f.tokenizer.Count(written+string(runes[:mid])) <= f.maxTokens {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	f.done, f.held = true, ""
+	model.SetFinishReason(f.gc, model.FinishLength)
+	model.EndOutput(f.gc)
+	return string(runes[:lo])
+}
+
+// firstStop 返回最早出现的停止序列的位置，没有时返回 -1
+func firstStop(text string, stops []string) int {
+	first := -1
+	for _, stop := range stops {
+		if i := strings.Index(text, stop); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	return first
+}
+
+// partialStop 返回文本末尾可能是停止序列开头的最长字节数
+func partialStop(text string, stops []string) int {
+	keep := 0
+	for _, stop := range stops {
+		for n := len(stop) - 1; n > keep; n-- {
+			if strings.HasSuffix(text, stop[:n]) {
+				keep = n
+				break
+			}
+		}
+	}
+	return keep
+}
@@ -0,0 +1,212 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"pplx2api/config"
+	"pplx2api/model"
+	"pplx2api/tokenizer"
+	"pplx2api/usage"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StageContext 按 token 预算裁剪对话的阶段
+const StageContext = "context"
+
+// maxSummaries 缓存的对话总结数，避免长对话每一轮都重新总结
+const maxSummaries = 256
+
+// summaryPrompt 请求上游总结被裁剪的早期消息
+const summaryPrompt = "Summarize the following earlier part of a conversation in a few sentences. " +
+	"Keep facts, names, decisions and open questions that later messages may refer to. Reply with the summary only.\n\n"
+
+func init() {
+	addChatStage(StageTransform, chatStage{StageContext, contextStage})
+}
+
+var (
+	summaries      = map[string]string{}
+	summariesMutex sync.Mutex
+)
+
+// contextStage fits a conversation whose estimated prompt tokens exceed
+// the context budget of the key, or CONTEXT_BUDGET, by dropping or
+// summarizing earlier messages. System messages and the last message are
+// always kept.
+func contextStage(r *chatRequest) error {
+	if r.Thread != nil {
+		// 追问已有会话时只发送最后一条消息
+		return nil
+	}
+	policy := config.ConfigInstance.Context.Merge(r.APIKey.Defaults.Context)
+	if policy.Budget <= 0 {
+		return nil
+	}
+	t := tokenizer.ForModel(r.Model)
+	msgs := r.Body.Messages
+	counts := make([]int, len(msgs))
+	total := 0
+	for i, msg := range msgs {
+		counts[i] = t.Count(messageText(msg))
+		total += counts[i]
+	}
+	if total <= policy.Budget {
+		return nil
+	}
+	var kept, dropped []map[string]interface{}
+	if policy.Strategy == config.ContextKeepLast {
+		kept, dropped = keepLastMessages(msgs, policy.KeepLast)
+	} else {
+		kept, dropped = dropOldestMessages(msgs, counts, total, policy.Budget)
+	}
+	if len(dropped) == 0 {
+		return nil
+	}
+	if policy.Strategy == config.ContextSummarize {
+		summary, err := summarizeMessages(r, policy, dropped)
+		if err != nil {
+			requestLog(r.c).Error(fmt.Sprintf("Failed to summarize %d messages, dropping them: %v", len(dropped), err))
+		} else {
+			kept = insertSummary(kept, summary)
+		}
+	}
+	requestLog(r.c).Info(fmt.Sprintf("Conversation of ~%d tokens exceeds the context budget of %d, %s %d messages", total, policy.Budget, policy.Strategy, len(dropped)))
+	r.c.Header("X-Context-Dropped", strconv.Itoa(len(dropped)))
+	r.Body.Messages = kept
+	return nil
+}
+
+// messageText 返回消息的文本内容，数组内容只取 text 片段
+func messageText(msg map[string]interface{}) string {
+	switch v := msg["content"].(type) {
+	case string:
+		return v
+	case []interface{}:
+		var texts []string
+		for _, item := range v {
+			if itemMap, ok := item.(map[string]interface{}); ok && itemMap["type"] == "text" {
+				if text, ok := itemMap["text"].(string); ok {
+					texts = append(texts, text)
+				}
+			}
+		}
+		return strings.Join(texts, "\n\n")
+	}
+	return ""
+}
+
+func isSystemMessage(msg map[string]interface{}) bool {
+	role, _ := msg["role"].(string)
+	return role == "system" || role == "developer"
+}
+
+// dropOldestMessages 从最早的非 system 消息开始丢弃，直到不超过预算
+func dropOldestMessages(msgs []map[string]interface{}, counts []int, total int, budget int) (kept, dropped []map[string]interface{}) {
+	for i, msg := range msgs {
+		if total > budget && i < len(msgs)-1 && !isSystemMessage(msg) {
+			dropped = append(dropped, msg)
+			total -= counts[i]
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	return kept, dropped
+}
+
+// keepLastMessages 保留 system 消息与最后 n 条其他消息
+func keepLastMessages(msgs []map[string]interface{}, n int) (kept, dropped []map[string]interface{}) {
+	if n < 1 {
+		n = 1
+	}
+	others := 0
+	for _, msg := range msgs {
+		if !isSystemMessage(msg) {
+			others++
+		}
+	}
+	for _, msg := range msgs {
+		if !isSystemMessage(msg) && others > n {
+			dropped = append(dropped, msg)
+			others--
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	return kept, dropped
+}
+
+// insertSummary 将总结作为 system 消息放在开头的 system 消息之后
+func insertSummary(msgs []map[string]interface{}, summary string) []map[string]interface{} {
+	i := 0
+	for i < len(msgs) && isSystemMessage(msgs[i]) {
+		i++
+	}
+	note := map[string]interface{}{"role": "system", "content": "Summary of the earlier conversation: " + summary}
+	result := make([]map[string]interface{}, 0, len(msgs)+1)
+	result = append(result, msgs[:i]...)
+	result = append(result, note)
+	return append(result, msgs[i:]...)
+}
+
+// summarizeMessages 用一次上游请求总结被裁剪的消息，相同的消息复用之前的总结
+func summarizeMessages(r *chatRequest, policy config.ContextPolicy, dropped []map[string]interface{}) (string, error) {
+	summaryModel := policy.SummaryModel
+	if summaryModel == "" {
+		summaryModel = r.Model
+	}
+	var transcript strings.Builder
+	for _, msg := range dropped {
+		role, _ := msg["role"].(string)
+		transcript.WriteString(role + ": " + messageText(msg) + "\n\n")
+	}
+	encoded, _ := json.Marshal([]string{r.APIKey.Name, summaryModel, transcript.String()})
+	sum := sha256.Sum256(encoded)
+	key := hex.EncodeToString(sum[:])
+	summariesMutex.Lock()
+	summary, ok := summaries[key]
+	summariesMutex.Unlock()
+	if ok {
+		return summary, nil
+	}
+
+	prompt := summaryPrompt + transcript.String()
+	attempt := &chatAttempt{
+		RequestModel: summaryModel,
+		Models:       config.ResolveModelChain(summaryModel),
+		Prompt:       prompt,
+		RawOutput:    true,
+		Timezone:     config.ConfigInstance.Timezone,
+	}
+	recorder := httptest.NewRecorder()
+	gc, _ := gin.CreateTestContext(recorder)
+	gc.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(r.c.Request.Context())
+	rec := model.Record(gc)
+	meter := usage.Start(gc, summaryModel, prompt, false)
+	err := attempt.sendWithRetry(gc)
+	meter.Record(r.APIKey.Name)
+	if err != nil {
+		return "", err
+	}
+	summary = strings.TrimSpace(rec.Content)
+	if summary == "" {
+		return "", fmt.Errorf("upstream returned an empty summary")
+	}
+	summariesMutex.Lock()
+	if len(summaries) >= maxSummaries {
+		for k := range summaries {
+			delete(summaries, k)
+			break
+		}
+	}
+	summaries[key] = summary
+	summariesMutex.Unlock()
+	return summary, nil
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"pplx2api/conversation"
+	"pplx2api/redact"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// recordConversation 记录请求与实际发送给上游的内容，按 key 的设置先遮盖个人信息，
+// 未开启或请求未到达发送阶段时跳过
+func recordConversation(r *chatRequest, err error) {
+	store := conversation.Default()
+	if store == nil || r.Attempt == nil {
+		return
+	}
+	record := conversation.Record{
+		ID:             uuid.New().String(),
+		RequestID:      requestLog(r.c).RequestID,
+		Key:            apiKeyLabel(r.c),
+		ConversationID: r.Body.ConversationID,
+		Model:          r.Body.Model,
+		Messages:       r.Body.Messages,
+		Prompt:         r.Attempt.sent,
+		Citations:      r.Attempt.citations,
+		Status:         conversation.StatusCompleted,
+		CreatedAt:      r.Started,
+		DurationMs:     time.Since(r.Started).Milliseconds(),
+	}
+	if r.Meter != nil {
+		record.Response = r.Meter.Completion()
+		record.Session = r.Meter.Session
+	}
+	if err != nil {
+		record.Status = conversation.StatusFailed
+		record.Error = err.Error()
+	}
+	if scrubber := redact.For(requestKey(r.c)); scrubber != nil {
+		record.Redact(scrubber)
+	}
+	if err := store.Save(record); err != nil {
+		requestLog(r.c).Error(fmt.Sprintf("Failed to record conversation: %v", err))
+	}
+}
+
+// conversationStore 返回记录存储，未开启时返回 404
+func conversationStore(c *gin.Context) conversation.Store {
+	store := conversation.Default()
+	if store == nil {
+		respondError(c, http.StatusNotFound, "", "Conversation recording is disabled")
+	}
+	return store
+}
+
+// ListConversationsHandler lists the recorded requests of the calling key
+func ListConversationsHandler(c *gin.Context) {
+	store := conversationStore(c)
+	if store == nil {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	records, err := store.List(apiKeyLabel(c), c.Query("conversation_id"), limit)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	summaries := make([]conversation.Record, 0, len(records))
+	for _, r := range records {
+		summaries = append(summaries, r.Summary())
+	}
+	c.JSON(http.StatusOK, gin.H{"object": "list", "data": summaries})
+}
+
+// GetConversationHandler returns one recorded request with prompt and response
+func GetConversationHandler(c *gin.Context) {
+	store := conversationStore(c)
+	if store == nil {
+		return
+	}
+	record, ok, err := store.Get(apiKeyLabel(c), c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if !ok {
+		respondError(c, http.StatusNotFound, "", "Conversation not found")
+		return
+	}
+	c.JSON(http.StatusOK, record)
+}
+
+// DeleteConversationHandler deletes one recorded request
+func DeleteConversationHandler(c *gin.Context) {
+	store := conversationStore(c)
+	if store == nil {
+		return
+	}
+	ok, err := store.Delete(apiKeyLabel(c), c.Param("id"))
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if !ok {
+		respondError(c, http.StatusNotFound, "", "Conversation not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": c.Param("id"), "deleted": true})
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	_ "embed"
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/logger"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dashboardPage 管理面板单页，数据通过 /admin 接口获取
+//
+//go:embed web/dashboard.html
+var dashboardPage []byte
+
+// statsWindow 面板展示的吞吐量时间范围
+const statsWindow = time.Hour
+
+// ThroughputBucket is the upstream request outcomes of all sessions in
+// one time bucket
+type ThroughputBucket struct {
+	Start       time.Time `json:"start"`
+	Successes   int       `json:"successes"`
+	RateLimited int       `json:"rate_limited"`
+	Errors      int       `json:"errors"`
+}
+
+// DashboardHandler serves the admin dashboard. The page itself holds no
+// data and is served without a key; it asks for an admin key and calls
+// the /admin endpoints with it.
+func DashboardHandler(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", dashboardPage)
+}
+
+// StatsHandler returns the upstream throughput and error rate of the last
+// hour in 5 minute buckets, with the current load
+func StatsHandler(c *gin.Context) {
+	config.ConfigInstance.RwMutex.RLock()
+	count := len(config.ConfigInstance.Sessions)
+	config.ConfigInstance.RwMutex.RUnlock()
+
+	now := time.Now()
+	slots := int(statsWindow / config.HistorySlot)
+	buckets := make([]ThroughputBucket, slots)
+	var total ThroughputBucket
+	for i := 0; i < count; i++ {
+		history := config.SessionStateAt(i).Buckets(now, config.HistorySlot)
+		history = history[len(history)-slots:]
+		for j, b := range history {
+			buckets[j].Start = b.Start
+			buckets[j].Successes += b.Successes
+			buckets[j].RateLimited += b.RateLimited
+			buckets[j].Errors += b.Errors
+			total.Successes += b.Successes
+			total.RateLimited += b.RateLimited
+			total.Errors += b.Errors
+		}
+	}
+	errorRate := 0.0
+	if requests := total.Successes + total.RateLimited + total.Errors; requests > 0 {
+		errorRate = float64(total.RateLimited+total.Errors) / float64(requests)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"bucket_seconds":  int(config.HistorySlot.Seconds()),
+		"buckets":         buckets,
+		"successes":       total.Successes,
+		"rate_limited":    total.RateLimited,
+		"errors":          total.Errors,
+		"error_rate":      errorRate,
+		"active_requests": activeRequests.Load(),
+		"queued_requests": queuedRequests.Load(),
+		"shed_requests":   shedRequests.Load(),
+		"sessions":        countSessions(),
+		"circuit_breaker": core.Breaker(),
+	})
+}
+
+// LogsHandler returns the most recent log lines kept in memory. ?limit=
+// caps the number of lines (default 200) and ?level= the minimum level.
+func LogsHandler(c *gin.Context) {
+	limit := 200
+	if raw := c.Query("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			respondError(c, http.StatusBadRequest, "", "Invalid limit: must be a positive integer")
+			return
+		}
+		limit = n
+	}
+	minLevel := logger.DEBUG
+	if raw := c.Query("level"); raw != "" {
+		level, ok := logger.ParseLevel(raw)
+		if !ok {
+			respondError(c, http.StatusBadRequest, "", fmt.Sprintf("Invalid level: %s", raw))
+			return
+		}
+		minLevel = level
+	}
+	lines := make([]logger.Line, 0, limit)
+	for _, line := range logger.Recent(0) {
+		if level, _ := logger.ParseLevel(line.Level); level >= minLevel {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > limit {
+		lines = lines[len(lines)-limit:]
+	}
+	c.JSON(http.StatusOK, gin.H{"lines": lines})
+}
+
+// ClearCooldownHandler ends the rate limit cooldown of a session early
+func ClearCooldownHandler(c *gin.Context) {
+	idx, err := strconv.Atoi(c.Param("index"))
+	if err == nil {
+		_, err = config.ConfigInstance.GetSessionForModel(idx)
+	}
+	if err != nil {
+		respondError(c, http.StatusNotFound, "", fmt.Sprintf("Session not found: %s", c.Param("index")))
+		return
+	}
+	config.SessionStateAt(idx).ClearCooldown()
+	logger.Info(fmt.Sprintf("Session %d cooldown cleared", idx))
+	c.JSON(http.StatusOK, gin.H{"index": idx, "available": config.SessionStateAt(idx).IsAvailable()})
+}
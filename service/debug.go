@@ -0,0 +1,42 @@
+package service
+
+import (
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/core"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DebugRequestHandler exports the upstream calls of a request as sanitized
+// curl commands, as JSON or with ?format=curl as a shell script.
+func DebugRequestHandler(c *gin.Context) {
+	if config.ConfigInstance.DebugCapture <= 0 {
+		respondError(c, http.StatusNotFound, "", "Debug capture is disabled, set DEBUG_CAPTURE")
+		return
+	}
+	calls := core.UpstreamCalls(c.Param("id"))
+	if len(calls) == 0 {
+		respondError(c, http.StatusNotFound, "", "No upstream calls captured for this request")
+		return
+	}
+	if c.Query("format") == "curl" {
+		var b strings.Builder
+		b.WriteString("# export PPLX_SESSION=<your __Secure-next-auth.session-token>\n")
+		for _, call := range calls {
+			b.WriteString("\n" + call.Curl() + "\n")
+		}
+		c.String(http.StatusOK, b.String())
+		return
+	}
+	type callView struct {
+		core.UpstreamCall
+		Curl string `json:"curl"`
+	}
+	views := make([]callView, 0, len(calls))
+	for _, call := range calls {
+		views = append(views, callView{UpstreamCall: call, Curl: call.Curl()})
+	}
+	c.JSON(http.StatusOK, gin.H{"request_id": c.Param("id"), "calls": views})
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"pplx2api/config"
+	"pplx2api/model"
+	"pplx2api/usage"
+	"sync"
+)
+
+// StageDedup 合并相同的并发请求的阶段
+const StageDedup = "dedup"
+
+// dedupSessionLabel 跟随其他请求回答的请求在会话记录中的账号标签
+const dedupSessionLabel = "dedup"
+
+func init() {
+	addChatStage(StageDispatch, chatStage{StageDedup, dedupStage})
+}
+
+var (
+	flights      = map[string]*model.Recording{}
+	flightsMutex sync.Mutex
+)
+
+// dedupStage coalesces identical concurrent requests. The first one is
+// sent upstream and its response recorded; requests arriving while it runs
+// follow the recording instead, each in its own response format. When the
+// first request fails before writing anything, followers send their own.
+func dedupStage(r *chatRequest) error {
+	if !config.ConfigInstance.DedupInflight || !cacheable(r) {
+		return nil
+	}
+	key := r.CacheKey
+	if key == "" {
+		key = normalizedKey(r)
+	}
+	flightsMutex.Lock()
+	leader, ok := flights[key]
+	if !ok {
+		rec := r.record()
+		flights[key] = rec
+		flightsMutex.Unlock()
+		r.after = append(r.after, func() {
+			flightsMutex.Lock()
+			if flights[key] == rec {
+				delete(flights, key)
+			}
+			flightsMutex.Unlock()
+			rec.Close()
+		})
+		return nil
+	}
+	flightsMutex.Unlock()
+
+	requestLog(r.c).Info("Identical request in flight, following its response")
+	r.Meter = usage.Start(r.c, r.Model, r.Attempt.Prompt, r.Body.Stream && r.Body.StreamOptions != nil && r.Body.StreamOptions.IncludeUsage)
+	if model.Follow(r.c.Request.Context(), r.c, leader, r.Body.Stream) {
+		r.Meter.Session = dedupSessionLabel
+		r.Done = true
+		return nil
+	}
+	if err := r.c.Request.Context().Err(); err != nil {
+		return err
+	}
+	requestLog(r.c).Info("Followed request failed, sending this one upstream")
+	return nil
+}
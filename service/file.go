@@ -0,0 +1,79 @@
+package service
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/utils"
+	"strings"
+)
+
+// fileExtensionTypes 在未提供 MIME 类型时按扩展名推断
+var fileExtensionTypes = map[string]string{
+	".pdf":  "application/pdf",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".doc":  "application/msword",
+	".csv":  "text/csv",
+	".txt":  "text/plain",
+	".md":   "text/markdown",
+}
+
+// resolveFilePart converts an OpenAI `file` content part into an upload.
+// file_data may be a data URI or a bare base64 string; file_id references
+// are not supported since the proxy has no files API.
+func resolveFilePart(part map[string]interface{}) (core.FileData, error) {
+	file, ok := part["file"].(map[string]interface{})
+	if !ok {
+		return core.FileData{}, fmt.Errorf("missing file object")
+	}
+	if _, ok := file["file_id"]; ok {
+		return core.FileData{}, fmt.Errorf("file_id is not supported, send file_data instead")
+	}
+	data, _ := file["file_data"].(string)
+	if data == "" {
+		return core.FileData{}, fmt.Errorf("missing file_data")
+	}
+	filename, _ := file["filename"].(string)
+	filename = path.Base(filename)
+
+	mimeType := ""
+	if strings.HasPrefix(data, "data:") {
+		header, payload, ok := strings.Cut(data, ",")
+		if !ok || !strings.Contains(header, ";base64") {
+			return core.FileData{}, fmt.Errorf("file_data must be base64 encoded")
+		}
+		mimeType = strings.TrimPrefix(strings.SplitN(header, ";", 2)[0], "data:")
+		data = payload
+	}
+	if mimeType == "" {
+		mimeType = fileExtensionTypes[strings.ToLower(path.Ext(filename))]
+	}
+	if mimeType == "" {
+		return core.FileData{}, fmt.Errorf("cannot determine file type of %q", filename)
+	}
+	if !config.ConfigInstance.IsFileTypeAllowed(mimeType) {
+		return core.FileData{}, fmt.Errorf("file type %s is not allowed", mimeType)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return core.FileData{}, fmt.Errorf("invalid base64 file_data: %v", err)
+	}
+	if len(decoded) > config.ConfigInstance.MaxFileSize {
+		return core.FileData{}, &tooLargeError{What: "file", Limit: config.ConfigInstance.MaxFileSize}
+	}
+
+	if filename == "" || filename == "." || filename == "/" {
+		ext := ""
+		for e, t := range fileExtensionTypes {
+			if t == mimeType {
+				ext = e
+				break
+			}
+		}
+		filename = utils.RandomString(5) + ext
+	}
+	return core.FileData{Filename: filename, Base64: data, MimeType: mimeType}, nil
+}
@@ -0,0 +1,176 @@
+package service
+
+import (
+	"net/http"
+	"pplx2api/model"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GeminiRequest is a Gemini generateContent request
+type GeminiRequest struct {
+	Contents          []geminiContent `json:"contents"`
+	SystemInstruction *geminiContent  `json:"systemInstruction,omitempty"`
+	GenerationConfig  *struct {
+		StopSequences   []string `json:"stopSequences,omitempty"`
+		MaxOutputTokens int      `json:"maxOutputTokens,omitempty"`
+		CandidateCount  int      `json:"candidateCount,omitempty"`
+	} `json:"generationConfig,omitempty"`
+	Tools []map[string]interface{} `json:"tools,omitempty"`
+}
+
+type geminiContent struct {
+	Role  string       `json:"role"`
+	Parts []geminiPart `json:"parts"`
+}
+
+type geminiPart struct {
+	Text       string `json:"text,omitempty"`
+	Thought    bool   `json:"thought,omitempty"`
+	InlineData *struct {
+		MimeType string `json:"mimeType"`
+		Data     string `json:"data"`
+	} `json:"inlineData,omitempty"`
+	FileData *struct {
+		MimeType string `json:"mimeType"`
+		FileURI  string `json:"fileUri"`
+	} `json:"fileData,omitempty"`
+	FunctionCall     interface{} `json:"functionCall,omitempty"`
+	FunctionResponse interface{} `json:"functionResponse,omitempty"`
+}
+
+// geminiSearchTools 开启联网搜索的 Gemini 工具
+var geminiSearchTools = []string{"googleSearch", "google_search", "googleSearchRetrieval", "google_search_retrieval"}
+
+// geminiStatus 与 HTTP 状态码对应的 Gemini 错误状态
+var geminiStatus = map[int]string{
+	http.StatusBadRequest:          "INVALID_ARGUMENT",
+	http.StatusUnauthorized:        "UNAUTHENTICATED",
+	http.StatusForbidden:           "PERMISSION_DENIED",
+	http.StatusNotFound:            "NOT_FOUND",
+	http.StatusGone:                "NOT_FOUND",
+	http.StatusTooManyRequests:     "RESOURCE_EXHAUSTED",
+	http.StatusServiceUnavailable:  "UNAVAILABLE",
+	http.StatusInternalServerError: "INTERNAL",
+}
+
+// geminiError 返回 Gemini 格式的错误响应体
+func geminiError(status int, message string) gin.H {
+	code, ok := geminiStatus[status]
+	if !ok {
+		code = "UNKNOWN"
+	}
+	return gin.H{"error": gin.H{"code": status, "message": message, "status": code}}
+}
+
+// GeminiHandler handles /v1beta/models/{model}:generateContent and
+// :streamGenerateContent. The request is translated to a chat completion
+// and the answer is returned as Gemini candidates; streams are SSE with
+// ?alt=sse and a JSON array otherwise.
+func GeminiHandler(c *gin.Context) {
+	action := c.Param("action")
+	i := strings.LastIndex(action, ":")
+	if i < 0 {
+		c.JSON(http.StatusNotFound, geminiError(http.StatusNotFound, "Unknown method, use :generateContent or :streamGenerateContent"))
+		return
+	}
+	modelName, method := action[:i], action[i+1:]
+	var stream bool
+	switch method {
+	case "generateContent":
+	case "streamGenerateContent":
+		stream = true
+	default:
+		c.JSON(http.StatusNotFound, geminiError(http.StatusNotFound, "Unknown method "+method))
+		return
+	}
+	model.SetGemini(c, modelName, c.Query("alt") == "sse")
+	runPipeline(c, withParseStage(func(r *chatRequest) error { return parseGeminiStage(r, modelName, stream) }))
+}
+
+// parseGeminiStage 解析 Gemini 请求并转换为聊天请求
+func parseGeminiStage(r *chatRequest, modelName string, stream bool) error {
+	if resumed, err := resumeStream(r); stream && resumed {
+		return err
+	}
+	var req GeminiRequest
+	if err := r.c.ShouldBindJSON(&req); err != nil {
+		return invalidBody(err)
+	}
+	if len(req.Contents) == 0 {
+		return abortWith(http.StatusBadRequest, "contents must not be empty")
+	}
+	var msgs []map[string]interface{}
+	if req.SystemInstruction != nil {
+		content, err := geminiMessageContent(req.SystemInstruction.Parts)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, map[string]interface{}{"role": "system", "content": content})
+	}
+	for _, content := range req.Contents {
+		role := "user"
+		if content.Role == "model" {
+			role = "assistant"
+		}
+		parts, err := geminiMessageContent(content.Parts)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, map[string]interface{}{"role": role, "content": parts})
+	}
+	if gen := req.GenerationConfig; gen != nil {
+		if gen.CandidateCount > 1 {
+			return abortWith(http.StatusBadRequest, "Only one candidate per request is supported")
+		}
+		if gen.MaxOutputTokens < 0 {
+			return abortWith(http.StatusBadRequest, "maxOutputTokens must not be negative")
+		}
+		r.Limits = outputLimits{stops: gen.StopSequences, maxTokens: gen.MaxOutputTokens}
+	}
+	r.Body = ChatCompletionRequest{
+		Model:         modelName,
+		Messages:      msgs,
+		Stream:        stream,
+		StreamOptions: &StreamOptions{IncludeUsage: true},
+	}
+	for _, tool := range req.Tools {
+		for _, name := range geminiSearchTools {
+			if _, ok := tool[name]; ok {
+				search := true
+				r.Body.WebSearch = &search
+			}
+		}
+	}
+	return nil
+}
+
+// geminiMessageContent 将 Gemini parts 转换为 OpenAI 的消息内容数组
+func geminiMessageContent(parts []geminiPart) ([]interface{}, error) {
+	content := []interface{}{}
+	for _, part := range parts {
+		switch {
+		case part.FunctionCall != nil || part.FunctionResponse != nil:
+			return nil, abortWith(http.StatusBadRequest, "Function calling is not supported")
+		case part.InlineData != nil:
+			dataURL := "data:" + part.InlineData.MimeType + ";base64," + part.InlineData.Data
+			if strings.HasPrefix(part.InlineData.MimeType, "image/") {
+				content = append(content, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": dataURL}})
+			} else {
+				content = append(content, map[string]interface{}{"type": "file", "file": map[string]interface{}{"file_data": dataURL, "filename": "attachment"}})
+			}
+		case part.FileData != nil:
+			uri := part.FileData.FileURI
+			if !strings.HasPrefix(part.FileData.MimeType, "image/") || !(strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://")) {
+				return nil, abortWith(http.StatusBadRequest, "fileData is only supported for http(s) image URLs, send other files as inlineData")
+			}
+			content = append(content, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": uri}})
+		case part.Thought:
+			// 历史中的推理内容不再发送
+		case part.Text != "":
+			content = append(content, map[string]interface{}{"type": "text", "text": part.Text})
+		}
+	}
+	return content, nil
+}
@@ -1,13 +1,18 @@
 package service
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"pplx2api/config"
 	"pplx2api/core"
-	"pplx2api/logger"
-	"pplx2api/utils"
+	"pplx2api/guard"
+	"pplx2api/model"
+	"pplx2api/redact"
+	"pplx2api/usage"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -17,10 +22,44 @@ type ChatCompletionRequest struct {
 	Messages []map[string]interface{} `json:"messages"`
 	Stream   bool                     `json:"stream"`
 	Tools    []map[string]interface{} `json:"tools,omitempty"`
+	// Stop 字符串或最多4个字符串的数组
+	Stop interface{} `json:"stop,omitempty"`
+	// RawOutput 扩展字段：跳过代理的所有后处理，用于排查格式问题来源
+	RawOutput     bool           `json:"raw_output,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	// ExtractClaims 扩展字段：返回从回答中提取的陈述及其引用
+	ExtractClaims *bool `json:"extract_claims,omitempty"`
+	// ThreadRetention 扩展字段：回答后上游会话的保留方式，keep、delete 或分钟数
+	ThreadRetention string `json:"thread_retention,omitempty"`
+	// InjectDate 扩展字段：设为 false 时不注入当前日期
+	InjectDate *bool `json:"inject_date,omitempty"`
+	// ConversationID 扩展字段：显式指定会话，用于复用 Perplexity 会话
+	ConversationID string `json:"conversation_id,omitempty"`
+	// 扩展字段：控制联网搜索，web_search 优先于模型名后缀
+	WebSearch           *bool    `json:"web_search,omitempty"`
+	SearchRecencyFilter string   `json:"search_recency_filter,omitempty"`
+	SearchDomainFilter  []string `json:"search_domain_filter,omitempty"`
 }
 
-type ErrorResponse struct {
-	Error string `json:"error"`
+// StreamOptions are the OpenAI streaming options
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// UserSessionHeader carries a caller supplied Perplexity session cookie
+const UserSessionHeader = "X-Pplx-Session"
+
+// SessionLabelHeader restricts a request to sessions carrying the given
+// labels, e.g. region=eu,team=research
+const SessionLabelHeader = "X-Session-Label"
+
+// ErrorResponse is the OpenAI error envelope returned by every endpoint
+type ErrorResponse = model.ErrorResponse
+
+// respondError writes an error response with a machine-readable code, an
+// empty code is derived from the status
+func respondError(c *gin.Context, status int, code string, message string) {
+	c.JSON(status, model.ErrorBody(c, status, code, message))
 }
 
 // HealthCheckHandler handles the health check endpoint
@@ -32,39 +71,338 @@ func HealthCheckHandler(c *gin.Context) {
 
 // ChatCompletionsHandler handles the chat completions endpoint
 func ChatCompletionsHandler(c *gin.Context) {
+	runChatPipeline(c)
+}
+
+// parseStage 解析请求体；客户端携带 Last-Event-ID 重连时直接从缓冲区续传
+func parseStage(r *chatRequest) error {
+	c := r.c
+	if resumed, err := resumeStream(r); resumed {
+		return err
+	}
+	if err := c.ShouldBindJSON(&r.Body); err != nil {
+		return invalidBody(err)
+	}
+	// logger.Info(fmt.Sprintf("Received request: %v", r.Body))
+	stops, ok := stringList(r.Body.Stop)
+	if !ok || len(stops) > 4 {
+		return abortWith(http.StatusBadRequest, "stop must be a string or an array of up to 4 strings")
+	}
+	r.Limits.stops = stops
+	return nil
+}
 
-	// Parse request body
-	var req ChatCompletionRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error: fmt.Sprintf("Invalid request: %v", err),
-		})
-		return
+// resumeStream 按 Last-Event-ID 从缓冲区续传，resumed 为 true 时不再解析请求体
+func resumeStream(r *chatRequest) (resumed bool, err error) {
+	c := r.c
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		return false, nil
+	}
+	rs, seq, ok := model.LookupStream(lastEventID)
+	if !ok {
+		return false, nil
 	}
-	// logger.Info(fmt.Sprintf("Received request: %v", req))
-	// Validate request
-	if len(req.Messages) == 0 {
-		c.JSON(http.StatusBadRequest, ErrorResponse{
-			Error: "No messages provided",
-		})
-		return
+	if rs != nil && !rs.OwnedBy(apiKeyLabel(c)) {
+		// 流 ID 出现在每一帧中，不能凭它读取其他 key 的回答
+		return true, abortWith(http.StatusNotFound, "Stream not found")
 	}
+	if rs == nil {
+		return true, abortWithCode(http.StatusGone, model.CodeStreamExpired, "Stream expired, cannot resume")
+	}
+	if !rs.Covers(seq) {
+		return true, abortWithCode(http.StatusGone, model.CodeStreamExpired, "Event %d is no longer buffered, cannot resume", seq)
+	}
+	requestLog(c).Info(fmt.Sprintf("Resuming stream %s after event %d", rs.ID, seq))
+	rs.Follow(c, seq)
+	r.Done = true
+	return true, nil
+}
 
+// validateStage 检查消息与模型，并应用 key 的默认模型与会话保留方式
+func validateStage(r *chatRequest) error {
+	if len(r.Body.Messages) == 0 {
+		return abortWith(http.StatusBadRequest, "No messages provided")
+	}
+	if err := checkRequestLimits(r.Body.Messages); err != nil {
+		return err
+	}
 	// Get model or use default
-	model := req.Model
-	if model == "" {
-		model = "claude-3.7-sonnet"
-	}
-	openSearch := false
-	if strings.HasSuffix(model, "-search") {
-		openSearch = true
-		model = strings.TrimSuffix(model, "-search")
-	}
-	model = config.ModelMapGet(model, model) // 获取模型名称
-	var prompt strings.Builder
-	img_data_list := []string{}
+	r.APIKey = requestKey(r.c)
+	// 模型名可带 @标签 后缀，如 sonar@region=eu
+	requested, labelSuffix, _ := strings.Cut(r.Body.Model, "@")
+	r.Model = requested
+	if r.Model == "" || r.APIKey.Defaults.ForceModel {
+		r.Model = r.APIKey.Defaults.Model
+	}
+	if r.Model == "" {
+		r.Model = "claude-3.7-sonnet"
+	}
+	if !r.APIKey.AllowsModel(r.Model) {
+		return abortWithCode(http.StatusForbidden, model.CodeModelNotAllowed, "API key is not allowed to use model %s", r.Model)
+	}
+	if err := resolveLabels(r, labelSuffix); err != nil {
+		return err
+	}
+	applyKeyDefaults(r)
+	return resolveRetention(r)
+}
+
+// resolveLabels 合并模型名后缀与请求头中的账号标签，key 的 session_labels 优先
+func resolveLabels(r *chatRequest, suffix string) error {
+	labels := map[string]string{}
+	for _, s := range []string{suffix, r.c.GetHeader(SessionLabelHeader)} {
+		parsed, err := config.ParseLabels(s)
+		if err != nil {
+			return abortWith(http.StatusBadRequest, "Invalid session label: %v", err)
+		}
+		for k, v := range parsed {
+			labels[k] = v
+		}
+	}
+	for k, v := range r.APIKey.Defaults.SessionLabels {
+		labels[k] = v
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	if !config.ConfigInstance.HasSessionWithLabels(labels) {
+		return abortWith(http.StatusBadRequest, "No session has labels %s", config.FormatLabels(labels))
+	}
+	r.Labels = labels
+	return nil
+}
+
+// applyKeyDefaults 注入 key 的系统提示词，并为客户端未设置的扩展字段使用 key 的默认值
+func applyKeyDefaults(r *chatRequest) {
+	d := r.APIKey.Defaults
+	if d.SystemPrompt != "" {
+		r.Body.Messages = withSystemPrompt(r.Body.Messages, d.SystemPrompt, d.SystemPromptMode)
+	}
+	// 模型名后缀同样指定了是否搜索，此时不使用默认值
+	suffixed := strings.HasSuffix(r.Model, "-search") || strings.HasSuffix(r.Model, "-nosearch")
+	if r.Body.WebSearch == nil && !suffixed {
+		r.Body.WebSearch = d.WebSearch
+	}
+	if r.Body.InjectDate == nil {
+		r.Body.InjectDate = d.InjectDate
+	}
+	if r.Body.ExtractClaims == nil {
+		r.Body.ExtractClaims = d.ExtractClaims
+	}
+}
+
+// withSystemPrompt 将系统提示词合并到第一条 system 消息之前，replace 模式下先去掉客户端的 system 消息
+func withSystemPrompt(msgs []map[string]interface{}, prompt string, mode string) []map[string]interface{} {
+	result := make([]map[string]interface{}, 0, len(msgs)+1)
+	for _, msg := range msgs {
+		if role, _ := msg["role"].(string); role == "system" && mode == config.SystemPromptReplace {
+			continue
+		}
+		result = append(result, msg)
+	}
+	if len(result) > 0 {
+		role, _ := result[0]["role"].(string)
+		if content, ok := result[0]["content"].(string); ok && role == "system" {
+			merged := make(map[string]interface{}, len(result[0]))
+			for k, v := range result[0] {
+				merged[k] = v
+			}
+			merged["content"] = prompt + "\n\n" + content
+			result[0] = merged
+			return result
+		}
+	}
+	return append([]map[string]interface{}{{"role": "system", "content": prompt}}, result...)
+}
+
+// routeStage 解析搜索开关与模型回退链，并决定使用轮询账号还是调用方自带的 session
+func routeStage(r *chatRequest) error {
+	if err := routeSearch(r); err != nil {
+		return err
+	}
+	r.Models = config.ResolveModelChain(r.Model) // 获取模型名称及回退链
+	if config.SearchModeModels[r.Models[0]] {
+		// 深度研究与 Pro Search 总是联网搜索
+		r.OpenSearch = true
+	}
+	if userSession := r.c.GetHeader(UserSessionHeader); userSession != "" && config.ConfigInstance.AllowUserSession {
+		r.UserSession = userSession
+	}
+	routeImported(r)
+	routeThread(r)
+	return nil
+}
+
+// routeSearch 根据模型名后缀与扩展字段决定是否联网搜索及搜索过滤条件
+func routeSearch(r *chatRequest) error {
+	req := r.Body
+	if strings.HasSuffix(r.Model, "-search") {
+		r.OpenSearch = true
+		r.Model = strings.TrimSuffix(r.Model, "-search")
+	} else if strings.HasSuffix(r.Model, "-nosearch") {
+		r.Model = strings.TrimSuffix(r.Model, "-nosearch")
+	}
+	filtered := req.SearchRecencyFilter != "" || len(req.SearchDomainFilter) > 0
+	switch {
+	case req.WebSearch != nil:
+		r.OpenSearch = *req.WebSearch
+	case filtered:
+		// 只设置了过滤条件时默认开启搜索
+		r.OpenSearch = true
+	}
+	if !r.OpenSearch {
+		return nil
+	}
+	if recency := strings.ToLower(req.SearchRecencyFilter); recency != "" {
+		valid := false
+		for _, f := range core.SearchRecencyFilters {
+			valid = valid || f == recency
+		}
+		if !valid {
+			return abortWith(http.StatusBadRequest, "Invalid search_recency_filter %q, use one of %s", req.SearchRecencyFilter, strings.Join(core.SearchRecencyFilters, ", "))
+		}
+		r.Search.RecencyFilter = recency
+	}
+	for _, domain := range req.SearchDomainFilter {
+		domain = strings.TrimSpace(domain)
+		if strings.Trim(domain, "-") == "" || strings.ContainsAny(domain, " /") {
+			return abortWith(http.StatusBadRequest, "Invalid search_domain_filter entry %q", domain)
+		}
+		r.Search.DomainFilter = append(r.Search.DomainFilter, domain)
+	}
+	return nil
+}
+
+// transformStage 将消息转换为上游请求：拼接提示词、收集图片与附件
+func transformStage(r *chatRequest) error {
+	c := r.c
+	msgs := r.Body.Messages
+	var followUp *chatTurn
+	if r.Thread != nil {
+		// 继续已有会话时只发送最后一条消息，账号不可用时回退为完整历史
+		last, err := renderMessages(c, msgs[len(msgs)-1:])
+		if err != nil {
+			return err
+		}
+		followUp = &last
+		msgs = msgs[:len(msgs)-1]
+	}
+	turn, err := renderMessages(c, msgs)
+	if err != nil {
+		return err
+	}
+	if followUp != nil {
+		turn.Prompt += followUp.Prompt
+		turn.Images = append(turn.Images, followUp.Images...)
+		turn.Files = append(turn.Files, followUp.Files...)
+	}
+	promptText, img_data_list, file_data_list := turn.Prompt, turn.Images, turn.Files
+	// 最后一条为助手消息时作为预填内容，让上游接着写
+	prefill, isPrefill := prefillText(r.Body.Messages)
+	if isPrefill {
+		promptText += prefillInstruction
+	}
+	if (len(img_data_list) > 0 || len(file_data_list) > 0) && !r.APIKey.HasScope(config.ScopeFiles) {
+		return abortWith(http.StatusForbidden, "API key is not allowed to upload files")
+	}
+	requestLog(c).Debug(fmt.Sprintf("Prompt: %s", redact.For(r.APIKey).String(promptText))) // 输出最终构造的内容
+	requestLog(c).Debug(fmt.Sprintf("img_data_list_length: %d", len(img_data_list)))
+	timezone := config.ConfigInstance.Timezone
+	if tz := r.APIKey.Defaults.Timezone; tz != "" {
+		timezone = tz
+	}
+	if config.ConfigInstance.DateInjection && (r.Body.InjectDate == nil || *r.Body.InjectDate) {
+		// 注入当前日期，使“今天”“最新”等查询不依赖上游服务器时间
+		if date := dateContext(timezone, time.Now()); date != "" {
+			promptText = date + promptText
+			if followUp != nil {
+				followUp.Prompt = date + followUp.Prompt
+			}
+		}
+	}
+	// 检索内容与附件不可信，加分隔说明并检查输出中的注入迹象
+	if guard.Enabled(r.OpenSearch, len(file_data_list) > 0) {
+		promptText = guard.WrapPrompt(promptText)
+		if followUp != nil {
+			followUp.Prompt = guard.WrapPrompt(followUp.Prompt)
+		}
+		if err := wrapDocuments(file_data_list); err != nil {
+			return err
+		}
+		if followUp != nil {
+			if err := wrapDocuments(followUp.Files); err != nil {
+				return err
+			}
+		}
+		if !r.Body.RawOutput {
+			guard.Start(c)
+		}
+	}
+	if isPrefill && !r.Body.RawOutput {
+		model.AddOutputFilter(c, &prefillFilter{prefill: prefill})
+	}
+	r.Prompt = promptText
+	r.Images = img_data_list
+	r.Files = file_data_list
+	r.Attempt = &chatAttempt{
+		RequestModel:  r.Model,
+		Models:        r.Models,
+		OpenSearch:    r.OpenSearch,
+		Search:        r.Search,
+		Prompt:        r.Prompt,
+		Images:        r.Images,
+		Files:         r.Files,
+		Stream:        r.Body.Stream,
+		RawOutput:     r.Body.RawOutput,
+		ExtractClaims: config.ConfigInstance.ExtractClaims,
+		Timezone:      timezone,
+		Thread:        r.Thread,
+		FollowUp:      followUp,
+		Labels:        r.Labels,
+	}
+	if r.Body.ExtractClaims != nil {
+		r.Attempt.ExtractClaims = *r.Body.ExtractClaims
+	}
+	r.Attempt.HedgeDelay = config.ConfigInstance.HedgeDelay
+	if ms := r.APIKey.Defaults.HedgeDelay; ms != nil && *ms >= 0 {
+		r.Attempt.HedgeDelay = time.Duration(*ms) * time.Millisecond
+	}
+	return nil
+}
+
+// dateContext 返回当前日期时间的说明，时区无效时返回空
+func dateContext(timezone string, now time.Time) string {
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return ""
+	}
+	now = now.In(loc)
+	return fmt.Sprintf("Current date and time: %s (%s, UTC%s).\n\n", now.Format("Monday, January 2, 2006 15:04"), timezone, now.Format("-07:00"))
+}
+
+// wrapDocuments 用分隔符包裹文本类附件
+func wrapDocuments(files []core.FileData) error {
+	for i, file := range files {
+		if !guard.IsTextDocument(file.MimeType) {
+			continue
+		}
+		wrapped, err := guard.WrapDocument(file)
+		if err != nil {
+			return abortWith(http.StatusBadRequest, "Invalid file: %v", err)
+		}
+		files[i] = wrapped
+	}
+	return nil
+}
+
+// renderMessages 将消息拼接为提示词并收集其中的图片与附件
+func renderMessages(c *gin.Context, messages []map[string]interface{}) (chatTurn, error) {
+	var msgs []promptMessage
+	img_data_list := []core.ImageData{}
+	file_data_list := []core.FileData{}
 	// Format messages into a single prompt
-	for _, msg := range req.Messages {
+	for _, msg := range messages {
 		role, roleOk := msg["role"].(string)
 		if !roleOk {
 			continue // 忽略无效格式
@@ -75,96 +413,146 @@ func ChatCompletionsHandler(c *gin.Context) {
 			continue
 		}
 
-		prompt.WriteString(utils.GetRolePrefix(role)) // 获取角色前缀
+		pm := promptMessage{Role: role}
+		if name, ok := msg["name"].(string); ok {
+			pm.Name = name
+		}
 		switch v := content.(type) {
 		case string: // 如果 content 直接是 string
-			prompt.WriteString(v + "\n\n")
+			pm.Texts = append(pm.Texts, v)
 		case []interface{}: // 如果 content 是 []interface{} 类型的数组
 			for _, item := range v {
 				if itemMap, ok := item.(map[string]interface{}); ok {
 					if itemType, ok := itemMap["type"].(string); ok {
 						if itemType == "text" {
 							if text, ok := itemMap["text"].(string); ok {
-								prompt.WriteString(text + "\n\n")
+								pm.Texts = append(pm.Texts, text)
 							}
 						} else if itemType == "image_url" {
 							if imageUrl, ok := itemMap["image_url"].(map[string]interface{}); ok {
 								if url, ok := imageUrl["url"].(string); ok {
 									if len(url) > 50 {
-										logger.Info(fmt.Sprintf("Image URL: %s ……", url[:50]))
+										requestLog(c).Info(fmt.Sprintf("Image URL: %s ……", url[:50]))
 									}
-									if strings.HasPrefix(url, "data:image/") {
-										// 保留 base64 编码的图片数据
-										url = strings.Split(url, ",")[1]
+									img, err := resolveImageURL(url)
+									if err != nil {
+										return chatTurn{}, invalidPart("image_url", err)
 									}
-									img_data_list = append(img_data_list, url) // 收集图片数据
+									img_data_list = append(img_data_list, img) // 收集图片数据
 								}
 							}
+						} else if itemType == "file" {
+							file, err := resolveFilePart(itemMap)
+							if err != nil {
+								return chatTurn{}, invalidPart("file", err)
+							}
+							file_data_list = append(file_data_list, file) // 收集附件数据
 						}
 					}
 				}
 			}
 		}
+		msgs = append(msgs, pm)
 	}
-	fmt.Println(prompt.String())                             // 输出最终构造的内容
-	fmt.Println("img_data_list_length:", len(img_data_list)) // 输出图片数据列表长度
-	var rootPrompt strings.Builder
-	rootPrompt.WriteString(prompt.String())
-	// 切号重试机制
-	var pplxClient *core.Client
-	index := config.Sr.NextIndex()
-	for i := 0; i < config.ConfigInstance.RetryCount; i++ {
-		if i > 0 {
-			prompt.Reset()
-			prompt.WriteString(rootPrompt.String())
-		}
-		index = (index + 1) % len(config.ConfigInstance.Sessions)
-		session, err := config.ConfigInstance.GetSessionForModel(index)
-		logger.Info(fmt.Sprintf("Using session for model %s: %s", model, session.SessionKey))
-		if err != nil {
-			logger.Error(fmt.Sprintf("Failed to get session for model %s: %v", model, err))
-			logger.Info("Retrying another session")
-			continue
-		}
-		// Initialize the Claude client
-		pplxClient = core.NewClient(session.SessionKey, config.ConfigInstance.Proxy, model, openSearch)
-		if len(img_data_list) > 0 {
-			err := pplxClient.UploadImage(img_data_list)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Failed to upload file: %v", err))
-				logger.Info("Retrying another session")
+	prompt, err := assemblePrompt(msgs)
+	if err != nil {
+		return chatTurn{}, abortWith(http.StatusInternalServerError, "Failed to render prompt template: %v", err)
+	}
+	return chatTurn{Prompt: prompt, Images: img_data_list, Files: file_data_list}, nil
+}
 
-				continue
-			}
+// dispatchStage 发送上游请求并将响应转发给客户端
+func dispatchStage(r *chatRequest) error {
+	c, req := r.c, r.Body
+	release, err := acquireRequestSlot(c.Request.Context())
+	if errors.Is(err, errOverloaded) {
+		c.Header("Retry-After", strconv.Itoa(overloadRetryAfter))
+		return abortWithCode(http.StatusServiceUnavailable, model.CodeOverloaded, "Too many concurrent requests, retry later")
+	}
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer trackRequest(c)()
+	if req.Stream && config.ConfigInstance.StreamResumeWindow > 0 && model.IsSSEStream(c) {
+		model.NewResumableStream(c, apiKeyLabel(c), config.ConfigInstance.StreamResumeWindow, config.ConfigInstance.StreamResumeBuffer)
+	}
+	if req.Stream && config.ConfigInstance.StreamRecovery > 0 {
+		model.TrackStreamed(c)
+	}
+	r.Meter = usage.Start(c, r.Model, r.Attempt.Prompt, req.Stream && req.StreamOptions != nil && req.StreamOptions.IncludeUsage)
+	if r.UserSession != "" {
+		return dispatchUserSession(r)
+	}
+	// 深度研究请求在停机时可转为异步任务，由下一个实例完成
+	if rr := trackResearch(c, r.Attempt); rr != nil {
+		defer rr.finish(c)
+	}
+	if err := r.Attempt.sendWithRetry(c); err != nil {
+		if se := circuitOpen(c, err); se != nil {
+			return se
 		}
-		if prompt.Len() > config.ConfigInstance.MaxChatHistoryLength {
-			err := pplxClient.UploadText(prompt.String())
-			if err != nil {
-				logger.Error(fmt.Sprintf("Failed to upload text: %v", err))
-				logger.Info("Retrying another session")
-
-				continue
-			}
-			prompt.Reset()
-			prompt.WriteString(config.ConfigInstance.PromptForFile)
+		var timeoutErr *core.TimeoutError
+		if errors.As(err, &timeoutErr) {
+			return abortWithCode(http.StatusGatewayTimeout, model.CodeUpstreamTimeout, "Perplexity did not finish the answer within %v", timeoutErr.After)
 		}
-		if _, err := pplxClient.SendMessage(prompt.String(), req.Stream, config.ConfigInstance.IsIncognito, c); err != nil {
-			logger.Error(fmt.Sprintf("Failed to send message: %v", err))
-			logger.Info("Retrying another session")
-
-			continue // Retry on error
+		if errors.Is(err, errSessionsExhausted) {
+			if wait := time.Until(nextSessionAvailable()); wait > 0 {
+				c.Header("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+			}
+			return abortWithCode(http.StatusTooManyRequests, model.CodeSessionsExhausted, "All sessions are rate limited or disabled, retry later")
 		}
+		return abortWith(http.StatusBadGateway, "Failed to process request after multiple attempts")
+	}
+	return nil
+}
 
-		return
+// circuitOpen 熔断时返回 503 并设置 Retry-After，其他错误返回 nil
+func circuitOpen(c *gin.Context, err error) error {
+	var circuitErr *core.CircuitOpenError
+	if !errors.As(err, &circuitErr) {
+		return nil
+	}
+	c.Header("Retry-After", strconv.Itoa(int(circuitErr.RetryAfter.Seconds())+1))
+	return abortWithCode(http.StatusServiceUnavailable, model.CodeCircuitOpen, "Perplexity is unavailable (circuit breaker open), retry in %ds", int(circuitErr.RetryAfter.Seconds())+1)
+}
 
+// dispatchUserSession 使用调用方自带的 session，不参与轮询也不持久化
+func dispatchUserSession(r *chatRequest) error {
+	c := r.c
+	entry := userSessions.Get(r.UserSession)
+	family := r.Attempt.family()
+	if !entry.state.IsAvailableFor(family) {
+		retryAfter := time.Until(entry.state.RateLimitedUntilFor(family))
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+		return abortWith(http.StatusTooManyRequests, "User session is rate limited")
+	}
+	requestLog(c).Info(fmt.Sprintf("Using user supplied session for model %s", r.Model))
+	r.Attempt.base = entry.client
+	r.Meter.Session = userSessionLabel
+	err := r.Attempt.sendObserved(config.SessionInfo{SessionKey: r.UserSession}, entry.state, c)
+	recordResult(-1, entry.state, config.ConfigInstance.Cooldowns.Family(r.Attempt.lastModel), err)
+	if err == nil {
+		return nil
+	}
+	requestLog(c).Error(fmt.Sprintf("Failed to send message with user session: %v", err))
+	if se := circuitOpen(c, err); se != nil {
+		return se
+	}
+	var rateLimitErr *core.RateLimitError
+	if errors.As(err, &rateLimitErr) {
+		return abortWith(http.StatusTooManyRequests, "User session is rate limited")
 	}
-	logger.Error("Failed for all retries")
-	c.JSON(http.StatusInternalServerError, ErrorResponse{
-		Error: "Failed to process request after multiple attempts"})
+	return abortWith(http.StatusBadGateway, "Failed to process request with user session: %v", err)
 }
 
-func ModelsHandler(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"data": config.ResponseModels,
-	})
+// postProcessStage 记录成功请求的用量，保存回答所在的会话供下一次追问，
+// 并按保留方式安排删除上游会话
+func postProcessStage(r *chatRequest) error {
+	r.Meter.Record(apiKeyLabel(r.c))
+	if r.ThreadKey != "" && r.Attempt.answered != nil && r.Retention != 0 {
+		threads.Put(r.ThreadKey, r.Attempt.answered)
+	}
+	retainThread(r.Attempt.answeredBy, r.Attempt.answered, r.Retention)
+	return nil
 }
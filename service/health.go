@@ -0,0 +1,76 @@
+package service
+
+import (
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/core"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SessionCounts summarizes the configured sessions for /readyz
+type SessionCounts struct {
+	Total       int `json:"total"`
+	Available   int `json:"available"`
+	RateLimited int `json:"rate_limited"`
+	// Dead 已归档或最近一小时只有失败的账号
+	Dead int `json:"dead"`
+}
+
+// countSessions 统计可用、冷却中与失效的账号数
+func countSessions() SessionCounts {
+	config.ConfigInstance.RwMutex.RLock()
+	sessions := make([]config.SessionInfo, len(config.ConfigInstance.Sessions))
+	copy(sessions, config.ConfigInstance.Sessions)
+	config.ConfigInstance.RwMutex.RUnlock()
+
+	now := time.Now()
+	counts := SessionCounts{Total: len(sessions)}
+	for i, session := range sessions {
+		state := config.SessionStateAt(i)
+		if session.Archived {
+			counts.Dead++
+			continue
+		}
+		if !state.IsAvailable() {
+			counts.RateLimited++
+			continue
+		}
+		if buckets := state.Buckets(now, time.Hour); len(buckets) > 0 && buckets[len(buckets)-1].Status == config.StatusErrored {
+			counts.Dead++
+			continue
+		}
+		counts.Available++
+	}
+	return counts
+}
+
+// HealthzHandler reports that the process is alive, for liveness probes
+func HealthzHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ReadyzHandler reports whether requests can be served: at least one
+// session is available and the upstream circuit breaker isn't open. With
+// ?verbose=true the session counts and breaker state are included.
+func ReadyzHandler(c *gin.Context) {
+	counts := countSessions()
+	breaker := core.Breaker()
+	status, reason := http.StatusOK, ""
+	switch {
+	case counts.Available == 0:
+		status, reason = http.StatusServiceUnavailable, "no session available"
+	case breaker.State == core.BreakerOpen:
+		status, reason = http.StatusServiceUnavailable, "upstream unreachable"
+	}
+	body := gin.H{"status": "ready"}
+	if status != http.StatusOK {
+		body = gin.H{"status": "not_ready", "reason": reason}
+	}
+	if c.Query("verbose") == "true" || c.Query("verbose") == "1" {
+		body["sessions"] = counts
+		body["circuit_breaker"] = breaker
+	}
+	c.JSON(status, body)
+}
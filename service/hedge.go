@@ -0,0 +1,252 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/model"
+	"pplx2api/usage"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errHedgeLost is returned to the attempt that lost a hedge race when it
+// still tries to write to the client
+var errHedgeLost = errors.New("another session answered first")
+
+// hedgeRace decides which of the attempts sent for one request answers the
+// client. The first to start its response wins; the others are cancelled
+// before they relay anything.
+type hedgeRace struct {
+	mutex   sync.Mutex
+	winner  *hedgeWriter
+	writers []*hedgeWriter
+}
+
+// hedgeWriter is the response writer of one contender. Until it wins the
+// race headers go to a private copy and nothing reaches the client.
+type hedgeWriter struct {
+	gin.ResponseWriter
+	race   *hedgeRace
+	header http.Header
+	cancel context.CancelFunc
+}
+
+// join adds a contender writing to w, cancelled by cancel when it loses
+func (r *hedgeRace) join(w gin.ResponseWriter, cancel context.CancelFunc) *hedgeWriter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	hw := &hedgeWriter{ResponseWriter: w, race: r, header: w.Header().Clone(), cancel: cancel}
+	r.writers = append(r.writers, hw)
+	return hw
+}
+
+// decided reports whether a contender has started responding
+func (r *hedgeRace) decided() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.winner != nil
+}
+
+// claim 没有胜者时让 w 成为胜者并取消其他请求，返回 w 是否为胜者
+func (w *hedgeWriter) claim() bool {
+	r := w.race
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.winner == nil {
+		r.winner = w
+		header := w.ResponseWriter.Header()
+		for k := range header {
+			delete(header, k)
+		}
+		for k, v := range w.header {
+			header[k] = v
+		}
+		for _, other := range r.writers {
+			if other != w {
+				other.cancel()
+			}
+		}
+	}
+	return r.winner == w
+}
+
+func (w *hedgeWriter) won() bool {
+	w.race.mutex.Lock()
+	defer w.race.mutex.Unlock()
+	return w.race.winner == w
+}
+
+func (w *hedgeWriter) Header() http.Header {
+	if w.won() {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *hedgeWriter) WriteHeader(code int) {
+	if w.claim() {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *hedgeWriter) WriteHeaderNow() {
+	if w.claim() {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *hedgeWriter) Write(data []byte) (int, error) {
+	if !w.claim() {
+		return 0, errHedgeLost
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *hedgeWriter) WriteString(s string) (int, error) {
+	if !w.claim() {
+		return 0, errHedgeLost
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *hedgeWriter) Flush() {
+	if w.won() {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *hedgeWriter) Written() bool {
+	return w.won() && w.ResponseWriter.Written()
+}
+
+func (w *hedgeWriter) Status() int {
+	if w.won() {
+		return w.ResponseWriter.Status()
+	}
+	return http.StatusOK
+}
+
+func (w *hedgeWriter) Size() int {
+	if w.won() {
+		return w.ResponseWriter.Size()
+	}
+	return -1
+}
+
+// hedgeable reports whether the attempt may be hedged. Only streams are,
+// since the race is decided when a response starts; resumable streams,
+// follow-ups bound to a session and long-running deep research are not.
+func (a *chatAttempt) hedgeable(c *gin.Context) bool {
+	return a.HedgeDelay > 0 && a.Stream && a.Thread == nil && a.base == nil &&
+		model.ResumableFrom(c) == nil && !config.ConfigInstance.IsDeepResearch(a.Models...) &&
+		hasOtherSessions()
+}
+
+// hasOtherSessions 报告是否配置了不止一个账号
+func hasOtherSessions() bool {
+	n, _ := config.ConfigInstance.SessionCount()
+	return n > 1
+}
+
+// hedgeSession 返回 index 之后第一个可以立即发送的账号及其状态，没有时返回 -1
+func hedgeSession(index int, route sessionRoute) (int, config.SessionInfo, *config.SessionState) {
+	n, _ := config.ConfigInstance.SessionCount()
+	for i := 1; i < n; i++ {
+		candidate := (index + i) % n
+		session, state, err := config.ConfigInstance.SessionWithState(candidate)
+		if err != nil || session.Archived || !route.fits(candidate) {
+			continue
+		}
+		if state.IsAvailableFor(route.family) && state.PacingDelay() == 0 {
+			return candidate, session, state
+		}
+	}
+	return -1, config.SessionInfo{}, nil
+}
+
+// sendHedged sends the attempt on session and, when it hasn't started
+// responding within HedgeDelay, sends it on a second session as well. The
+// first to respond is streamed to the client and the other is cancelled.
+// It records the results on the sessions and returns the index of the
+// session that served the attempt.
+func (a *chatAttempt) sendHedged(session config.SessionInfo, state *config.SessionState, index int, attempt int, route sessionRoute, c *gin.Context) (int, error) {
+	// 第二个请求使用发送前的副本，两者互不影响
+	hedge := *a
+	hc := c.Copy()
+	req, writer := c.Request, c.Writer
+	log := requestLog(c)
+	race := &hedgeRace{}
+
+	primaryCtx, cancelPrimary := context.WithCancel(req.Context())
+	defer cancelPrimary()
+	primaryWriter := race.join(writer, cancelPrimary)
+	c.Writer = primaryWriter
+	c.Request = req.WithContext(primaryCtx)
+	primaryDone := make(chan error, 1)
+	go func() { primaryDone <- a.sendTraced(session, state, index, attempt, c) }()
+	restore := func() {
+		c.Writer = writer
+		c.Request = req
+	}
+
+	timer := time.NewTimer(a.HedgeDelay)
+	defer timer.Stop()
+	var primaryErr error
+	select {
+	case primaryErr = <-primaryDone:
+		restore()
+		recordResult(index, state, config.ConfigInstance.Cooldowns.Family(a.lastModel), primaryErr)
+		return index, primaryErr
+	case <-timer.C:
+	}
+	hedgeIndex, hedgeInfo, hedgeState := hedgeSession(index, route)
+	if race.decided() || hedgeIndex < 0 {
+		primaryErr = <-primaryDone
+		restore()
+		recordResult(index, state, config.ConfigInstance.Cooldowns.Family(a.lastModel), primaryErr)
+		return index, primaryErr
+	}
+
+	log.Info(fmt.Sprintf("Session %d hasn't responded within %v, hedging on session %d", index, a.HedgeDelay, hedgeIndex))
+	hedgeState.ReservePacing(config.ConfigInstance.SessionMinInterval, config.ConfigInstance.SessionPacingJitter)
+	hedgeCtx, cancelHedge := context.WithCancel(req.Context())
+	defer cancelHedge()
+	hedgeWriter := race.join(writer, cancelHedge)
+	hc.Writer = hedgeWriter
+	hc.Request = req.WithContext(hedgeCtx)
+	hedgeDone := make(chan error, 1)
+	go func() { hedgeDone <- hedge.sendTraced(hedgeInfo, hedgeState, hedgeIndex, attempt, hc) }()
+
+	primaryErr = <-primaryDone
+	hedgeErr := <-hedgeDone
+	restore()
+
+	// 落败方被取消时正常返回，不说明账号的好坏，只记录其自身的失败
+	race.mutex.Lock()
+	winner := race.winner
+	race.mutex.Unlock()
+	if winner != hedgeWriter || primaryErr != nil {
+		recordResult(index, state, config.ConfigInstance.Cooldowns.Family(a.lastModel), primaryErr)
+	}
+	if winner != primaryWriter || hedgeErr != nil {
+		recordResult(hedgeIndex, hedgeState, config.ConfigInstance.Cooldowns.Family(hedge.lastModel), hedgeErr)
+	}
+	if winner == primaryWriter || (winner == nil && (primaryErr == nil || hedgeErr != nil)) {
+		return index, primaryErr
+	}
+
+	log.Info(fmt.Sprintf("Hedged request on session %d answered first", hedgeIndex))
+	*a = hedge
+	for k, v := range hc.Keys {
+		c.Set(k, v)
+	}
+	if meter := usage.MeterFrom(c); meter != nil {
+		meter.Session = maskSessionKey(hedgeInfo.SessionKey)
+	}
+	return hedgeIndex, hedgeErr
+}
@@ -0,0 +1,83 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"pplx2api/hooks"
+	"pplx2api/model"
+)
+
+// Hook stage names
+const (
+	StageHooks       = "hooks"
+	StagePromptHooks = "prompt_hooks"
+)
+
+func init() {
+	addChatStage(StageRoute, chatStage{StageHooks, hooksStage})
+	addChatStage(StageCache, chatStage{StagePromptHooks, promptHooksStage})
+}
+
+// hooksStage 运行 OnRequest 钩子，钩子可以修改消息或拒绝请求
+func hooksStage(r *chatRequest) error {
+	if !hooks.Enabled() {
+		return nil
+	}
+	r.Hooks = &hooks.Request{
+		Context:  r.c,
+		Key:      r.APIKey.Name,
+		Model:    r.Model,
+		Messages: r.Body.Messages,
+		Stream:   r.Body.Stream,
+	}
+	if err := hooks.OnRequest(r.Hooks); err != nil {
+		return hookError(err)
+	}
+	r.Body.Messages = r.Hooks.Messages
+	return nil
+}
+
+// promptHooksStage 运行 OnPromptBuilt 钩子改写发送给上游的提示词，并挂上 OnDelta 输出过滤
+func promptHooksStage(r *chatRequest) error {
+	if r.Hooks == nil {
+		return nil
+	}
+	prompt, err := hooks.OnPromptBuilt(r.Hooks, r.Attempt.Prompt)
+	if err != nil {
+		return hookError(err)
+	}
+	r.Prompt, r.Attempt.Prompt = prompt, prompt
+	if r.Attempt.FollowUp != nil {
+		if r.Attempt.FollowUp.Prompt, err = hooks.OnPromptBuilt(r.Hooks, r.Attempt.FollowUp.Prompt); err != nil {
+			return hookError(err)
+		}
+	}
+	// 钩子由部署方配置，raw_output 也不跳过
+	model.AddOutputFilter(r.c, r.Hooks)
+	return nil
+}
+
+// finishHooks 响应结束后运行 OnComplete 或 OnError 钩子
+func finishHooks(r *chatRequest, err error) {
+	if r.Hooks == nil {
+		return
+	}
+	if err != nil {
+		hooks.OnError(r.Hooks, err)
+		return
+	}
+	var output string
+	if r.Meter != nil {
+		output = r.Meter.Completion()
+	}
+	hooks.OnComplete(r.Hooks, output)
+}
+
+// hookError 将钩子的拒绝转为对应状态码，其余错误按内部错误返回
+func hookError(err error) error {
+	var reject *hooks.RejectError
+	if errors.As(err, &reject) {
+		return abortWithCode(reject.Status, reject.Code, "%s", reject.Message)
+	}
+	return abortWith(http.StatusInternalServerError, "%v", err)
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/core"
+	"strings"
+	"time"
+
+	"github.com/imroc/req/v3"
+)
+
+// resolveImageURL turns an OpenAI image_url into base64 image data. Both
+// data URIs and http(s) URLs are accepted; remote images are downloaded
+// through the configured proxy without any Perplexity cookies.
+func resolveImageURL(url string) (core.ImageData, error) {
+	if strings.HasPrefix(url, "data:") {
+		header, data, ok := strings.Cut(url, ",")
+		if !ok {
+			return core.ImageData{}, fmt.Errorf("malformed data URI")
+		}
+		mimeType := strings.TrimPrefix(strings.SplitN(header, ";", 2)[0], "data:")
+		if !strings.HasPrefix(mimeType, "image/") {
+			return core.ImageData{}, fmt.Errorf("unsupported data URI type: %s", mimeType)
+		}
+		if !strings.Contains(header, ";base64") {
+			return core.ImageData{}, fmt.Errorf("data URI is not base64 encoded")
+		}
+		if limit := config.ConfigInstance.MaxImageSize; base64.StdEncoding.DecodedLen(len(data)) > limit+2 {
+			// DecodedLen 未扣除末尾的填充，最多多算2字节
+			return core.ImageData{}, &tooLargeError{What: "image", Limit: limit}
+		}
+		return core.ImageData{Base64: data, MimeType: mimeType}, nil
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return core.ImageData{}, fmt.Errorf("unsupported image URL scheme")
+	}
+
+	client := req.C().SetTimeout(30 * time.Second)
+	if config.ConfigInstance.Proxy != "" {
+		client.SetProxyURL(config.ConfigInstance.Proxy)
+	}
+	resp, err := client.R().Get(url)
+	if err != nil {
+		return core.ImageData{}, fmt.Errorf("download image: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return core.ImageData{}, fmt.Errorf("download image: unexpected status code %d", resp.StatusCode)
+	}
+	body := resp.Bytes()
+	if limit := config.ConfigInstance.MaxImageSize; len(body) > limit {
+		return core.ImageData{}, &tooLargeError{What: "image", Limit: limit}
+	}
+	mimeType := strings.SplitN(resp.GetContentType(), ";", 2)[0]
+	if !strings.HasPrefix(mimeType, "image/") {
+		mimeType = http.DetectContentType(body)
+	}
+	if !strings.HasPrefix(mimeType, "image/") {
+		return core.ImageData{}, fmt.Errorf("downloaded content is not an image: %s", mimeType)
+	}
+	return core.ImageData{Base64: base64.StdEncoding.EncodeToString(body), MimeType: mimeType}, nil
+}
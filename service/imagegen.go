@@ -0,0 +1,183 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"pplx2api/config"
+	"pplx2api/model"
+	"pplx2api/usage"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxImagesPerRequest 单次请求最多生成的图片数
+const maxImagesPerRequest = 4
+
+// ImageGenerationRequest is the OpenAI images generation request
+type ImageGenerationRequest struct {
+	Prompt string `json:"prompt"`
+	// Model 为聊天模型时使用该模型发送请求；dall-e-3 等图片模型名被忽略，
+	// 实际的图片模型由 Perplexity 账号设置决定
+	Model          string `json:"model,omitempty"`
+	N              int    `json:"n,omitempty"`
+	Size           string `json:"size,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+}
+
+// GeneratedImage is one entry of the images response
+type GeneratedImage struct {
+	URL     string `json:"url,omitempty"`
+	B64JSON string `json:"b64_json,omitempty"`
+}
+
+// ImageGenerationResponse is the OpenAI images response
+type ImageGenerationResponse struct {
+	Created int64            `json:"created"`
+	Data    []GeneratedImage `json:"data"`
+}
+
+// ImageGenerationsHandler generates images by asking Perplexity for them
+// in a chat request and returning the images of the answer.
+func ImageGenerationsHandler(c *gin.Context) {
+	var req ImageGenerationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "", fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	if strings.TrimSpace(req.Prompt) == "" {
+		respondError(c, http.StatusBadRequest, "", "prompt is required")
+		return
+	}
+	if req.N == 0 {
+		req.N = 1
+	}
+	if req.N < 1 || req.N > maxImagesPerRequest {
+		respondError(c, http.StatusBadRequest, "", fmt.Sprintf("n must be between 1 and %d", maxImagesPerRequest))
+		return
+	}
+	switch req.ResponseFormat {
+	case "":
+		req.ResponseFormat = "url"
+	case "url", "b64_json":
+	default:
+		respondError(c, http.StatusBadRequest, "", "response_format must be url or b64_json")
+		return
+	}
+	aspect, err := aspectForSize(req.Size)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	key := requestKey(c)
+	chatModel := imageChatModel(req.Model, key)
+	if !key.AllowsModel(chatModel) {
+		respondError(c, http.StatusForbidden, model.CodeModelNotAllowed, fmt.Sprintf("API key is not allowed to use model %s", chatModel))
+		return
+	}
+
+	prompt := "Generate an image: " + req.Prompt
+	if aspect != "" {
+		prompt += "\nAspect ratio: " + aspect
+	}
+	var images []model.Image
+	for i := 0; i < req.N && len(images) < req.N; i++ {
+		generated, err := generateImages(c, key, chatModel, prompt)
+		if err != nil {
+			if se := circuitOpen(c, err); se != nil {
+				respondError(c, http.StatusServiceUnavailable, model.CodeCircuitOpen, se.Error())
+				return
+			}
+			if c.Request.Context().Err() != nil {
+				return
+			}
+			respondError(c, http.StatusBadGateway, "", fmt.Sprintf("Failed to generate image: %v", err))
+			return
+		}
+		if len(generated) == 0 {
+			break
+		}
+		images = append(images, generated...)
+	}
+	if len(images) == 0 {
+		respondError(c, http.StatusBadGateway, "", "Perplexity returned no image, check that image generation is available for the accounts")
+		return
+	}
+	if len(images) > req.N {
+		images = images[:req.N]
+	}
+
+	resp := ImageGenerationResponse{Created: time.Now().Unix()}
+	for _, image := range images {
+		if req.ResponseFormat == "url" {
+			resp.Data = append(resp.Data, GeneratedImage{URL: image.URL})
+			continue
+		}
+		data, err := resolveImageURL(image.URL)
+		if err != nil {
+			respondError(c, http.StatusBadGateway, "", fmt.Sprintf("Failed to download generated image: %v", err))
+			return
+		}
+		resp.Data = append(resp.Data, GeneratedImage{B64JSON: data.Base64})
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// generateImages 发送一次生成请求，返回回答中的图片
+func generateImages(c *gin.Context, key *config.APIKey, chatModel string, prompt string) ([]model.Image, error) {
+	attempt := &chatAttempt{
+		RequestModel: chatModel,
+		Models:       config.ResolveModelChain(chatModel),
+		Prompt:       prompt,
+		Timezone:     config.ConfigInstance.Timezone,
+	}
+	recorder := httptest.NewRecorder()
+	gc, _ := gin.CreateTestContext(recorder)
+	gc.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(c.Request.Context())
+	meter := usage.Start(gc, chatModel, prompt, false)
+	err := attempt.sendWithRetry(gc)
+	meter.Record(key.Name)
+	if err != nil {
+		return nil, err
+	}
+	return model.ImagesFrom(gc), nil
+}
+
+// imageChatModel 返回发送生成请求使用的聊天模型：key 强制指定的模型优先，
+// 其次为请求中已知的聊天模型，否则使用 key 的默认模型
+func imageChatModel(requested string, key *config.APIKey) string {
+	if key.Defaults.ForceModel {
+		return key.Defaults.Model
+	}
+	if _, ok := config.ModelMap[requested]; ok {
+		return requested
+	}
+	if key.Defaults.Model != "" {
+		return key.Defaults.Model
+	}
+	return "claude-3.7-sonnet"
+}
+
+// aspectForSize 将 OpenAI 的 size 映射为提示词中的宽高比，Perplexity 不支持指定像素尺寸
+func aspectForSize(size string) (string, error) {
+	if size == "" || size == "auto" {
+		return "", nil
+	}
+	w, h, ok := strings.Cut(size, "x")
+	width, err1 := strconv.Atoi(w)
+	height, err2 := strconv.Atoi(h)
+	if !ok || err1 != nil || err2 != nil || width <= 0 || height <= 0 {
+		return "", fmt.Errorf("invalid size %q, use WIDTHxHEIGHT such as 1024x1024", size)
+	}
+	switch {
+	case width == height:
+		return "square (1:1)", nil
+	case width > height:
+		return "landscape (16:9)", nil
+	default:
+		return "portrait (9:16)", nil
+	}
+}
@@ -0,0 +1,316 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"pplx2api/usage"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxImportSize 导入文件大小上限
+const maxImportSize = 256 << 20
+
+// importPrompt 创建 Perplexity 会话时附在历史之后，避免生成长回答
+const importPrompt = "The messages above are our conversation so far, imported from another app. " +
+	"Reply only with \"OK\"; I will continue the conversation in my next message."
+
+// importedConversation is a conversation imported from another app. Its
+// messages are prepended to requests that continue it by conversation_id.
+type importedConversation struct {
+	Key        string                   `json:"key"`
+	ID         string                   `json:"id"`
+	Title      string                   `json:"title"`
+	Messages   []map[string]interface{} `json:"messages"`
+	ImportedAt time.Time                `json:"imported_at"`
+}
+
+var (
+	imported      = map[string]*importedConversation{}
+	importedMutex sync.Mutex
+	importedOnce  sync.Once
+)
+
+func importedKey(keyName string, id string) string {
+	return keyName + "|" + id
+}
+
+// loadImported 首次使用时读取导入文件
+func loadImported() {
+	importedOnce.Do(func() {
+		data, err := os.ReadFile(config.ConfigInstance.ImportsFile)
+		if os.IsNotExist(err) {
+			return
+		}
+		var list []*importedConversation
+		if err == nil {
+			err = json.Unmarshal(data, &list)
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("Failed to load imported conversations: %v", err))
+			return
+		}
+		for _, conv := range list {
+			imported[importedKey(conv.Key, conv.ID)] = conv
+		}
+	})
+}
+
+// saveImported 将导入的会话写入文件，调用方需持有锁
+func saveImported() error {
+	list := make([]*importedConversation, 0, len(imported))
+	for _, conv := range imported {
+		list = append(list, conv)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ImportedAt.Before(list[j].ImportedAt) })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(config.ConfigInstance.ImportsFile, data, 0600)
+}
+
+// routeImported 请求通过 conversation_id 继续导入的会话时，在消息前加上导入的历史
+func routeImported(r *chatRequest) {
+	if r.Body.ConversationID == "" {
+		return
+	}
+	loadImported()
+	importedMutex.Lock()
+	conv, ok := imported[importedKey(requestKey(r.c).Name, r.Body.ConversationID)]
+	importedMutex.Unlock()
+	if !ok {
+		return
+	}
+	r.Body.Messages = append(append([]map[string]interface{}{}, conv.Messages...), r.Body.Messages...)
+}
+
+// chatGPTConversation is one conversation of a ChatGPT conversations.json export
+type chatGPTConversation struct {
+	ID             string                 `json:"id"`
+	ConversationID string                 `json:"conversation_id"`
+	Title          string                 `json:"title"`
+	CurrentNode    string                 `json:"current_node"`
+	Mapping        map[string]chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	Parent  string `json:"parent"`
+	Message *struct {
+		Author struct {
+			Role string `json:"role"`
+		} `json:"author"`
+		Content struct {
+			ContentType string        `json:"content_type"`
+			Parts       []interface{} `json:"parts"`
+		} `json:"content"`
+		Metadata struct {
+			Hidden bool `json:"is_visually_hidden_from_conversation"`
+		} `json:"metadata"`
+	} `json:"message"`
+}
+
+// messages returns the visible text messages on the branch ending at the
+// current node, oldest first. Tool calls and image parts are skipped.
+func (c chatGPTConversation) messages() []map[string]interface{} {
+	var msgs []map[string]interface{}
+	seen := map[string]bool{}
+	for id := c.CurrentNode; id != "" && !seen[id]; id = c.Mapping[id].Parent {
+		seen[id] = true
+		m := c.Mapping[id].Message
+		if m == nil || m.Metadata.Hidden {
+			continue
+		}
+		role := m.Author.Role
+		if role != "user" && role != "assistant" && role != "system" {
+			continue
+		}
+		if m.Content.ContentType != "text" && m.Content.ContentType != "multimodal_text" {
+			continue
+		}
+		var parts []string
+		for _, p := range m.Content.Parts {
+			if s, ok := p.(string); ok && strings.TrimSpace(s) != "" {
+				parts = append(parts, s)
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		msgs = append(msgs, map[string]interface{}{"role": role, "content": strings.Join(parts, "\n\n")})
+	}
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+	return msgs
+}
+
+// readChatGPTExport 读取 conversations.json，或包含它的导出 zip 文件
+func readChatGPTExport(body io.Reader) ([]chatGPTConversation, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxImportSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxImportSize {
+		return nil, fmt.Errorf("export is larger than %d MB", maxImportSize>>20)
+	}
+	if bytes.HasPrefix(data, []byte("PK")) {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, fmt.Errorf("read zip: %w", err)
+		}
+		data = nil
+		for _, f := range zr.File {
+			if f.Name != "conversations.json" && !strings.HasSuffix(f.Name, "/conversations.json") {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			data, err = io.ReadAll(io.LimitReader(rc, maxImportSize))
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		if data == nil {
+			return nil, fmt.Errorf("zip has no conversations.json")
+		}
+	}
+	var convs []chatGPTConversation
+	if err := json.Unmarshal(data, &convs); err != nil {
+		return nil, fmt.Errorf("parse conversations.json: %w", err)
+	}
+	return convs, nil
+}
+
+// importResult is the outcome of importing one conversation
+type importResult struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Messages int    `json:"messages"`
+	Thread   bool   `json:"thread"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ImportChatGPTHandler imports a ChatGPT export, conversations.json or the
+// zip file, for the key named by ?key (the caller's key by default). The
+// conversations are continued by sending their id as conversation_id. With
+// ?create_threads=true each one is also sent to Perplexity once so that
+// follow-ups only send the new message; ?ids=a,b limits the import.
+func ImportChatGPTHandler(c *gin.Context) {
+	keyName := c.DefaultQuery("key", requestKey(c).Name)
+	var key *config.APIKey
+	for _, k := range config.ConfigInstance.Keys.List() {
+		if k.Name == keyName {
+			k := k
+			key = &k
+		}
+	}
+	if key == nil {
+		respondError(c, http.StatusNotFound, "", fmt.Sprintf("Key %s not found", keyName))
+		return
+	}
+	createThreads := c.Query("create_threads") == "true"
+	if createThreads && !config.ConfigInstance.ThreadReuse {
+		respondError(c, http.StatusBadRequest, "", "create_threads requires THREAD_REUSE=true")
+		return
+	}
+	modelName := c.DefaultQuery("model", "claude-3.7-sonnet")
+	var only map[string]bool
+	if ids := c.Query("ids"); ids != "" {
+		only = map[string]bool{}
+		for _, id := range strings.Split(ids, ",") {
+			only[strings.TrimSpace(id)] = true
+		}
+	}
+	convs, err := readChatGPTExport(c.Request.Body)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "", fmt.Sprintf("Invalid export: %v", err))
+		return
+	}
+
+	loadImported()
+	results := []importResult{}
+	for _, conv := range convs {
+		id := conv.ConversationID
+		if id == "" {
+			id = conv.ID
+		}
+		if id == "" || (only != nil && !only[id]) {
+			continue
+		}
+		result := importResult{ID: id, Title: conv.Title}
+		msgs := conv.messages()
+		result.Messages = len(msgs)
+		if len(msgs) == 0 {
+			result.Error = "no text messages"
+			results = append(results, result)
+			continue
+		}
+		importedMutex.Lock()
+		imported[importedKey(key.Name, id)] = &importedConversation{
+			Key: key.Name, ID: id, Title: conv.Title, Messages: msgs, ImportedAt: time.Now(),
+		}
+		importedMutex.Unlock()
+		if createThreads {
+			if err := createImportedThread(c, key.Name, modelName, id, msgs); err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Thread = true
+			}
+		}
+		results = append(results, result)
+	}
+	importedMutex.Lock()
+	err = saveImported()
+	importedMutex.Unlock()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "", fmt.Sprintf("Failed to save imported conversations: %v", err))
+		return
+	}
+	requestLog(c).Info(fmt.Sprintf("Imported %d ChatGPT conversations for key %s", len(results), key.Name))
+	c.JSON(http.StatusOK, gin.H{"key": key.Name, "imported": results})
+}
+
+// createImportedThread 在 Perplexity 上创建包含导入历史的会话并记录到会话映射
+func createImportedThread(c *gin.Context, keyName string, modelName string, id string, msgs []map[string]interface{}) error {
+	turn, err := renderMessages(c, append(append([]map[string]interface{}{}, msgs...), map[string]interface{}{"role": "user", "content": importPrompt}))
+	if err != nil {
+		return err
+	}
+	resolved := strings.TrimSuffix(strings.TrimSuffix(modelName, "-search"), "-nosearch")
+	attempt := &chatAttempt{
+		RequestModel: resolved,
+		Models:       config.ResolveModelChain(resolved),
+		Prompt:       turn.Prompt,
+		Timezone:     config.ConfigInstance.Timezone,
+	}
+	recorder := httptest.NewRecorder()
+	gc, _ := gin.CreateTestContext(recorder)
+	gc.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil).WithContext(c.Request.Context())
+	meter := usage.Start(gc, resolved, attempt.Prompt, false)
+	if err := attempt.sendWithRetry(gc); err != nil {
+		return err
+	}
+	meter.Record(keyName)
+	if attempt.answered == nil {
+		return fmt.Errorf("upstream returned no thread")
+	}
+	threads.Put(conversationKey(keyName, resolved, id, nil), attempt.answered)
+	return nil
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/middleware"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keyView is an API key as shown by the admin API, with the secret masked
+// and the hashes left out
+type keyView struct {
+	config.APIKey
+	Key          string `json:"key"`
+	KeyHash      string `json:"key_hash,omitempty"`
+	PreviousHash string `json:"previous_key_hash,omitempty"`
+	Static       bool   `json:"static"`
+	Expired      bool   `json:"expired,omitempty"`
+}
+
+// KeysHandler lists the configured client keys
+func KeysHandler(c *gin.Context) {
+	var views []keyView
+	now := time.Now()
+	for _, k := range config.ConfigInstance.Keys.List() {
+		masked := maskSessionKey(k.Key)
+		if k.Key == "" {
+			masked = k.Prefix + "****"
+		}
+		views = append(views, keyView{APIKey: k, Key: masked, Static: k.Static(), Expired: k.Expired(now)})
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": views})
+}
+
+// PutKeyHandler creates a client key or replaces the key with the same name.
+// A generated secret is returned once and can't be read back later.
+func PutKeyHandler(c *gin.Context) {
+	var key config.APIKey
+	if err := c.ShouldBindJSON(&key); err != nil {
+		respondError(c, http.StatusBadRequest, "", fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	generated, err := config.ConfigInstance.Keys.Put(key)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, config.ErrStaticKey) {
+			status = http.StatusConflict
+		}
+		respondError(c, status, "", err.Error())
+		return
+	}
+	resp := gin.H{"name": key.Name, "status": "saved"}
+	if generated != "" {
+		resp["key"] = generated
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// RotateKeyHandler gives a key a new secret and returns it. With ?grace=
+// (seconds or a duration like 24h) the old secret keeps working that long.
+func RotateKeyHandler(c *gin.Context) {
+	var grace time.Duration
+	if raw := c.Query("grace"); raw != "" {
+		if seconds, err := strconv.Atoi(raw); err == nil {
+			grace = time.Duration(seconds) * time.Second
+		} else if grace, err = time.ParseDuration(raw); err != nil {
+			respondError(c, http.StatusBadRequest, "", "grace must be seconds or a duration like 24h")
+			return
+		}
+	}
+	name := c.Param("name")
+	secret, err := config.ConfigInstance.Keys.Rotate(name, grace)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, config.ErrKeyNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, config.ErrStaticKey):
+			status = http.StatusConflict
+		}
+		respondError(c, status, "", err.Error())
+		return
+	}
+	resp := gin.H{"name": name, "key": secret, "status": "rotated"}
+	if grace > 0 {
+		resp["previous_expires_at"] = time.Now().Add(grace).UTC().Format(time.RFC3339)
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// DeleteKeyHandler removes a client key
+func DeleteKeyHandler(c *gin.Context) {
+	name := c.Param("name")
+	found, err := config.ConfigInstance.Keys.Delete(name)
+	if !found {
+		respondError(c, http.StatusNotFound, "", "Key not found")
+		return
+	}
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, config.ErrStaticKey) {
+			status = http.StatusConflict
+		}
+		respondError(c, status, "", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": name, "status": "deleted"})
+}
+
+// requestKey returns the key the request authenticated with
+func requestKey(c *gin.Context) *config.APIKey {
+	if k := middleware.APIKeyFrom(c); k != nil {
+		return k
+	}
+	return &config.APIKey{}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/model"
+	"unicode/utf8"
+)
+
+// tooLargeError is an attachment over its size limit
+type tooLargeError struct {
+	What  string
+	Limit int
+}
+
+func (e *tooLargeError) Error() string {
+	return fmt.Sprintf("%s exceeds %d bytes", e.What, e.Limit)
+}
+
+// invalidBody 返回请求体解析失败的错误，超出大小上限时返回 413
+func invalidBody(err error) error {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return abortWithCode(http.StatusRequestEntityTooLarge, model.CodeRequestTooLarge, "Request body exceeds the limit of %d bytes", maxErr.Limit)
+	}
+	return abortWith(http.StatusBadRequest, "Invalid request: %v", err)
+}
+
+// invalidPart 返回图片或附件无效的错误，超出大小上限时返回 413
+func invalidPart(kind string, err error) error {
+	var tooLarge *tooLargeError
+	if errors.As(err, &tooLarge) {
+		return abortWithCode(http.StatusRequestEntityTooLarge, model.CodeRequestTooLarge, "Invalid %s: %v", kind, err)
+	}
+	return abortWith(http.StatusBadRequest, "Invalid %s: %v", kind, err)
+}
+
+// checkRequestLimits 在下载图片与拼接提示词之前检查消息数、图片数、附件数与文本长度
+func checkRequestLimits(msgs []map[string]interface{}) error {
+	cfg := config.ConfigInstance
+	if cfg.MaxMessages > 0 && len(msgs) > cfg.MaxMessages {
+		return abortWithCode(http.StatusBadRequest, model.CodeLimitExceeded, "Request has %d messages, the limit is %d", len(msgs), cfg.MaxMessages)
+	}
+	var images, files, chars int
+	for _, msg := range msgs {
+		switch content := msg["content"].(type) {
+		case string:
+			chars += utf8.RuneCountInString(content)
+		case []interface{}:
+			for _, item := range content {
+				part, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				switch part["type"] {
+				case "text":
+					text, _ := part["text"].(string)
+					chars += utf8.RuneCountInString(text)
+				case "image_url":
+					images++
+				case "file":
+					files++
+				}
+			}
+		}
+	}
+	if cfg.MaxImages > 0 && images > cfg.MaxImages {
+		return abortWithCode(http.StatusBadRequest, model.CodeLimitExceeded, "Request has %d images, the limit is %d", images, cfg.MaxImages)
+	}
+	if cfg.MaxFiles > 0 && files > cfg.MaxFiles {
+		return abortWithCode(http.StatusBadRequest, model.CodeLimitExceeded, "Request has %d files, the limit is %d", files, cfg.MaxFiles)
+	}
+	if cfg.MaxPromptChars > 0 && chars > cfg.MaxPromptChars {
+		return abortWithCode(http.StatusRequestEntityTooLarge, model.CodeLimitExceeded, "Messages have %d characters, the limit is %d", chars, cfg.MaxPromptChars)
+	}
+	return nil
+}
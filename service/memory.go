@@ -0,0 +1,130 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"pplx2api/cache"
+	"pplx2api/config"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Memory pressure levels, relative to the memory limit
+const (
+	PressureLow    = "low"
+	PressureMedium = "medium"
+	PressureHigh   = "high"
+)
+
+var (
+	requestSlots     chan struct{}
+	requestSlotsOnce sync.Once
+	activeRequests   atomic.Int64
+	queuedRequests   atomic.Int64
+	shedRequests     atomic.Int64
+)
+
+// errOverloaded 排队已满或等待超时，请求被拒绝
+var errOverloaded = errors.New("too many concurrent requests")
+
+// overloadRetryAfter 拒绝请求时建议客户端等待的秒数
+const overloadRetryAfter = 5
+
+// acquireRequestSlot waits for one of the MAX_CONCURRENT_REQUESTS slots and
+// returns its release function. It fails when the client leaves first, and
+// with errOverloaded when MAX_QUEUED_REQUESTS are already waiting or no slot
+// frees up within QUEUE_TIMEOUT.
+func acquireRequestSlot(ctx context.Context) (func(), error) {
+	requestSlotsOnce.Do(func() {
+		if n := config.ConfigInstance.MaxConcurrentRequests; n > 0 {
+			requestSlots = make(chan struct{}, n)
+		}
+	})
+	activeRequests.Add(1)
+	release := func() { activeRequests.Add(-1) }
+	if requestSlots == nil {
+		return release, nil
+	}
+	releaseSlot := func() {
+		<-requestSlots
+		release()
+	}
+	select {
+	case requestSlots <- struct{}{}:
+		return releaseSlot, nil
+	default:
+	}
+
+	cfg := config.ConfigInstance
+	queued := queuedRequests.Add(1)
+	defer queuedRequests.Add(-1)
+	if cfg.MaxQueuedRequests >= 0 && queued > int64(cfg.MaxQueuedRequests) {
+		release()
+		shedRequests.Add(1)
+		return nil, errOverloaded
+	}
+	var timeout <-chan time.Time
+	if cfg.QueueTimeout > 0 {
+		timer := time.NewTimer(cfg.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case requestSlots <- struct{}{}:
+		return releaseSlot, nil
+	case <-timeout:
+		release()
+		shedRequests.Add(1)
+		return nil, errOverloaded
+	case <-ctx.Done():
+		release()
+		return nil, ctx.Err()
+	}
+}
+
+// MemoryHandler reports the memory use of the process and the pressure
+// relative to MEMORY_LIMIT
+func MemoryHandler(c *gin.Context) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	// SetMemoryLimit 传入负数时只返回当前值
+	limit := debug.SetMemoryLimit(-1)
+	resp := gin.H{
+		"profile":           config.ConfigInstance.MemoryProfile,
+		"heap_alloc_bytes":  m.HeapAlloc,
+		"heap_inuse_bytes":  m.HeapInuse,
+		"sys_bytes":         m.Sys,
+		"num_gc":            m.NumGC,
+		"gc_pause_total_ns": m.PauseTotalNs,
+		"goroutines":        runtime.NumGoroutine(),
+		"active_requests":   activeRequests.Load(),
+		"max_concurrent":    config.ConfigInstance.MaxConcurrentRequests,
+		"queued_requests":   queuedRequests.Load(),
+		"max_queued":        config.ConfigInstance.MaxQueuedRequests,
+		"shed_requests":     shedRequests.Load(),
+		"sse_buffer_bytes":  config.ConfigInstance.SSEBufferSize,
+	}
+	if cache.Enabled() {
+		resp["response_cache"] = cache.CurrentStats()
+	}
+	if config.ConfigInstance.MemoryLimit > 0 {
+		ratio := float64(m.Sys-m.HeapReleased) / float64(limit)
+		pressure := PressureLow
+		switch {
+		case ratio >= 0.9:
+			pressure = PressureHigh
+		case ratio >= 0.7:
+			pressure = PressureMedium
+		}
+		resp["memory_limit_bytes"] = limit
+		resp["usage_ratio"] = ratio
+		resp["pressure"] = pressure
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,221 @@
+package service
+
+import (
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/logger"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ModelObject is an entry of the OpenAI /v1/models listing
+type ModelObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// modelCache 缓存按账号订阅等级合并后的模型列表
+type modelCache struct {
+	mutex     sync.Mutex
+	models    []ModelObject
+	fetchedAt time.Time
+}
+
+var models = &modelCache{}
+
+// modelOwners 根据模型名前缀推断所属厂商
+var modelOwners = []struct {
+	prefix string
+	owner  string
+}{
+	{"claude", "anthropic"},
+	{"gpt", "openai"},
+	{"o1", "openai"},
+	{"o3", "openai"},
+	{"o4", "openai"},
+	{"gemini", "google"},
+	{"grok", "xai"},
+	{"deepseek", "deepseek"},
+	{"r1", "deepseek"},
+	{"kimi", "moonshot"},
+}
+
+func modelOwner(id string) string {
+	for _, o := range modelOwners {
+		if strings.HasPrefix(id, o.prefix) {
+			return o.owner
+		}
+	}
+	return "perplexity"
+}
+
+// requiredTier 返回上游模型所需的订阅等级
+func requiredTier(m core.UpstreamModel) string {
+	if m.SubscriptionTier != "" {
+		return m.SubscriptionTier
+	}
+	if _, isMax := config.MaxModelMap[config.ModelReverseMapGet(m.ID, m.ID)]; isMax {
+		return core.TierMax
+	}
+	return core.TierPro
+}
+
+// staticUpstreamModels is used when the upstream model list can't be fetched
+func staticUpstreamModels() []core.UpstreamModel {
+	upstream := make([]core.UpstreamModel, 0, len(config.ModelMap))
+	for _, id := range config.ModelMap {
+		upstream = append(upstream, core.UpstreamModel{ID: id})
+	}
+	return upstream
+}
+
+// sessionTier 获取并记录账号订阅等级，失败时按 IS_MAX_SUBSCRIBE 推断
+func sessionTier(index int, session config.SessionInfo) string {
+	tier, err := detectTier(index, session)
+	if err != nil {
+		logger.Error("Failed to detect subscription tier: " + err.Error())
+		if config.ConfigInstance.IsMaxSubscribe {
+			return core.TierMax
+		}
+		return core.TierPro
+	}
+	if config.ConfigInstance.IsMaxSubscribe && !core.TierAllows(tier, core.TierMax) {
+		return core.TierMax
+	}
+	return tier
+}
+
+// fetchModels queries every active session and keeps the models at least one
+// of them can use, listed under their configured aliases.
+func fetchModels() []ModelObject {
+	config.ConfigInstance.RwMutex.RLock()
+	sessions := make([]config.SessionInfo, len(config.ConfigInstance.Sessions))
+	copy(sessions, config.ConfigInstance.Sessions)
+	config.ConfigInstance.RwMutex.RUnlock()
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var upstream []core.UpstreamModel
+	tiers := []string{}
+	for i, session := range sessions {
+		if session.Archived {
+			continue
+		}
+		wg.Add(1)
+		go func(index int, session config.SessionInfo) {
+			defer wg.Done()
+			client := core.NewSessionClient(session, "", false)
+			tier := sessionTier(index, session)
+			list, err := client.GetModels()
+			mutex.Lock()
+			defer mutex.Unlock()
+			tiers = append(tiers, tier)
+			if err != nil {
+				logger.Error("Failed to fetch upstream models: " + err.Error())
+				return
+			}
+			if upstream == nil {
+				upstream = list
+			}
+		}(i, session)
+	}
+	wg.Wait()
+	if len(tiers) == 0 {
+		tiers = append(tiers, core.TierPro)
+		if config.ConfigInstance.IsMaxSubscribe {
+			tiers[0] = core.TierMax
+		}
+	}
+	if upstream == nil {
+		upstream = staticUpstreamModels()
+	} else {
+		setUpstreamTiers(upstream)
+	}
+
+	now := time.Now().Unix()
+	seen := map[string]bool{}
+	result := []ModelObject{}
+	add := func(id string) {
+		if seen[id] {
+			return
+		}
+		seen[id] = true
+		result = append(result,
+			ModelObject{ID: id, Object: "model", Created: now, OwnedBy: modelOwner(id)},
+			ModelObject{ID: id + "-search", Object: "model", Created: now, OwnedBy: modelOwner(id)},
+		)
+	}
+	usableIDs := map[string]bool{}
+	for _, m := range upstream {
+		usable := false
+		for _, tier := range tiers {
+			if core.TierAllows(tier, requiredTier(m)) {
+				usable = true
+				break
+			}
+		}
+		if !usable {
+			continue
+		}
+		usableIDs[m.ID] = true
+		// 优先使用配置中的别名
+		for alias, id := range config.ModelMap {
+			if id == m.ID {
+				add(alias)
+			}
+		}
+		if _, aliased := config.ModelReverseMap[m.ID]; !aliased {
+			add(m.ID)
+		}
+	}
+	// 回退链别名只要链上有一个模型可用即展示
+	for alias := range config.ConfigInstance.ModelChains {
+		for _, id := range config.ResolveModelChain(alias) {
+			if usableIDs[id] {
+				add(alias)
+				break
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+// List returns the cached model list, refreshing it once the TTL expired
+func (mc *modelCache) List() []ModelObject {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+	if mc.models == nil || time.Since(mc.fetchedAt) > config.ConfigInstance.ModelsCacheTTL {
+		mc.models = fetchModels()
+		mc.fetchedAt = time.Now()
+	}
+	return mc.models
+}
+
+func ModelsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   visibleModels(requestKey(c), models.List()),
+	})
+}
+
+// visibleModels 只返回 key 允许使用的模型，客户端不会看到请求时会被拒绝的模型
+func visibleModels(apiKey *config.APIKey, list []ModelObject) []ModelObject {
+	if len(apiKey.AllowedModels) == 0 {
+		return list
+	}
+	visible := []ModelObject{}
+	for _, m := range list {
+		if apiKey.AllowsModel(m.ID) {
+			visible = append(visible, m)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"encoding/base64"
+	"net/http"
+	"pplx2api/model"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ollamaVersion 返回给检查 Ollama 版本的客户端
+const ollamaVersion = "0.6.0"
+
+// ollamaOptions are the Ollama model options the proxy supports
+type ollamaOptions struct {
+	NumPredict int      `json:"num_predict,omitempty"`
+	Stop       []string `json:"stop,omitempty"`
+}
+
+// OllamaChatRequest is an Ollama /api/chat request
+type OllamaChatRequest struct {
+	Model    string `json:"model"`
+	Messages []struct {
+		Role    string   `json:"role"`
+		Content string   `json:"content"`
+		Images  []string `json:"images,omitempty"`
+	} `json:"messages"`
+	// Stream 未设置时默认为 true
+	Stream  *bool          `json:"stream,omitempty"`
+	Options *ollamaOptions `json:"options,omitempty"`
+}
+
+// OllamaGenerateRequest is an Ollama /api/generate request
+type OllamaGenerateRequest struct {
+	Model   string         `json:"model"`
+	Prompt  string         `json:"prompt"`
+	System  string         `json:"system,omitempty"`
+	Images  []string       `json:"images,omitempty"`
+	Stream  *bool          `json:"stream,omitempty"`
+	Options *ollamaOptions `json:"options,omitempty"`
+}
+
+// ollamaModel 去掉 Ollama 模型名的 :latest 标签
+func ollamaModel(name string) string {
+	return strings.TrimSuffix(name, ":latest")
+}
+
+// OllamaChatHandler handles the Ollama /api/chat endpoint
+func OllamaChatHandler(c *gin.Context) {
+	runOllamaPipeline(c, false)
+}
+
+// OllamaGenerateHandler handles the Ollama /api/generate endpoint
+func OllamaGenerateHandler(c *gin.Context) {
+	runOllamaPipeline(c, true)
+}
+
+// runOllamaPipeline 以 Ollama 请求替换解析阶段
+func runOllamaPipeline(c *gin.Context, generate bool) {
+	runPipeline(c, withParseStage(func(r *chatRequest) error { return parseOllamaStage(r, generate) }))
+}
+
+// parseOllamaStage 解析 Ollama 请求并转换为聊天请求
+func parseOllamaStage(r *chatRequest, generate bool) error {
+	var (
+		modelName string
+		stream    *bool
+		options   *ollamaOptions
+		msgs      []map[string]interface{}
+	)
+	if generate {
+		var req OllamaGenerateRequest
+		if err := r.c.ShouldBindJSON(&req); err != nil {
+			return invalidBody(err)
+		}
+		modelName, stream, options = req.Model, req.Stream, req.Options
+		if req.Prompt == "" {
+			// 空提示词在 Ollama 中用于加载模型，直接返回完成
+			empty := ""
+			r.c.JSON(http.StatusOK, model.OllamaResponse{Model: req.Model, CreatedAt: time.Now().UTC(), Response: &empty, Done: true, DoneReason: "load"})
+			r.Done = true
+			return nil
+		}
+		if req.System != "" {
+			msgs = append(msgs, map[string]interface{}{"role": "system", "content": req.System})
+		}
+		content, err := ollamaContent(req.Prompt, req.Images)
+		if err != nil {
+			return err
+		}
+		msgs = append(msgs, map[string]interface{}{"role": "user", "content": content})
+	} else {
+		var req OllamaChatRequest
+		if err := r.c.ShouldBindJSON(&req); err != nil {
+			return invalidBody(err)
+		}
+		modelName, stream, options = req.Model, req.Stream, req.Options
+		for _, m := range req.Messages {
+			content, err := ollamaContent(m.Content, m.Images)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, map[string]interface{}{"role": m.Role, "content": content})
+		}
+	}
+	if options != nil {
+		if options.NumPredict > 0 {
+			r.Limits.maxTokens = options.NumPredict
+		}
+		r.Limits.stops = options.Stop
+	}
+	r.Body = ChatCompletionRequest{
+		Model:         ollamaModel(modelName),
+		Messages:      msgs,
+		Stream:        stream == nil || *stream,
+		StreamOptions: &StreamOptions{IncludeUsage: true},
+	}
+	// 响应中的模型名与请求保持一致
+	model.SetOllama(r.c, modelName, generate)
+	return nil
+}
+
+// ollamaContent 将文本与 base64 图片转换为 OpenAI 的消息内容
+func ollamaContent(text string, images []string) (interface{}, error) {
+	if len(images) == 0 {
+		return text, nil
+	}
+	content := []interface{}{map[string]interface{}{"type": "text", "text": text}}
+	for _, img := range images {
+		// Ollama 的图片为不带 MIME 类型的 base64，按内容推断类型
+		head, err := base64.StdEncoding.DecodeString(img[:min(len(img), 64)&^3])
+		if err != nil {
+			return nil, abortWith(http.StatusBadRequest, "Invalid image: not base64 encoded")
+		}
+		mimeType := http.DetectContentType(head)
+		if !strings.HasPrefix(mimeType, "image/") {
+			return nil, abortWith(http.StatusBadRequest, "Invalid image: unsupported type %s", mimeType)
+		}
+		content = append(content, map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "data:" + mimeType + ";base64," + img}})
+	}
+	return content, nil
+}
+
+// OllamaTagsHandler lists the models in the Ollama /api/tags format
+func OllamaTagsHandler(c *gin.Context) {
+	list := []gin.H{}
+	for _, m := range visibleModels(requestKey(c), models.List()) {
+		list = append(list, gin.H{
+			"name":        m.ID + ":latest",
+			"model":       m.ID + ":latest",
+			"modified_at": time.Unix(m.Created, 0).UTC(),
+			"size":        0,
+			"digest":      "",
+			"details":     gin.H{"format": "remote", "family": m.OwnedBy, "families": []string{m.OwnedBy}},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"models": list})
+}
+
+// OllamaVersionHandler reports an Ollama version for clients that check it
+func OllamaVersionHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"version": ollamaVersion})
+}
@@ -0,0 +1,196 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/hooks"
+	"pplx2api/model"
+	"pplx2api/tracing"
+	"pplx2api/usage"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// chatRequest carries one chat completion through the pipeline. Each stage
+// fills in the fields later stages need.
+type chatRequest struct {
+	c    *gin.Context
+	Body ChatCompletionRequest
+	// APIKey 发起请求的客户端 key
+	APIKey *config.APIKey
+	// Model 去掉 -search 后缀的模型名，Models 为回退链
+	Model      string
+	Models     []string
+	OpenSearch bool
+	// Search 联网搜索的过滤条件
+	Search core.SearchOptions
+	// UserSession 调用方自带的 session，为空时使用轮询账号
+	UserSession string
+	// Labels 请求指定的账号标签，来自模型名后缀、请求头与 key 的设置
+	Labels map[string]string
+	// Thread 可继续的 Perplexity 会话，ThreadKey 为本次回答的存储键
+	Thread    *threadRef
+	ThreadKey string
+	// Retention 回答后上游会话的保留时间，RetainThread 表示一直保留
+	Retention time.Duration
+	Prompt    string
+	Images    []core.ImageData
+	Files     []core.FileData
+	// Limits 停止序列与 max_tokens，由解析阶段设置
+	Limits  outputLimits
+	Attempt *chatAttempt
+	Meter   *usage.Meter
+	// CacheKey 响应缓存的键，Recording 为本次录制的回答，未启用缓存时为空
+	CacheKey  string
+	Recording *model.Recording
+	// Hooks 传给钩子的请求，未注册钩子时为空
+	Hooks *hooks.Request
+	// after 管线结束后执行，无论是否出错
+	after []func()
+	// Done 为 true 时响应已完成，跳过后续阶段
+	Done bool
+	// Started 请求开始处理的时间
+	Started time.Time
+}
+
+// chatStage is one step of the chat completion pipeline. Returning an
+// error stops the pipeline and the error is sent to the client; setting
+// Done stops it without an error, e.g. after serving a cached response.
+type chatStage struct {
+	name string
+	run  func(r *chatRequest) error
+}
+
+// Pipeline stage names, in order
+const (
+	StageParse       = "parse"
+	StageValidate    = "validate"
+	StageRoute       = "route"
+	StageTransform   = "transform"
+	StageLimits      = "limits"
+	StageDispatch    = "dispatch"
+	StagePostProcess = "post_process"
+)
+
+// chatPipeline 聊天请求的处理阶段，最后统一由 respondStage 输出错误
+var chatPipeline = []chatStage{
+	{StageParse, parseStage},
+	{StageValidate, validateStage},
+	{StageRoute, routeStage},
+	{StageTransform, transformStage},
+	{StageLimits, limitsStage},
+	{StageDispatch, dispatchStage},
+	{StagePostProcess, postProcessStage},
+}
+
+// addChatStage inserts a stage before the stage named before, or appends
+// it when there is no such stage. It must be called during init.
+func addChatStage(before string, stage chatStage) {
+	for i, s := range chatPipeline {
+		if s.name == before {
+			chatPipeline = append(chatPipeline[:i], append([]chatStage{stage}, chatPipeline[i:]...)...)
+			return
+		}
+	}
+	chatPipeline = append(chatPipeline, stage)
+}
+
+// withParseStage returns the chat pipeline with its parse stage replaced,
+// for endpoints that accept another request format.
+func withParseStage(parse func(r *chatRequest) error) []chatStage {
+	stages := make([]chatStage, len(chatPipeline))
+	copy(stages, chatPipeline)
+	for i, stage := range stages {
+		if stage.name == StageParse {
+			stages[i] = chatStage{StageParse, parse}
+		}
+	}
+	return stages
+}
+
+// record 开始录制本次回答，已在录制时返回同一份
+func (r *chatRequest) record() *model.Recording {
+	if r.Recording == nil {
+		r.Recording = model.Record(r.c)
+	}
+	return r.Recording
+}
+
+// stageError is a pipeline error with the HTTP status sent to the client
+type stageError struct {
+	Status int
+	// Code 机器可读的错误码，为空时按状态码给出
+	Code    string
+	Message string
+}
+
+func (e *stageError) Error() string {
+	return e.Message
+}
+
+// abortWith returns a stageError with a formatted message
+func abortWith(status int, format string, args ...interface{}) error {
+	return &stageError{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+// abortWithCode returns a stageError with a machine-readable code
+func abortWithCode(status int, code string, format string, args ...interface{}) error {
+	return &stageError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// runChatPipeline runs the chat completion pipeline
+func runChatPipeline(c *gin.Context) {
+	runPipeline(c, chatPipeline)
+}
+
+// runPipeline runs the stages in order, each in its own span, then
+// responds with the error that stopped the pipeline, if any.
+func runPipeline(c *gin.Context, stages []chatStage) {
+	r := &chatRequest{c: c, Started: time.Now()}
+	defer model.StartKeepalive(c, config.ConfigInstance.SSEKeepalive)()
+	defer model.StartCoalescing(c, config.ConfigInstance.StreamFlushInterval, config.ConfigInstance.StreamFlushBytes)()
+	defer func() {
+		for _, f := range r.after {
+			f()
+		}
+	}()
+	var err error
+	for _, stage := range stages {
+		parent := c.Request.Context()
+		ctx, span := tracing.Start(parent, "pipeline."+stage.name, tracing.KindInternal)
+		c.Request = c.Request.WithContext(ctx)
+		err = stage.run(r)
+		c.Request = c.Request.WithContext(parent)
+		span.SetError(err)
+		span.End()
+		if err != nil || r.Done {
+			break
+		}
+	}
+	if err != nil && r.Meter != nil {
+		// 参数错误等在开始计量前返回的请求不计入错误数
+		r.Meter.RecordError(apiKeyLabel(c))
+	}
+	recordConversation(r, err)
+	respondStage(r, err)
+	finishHooks(r, err)
+}
+
+// respondStage 输出终止管线的错误；已开始输出或客户端已断开时不再写入
+func respondStage(r *chatRequest, err error) {
+	if err == nil || r.c.Writer.Written() || r.c.Request.Context().Err() != nil {
+		return
+	}
+	status, code, message := http.StatusInternalServerError, "", err.Error()
+	if se, ok := err.(*stageError); ok {
+		status, code = se.Status, se.Code
+	}
+	if model.IsGemini(r.c) {
+		r.c.JSON(status, geminiError(status, message))
+		return
+	}
+	respondError(r.c, status, code, message)
+}
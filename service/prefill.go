@@ -0,0 +1,66 @@
+package service
+
+import (
+	"strings"
+	"sync"
+)
+
+// prefillInstruction 要求上游从助手消息末尾继续，而不是重新回答
+const prefillInstruction = "(Continue the last Assistant message above from exactly where it ends. " +
+	"Reply with the continuation only, do not repeat any of it.)\n\n"
+
+// prefillText returns the text of the last message when it is from the
+// assistant, which Anthropic style clients send as a prefill to continue.
+func prefillText(msgs []map[string]interface{}) (string, bool) {
+	if len(msgs) == 0 {
+		return "", false
+	}
+	last := msgs[len(msgs)-1]
+	if role, _ := last["role"].(string); role != "assistant" {
+		return "", false
+	}
+	text := messageText(last)
+	return text, text != ""
+}
+
+// prefillFilter drops the prefill when the model repeats it at the start
+// of its output, so the client only receives the continuation. Output that
+// may still turn out to be the repeated prefill is held back until decided.
+type prefillFilter struct {
+	prefill string
+
+	mutex   sync.Mutex
+	held    string
+	decided bool
+}
+
+func (f *prefillFilter) Filter(text string) string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.decided {
+		return text
+	}
+	f.held += text
+	trimmed := strings.TrimLeft(f.held, " \n")
+	switch {
+	case strings.HasPrefix(trimmed, f.prefill):
+		f.decided = true
+		return strings.TrimPrefix(trimmed, f.prefill)
+	case strings.HasPrefix(f.prefill, trimmed):
+		// 目前为止都与预填内容一致，继续等待
+		return ""
+	}
+	f.decided = true
+	held := f.held
+	f.held = ""
+	return held
+}
+
+// Flush 输出结束时仍未确定，说明输出只是预填内容的一部分，丢弃
+func (f *prefillFilter) Flush() string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.decided = true
+	f.held = ""
+	return ""
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"fmt"
+	"pplx2api/config"
+	"pplx2api/utils"
+	"strings"
+)
+
+// promptMessage is one chat message flattened to its text parts
+type promptMessage struct {
+	Role  string
+	Name  string
+	Texts []string
+}
+
+// promptFields are the fields available to PROMPT_TEMPLATE
+type promptFields struct {
+	Role    string
+	Label   string
+	Name    string
+	Content string
+}
+
+// assemblePrompt joins the messages into the prompt sent to Perplexity,
+// following the configured PromptStrategy.
+func assemblePrompt(msgs []promptMessage) (string, error) {
+	p := config.ConfigInstance.Prompt
+	for i := range msgs {
+		// developer 是新版 OpenAI 接口中 system 的别名
+		if msgs[i].Role == "developer" {
+			msgs[i].Role = "system"
+		}
+	}
+	if p.SystemMerge == config.SystemTop {
+		msgs = systemFirst(msgs)
+	}
+	var prompt strings.Builder
+	for _, m := range msgs {
+		name := ""
+		if p.IncludeNames {
+			name = m.Name
+		}
+		switch p.Format {
+		case config.PromptPlain:
+			for _, text := range m.Texts {
+				prompt.WriteString(text + "\n\n")
+			}
+		case config.PromptXML:
+			if name != "" {
+				fmt.Fprintf(&prompt, "<%s name=%q>\n", m.Role, name)
+			} else {
+				fmt.Fprintf(&prompt, "<%s>\n", m.Role)
+			}
+			prompt.WriteString(strings.Join(m.Texts, "\n\n") + "\n</" + m.Role + ">\n\n")
+		case config.PromptTemplate:
+			fields := promptFields{Role: m.Role, Label: p.Label(m.Role), Name: name, Content: strings.Join(m.Texts, "\n\n")}
+			if err := p.Template.Execute(&prompt, fields); err != nil {
+				return "", err
+			}
+		default:
+			prompt.WriteString(utils.GetRolePrefix(m.Role, name)) // 获取角色前缀
+			for _, text := range m.Texts {
+				prompt.WriteString(text + "\n\n")
+			}
+		}
+	}
+	return prompt.String(), nil
+}
+
+// systemFirst 将所有 system 消息合并为开头的一条
+func systemFirst(msgs []promptMessage) []promptMessage {
+	system := promptMessage{Role: "system"}
+	rest := make([]promptMessage, 0, len(msgs))
+	for _, m := range msgs {
+		if m.Role == "system" {
+			system.Texts = append(system.Texts, m.Texts...)
+			continue
+		}
+		rest = append(rest, m)
+	}
+	if len(system.Texts) == 0 {
+		return rest
+	}
+	return append([]promptMessage{system}, rest...)
+}
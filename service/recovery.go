@@ -0,0 +1,28 @@
+package service
+
+import (
+	"pplx2api/config"
+	"pplx2api/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+// continueStream turns the attempt into a request to continue the answer
+// already streamed to the client, after the upstream stream broke off.
+// The streamed text is sent as an assistant prefill and a repeat of it at
+// the start of the new answer is dropped, so the client stream carries on
+// as if nothing happened.
+func (a *chatAttempt) continueStream(c *gin.Context) {
+	streamed := model.Streamed(c)
+	if streamed == "" {
+		// 还没有输出正文，直接重新请求
+		return
+	}
+	if a.basePrompt == "" {
+		a.basePrompt = a.Prompt
+	}
+	// 续写带上完整对话，在新会话中发送
+	a.FollowUp = nil
+	a.Prompt = a.basePrompt + "\n\n" + config.ConfigInstance.Prompt.Label("assistant") + ": " + streamed + "\n\n" + prefillInstruction
+	model.PrependOutputFilter(c, &prefillFilter{prefill: streamed})
+}
@@ -0,0 +1,23 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ReloadConfigHandler reloads sessions, keys, proxies and model mappings,
+// like sending SIGHUP, for platforms without signals
+func ReloadConfigHandler(c *gin.Context) {
+	if err := config.Reload(); err != nil {
+		respondError(c, http.StatusBadRequest, "", fmt.Sprintf("Failed to reload config: %v", err))
+		return
+	}
+	cfg := config.ConfigInstance
+	cfg.RwMutex.RLock()
+	sessions := len(cfg.Sessions)
+	cfg.RwMutex.RUnlock()
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions, "keys": cfg.Keys.Len(), "proxies": cfg.ProxyPool.Len()})
+}
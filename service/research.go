@@ -0,0 +1,311 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"pplx2api/model"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// researchKey is the gin context key of the tracked deep research request
+const researchKey = "research_request"
+
+// Research job states
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// researchJobRetention 已结束任务的保留时间
+const researchJobRetention = 24 * time.Hour
+
+// researchRequest is an in-flight deep research completion that shutdown
+// may hand off to the next instance instead of cutting it.
+type researchRequest struct {
+	attempt *chatAttempt
+	ctx     context.Context
+	cancel  context.CancelFunc
+	jobID   string
+	done    chan struct{}
+}
+
+// ResearchJob is a deep research request persisted across restarts
+type ResearchJob struct {
+	ID        string          `json:"id"`
+	Status    string          `json:"status"`
+	Attempt   *chatAttempt    `json:"attempt,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+var (
+	researchRequests      = map[*researchRequest]struct{}{}
+	researchRequestsMutex sync.Mutex
+	researchJobs          = map[string]*ResearchJob{}
+	researchJobsMutex     sync.Mutex
+)
+
+// trackResearch registers a deep research request so shutdown can drain it.
+// It returns nil for other requests.
+func trackResearch(c *gin.Context, attempt *chatAttempt) *researchRequest {
+	if !config.ConfigInstance.IsDeepResearch(append([]string{attempt.RequestModel}, attempt.Models...)...) {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	rr := &researchRequest{attempt: attempt, ctx: ctx, cancel: cancel, done: make(chan struct{})}
+	c.Request = c.Request.WithContext(ctx)
+	c.Set(researchKey, rr)
+	researchRequestsMutex.Lock()
+	researchRequests[rr] = struct{}{}
+	researchRequestsMutex.Unlock()
+	return rr
+}
+
+// researchFrom returns the deep research request attached to c, if any
+func researchFrom(c *gin.Context) *researchRequest {
+	if v, ok := c.Get(researchKey); ok {
+		return v.(*researchRequest)
+	}
+	return nil
+}
+
+// finish 注销请求；若已移交为异步任务，告知客户端任务 ID
+func (rr *researchRequest) finish(c *gin.Context) {
+	researchRequestsMutex.Lock()
+	delete(researchRequests, rr)
+	jobID := rr.jobID
+	researchRequestsMutex.Unlock()
+	defer close(rr.done)
+	defer rr.cancel()
+	if jobID == "" {
+		return
+	}
+	if !rr.attempt.Stream {
+		c.JSON(http.StatusAccepted, gin.H{"id": jobID, "status": JobPending})
+		return
+	}
+	notice := fmt.Sprintf("\n\n> Server is restarting, this deep research continues as job `%s`. Fetch the result from /v1/research/jobs/%s\n", jobID, jobID)
+	model.ReturnOpenAIResponse(notice, true, c)
+	model.StreamDone(c)
+}
+
+// DrainResearch waits for in-flight deep research requests until ctx is
+// done. Requests still running afterwards are persisted as jobs when
+// DEEP_RESEARCH_HANDOFF is enabled, then cancelled either way.
+func DrainResearch(ctx context.Context) {
+	if waitResearch(ctx) {
+		return
+	}
+
+	researchRequestsMutex.Lock()
+	var pending []*researchRequest
+	for rr := range researchRequests {
+		// 自带账号的请求无法由其他实例完成
+		if config.ConfigInstance.DeepResearchHandoff && rr.attempt.base == nil {
+			rr.jobID = strings.ReplaceAll(uuid.New().String(), "-", "")
+		}
+		pending = append(pending, rr)
+	}
+	researchRequestsMutex.Unlock()
+
+	for _, rr := range pending {
+		if rr.jobID != "" {
+			attempt := *rr.attempt
+			attempt.Stream = false
+			now := time.Now()
+			putResearchJob(&ResearchJob{ID: rr.jobID, Status: JobPending, Attempt: &attempt, CreatedAt: now, UpdatedAt: now})
+			logger.Info(fmt.Sprintf("Handing off deep research request as job %s", rr.jobID))
+		} else {
+			logger.Info("Cutting deep research request at drain timeout")
+		}
+		rr.cancel()
+	}
+	if err := saveResearchJobs(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to save research jobs: %v", err))
+	}
+	// 等待处理函数写出任务通知
+	timeout := time.After(5 * time.Second)
+	for _, rr := range pending {
+		select {
+		case <-rr.done:
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// waitResearch 等待所有深度研究请求结束，超时返回 false
+func waitResearch(ctx context.Context) bool {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		researchRequestsMutex.Lock()
+		remaining := len(researchRequests)
+		researchRequestsMutex.Unlock()
+		if remaining == 0 {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func putResearchJob(job *ResearchJob) {
+	researchJobsMutex.Lock()
+	defer researchJobsMutex.Unlock()
+	researchJobs[job.ID] = job
+}
+
+// loadResearchJobs 从任务文件读取任务
+func loadResearchJobs() error {
+	data, err := os.ReadFile(config.ConfigInstance.ResearchJobsFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var jobs []*ResearchJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return fmt.Errorf("parse %s: %w", config.ConfigInstance.ResearchJobsFile, err)
+	}
+	researchJobsMutex.Lock()
+	defer researchJobsMutex.Unlock()
+	for _, job := range jobs {
+		researchJobs[job.ID] = job
+	}
+	return nil
+}
+
+// saveResearchJobs 将任务写入任务文件，并清理过期的已结束任务
+func saveResearchJobs() error {
+	researchJobsMutex.Lock()
+	jobs := make([]*ResearchJob, 0, len(researchJobs))
+	for id, job := range researchJobs {
+		finished := job.Status == JobCompleted || job.Status == JobFailed
+		if finished && time.Since(job.UpdatedAt) > researchJobRetention {
+			delete(researchJobs, id)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	data, err := json.MarshalIndent(jobs, "", "  ")
+	researchJobsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		if err := os.Remove(config.ConfigInstance.ResearchJobsFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(config.ConfigInstance.ResearchJobsFile, data, 0644)
+}
+
+// ResumeResearchJobs loads the jobs handed off by a previous instance and
+// completes the pending ones in the background, one at a time.
+func ResumeResearchJobs() {
+	if err := loadResearchJobs(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to load research jobs: %v", err))
+		return
+	}
+	researchJobsMutex.Lock()
+	var pending []*ResearchJob
+	for _, job := range researchJobs {
+		// 上个实例运行中被中断的任务重新执行
+		if job.Status == JobPending || job.Status == JobRunning {
+			pending = append(pending, job)
+		}
+	}
+	researchJobsMutex.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	logger.Info(fmt.Sprintf("Resuming %d research jobs", len(pending)))
+	go func() {
+		for _, job := range pending {
+			runResearchJob(job)
+		}
+	}()
+}
+
+// runResearchJob 在没有客户端连接的情况下执行任务并记录非流式结果
+func runResearchJob(job *ResearchJob) {
+	if job.Attempt == nil {
+		setJobStatus(job, JobFailed, nil, "job has no request")
+		return
+	}
+	setJobStatus(job, JobRunning, nil, "")
+	recorder := httptest.NewRecorder()
+	gc, _ := gin.CreateTestContext(recorder)
+	gc.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	gc.Request = gc.Request.WithContext(logger.ContextWithRequestID(gc.Request.Context(), "job-"+job.ID))
+	err := job.Attempt.sendWithRetry(gc)
+	if err == nil && recorder.Code == http.StatusOK {
+		logger.Info(fmt.Sprintf("Research job %s completed", job.ID))
+		setJobStatus(job, JobCompleted, recorder.Body.Bytes(), "")
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("unexpected status code: %d", recorder.Code)
+	}
+	logger.Error(fmt.Sprintf("Research job %s failed: %v", job.ID, err))
+	setJobStatus(job, JobFailed, nil, err.Error())
+}
+
+func setJobStatus(job *ResearchJob, status string, result []byte, errMsg string) {
+	researchJobsMutex.Lock()
+	job.Status = status
+	job.Result = result
+	job.Error = errMsg
+	job.UpdatedAt = time.Now()
+	if status == JobCompleted || status == JobFailed {
+		// 任务结束后不再需要保留请求内容
+		job.Attempt = nil
+	}
+	researchJobsMutex.Unlock()
+	if err := saveResearchJobs(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to save research jobs: %v", err))
+	}
+}
+
+// ResearchJobHandler returns the state of a handed off deep research job
+func ResearchJobHandler(c *gin.Context) {
+	researchJobsMutex.Lock()
+	job, ok := researchJobs[c.Param("id")]
+	var resp gin.H
+	if ok {
+		resp = gin.H{"id": job.ID, "status": job.Status, "created_at": job.CreatedAt, "updated_at": job.UpdatedAt}
+		if job.Result != nil {
+			resp["result"] = job.Result
+		}
+		if job.Error != "" {
+			resp["error"] = job.Error
+		}
+	}
+	researchJobsMutex.Unlock()
+	if !ok {
+		respondError(c, http.StatusNotFound, "", "Research job not found")
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
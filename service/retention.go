@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/logger"
+	"sync"
+	"time"
+)
+
+// threadDeletions holds the pending deletions of upstream threads, keyed by
+// the thread's context id so a follow-up restarts the countdown.
+type threadDeletions struct {
+	mutex  sync.Mutex
+	timers map[string]*time.Timer
+}
+
+var deletions = &threadDeletions{timers: map[string]*time.Timer{}}
+
+// resolveRetention 按请求、key 默认值、THREAD_RETENTION 的顺序决定会话保留方式
+func resolveRetention(r *chatRequest) error {
+	r.Retention = config.ConfigInstance.ThreadRetention
+	for _, value := range []string{r.APIKey.Defaults.ThreadRetention, r.Body.ThreadRetention} {
+		if value == "" {
+			continue
+		}
+		retention, err := config.ParseThreadRetention(value)
+		if err != nil {
+			return abortWith(http.StatusBadRequest, "Invalid thread_retention: %v", err)
+		}
+		r.Retention = retention
+	}
+	return nil
+}
+
+// retainThread applies the retention to the thread an answer was written
+// in: it is deleted now, after the retention, or kept.
+func retainThread(client *core.Client, ref *threadRef, retention time.Duration) {
+	if client == nil || ref == nil || ref.Thread.BackendUUID == "" {
+		return
+	}
+	key := ref.Thread.ContextUUID
+	deletions.mutex.Lock()
+	defer deletions.mutex.Unlock()
+	if timer, ok := deletions.timers[key]; ok {
+		timer.Stop()
+		delete(deletions.timers, key)
+	}
+	switch {
+	case retention < 0:
+		return
+	case retention == 0:
+		go deleteThread(client, ref.Thread)
+	default:
+		thread := ref.Thread
+		deletions.timers[key] = time.AfterFunc(retention, func() {
+			deletions.mutex.Lock()
+			delete(deletions.timers, key)
+			deletions.mutex.Unlock()
+			deleteThread(client, thread)
+		})
+	}
+}
+
+// deleteThread 删除上游会话，并使指向它的会话映射失效
+func deleteThread(client *core.Client, thread core.Thread) {
+	threads.Forget(thread.ContextUUID)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := client.DeleteThread(ctx, thread); err != nil {
+		logger.WithRequestID(client.RequestID).Error(fmt.Sprintf("Failed to delete thread %s: %v", thread.BackendUUID, err))
+		return
+	}
+	logger.WithRequestID(client.RequestID).Info(fmt.Sprintf("Deleted thread %s", thread.BackendUUID))
+}
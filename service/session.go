@@ -0,0 +1,280 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/job"
+	"pplx2api/logger"
+	"pplx2api/notify"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SessionCalendar is the per-session availability history of the last 24h
+type SessionCalendar struct {
+	Index   int                    `json:"index"`
+	Session string                 `json:"session"`
+	Buckets []config.SessionBucket `json:"buckets"`
+}
+
+// maskSessionKey 只保留 session key 的首尾几位，避免泄露完整 cookie。
+// 所有 cookie 的开头都相同，结尾用于区分账号
+func maskSessionKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:4] + "****" + key[len(key)-4:]
+}
+
+// SessionCalendarHandler returns per-session availability buckets for the
+// last 24h. The bucket size defaults to 1h and can be set with ?bucket=15m.
+func SessionCalendarHandler(c *gin.Context) {
+	bucket := time.Hour
+	if raw := c.Query("bucket"); raw != "" {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < config.HistorySlot || d > config.HistoryWindow {
+			respondError(c, http.StatusBadRequest, "", fmt.Sprintf("Invalid bucket: must be a duration between %v and %v", config.HistorySlot, config.HistoryWindow))
+			return
+		}
+		bucket = d
+	}
+
+	config.ConfigInstance.RwMutex.RLock()
+	sessions := make([]config.SessionInfo, len(config.ConfigInstance.Sessions))
+	copy(sessions, config.ConfigInstance.Sessions)
+	config.ConfigInstance.RwMutex.RUnlock()
+
+	now := time.Now()
+	calendars := make([]SessionCalendar, 0, len(sessions))
+	for i, session := range sessions {
+		calendars = append(calendars, SessionCalendar{
+			Index:   i,
+			Session: maskSessionKey(session.SessionKey),
+			Buckets: config.SessionStateAt(i).Buckets(now, bucket),
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"bucket_seconds": int(bucket.Truncate(config.HistorySlot).Seconds()),
+		"window_start":   now.Truncate(config.HistorySlot).Add(config.HistorySlot - config.HistoryWindow),
+		"sessions":       calendars,
+	})
+}
+
+// SessionSummary describes one configured session for the admin API
+type SessionSummary struct {
+	Index            int        `json:"index"`
+	Session          string     `json:"session"`
+	Archived         bool       `json:"archived"`
+	Available        bool       `json:"available"`
+	RateLimitedUntil *time.Time `json:"rate_limited_until,omitempty"`
+	// FamilyCooldowns 单独冷却中的模型类别及其结束时间
+	FamilyCooldowns map[string]time.Time `json:"family_cooldowns,omitempty"`
+	// LearnedCooldowns 开启 ADAPTIVE_COOLDOWN 时各模型类别学习到的冷却秒数
+	LearnedCooldowns map[string]int `json:"learned_cooldowns,omitempty"`
+	// DisabledReason 因认证失败被自动停用的原因
+	DisabledReason string `json:"disabled_reason,omitempty"`
+	// Stalls 最近24小时内流式响应中途停滞的次数
+	Stalls int `json:"stalls"`
+	// Tier 检测到的订阅等级，未检测时为空
+	Tier string `json:"tier,omitempty"`
+	// Labels 账号标签
+	Labels map[string]string `json:"labels,omitempty"`
+	// BudgetExceeded 用完的用量预算，BudgetResetsAt 为其重置时间
+	BudgetExceeded string     `json:"budget_exceeded,omitempty"`
+	BudgetResetsAt *time.Time `json:"budget_resets_at,omitempty"`
+	// ChallengedUntil 经过固定代理遇到 Cloudflare 验证后暂停使用到的时间
+	ChallengedUntil *time.Time `json:"challenged_until,omitempty"`
+	// HeaderProfile 账号发送的请求头 profile
+	HeaderProfile string `json:"header_profile,omitempty"`
+}
+
+// SessionsHandler lists all sessions including archived ones
+func SessionsHandler(c *gin.Context) {
+	config.ConfigInstance.RwMutex.RLock()
+	sessions := make([]config.SessionInfo, len(config.ConfigInstance.Sessions))
+	copy(sessions, config.ConfigInstance.Sessions)
+	config.ConfigInstance.RwMutex.RUnlock()
+
+	summaries := make([]SessionSummary, 0, len(sessions))
+	for i, session := range sessions {
+		state := config.SessionStateAt(i)
+		summary := SessionSummary{
+			Index:          i,
+			Session:        maskSessionKey(session.SessionKey),
+			Archived:       session.Archived,
+			Available:      !session.Archived && state.IsAvailable(),
+			Stalls:         state.Stalls(),
+			DisabledReason: session.DisabledReason,
+			Tier:           state.Tier(),
+			Labels:         session.Labels,
+		}
+		if proxy, fixed := config.ConfigInstance.FixedProxyFor(session); fixed {
+			if until := state.ChallengedUntil(proxy); !until.IsZero() {
+				summary.Available = false
+				summary.ChallengedUntil = &until
+			}
+		}
+		if profile, ok := config.ConfigInstance.HeaderProfileFor(session); ok {
+			summary.HeaderProfile = profile.Name
+		}
+		if exceeded, resets := overBudget(session); exceeded != "" {
+			summary.Available = false
+			summary.BudgetExceeded, summary.BudgetResetsAt = exceeded, &resets
+		}
+		if until := state.RateLimitedUntil(); until.After(time.Now()) {
+			summary.RateLimitedUntil = &until
+		}
+		if families := state.FamilyCooldowns(); len(families) > 0 {
+			summary.FamilyCooldowns = families
+		}
+		for family, d := range state.LearnedCooldowns() {
+			if summary.LearnedCooldowns == nil {
+				summary.LearnedCooldowns = map[string]int{}
+			}
+			summary.LearnedCooldowns[family] = int(d.Seconds())
+		}
+		summaries = append(summaries, summary)
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": summaries, "circuit_breaker": core.Breaker()})
+}
+
+// maxCookieExportSize 上传的 cookie 导出文件的大小上限
+const maxCookieExportSize = 1 << 20
+
+// ImportCookiesHandler adds the Perplexity sessions found in a browser
+// cookie export sent as the body, a Netscape cookies.txt or a JSON export.
+// Sessions already configured are left alone.
+func ImportCookiesHandler(c *gin.Context) {
+	data, err := io.ReadAll(io.LimitReader(c.Request.Body, maxCookieExportSize+1))
+	if err == nil && len(data) > maxCookieExportSize {
+		err = fmt.Errorf("export is larger than %d KB", maxCookieExportSize>>10)
+	}
+	var keys []string
+	if err == nil {
+		keys, err = config.ParseCookieExport(data)
+	}
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "", fmt.Sprintf("Invalid cookie export: %v", err))
+		return
+	}
+	added := config.ConfigInstance.AddSessions(keys)
+	sessions := make([]gin.H, 0, len(added))
+	for _, idx := range added {
+		session, _ := config.ConfigInstance.GetSessionForModel(idx)
+		sessions = append(sessions, gin.H{"index": idx, "session": maskSessionKey(session.SessionKey)})
+	}
+	if len(added) > 0 {
+		if err := job.SaveSessions(); err != nil {
+			logger.Error(fmt.Sprintf("Failed to persist sessions: %v", err))
+		}
+	}
+	logger.Info(fmt.Sprintf("Imported %d of %d sessions from a cookie export", len(added), len(keys)))
+	c.JSON(http.StatusOK, gin.H{"found": len(keys), "added": sessions})
+}
+
+// ArchiveSessionHandler takes a session out of rotation without deleting it
+func ArchiveSessionHandler(c *gin.Context) {
+	setSessionArchived(c, true)
+}
+
+// ReactivateSessionHandler puts an archived session back into rotation
+func ReactivateSessionHandler(c *gin.Context) {
+	setSessionArchived(c, false)
+}
+
+func setSessionArchived(c *gin.Context, archived bool) {
+	idx, err := strconv.Atoi(c.Param("index"))
+	if err == nil {
+		err = config.ConfigInstance.SetSessionArchived(idx, archived)
+	}
+	if err != nil {
+		respondError(c, http.StatusNotFound, "", fmt.Sprintf("Session not found: %s", c.Param("index")))
+		return
+	}
+	if !archived {
+		config.SessionStateAt(idx).ResetAuthFailures()
+	}
+	if err := job.SaveSessions(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to persist sessions: %v", err))
+	}
+	logger.Info(fmt.Sprintf("Session %d archived: %t", idx, archived))
+	c.JSON(http.StatusOK, gin.H{
+		"index":    idx,
+		"archived": archived,
+	})
+}
+
+// quarantineOnAuthFailure 账号连续认证失败达到 AUTH_FAILURE_THRESHOLD 时将其归档，
+// 不再参与轮询，直到管理员重新启用。账号按标识 key 查找，index 只用于日志
+func quarantineOnAuthFailure(index int, key string, failures int, authErr *core.AuthError) {
+	threshold := config.ConfigInstance.AuthFailureThreshold
+	if threshold <= 0 || failures < threshold {
+		logger.Info(fmt.Sprintf("Session %d rejected with status %d (%d consecutive)", index, authErr.Status, failures))
+		return
+	}
+	reason := fmt.Sprintf("%d consecutive authentication failures (status %d)", failures, authErr.Status)
+	// 按标识查找，请求期间热重载调整了顺序时仍归档出错的账号
+	index, ok := config.ConfigInstance.QuarantineSessionKey(key, reason)
+	if !ok {
+		return
+	}
+	logger.Error(fmt.Sprintf("Session %d disabled after %s, re-enable it with POST /admin/sessions/%d/reactivate", index, reason, index))
+	if err := job.SaveSessions(); err != nil {
+		logger.Error(fmt.Sprintf("Failed to persist sessions: %v", err))
+	}
+	notify.Send(notify.Event{
+		Event:   notify.SessionQuarantined,
+		Message: fmt.Sprintf("Session %d was disabled after %s", index, reason),
+		Data:    map[string]interface{}{"session": index, "status": authErr.Status, "failures": failures},
+	})
+	notifyExhausted()
+}
+
+// notifyRateLimited 账号或其某一模型类别进入冷却时发送告警
+func notifyRateLimited(index int, family string, cooldown time.Duration) {
+	until := time.Now().Add(cooldown)
+	notify.Send(notify.Event{
+		Event:   notify.SessionRateLimited,
+		Message: fmt.Sprintf("Session %d was rate limited for %s models, cooling down until %s", index, family, until.Format(time.RFC3339)),
+		Data:    map[string]interface{}{"session": index, "family": family, "rate_limited_until": until},
+	})
+	notifyExhausted()
+}
+
+// nextSessionAvailable 返回最早结束冷却的未归档账号的可用时间，没有时返回零值
+func nextSessionAvailable() time.Time {
+	config.ConfigInstance.RwMutex.RLock()
+	sessions := make([]config.SessionInfo, len(config.ConfigInstance.Sessions))
+	copy(sessions, config.ConfigInstance.Sessions)
+	config.ConfigInstance.RwMutex.RUnlock()
+
+	var next time.Time
+	for i, session := range sessions {
+		if session.Archived {
+			continue
+		}
+		until := config.SessionStateAt(i).RateLimitedUntil()
+		if next.IsZero() || until.Before(next) {
+			next = until
+		}
+	}
+	return next
+}
+
+// notifyExhausted 没有可用账号时发送 sessions.exhausted 告警
+func notifyExhausted() {
+	counts := countSessions()
+	if counts.Available > 0 {
+		return
+	}
+	notify.Send(notify.Event{
+		Event:   notify.SessionsExhausted,
+		Message: fmt.Sprintf("No session is available: %d rate limited, %d dead of %d", counts.RateLimited, counts.Dead, counts.Total),
+		Data:    map[string]interface{}{"rate_limited": counts.RateLimited, "dead": counts.Dead, "total": counts.Total},
+	})
+}
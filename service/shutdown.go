@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"pplx2api/logger"
+	"pplx2api/model"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// inflightRequest is a chat completion that shutdown can end early
+type inflightRequest struct {
+	c         *gin.Context
+	interrupt chan struct{}
+	once      sync.Once
+}
+
+var (
+	inflightRequests      = map[*inflightRequest]struct{}{}
+	inflightRequestsMutex sync.Mutex
+	inflightDone          = make(chan struct{}, 1)
+)
+
+// trackRequest registers an upstream request so InterruptRequests can end
+// it with a proper finish chunk. The returned function unregisters it.
+func trackRequest(c *gin.Context) func() {
+	ir := &inflightRequest{c: c, interrupt: make(chan struct{})}
+	model.SetInterrupt(c, ir.interrupt)
+	inflightRequestsMutex.Lock()
+	inflightRequests[ir] = struct{}{}
+	inflightRequestsMutex.Unlock()
+	return func() {
+		inflightRequestsMutex.Lock()
+		delete(inflightRequests, ir)
+		empty := len(inflightRequests) == 0
+		inflightRequestsMutex.Unlock()
+		if empty {
+			select {
+			case inflightDone <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// InterruptRequests ends the in-flight completions that aren't deep
+// research: streams get a notice, finish_reason length and their end
+// marker instead of being cut mid-sentence. It waits until they have
+// finished writing or ctx is done, reporting whether all finished.
+func InterruptRequests(ctx context.Context) bool {
+	inflightRequestsMutex.Lock()
+	n := 0
+	for ir := range inflightRequests {
+		// 深度研究请求由 DrainResearch 处理
+		if researchFrom(ir.c) != nil {
+			continue
+		}
+		ir.once.Do(func() { close(ir.interrupt) })
+		n++
+	}
+	inflightRequestsMutex.Unlock()
+	if n == 0 {
+		return true
+	}
+	logger.Info(fmt.Sprintf("Ending %d in-flight requests for shutdown", n))
+	for {
+		inflightRequestsMutex.Lock()
+		remaining := 0
+		for ir := range inflightRequests {
+			if researchFrom(ir.c) == nil {
+				remaining++
+			}
+		}
+		inflightRequestsMutex.Unlock()
+		if remaining == 0 {
+			return true
+		}
+		select {
+		case <-inflightDone:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
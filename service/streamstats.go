@@ -0,0 +1,106 @@
+package service
+
+import (
+	"fmt"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"pplx2api/model"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// streamStats measures the throughput of one streamed attempt and counts
+// stalls, i.e. gaps between deltas longer than STREAM_STALL_THRESHOLD once
+// output has started. A slow model streams steadily at a low rate; a stall
+// is output stopping mid-stream.
+type streamStats struct {
+	log       logger.Entry
+	threshold time.Duration
+
+	mutex      sync.Mutex
+	start      time.Time
+	first      time.Time
+	last       time.Time
+	words      int
+	deltas     int
+	stalls     int
+	longestGap time.Duration
+}
+
+// startStreamStats attaches stream statistics to c
+func startStreamStats(c *gin.Context) *streamStats {
+	stats := &streamStats{
+		log:       requestLog(c),
+		threshold: config.ConfigInstance.StreamStallThreshold,
+		start:     time.Now(),
+	}
+	model.SetStreamObserver(c, stats)
+	return stats
+}
+
+func (s *streamStats) OnDelta(text string) {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.deltas == 0 {
+		s.first = now
+	} else {
+		gap := now.Sub(s.last)
+		if gap > s.longestGap {
+			s.longestGap = gap
+		}
+		if gap > s.threshold {
+			s.stalls++
+			s.log.Warn(fmt.Sprintf("Stream stalled for %v mid-stream", gap.Round(time.Millisecond)))
+		}
+	}
+	s.last = now
+	s.deltas++
+	s.words += countWords(text)
+}
+
+// countWords 按空白分词，中日韩文字按字计数
+func countWords(text string) int {
+	words := 0
+	for _, field := range strings.Fields(text) {
+		if utf8.RuneCountInString(field) > 1 && isCJKText(field) {
+			words += utf8.RuneCountInString(field)
+		} else {
+			words++
+		}
+	}
+	return words
+}
+
+func isCJKText(text string) bool {
+	r, _ := utf8.DecodeRuneInString(text)
+	return r >= 0x2E80
+}
+
+// finish logs the throughput of the stream and returns its stall count
+func (s *streamStats) finish() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.deltas == 0 {
+		return 0
+	}
+	duration := s.last.Sub(s.first)
+	wps := 0.0
+	if duration > 0 {
+		wps = float64(s.words) / duration.Seconds()
+	}
+	kind := "normal"
+	switch {
+	case s.stalls > 0:
+		kind = "stalled"
+	case s.deltas > 1 && wps < config.ConfigInstance.StreamSlowWPS:
+		kind = "slow"
+	}
+	s.log.Info(fmt.Sprintf("Stream %s: %d words in %v (%.1f words/s), first delta after %v, %d stalls, longest gap %v",
+		kind, s.words, duration.Round(time.Millisecond), wps, s.first.Sub(s.start).Round(time.Millisecond), s.stalls, s.longestGap.Round(time.Millisecond)))
+	return s.stalls
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"pplx2api/config"
+	"pplx2api/core"
+	"sync"
+	"time"
+)
+
+// threadRef is a Perplexity thread a conversation can be continued in.
+// Follow-ups only work on the account that owns the thread.
+type threadRef struct {
+	SessionKey string
+	Thread     core.Thread
+	updated    time.Time
+}
+
+// chatTurn is the prompt and attachments of only the newest message,
+// sent instead of the whole history when a thread is continued.
+type chatTurn struct {
+	Prompt string
+	Images []core.ImageData
+	Files  []core.FileData
+}
+
+// threadStore 将客户端会话映射到 Perplexity 会话，仅保存在内存中
+type threadStore struct {
+	mutex   sync.Mutex
+	threads map[string]*threadRef
+}
+
+var threads = &threadStore{threads: map[string]*threadRef{}}
+
+// Get returns the thread stored under key, dropping expired threads
+func (s *threadStore) Get(key string) *threadRef {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	for k, t := range s.threads {
+		if now.Sub(t.updated) > config.ConfigInstance.ThreadTTL {
+			delete(s.threads, k)
+		}
+	}
+	return s.threads[key]
+}
+
+// Put stores the thread a conversation continues in
+func (s *threadStore) Put(key string, t *threadRef) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t.updated = time.Now()
+	s.threads[key] = t
+}
+
+// Forget drops the conversations continued in the thread with contextUUID
+func (s *threadStore) Forget(contextUUID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k, t := range s.threads {
+		if t.Thread.ContextUUID == contextUUID {
+			delete(s.threads, k)
+		}
+	}
+}
+
+// conversationKey identifies a conversation by its explicit id, or by the
+// digest of its messages. Assistant replies are left out of the digest as
+// clients often reformat them when sending the history back.
+func conversationKey(keyName string, model string, conversationID string, messages []map[string]interface{}) string {
+	if conversationID != "" {
+		return keyName + "|id|" + conversationID
+	}
+	h := sha256.New()
+	h.Write([]byte(model))
+	for _, msg := range messages {
+		role, _ := msg["role"].(string)
+		h.Write([]byte{0})
+		h.Write([]byte(role))
+		if role == "assistant" {
+			continue
+		}
+		content, _ := json.Marshal(msg["content"])
+		h.Write(content)
+	}
+	return keyName + "|" + hex.EncodeToString(h.Sum(nil))
+}
+
+// routeThread 查找可以继续的会话，并记录本次回答的存储键
+func routeThread(r *chatRequest) {
+	msgs := r.Body.Messages
+	if !config.ConfigInstance.ThreadReuse || len(msgs) == 0 {
+		return
+	}
+	keyName := requestKey(r.c).Name
+	if last, _ := msgs[len(msgs)-1]["role"].(string); last != "user" {
+		return
+	}
+	if r.Body.ConversationID != "" {
+		r.ThreadKey = conversationKey(keyName, r.Model, r.Body.ConversationID, nil)
+		r.Thread = threads.Get(r.ThreadKey)
+		return
+	}
+	// 下一轮消息为本次消息加上助手回复
+	next := append(append([]map[string]interface{}{}, msgs...), map[string]interface{}{"role": "assistant"})
+	r.ThreadKey = conversationKey(keyName, r.Model, "", next)
+	if len(msgs) > 1 {
+		r.Thread = threads.Get(conversationKey(keyName, r.Model, "", msgs[:len(msgs)-1]))
+	}
+}
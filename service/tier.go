@@ -0,0 +1,157 @@
+package service
+
+import (
+	"fmt"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/logger"
+	"sync"
+	"time"
+)
+
+// tierRetry 检测订阅等级失败后再次尝试的间隔
+const tierRetry = 10 * time.Minute
+
+// How well a session's tier fits the model of an attempt
+const (
+	fitDenied = iota
+	// fitOverflow 只在没有更合适的可用账号时使用
+	fitOverflow
+	fitPreferred
+)
+
+var (
+	// upstreamTiers 上游模型配置中各模型所需的订阅等级
+	upstreamTiers      = map[string]string{}
+	upstreamTiersMutex sync.RWMutex
+)
+
+// setUpstreamTiers 记录上游模型列表中标注的订阅等级
+func setUpstreamTiers(list []core.UpstreamModel) {
+	tiers := make(map[string]string, len(list))
+	for _, m := range list {
+		if m.SubscriptionTier != "" {
+			tiers[m.ID] = m.SubscriptionTier
+		}
+	}
+	upstreamTiersMutex.Lock()
+	upstreamTiers = tiers
+	upstreamTiersMutex.Unlock()
+}
+
+// requiredTierOf returns the tier an upstream model needs, as advertised
+// upstream when known
+func requiredTierOf(id string) string {
+	upstreamTiersMutex.RLock()
+	tier, ok := upstreamTiers[id]
+	upstreamTiersMutex.RUnlock()
+	if ok {
+		return tier
+	}
+	return requiredTier(core.UpstreamModel{ID: id})
+}
+
+// detectTier 查询账号的订阅等级并记录在账号状态上
+func detectTier(index int, session config.SessionInfo) (string, error) {
+	client := core.NewSessionClient(session, "", false)
+	tier, err := client.GetSubscriptionTier()
+	if err != nil {
+		return "", err
+	}
+	config.SessionStateAt(index).SetTier(tier)
+	return tier, nil
+}
+
+// sessionRoute decides which sessions may serve an attempt. Only sessions
+// carrying the requested labels and within their budget are used. With TIER_ROUTING set, sessions whose tier doesn't allow the model are left
+// out, and sessions of a higher tier than a free model needs are kept for
+// paid models; in overflow mode both are used when nothing else is
+// available. Sessions of unknown tier are always used.
+type sessionRoute struct {
+	family   string
+	required string
+	// labels 账号必须带有的标签
+	labels map[string]string
+	// level 账号至少需要的匹配程度，0 表示不按等级分配
+	level int
+}
+
+// route returns the session route of the attempt's primary model
+func (a *chatAttempt) route() sessionRoute {
+	r := sessionRoute{family: a.family(), labels: a.Labels}
+	if config.ConfigInstance.TierRouting == "" || len(a.Models) == 0 {
+		return r
+	}
+	r.required = requiredTierOf(a.Models[0])
+	config.ConfigInstance.RwMutex.RLock()
+	sessions := make([]config.SessionInfo, len(config.ConfigInstance.Sessions))
+	copy(sessions, config.ConfigInstance.Sessions)
+	config.ConfigInstance.RwMutex.RUnlock()
+
+	best := fitDenied
+	for i, session := range sessions {
+		if session.Archived || !session.HasLabels(r.labels) {
+			continue
+		}
+		if exceeded, _ := overBudget(session); exceeded != "" {
+			continue
+		}
+		state := config.SessionStateAt(i)
+		if state.StartTierCheck(tierRetry) {
+			go func(index int, session config.SessionInfo) {
+				if _, err := detectTier(index, session); err != nil {
+					logger.Error(fmt.Sprintf("Failed to detect subscription tier of session %d: %v", index, err))
+				}
+			}(i, session)
+		}
+		if fit := r.fit(state.Tier()); fit > best && state.IsAvailableFor(r.family) {
+			best = fit
+		}
+	}
+	r.level = best
+	if best == fitDenied {
+		// 没有合适的可用账号，只选择最合适的账号，等待其冷却结束
+		r.level = fitPreferred
+	}
+	return r
+}
+
+// fit 返回订阅等级为 tier 的账号与所需等级的匹配程度
+func (r sessionRoute) fit(tier string) int {
+	switch {
+	case tier == "":
+		return fitPreferred
+	case !core.TierAllows(tier, r.required):
+		if config.ConfigInstance.TierRouting == config.TierRoutingOverflow {
+			return fitOverflow
+		}
+		return fitDenied
+	case r.required == core.TierFree && tier != core.TierFree:
+		return fitOverflow
+	}
+	return fitPreferred
+}
+
+// labelled reports whether the session at index carries the route's labels
+func (r sessionRoute) labelled(index int) bool {
+	if len(r.labels) == 0 {
+		return true
+	}
+	session, err := config.ConfigInstance.GetSessionForModel(index)
+	return err == nil && session.HasLabels(r.labels)
+}
+
+// fits reports whether the session at index may serve the attempt
+func (r sessionRoute) fits(index int) bool {
+	session, err := config.ConfigInstance.GetSessionForModel(index)
+	if err != nil || !session.HasLabels(r.labels) {
+		return false
+	}
+	if exceeded, _ := overBudget(session); exceeded != "" {
+		return false
+	}
+	if r.level == 0 {
+		return true
+	}
+	return r.fit(config.SessionStateAt(index).Tier()) >= r.level
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/tokenizer"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenizeRequest asks for the prompt token count of a chat or text request
+type TokenizeRequest struct {
+	Model    string                   `json:"model"`
+	Messages []map[string]interface{} `json:"messages,omitempty"`
+	// Prompt 文本补全的提示词，字符串或只含一个字符串的数组
+	Prompt     interface{} `json:"prompt,omitempty"`
+	InjectDate *bool       `json:"inject_date,omitempty"`
+}
+
+// TokenizeResponse is the estimated prompt token count
+type TokenizeResponse struct {
+	Object       string `json:"object"`
+	Model        string `json:"model"`
+	Tokenizer    string `json:"tokenizer"`
+	PromptTokens int    `json:"prompt_tokens"`
+	// Attachments 不计入 token 的图片与附件数
+	Attachments int `json:"attachments,omitempty"`
+}
+
+// TokenizeHandler estimates the prompt tokens of a request the way the
+// usage is metered: the messages are joined into the prompt sent upstream,
+// with the key's system prompt and the current date, and counted with the
+// model's tokenizer. Images and files aren't downloaded or counted.
+func TokenizeHandler(c *gin.Context) {
+	var req TokenizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, "", fmt.Sprintf("Invalid request: %v", err))
+		return
+	}
+	prompts, ok := stringList(req.Prompt)
+	if !ok || len(prompts) > 1 {
+		respondError(c, http.StatusBadRequest, "", "prompt must be a string")
+		return
+	}
+	if len(req.Messages) == 0 && len(prompts) == 0 {
+		respondError(c, http.StatusBadRequest, "", "messages or prompt is required")
+		return
+	}
+	requestModel, _, _ := strings.Cut(req.Model, "@")
+
+	messages := req.Messages
+	if len(prompts) == 1 {
+		messages = []map[string]interface{}{{"role": "user", "content": prompts[0]}}
+	}
+	d := requestKey(c).Defaults
+	if d.SystemPrompt != "" {
+		messages = withSystemPrompt(messages, d.SystemPrompt, d.SystemPromptMode)
+	}
+	msgs, attachments := textMessages(messages)
+	prompt, err := assemblePrompt(msgs)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, "", fmt.Sprintf("Failed to render prompt template: %v", err))
+		return
+	}
+	if req.InjectDate == nil {
+		req.InjectDate = d.InjectDate
+	}
+	if config.ConfigInstance.DateInjection && (req.InjectDate == nil || *req.InjectDate) {
+		timezone := config.ConfigInstance.Timezone
+		if d.Timezone != "" {
+			timezone = d.Timezone
+		}
+		prompt = dateContext(timezone, time.Now()) + prompt
+	}
+	t := tokenizer.ForModel(requestModel)
+	c.JSON(http.StatusOK, TokenizeResponse{
+		Object:       "tokenize",
+		Model:        requestModel,
+		Tokenizer:    t.Name(),
+		PromptTokens: t.Count(prompt),
+		Attachments:  attachments,
+	})
+}
+
+// textMessages 只取出消息中的文本，返回其余的图片与附件数
+func textMessages(messages []map[string]interface{}) ([]promptMessage, int) {
+	var msgs []promptMessage
+	attachments := 0
+	for _, msg := range messages {
+		role, ok := msg["role"].(string)
+		if !ok {
+			continue
+		}
+		pm := promptMessage{Role: role}
+		if name, ok := msg["name"].(string); ok {
+			pm.Name = name
+		}
+		switch v := msg["content"].(type) {
+		case string:
+			pm.Texts = append(pm.Texts, v)
+		case []interface{}:
+			for _, item := range v {
+				part, _ := item.(map[string]interface{})
+				switch part["type"] {
+				case "text":
+					if text, ok := part["text"].(string); ok {
+						pm.Texts = append(pm.Texts, text)
+					}
+				case "image_url", "file":
+					attachments++
+				}
+			}
+		default:
+			continue
+		}
+		msgs = append(msgs, pm)
+	}
+	return msgs, attachments
+}
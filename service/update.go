@@ -0,0 +1,39 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"pplx2api/update"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UpdateStatusHandler returns the running version and the result of the last update check
+func UpdateStatusHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, update.Current())
+}
+
+// UpdateCheckHandler checks for a new release now
+func UpdateCheckHandler(c *gin.Context) {
+	status := update.Check(c.Request.Context())
+	if status.Error != "" {
+		c.JSON(http.StatusBadGateway, status)
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+// UpdateApplyHandler installs the latest release after verifying its
+// signature; the proxy must be restarted to run it.
+func UpdateApplyHandler(c *gin.Context) {
+	version, err := update.Apply(c.Request.Context())
+	if err != nil {
+		status := http.StatusBadRequest
+		if !errors.Is(err, update.ErrNoUpdate) {
+			status = http.StatusInternalServerError
+		}
+		respondError(c, status, "", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"installed": version, "restart_required": true})
+}
@@ -0,0 +1,175 @@
+package service
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"pplx2api/usage"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userSessionLabel 自带账号请求在用量统计中的 session 名称
+const userSessionLabel = "user"
+
+// apiKeyLabel 返回请求所用 API key 的名称，用于用量统计
+func apiKeyLabel(c *gin.Context) string {
+	return requestKey(c).Name
+}
+
+// UsageHandler returns the estimated token usage accumulated per API key
+// and per session, or only the usage of a time window when ?window=,
+// ?since= or ?until= is set
+func UsageHandler(c *gin.Context) {
+	since, until, windowed, err := usageWindow(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	if !windowed {
+		c.JSON(http.StatusOK, usage.Snapshot())
+		return
+	}
+	report := usage.Window(since, until)
+	c.JSON(http.StatusOK, gin.H{"since": since, "until": until, "keys": report.Keys, "sessions": report.Sessions})
+}
+
+// UsageKeysHandler returns the usage per API key, see UsageHandler
+func UsageKeysHandler(c *gin.Context) {
+	usageScopeHandler(c, usage.ScopeKeys)
+}
+
+// UsageSessionsHandler returns the usage per session, see UsageHandler
+func UsageSessionsHandler(c *gin.Context) {
+	usageScopeHandler(c, usage.ScopeSessions)
+}
+
+func usageScopeHandler(c *gin.Context, scope string) {
+	since, until, windowed, err := usageWindow(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	var report usage.Report
+	if windowed {
+		report = usage.Window(since, until)
+	} else {
+		report = usage.Snapshot()
+	}
+	totals := report.Keys
+	if scope == usage.ScopeSessions {
+		totals = report.Sessions
+	}
+	body := gin.H{scope: totals}
+	if windowed {
+		body["since"], body["until"] = since, until
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// UsageExportHandler exports the usage as CSV, one row per period, scope
+// and name. The window defaults to the last 30 days and ?group= sets the
+// period: hour, day (default) or none.
+func UsageExportHandler(c *gin.Context) {
+	since, until, windowed, err := usageWindow(c)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, "", err.Error())
+		return
+	}
+	if !windowed {
+		until = time.Now()
+		since = until.Add(-30 * 24 * time.Hour)
+	}
+	var length time.Duration
+	switch c.DefaultQuery("group", "day") {
+	case "hour":
+		length = time.Hour
+	case "day":
+		length = 24 * time.Hour
+	case "none":
+	default:
+		respondError(c, http.StatusBadRequest, "", "Invalid group: use hour, day or none")
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=usage-%s-%s.csv", since.UTC().Format("20060102"), until.UTC().Format("20060102")))
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"period_start", "scope", "name", "requests", "errors", "prompt_tokens", "completion_tokens", "total_tokens"})
+	for _, p := range usage.Periods(since, until, length) {
+		for _, scope := range []string{usage.ScopeKeys, usage.ScopeSessions} {
+			totals := p.Keys
+			if scope == usage.ScopeSessions {
+				totals = p.Sessions
+			}
+			names := make([]string, 0, len(totals))
+			for name := range totals {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				t := totals[name]
+				w.Write([]string{
+					p.Start.UTC().Format(time.RFC3339), scope, name,
+					strconv.Itoa(t.Requests), strconv.Itoa(t.Errors),
+					strconv.Itoa(t.PromptTokens), strconv.Itoa(t.CompletionTokens), strconv.Itoa(t.TotalTokens),
+				})
+			}
+		}
+	}
+	w.Flush()
+}
+
+// usageWindow 解析 window（如 24h、7d）或 since/until（RFC3339 或 2006-01-02）查询参数，
+// 都未设置时 windowed 为 false
+func usageWindow(c *gin.Context) (since time.Time, until time.Time, windowed bool, err error) {
+	until = time.Now()
+	if raw := c.Query("until"); raw != "" {
+		if until, err = parseUsageTime(raw); err != nil {
+			return since, until, false, fmt.Errorf("Invalid until: %s", raw)
+		}
+		windowed = true
+	}
+	if raw := c.Query("since"); raw != "" {
+		if since, err = parseUsageTime(raw); err != nil {
+			return since, until, false, fmt.Errorf("Invalid since: %s", raw)
+		}
+		windowed = true
+	} else if raw := c.Query("window"); raw != "" {
+		d, err := parseUsageDuration(raw)
+		if err != nil || d <= 0 {
+			return since, until, false, fmt.Errorf("Invalid window: %s, use a duration such as 24h or 7d", raw)
+		}
+		since = until.Add(-d)
+		windowed = true
+	} else if windowed {
+		since = until.Add(-usage.HistoryRetention)
+	}
+	if windowed && !since.Before(until) {
+		return since, until, false, fmt.Errorf("Invalid window: since must be before until")
+	}
+	return since, until, windowed, nil
+}
+
+func parseUsageTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+// parseUsageDuration 在 time.ParseDuration 的基础上支持天数，如 7d
+func parseUsageDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
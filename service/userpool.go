@@ -0,0 +1,55 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"pplx2api/config"
+	"pplx2api/core"
+	"sync"
+	"time"
+)
+
+// userSession is the cached per-user state of bring-your-own-session mode.
+// It is never persisted and never joins the shared session pool.
+type userSession struct {
+	client   *core.Client
+	state    *config.SessionState
+	lastUsed time.Time
+}
+
+// userPool 以 cookie 哈希为键缓存用户的连接与限流状态
+type userPool struct {
+	mutex    sync.Mutex
+	sessions map[string]*userSession
+}
+
+var userSessions = &userPool{sessions: map[string]*userSession{}}
+
+func hashSessionKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the cached entry for a user cookie, creating it if needed.
+// Entries idle for longer than UserSessionTTL are dropped.
+func (p *userPool) Get(sessionKey string) *userSession {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for hash, s := range p.sessions {
+		if now.Sub(s.lastUsed) > config.ConfigInstance.UserSessionTTL {
+			delete(p.sessions, hash)
+		}
+	}
+	hash := hashSessionKey(sessionKey)
+	s, ok := p.sessions[hash]
+	if !ok {
+		s = &userSession{
+			client: core.NewClient(sessionKey, config.ConfigInstance.Proxy, "", false),
+			state:  &config.SessionState{},
+		}
+		p.sessions[hash] = s
+	}
+	s.lastUsed = now
+	return s
+}
@@ -0,0 +1,122 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"pplx2api/config"
+	"pplx2api/core"
+	"pplx2api/job"
+	"pplx2api/logger"
+	"pplx2api/notify"
+	"time"
+)
+
+// Session check results of the startup validation
+const (
+	CheckOK          = "ok"
+	CheckInvalid     = "invalid"
+	CheckUnreachable = "unreachable"
+)
+
+// warmupTimeout 启动检查等待所有账号返回的最长时间
+const warmupTimeout = 30 * time.Second
+
+// SessionCheck is the startup validation result of one session
+type SessionCheck struct {
+	Index  int
+	Status string
+	Tier   string
+	Err    error
+}
+
+// ValidateSessions checks every active session in parallel before the
+// server starts, with VALIDATE_SESSIONS. Sessions upstream rejects are
+// archived like after repeated authentication failures; sessions that
+// couldn't be reached, e.g. through a broken proxy, stay in rotation but
+// don't count as usable. With fewer than MIN_USABLE_SESSIONS usable it
+// returns an error under VALIDATE_SESSIONS_STRICT and otherwise starts
+// degraded with an error logged.
+func ValidateSessions() error {
+	cfg := config.ConfigInstance
+	if !cfg.ValidateSessions {
+		return nil
+	}
+	cfg.RwMutex.RLock()
+	sessions := make([]config.SessionInfo, len(cfg.Sessions))
+	copy(sessions, cfg.Sessions)
+	cfg.RwMutex.RUnlock()
+
+	results := make(chan SessionCheck, len(sessions))
+	pending := 0
+	for i, session := range sessions {
+		if session.Archived {
+			continue
+		}
+		pending++
+		go func(index int, session config.SessionInfo) {
+			results <- checkSession(index, session)
+		}(i, session)
+	}
+	logger.Info(fmt.Sprintf("Validating %d sessions", pending))
+
+	usable, invalid := 0, 0
+	timeout := time.After(warmupTimeout)
+	for ; pending > 0; pending-- {
+		var check SessionCheck
+		select {
+		case check = <-results:
+		case <-timeout:
+			logger.Error(fmt.Sprintf("%d sessions didn't answer within %v", pending, warmupTimeout))
+			pending = 0
+			continue
+		}
+		switch check.Status {
+		case CheckOK:
+			usable++
+			config.SessionStateAt(check.Index).SetTier(check.Tier)
+			logger.Info(fmt.Sprintf("Session %d is valid (%s)", check.Index, check.Tier))
+		case CheckInvalid:
+			invalid++
+			reason := fmt.Sprintf("rejected at startup validation: %v", check.Err)
+			if cfg.QuarantineSession(check.Index, reason) {
+				logger.Error(fmt.Sprintf("Session %d disabled, %s", check.Index, reason))
+				notify.Send(notify.Event{
+					Event:   notify.SessionQuarantined,
+					Message: fmt.Sprintf("Session %d was disabled, %s", check.Index, reason),
+					Data:    map[string]interface{}{"session": check.Index, "reason": reason},
+				})
+			}
+		default:
+			logger.Error(fmt.Sprintf("Session %d couldn't be validated: %v", check.Index, check.Err))
+		}
+	}
+	if invalid > 0 {
+		if err := job.SaveSessions(); err != nil {
+			logger.Error(fmt.Sprintf("Failed to persist sessions: %v", err))
+		}
+	}
+	logger.Info(fmt.Sprintf("Session validation: %d usable, %d invalid of %d", usable, invalid, len(sessions)))
+	if usable >= cfg.MinUsableSessions {
+		return nil
+	}
+	err := fmt.Errorf("only %d usable sessions, MIN_USABLE_SESSIONS is %d", usable, cfg.MinUsableSessions)
+	if cfg.ValidateSessionsStrict {
+		return err
+	}
+	logger.Error(fmt.Sprintf("Starting degraded: %v", err))
+	return nil
+}
+
+// checkSession 查询账号设置以确认 cookie 有效，并获取订阅等级
+func checkSession(index int, session config.SessionInfo) SessionCheck {
+	client := core.NewSessionClient(session, "", false)
+	tier, err := client.GetSubscriptionTier()
+	var authErr *core.AuthError
+	switch {
+	case err == nil:
+		return SessionCheck{Index: index, Status: CheckOK, Tier: tier}
+	case errors.As(err, &authErr):
+		return SessionCheck{Index: index, Status: CheckInvalid, Err: err}
+	}
+	return SessionCheck{Index: index, Status: CheckUnreachable, Err: err}
+}
@@ -0,0 +1,224 @@
+// Package shared keeps the state replicas behind one load balancer must
+// agree on in Redis: session cooldowns, the rotation counter, the usage
+// totals and cached responses.
+//
+// It is enabled by REDIS_URL. When Redis is unreachable each replica falls
+// back to its own in-memory state and retries after a short pause, so a
+// Redis outage degrades coordination but never fails requests.
+package shared
+
+import (
+	"fmt"
+	"pplx2api/cache"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"pplx2api/model"
+	"pplx2api/usage"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// cooldownCacheTTL 冷却状态的本地缓存时间，避免选号时频繁访问 Redis
+	cooldownCacheTTL = time.Second
+	// retryAfterFailure Redis 出错后暂停访问的时间
+	retryAfterFailure = 10 * time.Second
+)
+
+// Store implements config.SharedState, usage.SharedCounter and
+// cache.SharedStore on Redis
+type Store struct {
+	redis  *client
+	prefix string
+
+	mutex     sync.Mutex
+	cooldowns map[string]cachedCooldown
+	downUntil time.Time
+}
+
+type cachedCooldown struct {
+	until   time.Time
+	fetched time.Time
+}
+
+// Setup connects the shared state when REDIS_URL is set
+func Setup() {
+	cfg := config.ConfigInstance
+	if cfg.RedisURL == "" {
+		return
+	}
+	redis, err := newClient(cfg.RedisURL)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Invalid REDIS_URL: %v", err))
+		return
+	}
+	s := &Store{redis: redis, prefix: cfg.RedisPrefix, cooldowns: map[string]cachedCooldown{}}
+	if _, err := redis.do("PING"); err != nil {
+		logger.Error(fmt.Sprintf("Redis is unreachable, using local state until it is back: %v", err))
+	}
+	config.Shared = s
+	usage.Shared = s
+	cache.Shared = s
+}
+
+func (s *Store) key(parts ...string) string {
+	key := s.prefix
+	for _, p := range parts {
+		key += ":" + p
+	}
+	return key
+}
+
+// do 执行命令；Redis 出错后暂停访问一段时间，期间直接返回错误
+func (s *Store) do(args ...string) (interface{}, error) {
+	s.mutex.Lock()
+	down := time.Now().Before(s.downUntil)
+	s.mutex.Unlock()
+	if down {
+		return nil, fmt.Errorf("redis unavailable")
+	}
+	reply, err := s.redis.do(args...)
+	if err != nil {
+		if _, isReply := err.(respError); !isReply {
+			logger.Error(fmt.Sprintf("Redis error, using local state for %v: %v", retryAfterFailure, err))
+			s.mutex.Lock()
+			s.downUntil = time.Now().Add(retryAfterFailure)
+			s.mutex.Unlock()
+		}
+	}
+	return reply, err
+}
+
+// Cooldown returns the shared cooldown end of a session
+func (s *Store) Cooldown(session string) time.Time {
+	now := time.Now()
+	s.mutex.Lock()
+	cached, ok := s.cooldowns[session]
+	s.mutex.Unlock()
+	if ok && now.Sub(cached.fetched) < cooldownCacheTTL {
+		return cached.until
+	}
+	reply, err := s.do("GET", s.key("cooldown", session))
+	if err != nil {
+		return cached.until
+	}
+	var until time.Time
+	if value, ok := reply.(string); ok {
+		if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+			until = time.UnixMilli(ms)
+		}
+	}
+	s.mutex.Lock()
+	s.cooldowns[session] = cachedCooldown{until: until, fetched: now}
+	s.mutex.Unlock()
+	return until
+}
+
+// SetCooldown extends the shared cooldown of a session; the key expires
+// together with the cooldown.
+func (s *Store) SetCooldown(session string, until time.Time) {
+	if current := s.Cooldown(session); !until.After(current) {
+		return
+	}
+	ttl := time.Until(until).Milliseconds()
+	if ttl <= 0 {
+		return
+	}
+	s.do("SET", s.key("cooldown", session), strconv.FormatInt(until.UnixMilli(), 10), "PX", strconv.FormatInt(ttl, 10))
+	s.mutex.Lock()
+	s.cooldowns[session] = cachedCooldown{until: until, fetched: time.Now()}
+	s.mutex.Unlock()
+}
+
+// ClearCooldown removes the shared cooldown of a session
+func (s *Store) ClearCooldown(session string) {
+	s.do("DEL", s.key("cooldown", session))
+	s.mutex.Lock()
+	s.cooldowns[session] = cachedCooldown{fetched: time.Now()}
+	s.mutex.Unlock()
+}
+
+// NextIndex increments the shared rotation counter
+func (s *Store) NextIndex() (int64, error) {
+	reply, err := s.do("INCR", s.key("rotation"))
+	if err != nil {
+		return 0, err
+	}
+	n, _ := reply.(int64)
+	// INCR 从 1 开始，减一使首个请求使用第一个账号
+	return n - 1, nil
+}
+
+// CachedResponse returns a cached response; a Redis error counts as a miss
+func (s *Store) CachedResponse(key string) ([]byte, bool) {
+	reply, err := s.do("GET", s.key("cache", key))
+	if err != nil {
+		return nil, false
+	}
+	value, ok := reply.(string)
+	return []byte(value), ok
+}
+
+// CacheResponse stores a response that expires after ttl
+func (s *Store) CacheResponse(key string, value []byte, ttl time.Duration) {
+	s.do("SET", s.key("cache", key), string(value), "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+}
+
+// Add adds one completion to the shared totals of name
+func (s *Store) Add(scope string, name string, u model.Usage) {
+	hash := s.key("usage", scope, name)
+	if _, err := s.do("SADD", s.key("usage", scope), name); err != nil {
+		return
+	}
+	s.do("HINCRBY", hash, "requests", "1")
+	s.do("HINCRBY", hash, "prompt_tokens", strconv.Itoa(u.PromptTokens))
+	s.do("HINCRBY", hash, "completion_tokens", strconv.Itoa(u.CompletionTokens))
+	s.do("HINCRBY", hash, "total_tokens", strconv.Itoa(u.TotalTokens))
+}
+
+// AddError adds one failed request to the shared totals of name
+func (s *Store) AddError(scope string, name string) {
+	if _, err := s.do("SADD", s.key("usage", scope), name); err != nil {
+		return
+	}
+	s.do("HINCRBY", s.key("usage", scope, name), "errors", "1")
+}
+
+// Totals returns the shared totals of every name in scope
+func (s *Store) Totals(scope string) (map[string]usage.Totals, error) {
+	reply, err := s.do("SMEMBERS", s.key("usage", scope))
+	if err != nil {
+		return nil, err
+	}
+	names, _ := reply.([]interface{})
+	totals := make(map[string]usage.Totals, len(names))
+	for _, n := range names {
+		name, _ := n.(string)
+		reply, err := s.do("HGETALL", s.key("usage", scope, name))
+		if err != nil {
+			return nil, err
+		}
+		fields, _ := reply.([]interface{})
+		var t usage.Totals
+		for i := 0; i+1 < len(fields); i += 2 {
+			field, _ := fields[i].(string)
+			value, _ := fields[i+1].(string)
+			v, _ := strconv.Atoi(value)
+			switch field {
+			case "requests":
+				t.Requests = v
+			case "errors":
+				t.Errors = v
+			case "prompt_tokens":
+				t.PromptTokens = v
+			case "completion_tokens":
+				t.CompletionTokens = v
+			case "total_tokens":
+				t.TotalTokens = v
+			}
+		}
+		totals[name] = t
+	}
+	return totals, nil
+}
@@ -0,0 +1,131 @@
+// Package tokenizer estimates token counts for prompts and completions.
+//
+// Perplexity doesn't report usage, so counts are approximations of the
+// tokenizers the upstream models use. Which approximation applies to a model
+// is configured with TOKENIZERS; counts feed usage accounting and context
+// guardrails, so picking the closest one matters for budgets.
+package tokenizer
+
+import (
+	"fmt"
+	"math"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tokenizer names accepted in config
+const (
+	CL100K = "cl100k"
+	O200K  = "o200k"
+	Char   = "char"
+)
+
+// Tokenizer estimates the number of tokens of a text
+type Tokenizer interface {
+	Name() string
+	Count(text string) int
+}
+
+// pieceRegexp 近似 tiktoken 的预分词规则：缩写、单词、数字、标点、空白
+var pieceRegexp = regexp.MustCompile(`'(?:s|t|re|ve|m|ll|d)| ?\pL+| ?\pN{1,3}| ?[^\s\pL\pN]+|\s+`)
+
+// bpeEstimator approximates a byte-pair encoding by splitting text the way
+// tiktoken does and charging each piece according to its script.
+type bpeEstimator struct {
+	name string
+	// latinCharsPerToken 拉丁字母单词平均每个 token 的字符数
+	latinCharsPerToken float64
+	// cjkTokensPerChar 中日韩字符平均每个字符的 token 数
+	cjkTokensPerChar float64
+}
+
+func (b bpeEstimator) Name() string {
+	return b.name
+}
+
+func (b bpeEstimator) Count(text string) int {
+	if text == "" {
+		return 0
+	}
+	total := 0.0
+	for _, piece := range pieceRegexp.FindAllString(text, -1) {
+		trimmed := strings.TrimLeft(piece, " ")
+		if trimmed == "" {
+			// 连续空白通常合并为一个 token
+			total++
+			continue
+		}
+		r, _ := utf8.DecodeRuneInString(trimmed)
+		switch {
+		case isCJK(r):
+			total += float64(utf8.RuneCountInString(trimmed)) * b.cjkTokensPerChar
+		case unicode.IsLetter(r):
+			total += math.Ceil(float64(utf8.RuneCountInString(trimmed)) / b.latinCharsPerToken)
+		default:
+			total += math.Ceil(float64(utf8.RuneCountInString(trimmed)) / 2)
+		}
+	}
+	return int(math.Ceil(total))
+}
+
+func isCJK(r rune) bool {
+	return unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) ||
+		unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r)
+}
+
+// charEstimator counts one token per four characters regardless of script
+type charEstimator struct{}
+
+func (charEstimator) Name() string {
+	return Char
+}
+
+func (charEstimator) Count(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+var tokenizers = map[string]Tokenizer{
+	CL100K: bpeEstimator{name: CL100K, latinCharsPerToken: 4, cjkTokensPerChar: 1.2},
+	O200K:  bpeEstimator{name: O200K, latinCharsPerToken: 4.5, cjkTokensPerChar: 0.8},
+	Char:   charEstimator{},
+}
+
+// Get returns the tokenizer with the given name, falling back to cl100k
+func Get(name string) Tokenizer {
+	if t, ok := tokenizers[strings.ToLower(name)]; ok {
+		return t
+	}
+	return tokenizers[CL100K]
+}
+
+// ForModel picks the tokenizer configured for a model. Patterns are matched
+// in config order; a trailing * matches any suffix.
+func ForModel(model string) Tokenizer {
+	for _, rule := range config.ConfigInstance.Tokenizers {
+		pattern := rule.Pattern
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(model, prefix) {
+				return Get(rule.Tokenizer)
+			}
+		} else if pattern == model {
+			return Get(rule.Tokenizer)
+		}
+	}
+	return Get(config.ConfigInstance.DefaultTokenizer)
+}
+
+func init() {
+	names := []string{config.ConfigInstance.DefaultTokenizer}
+	for _, rule := range config.ConfigInstance.Tokenizers {
+		names = append(names, rule.Tokenizer)
+	}
+	for _, name := range names {
+		if _, ok := tokenizers[strings.ToLower(name)]; !ok {
+			logger.Warn(fmt.Sprintf("Unknown tokenizer %q, falling back to %s", name, CL100K))
+		}
+	}
+}
@@ -0,0 +1,332 @@
+// Package tracing records request spans and exports them over OTLP/HTTP
+// in the JSON encoding, so any OpenTelemetry collector can ingest them.
+//
+// Tracing is off unless OTEL_EXPORTER_OTLP_ENDPOINT is set; spans started
+// while it is off are no-ops. Spans are batched and exported in the
+// background; when the export queue is full new spans are dropped rather
+// than slowing requests down.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds as defined by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+const (
+	queueSize     = 2048
+	batchSize     = 256
+	flushInterval = 5 * time.Second
+)
+
+// Span is one timed operation of a trace
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mutex    sync.Mutex
+	end      time.Time
+	attrs    map[string]interface{}
+	errMsg   string
+	finished bool
+}
+
+type spanKey struct{}
+
+var (
+	queue     chan *Span
+	flushNow  chan chan struct{}
+	startOnce sync.Once
+)
+
+// Enabled reports whether spans are exported
+func Enabled() bool {
+	return config.ConfigInstance.TraceEndpoint != ""
+}
+
+// Start begins a span as a child of the span in ctx, or a new trace
+func Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	startOnce.Do(startExporter)
+	span := &Span{name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	rand.Read(span.spanID[:])
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok {
+		span.traceID = parent.traceID
+		span.parentID = parent.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// StartRemote begins a server span continuing a W3C traceparent, starting
+// a new trace when the header is missing or invalid.
+func StartRemote(ctx context.Context, name string, traceparent string) (context.Context, *Span) {
+	ctx, span := Start(ctx, name, KindServer)
+	if span == nil {
+		return ctx, nil
+	}
+	// traceparent: 00-<trace-id>-<parent-id>-<flags>
+	parts := strings.Split(traceparent, "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		traceID, err1 := hex.DecodeString(parts[1])
+		parentID, err2 := hex.DecodeString(parts[2])
+		if err1 == nil && err2 == nil {
+			copy(span.traceID[:], traceID)
+			copy(span.parentID[:], parentID)
+		}
+	}
+	return ctx, span
+}
+
+// TraceID returns the hex trace id of the span, empty for a no-op span
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// SetAttr sets an attribute; values are strings, bools, ints or floats
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.errMsg = err.Error()
+}
+
+// End finishes the span and queues it for export. Later calls are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.finished {
+		s.mutex.Unlock()
+		return
+	}
+	s.finished = true
+	s.end = time.Now()
+	s.mutex.Unlock()
+	select {
+	case queue <- s:
+	default:
+		// 队列已满时丢弃，避免拖慢请求
+	}
+}
+
+// Flush exports the queued spans, waiting until ctx is done at most
+func Flush(ctx context.Context) {
+	if !Enabled() || queue == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case flushNow <- done:
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func startExporter() {
+	queue = make(chan *Span, queueSize)
+	flushNow = make(chan chan struct{})
+	go exportLoop()
+}
+
+func exportLoop() {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case span := <-queue:
+			batch = append(batch, span)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-flushNow:
+			// 取出队列中剩余的 span 一并导出
+			for drained := false; !drained; {
+				select {
+				case span := <-queue:
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			export(batch)
+			batch = nil
+			close(done)
+			continue
+		}
+		if len(batch) > 0 {
+			export(batch)
+			batch = nil
+		}
+	}
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+func export(spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(encode(spans))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to encode spans: %v", err))
+		return
+	}
+	endpoint := strings.TrimSuffix(config.ConfigInstance.TraceEndpoint, "/") + "/v1/traces"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to create trace export request: %v", err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range config.ConfigInstance.TraceHeaders {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to export %d spans: %v", len(spans), err))
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Error(fmt.Sprintf("Failed to export %d spans: status %d", len(spans), resp.StatusCode))
+	}
+}
+
+// OTLP JSON 编码
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+func attr(key string, value interface{}) otlpAttr {
+	a := otlpAttr{Key: key}
+	switch v := value.(type) {
+	case bool:
+		a.Value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		a.Value.IntValue = &s
+	case float64:
+		a.Value.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		a.Value.StringValue = &s
+	}
+	return a
+}
+
+func encode(spans []*Span) map[string]interface{} {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mutex.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: 1},
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for k, v := range s.attrs {
+			o.Attributes = append(o.Attributes, attr(k, v))
+		}
+		if s.errMsg != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.errMsg}
+		}
+		s.mutex.Unlock()
+		encoded = append(encoded, o)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttr{attr("service.name", config.ConfigInstance.TraceServiceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "pplx2api"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
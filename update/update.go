@@ -0,0 +1,305 @@
+// Package update checks GitHub for newer releases of the proxy and replaces
+// the running binary with a signed release when an admin approves it.
+//
+// Release binaries are named pplx2api_<os>_<arch> (.exe on Windows) and are
+// accompanied by <binary>.sig, the base64 ed25519 signature of the binary.
+// A binary is only installed when its signature verifies against
+// UPDATE_PUBLIC_KEY; without a key updates can be checked but not applied.
+package update
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"pplx2api/config"
+	"pplx2api/logger"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version is the running version, set at build time with
+// -ldflags "-X pplx2api/update.Version=v1.2.3"
+var Version = "dev"
+
+// maxBinarySize 下载的二进制文件大小上限
+const maxBinarySize = 200 << 20
+
+// Status is the result of the last update check
+type Status struct {
+	Current   string    `json:"current"`
+	Latest    string    `json:"latest,omitempty"`
+	Available bool      `json:"available"`
+	URL       string    `json:"url,omitempty"`
+	Notes     string    `json:"notes,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	// Applied 已安装但尚未重启生效的版本
+	Applied string `json:"applied,omitempty"`
+}
+
+type release struct {
+	TagName string  `json:"tag_name"`
+	HTMLURL string  `json:"html_url"`
+	Body    string  `json:"body"`
+	Assets  []asset `json:"assets"`
+}
+
+type asset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+var (
+	mutex   sync.Mutex
+	status  = Status{Current: Version}
+	latest  *release
+	applyMu sync.Mutex
+)
+
+var httpClient = &http.Client{Timeout: 5 * time.Minute}
+
+// Start checks for updates in the background every UPDATE_CHECK_INTERVAL
+// when UPDATE_CHECK is enabled.
+func Start(ctx context.Context) {
+	cfg := config.ConfigInstance
+	if !cfg.UpdateCheck {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.UpdateCheckInterval)
+		defer ticker.Stop()
+		for {
+			Check(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Current returns the status of the last check
+func Current() Status {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return status
+}
+
+// Check fetches the latest release and compares it with the running version
+func Check(ctx context.Context) Status {
+	rel, err := fetchLatest(ctx)
+	mutex.Lock()
+	defer mutex.Unlock()
+	status.CheckedAt = time.Now()
+	if err != nil {
+		status.Error = err.Error()
+		logger.Error(fmt.Sprintf("Update check failed: %v", err))
+		return status
+	}
+	latest = rel
+	status.Error = ""
+	status.Latest = rel.TagName
+	status.URL = rel.HTMLURL
+	status.Notes = rel.Body
+	status.Available = newer(rel.TagName, Version)
+	if status.Available {
+		logger.Info(fmt.Sprintf("Update available: %s (running %s) %s", rel.TagName, Version, rel.HTMLURL))
+	}
+	return status
+}
+
+func fetchLatest(ctx context.Context) (*release, error) {
+	url := fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", config.ConfigInstance.UpdateRepo)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("github returned status %d", resp.StatusCode)
+	}
+	var rel release
+	if err := json.NewDecoder(resp.Body).Decode(&rel); err != nil {
+		return nil, fmt.Errorf("decode release: %w", err)
+	}
+	return &rel, nil
+}
+
+// parseVersion 解析 v1.2.3 形式的版本号，忽略预发布后缀
+func parseVersion(v string) ([3]int, bool) {
+	var parts [3]int
+	v = strings.TrimPrefix(strings.TrimSpace(v), "v")
+	v, _, _ = strings.Cut(v, "-")
+	fields := strings.Split(v, ".")
+	if len(fields) == 0 || len(fields) > 3 {
+		return parts, false
+	}
+	for i, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return parts, false
+		}
+		parts[i] = n
+	}
+	return parts, true
+}
+
+// newer reports whether tag is a later version than current. Development
+// builds have no version and are never offered updates.
+func newer(tag string, current string) bool {
+	a, ok1 := parseVersion(tag)
+	b, ok2 := parseVersion(current)
+	if !ok1 || !ok2 {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] > b[i]
+		}
+	}
+	return false
+}
+
+// assetName 当前平台的发布文件名
+func assetName() string {
+	name := fmt.Sprintf("pplx2api_%s_%s", runtime.GOOS, runtime.GOARCH)
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// ErrNoUpdate is returned by Apply when no newer release is known
+var ErrNoUpdate = errors.New("no update available, run a check first")
+
+// Apply downloads the latest release for this platform, verifies its
+// signature and replaces the running executable. The new version takes
+// effect after a restart.
+func Apply(ctx context.Context) (string, error) {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	mutex.Lock()
+	rel, available := latest, status.Available
+	mutex.Unlock()
+	if rel == nil || !available {
+		return "", ErrNoUpdate
+	}
+	key, err := publicKey()
+	if err != nil {
+		return "", err
+	}
+	var binURL, sigURL string
+	for _, a := range rel.Assets {
+		switch a.Name {
+		case assetName():
+			binURL = a.URL
+		case assetName() + ".sig":
+			sigURL = a.URL
+		}
+	}
+	if binURL == "" || sigURL == "" {
+		return "", fmt.Errorf("release %s has no signed binary %s", rel.TagName, assetName())
+	}
+	binary, err := download(ctx, binURL)
+	if err != nil {
+		return "", fmt.Errorf("download binary: %w", err)
+	}
+	sigText, err := download(ctx, sigURL)
+	if err != nil {
+		return "", fmt.Errorf("download signature: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigText)))
+	if err != nil || !ed25519.Verify(key, binary, sig) {
+		return "", fmt.Errorf("signature of %s does not verify, not installing", assetName())
+	}
+	if err := replaceExecutable(binary); err != nil {
+		return "", err
+	}
+	mutex.Lock()
+	status.Applied = rel.TagName
+	mutex.Unlock()
+	logger.Info(fmt.Sprintf("Installed %s, restart to run it", rel.TagName))
+	return rel.TagName, nil
+}
+
+func publicKey() (ed25519.PublicKey, error) {
+	raw := config.ConfigInstance.UpdatePublicKey
+	if raw == "" {
+		return nil, errors.New("UPDATE_PUBLIC_KEY is not set, refusing to install unverified binaries")
+	}
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("UPDATE_PUBLIC_KEY is not a base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBinarySize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBinarySize {
+		return nil, errors.New("file too large")
+	}
+	return data, nil
+}
+
+// replaceExecutable 写入新文件后改名替换；运行中的文件先改名为 .old，
+// Windows 上无法覆盖运行中的程序但可以改名
+func replaceExecutable(binary []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return err
+	}
+	info, err := os.Stat(exe)
+	if err != nil {
+		return err
+	}
+	next, old := exe+".new", exe+".old"
+	if err := os.WriteFile(next, binary, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("write %s: %w", next, err)
+	}
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		os.Remove(next)
+		return fmt.Errorf("move running binary: %w", err)
+	}
+	if err := os.Rename(next, exe); err != nil {
+		// 恢复原文件
+		os.Rename(old, exe)
+		return fmt.Errorf("install new binary: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package usage
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// HistoryBucket is the resolution of the usage history
+	HistoryBucket = time.Hour
+	// HistoryRetention is how far back the usage history is kept
+	HistoryRetention = 31 * 24 * time.Hour
+)
+
+// historyBucket 一个小时内各 key 与 session 的用量
+type historyBucket struct {
+	keys     map[string]*Totals
+	sessions map[string]*Totals
+}
+
+// history 按小时开始时间索引，由 totalsMutex 保护
+var history = map[int64]*historyBucket{}
+
+// historyAt 返回 t 所在小时的用量，并清理超出保留期的记录，调用方需持有锁
+func historyAt(t time.Time) *historyBucket {
+	start := t.Truncate(HistoryBucket).Unix()
+	h, ok := history[start]
+	if !ok {
+		cutoff := t.Add(-HistoryRetention).Unix()
+		for s := range history {
+			if s < cutoff {
+				delete(history, s)
+			}
+		}
+		h = &historyBucket{keys: map[string]*Totals{}, sessions: map[string]*Totals{}}
+		history[start] = h
+	}
+	return h
+}
+
+// Period is the usage of one period of a windowed report
+type Period struct {
+	Start time.Time `json:"start"`
+	Report
+}
+
+// Window returns the usage recorded by this replica between since and
+// until, at the resolution of HistoryBucket
+func Window(since time.Time, until time.Time) Report {
+	periods := Periods(since, until, 0)
+	if len(periods) == 0 {
+		return Report{Keys: map[string]Totals{}, Sessions: map[string]Totals{}}
+	}
+	return periods[0].Report
+}
+
+// Periods splits the usage between since and until into periods of the
+// given length, aligned to UTC, oldest first. Periods without usage are
+// left out. A zero length returns the whole window as one period.
+func Periods(since time.Time, until time.Time, length time.Duration) []Period {
+	totalsMutex.Lock()
+	defer totalsMutex.Unlock()
+	byStart := map[int64]*Period{}
+	for start, h := range history {
+		t := time.Unix(start, 0).UTC()
+		if !t.Add(HistoryBucket).After(since) || !t.Before(until) {
+			continue
+		}
+		periodStart := since
+		if length > 0 {
+			periodStart = t.Truncate(length)
+		}
+		p, ok := byStart[periodStart.Unix()]
+		if !ok {
+			p = &Period{Start: periodStart, Report: Report{Keys: map[string]Totals{}, Sessions: map[string]Totals{}}}
+			byStart[periodStart.Unix()] = p
+		}
+		merge(p.Keys, h.keys)
+		merge(p.Sessions, h.sessions)
+	}
+	periods := make([]Period, 0, len(byStart))
+	for _, p := range byStart {
+		periods = append(periods, *p)
+	}
+	sort.Slice(periods, func(i, j int) bool { return periods[i].Start.Before(periods[j].Start) })
+	return periods
+}
+
+// SessionSince returns the usage this replica recorded for session since
+// the start of the history bucket containing since
+func SessionSince(session string, since time.Time) Totals {
+	totalsMutex.Lock()
+	defer totalsMutex.Unlock()
+	var sum Totals
+	from := since.Truncate(HistoryBucket).Unix()
+	for start, h := range history {
+		if start < from {
+			continue
+		}
+		if t, ok := h.sessions[session]; ok {
+			sum.Requests += t.Requests
+			sum.Errors += t.Errors
+			sum.PromptTokens += t.PromptTokens
+			sum.CompletionTokens += t.CompletionTokens
+			sum.TotalTokens += t.TotalTokens
+		}
+	}
+	return sum
+}
+
+func merge(into map[string]Totals, from map[string]*Totals) {
+	for name, t := range from {
+		sum := into[name]
+		sum.Requests += t.Requests
+		sum.Errors += t.Errors
+		sum.PromptTokens += t.PromptTokens
+		sum.CompletionTokens += t.CompletionTokens
+		sum.TotalTokens += t.TotalTokens
+		into[name] = sum
+	}
+}
@@ -0,0 +1,211 @@
+// Package usage estimates the token usage of completions and keeps running
+// totals per API key and per session, plus hourly history for reports over
+// a time window.
+//
+// Perplexity doesn't report usage, so counts come from the tokenizer
+// approximations and are only as accurate as the tokenizer picked for the
+// model.
+package usage
+
+import (
+	"pplx2api/model"
+	"pplx2api/tokenizer"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Meter counts the tokens of one completion. It is attached to the gin
+// context so the response writers in model can report usage.
+type Meter struct {
+	tokenizer    tokenizer.Tokenizer
+	promptTokens int
+	includeUsage bool
+
+	mutex      sync.Mutex
+	completion strings.Builder
+	// Session 实际处理请求的 session，由重试循环设置
+	Session string
+}
+
+// Totals are the accumulated usage of one API key or session. Requests
+// counts completed requests; failed ones are only counted in Errors.
+type Totals struct {
+	Requests         int `json:"requests"`
+	Errors           int `json:"errors"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// Report is a snapshot of all accumulated usage
+type Report struct {
+	Keys     map[string]Totals `json:"keys"`
+	Sessions map[string]Totals `json:"sessions"`
+}
+
+// Scopes of the totals kept by a SharedCounter
+const (
+	ScopeKeys     = "keys"
+	ScopeSessions = "sessions"
+)
+
+// SharedCounter accumulates totals across replicas
+type SharedCounter interface {
+	Add(scope string, name string, u model.Usage)
+	AddError(scope string, name string)
+	Totals(scope string) (map[string]Totals, error)
+}
+
+// Shared is the counter shared between replicas, nil when REDIS_URL is unset
+var Shared SharedCounter
+
+var (
+	keyTotals     = map[string]*Totals{}
+	sessionTotals = map[string]*Totals{}
+	totalsMutex   sync.Mutex
+)
+
+// Start creates a meter for a completion of modelName and attaches it to gc
+func Start(gc *gin.Context, modelName string, prompt string, includeUsage bool) *Meter {
+	t := tokenizer.ForModel(modelName)
+	m := &Meter{
+		tokenizer:    t,
+		promptTokens: t.Count(prompt),
+		includeUsage: includeUsage,
+	}
+	model.SetUsageMeter(gc, m)
+	return m
+}
+
+// MeterFrom returns the meter attached to gc, if any
+func MeterFrom(gc *gin.Context) *Meter {
+	if m, ok := model.UsageMeterFrom(gc).(*Meter); ok {
+		return m
+	}
+	return nil
+}
+
+// AddCompletion records text written to the client
+func (m *Meter) AddCompletion(text string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.completion.WriteString(text)
+}
+
+// Completion returns the text written to the client so far
+func (m *Meter) Completion() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.completion.String()
+}
+
+// Usage returns the estimated usage so far
+func (m *Meter) Usage() model.Usage {
+	m.mutex.Lock()
+	completion := m.completion.String()
+	m.mutex.Unlock()
+	completionTokens := m.tokenizer.Count(completion)
+	return model.Usage{
+		PromptTokens:     m.promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      m.promptTokens + completionTokens,
+	}
+}
+
+// IncludeInStream reports whether the client asked for a usage chunk
+func (m *Meter) IncludeInStream() bool {
+	return m.includeUsage
+}
+
+// Record adds the usage of a finished completion to the totals of key and of the meter's session
+func (m *Meter) Record(key string) {
+	u := m.Usage()
+	totalsMutex.Lock()
+	add(keyTotals, key, u)
+	if m.Session != "" {
+		add(sessionTotals, m.Session, u)
+	}
+	h := historyAt(time.Now())
+	add(h.keys, key, u)
+	if m.Session != "" {
+		add(h.sessions, m.Session, u)
+	}
+	totalsMutex.Unlock()
+	if Shared != nil {
+		Shared.Add(ScopeKeys, key, u)
+		if m.Session != "" {
+			Shared.Add(ScopeSessions, m.Session, u)
+		}
+	}
+}
+
+// RecordError counts a request of key that failed, and the session that
+// was tried last if any
+func (m *Meter) RecordError(key string) {
+	totalsMutex.Lock()
+	addError(keyTotals, key)
+	if m.Session != "" {
+		addError(sessionTotals, m.Session)
+	}
+	h := historyAt(time.Now())
+	addError(h.keys, key)
+	if m.Session != "" {
+		addError(h.sessions, m.Session)
+	}
+	totalsMutex.Unlock()
+	if Shared != nil {
+		Shared.AddError(ScopeKeys, key)
+		if m.Session != "" {
+			Shared.AddError(ScopeSessions, m.Session)
+		}
+	}
+}
+
+func totalsOf(totals map[string]*Totals, name string) *Totals {
+	t, ok := totals[name]
+	if !ok {
+		t = &Totals{}
+		totals[name] = t
+	}
+	return t
+}
+
+func addError(totals map[string]*Totals, name string) {
+	totalsOf(totals, name).Errors++
+}
+
+func add(totals map[string]*Totals, name string, u model.Usage) {
+	t := totalsOf(totals, name)
+	t.Requests++
+	t.PromptTokens += u.PromptTokens
+	t.CompletionTokens += u.CompletionTokens
+	t.TotalTokens += u.TotalTokens
+}
+
+// Snapshot returns a copy of the accumulated totals, of all replicas when
+// a shared counter is set and reachable
+func Snapshot() Report {
+	if Shared != nil {
+		keys, err := Shared.Totals(ScopeKeys)
+		if err == nil {
+			var sessions map[string]Totals
+			if sessions, err = Shared.Totals(ScopeSessions); err == nil {
+				return Report{Keys: keys, Sessions: sessions}
+			}
+		}
+	}
+	totalsMutex.Lock()
+	defer totalsMutex.Unlock()
+	return Report{Keys: copyTotals(keyTotals), Sessions: copyTotals(sessionTotals)}
+}
+
+func copyTotals(totals map[string]*Totals) map[string]Totals {
+	out := make(map[string]Totals, len(totals))
+	for name, t := range totals {
+		out[name] = *t
+	}
+	return out
+}
@@ -4,19 +4,11 @@ import (
 	"pplx2api/config"
 )
 
-// **获取角色前缀**
-func GetRolePrefix(role string) string {
-	if config.ConfigInstance.NoRolePrefix {
-		return ""
-	}
-	switch role {
-	case "system":
-		return "System: "
-	case "user":
-		return "Human: "
-	case "assistant":
-		return "Assistant: "
-	default:
-		return "Unknown: "
+// **获取角色前缀**，name 非空时附在角色名后
+func GetRolePrefix(role string, name string) string {
+	label := config.ConfigInstance.Prompt.Label(role)
+	if name != "" {
+		label += " (" + name + ")"
 	}
+	return label + ": "
 }